@@ -0,0 +1,841 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"tool_cache/repo"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// runCommand xử lý các lệnh CLI:
+//
+//	outbox list [pending|failed|done]
+//	outbox show <id>
+//	outbox replay <id>|pending|failed
+//	outbox compact
+//	reconcile -from <id> [-to <id>] [-repair] [-rate n] [-every 5m]
+//	purge -channel <id> [-older 720h]
+//	ban-expiry [-every 1m]
+//	owner transfer -channel <id> -from <uid> -to <uid>
+//	owner check -channel <id>
+//	owner scan
+//	channels -user <uid> [-role all|active|admin|banned|pending] [-es] [-limit 100] [-offset 0]
+//	erase -user <uid> [-report]
+//	moderate kick|ban|unban -channels 1,2,3 -users 4,5 [-actor <id>] [-rights <mask|names>] [-until 24h]
+//	channel drop -channel <id>
+//	channel copy|merge -src <id> -dst <id> [-policy keep_dst|keep_src|highest_role]
+//	stats -channels 1,2,3 [-verify] [-repair]
+//	activity -channels 1,2,3 [-interval hour|day|week] [-from 2026-01-02] [-to 2026-01-09] [-format csv|json] [-out file]
+//	join list|request|approve|decline -channel <id> [-users 1,2,3|all] [-actor <id>] [-limit 50] [-offset 0] [-newest]
+//	serve [-addr :8080] [-grpc :9090] [-drain-grace 5s]
+//	health [-url http://host:8080] [-watch 10s]
+//	interrupted list|repair
+func runCommand(args []string) error {
+	switch args[0] {
+	case "outbox":
+		return runOutbox(args[1:])
+	case "reconcile":
+		return runReconcile(args[1:])
+	case "purge":
+		return runPurge(args[1:])
+	case "ban-expiry":
+		return runBanExpiry(args[1:])
+	case "join":
+		return runJoin(args[1:])
+	case "owner":
+		return runOwner(args[1:])
+	case "channels":
+		return runUserChannels(args[1:])
+	case "erase":
+		return runErase(args[1:])
+	case "moderate":
+		return runModerate(args[1:])
+	case "channel":
+		return runChannel(args[1:])
+	case "stats":
+		return runStats(args[1:])
+	case "activity":
+		return runActivity(args[1:])
+	case "serve":
+		return runServe(args[1:])
+	case "health":
+		return runHealth(args[1:])
+	case "interrupted":
+		return runInterrupted(args[1:])
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func runOutbox(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: outbox list|show|replay|compact")
+	}
+	outbox := store.Outbox()
+
+	switch args[0] {
+	case "list":
+		status := ""
+		if len(args) > 1 {
+			status = args[1]
+		}
+		for _, e := range outbox.List(status) {
+			fmt.Printf("%s\t%s\tchannel=%d\top=%s\tusers=%d\tapplied=%v\tattempts=%d\t%s\t%s\n",
+				e.ID, e.Status, e.ChannelID, e.Op, len(e.Users()), e.Applied, e.Attempts,
+				time.Unix(e.CreatedAt, 0).Format(time.RFC3339), e.LastError)
+		}
+		return nil
+
+	case "show":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: outbox show <id>")
+		}
+		e, ok := outbox.Get(args[1])
+		if !ok {
+			return fmt.Errorf("outbox entry %s not found", args[1])
+		}
+		fmt.Printf("id: %s\nstatus: %s\nchannel: %d\nop: %s\nversion: %d\napplied version: %d\nusers: %d\napplied: %v\nattempts: %d\nlast error: %s\n",
+			e.ID, e.Status, e.ChannelID, e.Op, e.Version, e.AppliedVersion, len(e.Users()), e.Applied, e.Attempts, e.LastError)
+		return nil
+
+	case "replay":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: outbox replay <id>|pending|failed")
+		}
+		switch args[1] {
+		case repo.OUTBOX_STATUS_PENDING, repo.OUTBOX_STATUS_FAILED:
+			n, err := store.Relay().ReplayAll(args[1])
+			fmt.Printf("Replayed %d entries\n", n)
+			return err
+		}
+		return store.Relay().Replay(args[1])
+
+	case "compact":
+		return outbox.Compact()
+	}
+	return fmt.Errorf("unknown outbox command %q", args[0])
+}
+
+// runReconcile so khớp ES và Redis một lần, hoặc chạy định kỳ nếu có -every.
+func runReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	from := fs.Int("from", int(channelID), "channel id bắt đầu")
+	to := fs.Int("to", 0, "channel id kết thúc (mặc định = from)")
+	repair := fs.Bool("repair", false, "ghi lại Redis từ ES khi lệch")
+	rate := fs.Int("rate", 10, "số channel tối đa mỗi giây (0 = không giới hạn)")
+	every := fs.Duration("every", 0, "chạy định kỳ theo chu kỳ này (0 = chạy một lần)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to < *from {
+		*to = *from
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reconciler := repo.NewReconciler(elaC, redisC)
+	if *every > 0 {
+		err := reconciler.Run(ctx, int32(*from), int32(*to), *every, *repair, *rate, printReconcileReport)
+		if err == context.Canceled {
+			return nil
+		}
+		return err
+	}
+
+	reports, err := reconciler.CheckRange(ctx, int32(*from), int32(*to), *repair, *rate)
+	inconsistent := 0
+	for _, r := range reports {
+		if !r.Consistent() {
+			inconsistent++
+		}
+		printReconcileReport(r)
+	}
+	fmt.Printf("Checked %d channels, %d inconsistent\n", len(reports), inconsistent)
+	return err
+}
+
+func printReconcileReport(r *repo.ReconcileReport) {
+	status := "OK"
+	if !r.Consistent() {
+		status = "MISMATCH"
+	}
+	fmt.Printf("channel=%d %s es=%d set=%d str=%d missing_set=%d extra_set=%d missing_str=%d extra_str=%d version es=%d redis=%d repaired=%v %s\n",
+		r.ChannelID, status, r.ESCount, r.SetCount, r.StrCount,
+		len(r.MissingInSet), len(r.ExtraInSet), len(r.MissingInStr), len(r.ExtraInStr),
+		r.ESVersion, r.RedisVersion, r.Repaired, r.Error)
+}
+
+// runPurge xoá cứng participant đã rời / bị kick lâu hơn -older (retention).
+func runPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	channel := fs.Int("channel", int(channelID), "channel id")
+	older := fs.Duration("older", 30*24*time.Hour, "chỉ xoá user rời / bị kick trước khoảng thời gian này")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	before := int32(time.Now().Add(-*older).Unix())
+	deleted, err := store.PurgeDeparted(int32(*channel), before)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d participants from channel %d\n", deleted, *channel)
+	return nil
+}
+
+// runBanExpiry gỡ các lệnh cấm đã hết hạn một lần, hoặc chạy định kỳ nếu có -every.
+// Có thể chạy cùng lúc ở nhiều process, mỗi channel được khoá bằng Redis.
+func runBanExpiry(args []string) error {
+	fs := flag.NewFlagSet("ban-expiry", flag.ContinueOnError)
+	every := fs.Duration("every", 0, "chạy định kỳ theo chu kỳ này (0 = chạy một lần)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	worker := repo.NewBanExpiryWorker(elaC, redisC, store)
+	if *every > 0 {
+		err := worker.Run(ctx, *every, printBanExpiryReport)
+		if err == context.Canceled {
+			return nil
+		}
+		return err
+	}
+
+	report, err := worker.RunOnce(ctx)
+	if report != nil {
+		printBanExpiryReport(report)
+	}
+	return err
+}
+
+func printBanExpiryReport(r *repo.BanExpiryReport) {
+	fmt.Printf("channels=%d lifted=%d skipped=%d errors=%d\n", r.Channels, r.Lifted, r.Skipped, len(r.Errors))
+	for _, e := range r.Errors {
+		fmt.Println("  ", e)
+	}
+}
+
+// runJoin quản lý hàng chờ duyệt yêu cầu tham gia của channel.
+func runJoin(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: join list|request|approve|decline -channel <id> ...")
+	}
+	fs := flag.NewFlagSet("join "+args[0], flag.ContinueOnError)
+	channel := fs.Int("channel", int(channelID), "channel id")
+	users := fs.String("users", "", "danh sách user id phân cách bằng dấu phẩy, all = toàn bộ hàng chờ (approve / decline)")
+	actor := fs.Int("actor", 0, "user id của admin duyệt / từ chối")
+	limit := fs.Int("limit", 50, "số yêu cầu mỗi trang")
+	offset := fs.Int("offset", 0, "vị trí bắt đầu")
+	newest := fs.Bool("newest", false, "sắp xếp yêu cầu mới nhất trước")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	cid := int32(*channel)
+
+	if args[0] == "list" {
+		items, total, err := elaC.GetPendingParticipants(cid, int32(*limit), int32(*offset), *newest)
+		if err != nil {
+			return err
+		}
+		for _, p := range items {
+			var invitedAt int32
+			if p.Data != nil {
+				invitedAt = p.Data.InvitedAt
+			}
+			fmt.Printf("%d\t%s\n", p.UserID, time.Unix(int64(invitedAt), 0).Format(time.RFC3339))
+		}
+		fmt.Printf("Pending %d/%d join requests of channel %d\n", len(items), total, cid)
+		return nil
+	}
+
+	if *users == "all" {
+		var (
+			n   int
+			err error
+		)
+		switch args[0] {
+		case "approve":
+			n, err = store.ApproveAllJoinRequests(cid, int32(*actor))
+		case "decline":
+			n, err = store.DeclineAllJoinRequests(cid, int32(*actor))
+		default:
+			return fmt.Errorf("-users all only supports approve / decline")
+		}
+		fmt.Printf("%s %d join requests of channel %d\n", args[0], n, cid)
+		return err
+	}
+
+	ids, err := parseUserIDs(*users)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "request":
+		return store.RequestJoin(cid, ids)
+	case "approve":
+		return store.ApproveJoinRequests(cid, int32(*actor), ids)
+	case "decline":
+		return store.DeclineJoinRequests(cid, int32(*actor), ids)
+	}
+	return fmt.Errorf("unknown join command %q", args[0])
+}
+
+func parseUserIDs(s string) ([]int32, error) {
+	var ids []int32
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user id %q", part)
+		}
+		ids = append(ids, int32(v))
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("-users is required")
+	}
+	return ids, nil
+}
+
+// runOwner chuyển quyền sở hữu và kiểm tra ràng buộc mỗi channel có đúng một creator.
+func runOwner(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: owner transfer|check|scan")
+	}
+	fs := flag.NewFlagSet("owner "+args[0], flag.ContinueOnError)
+	channel := fs.Int("channel", int(channelID), "channel id")
+	from := fs.Int("from", 0, "creator hiện tại")
+	to := fs.Int("to", 0, "user nhận quyền sở hữu")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "transfer":
+		if err := store.TransferOwnership(int32(*channel), int32(*from), int32(*to)); err != nil {
+			return err
+		}
+		fmt.Printf("Transferred ownership of channel %d from %d to %d\n", *channel, *from, *to)
+		return nil
+
+	case "check":
+		creators, err := elaC.GetCreatorIDs(int32(*channel))
+		if err != nil {
+			return err
+		}
+		status := "OK"
+		if len(creators) != 1 {
+			status = "INVALID"
+		}
+		fmt.Printf("channel=%d %s creators=%v\n", *channel, status, creators)
+		return nil
+
+	case "scan":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		invalid := 0
+		scanned, err := elaC.ScanCreatorViolations(ctx, func(v repo.CreatorViolationDO) error {
+			invalid++
+			fmt.Printf("channel=%d members=%d creators=%d\n", v.ChannelID, v.Members, v.Creators)
+			return nil
+		})
+		fmt.Printf("Scanned %d channels, %d without exactly one creator\n", scanned, invalid)
+		return err
+	}
+	return fmt.Errorf("unknown owner command %q", args[0])
+}
+
+// runUserChannels liệt kê channel của user từ reverse index Redis (mặc định) hoặc truy vấn thẳng ES (-es).
+func runUserChannels(args []string) error {
+	fs := flag.NewFlagSet("channels", flag.ContinueOnError)
+	user := fs.Int("user", 0, "user id")
+	role := fs.String("role", "all", "all|active|admin|banned|pending")
+	useES := fs.Bool("es", false, "truy vấn trực tiếp ES thay vì Redis")
+	limit := fs.Int("limit", 100, "số channel mỗi trang (chỉ áp dụng với -es)")
+	offset := fs.Int("offset", 0, "vị trí bắt đầu (chỉ áp dụng với -es)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var states []repo.ParticipantState
+	switch *role {
+	case "all":
+	case "active":
+		states = repo.USER_CHANNEL_STATES_ACTIVE
+	case "admin":
+		states = repo.USER_CHANNEL_STATES_ADMIN
+	case "banned":
+		states = repo.USER_CHANNEL_STATES_BANNED
+	case "pending":
+		states = repo.USER_CHANNEL_STATES_PENDING
+	default:
+		return fmt.Errorf("unknown role %q", *role)
+	}
+
+	var (
+		items []repo.UserChannelDO
+		err   error
+	)
+	if *useES {
+		var total int32
+		items, total, err = elaC.GetUserChannels(int32(*user), states, int32(*limit), int32(*offset))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("total: %d\n", total)
+	} else if items, err = userIndex.List(int32(*user), states...); err != nil {
+		return err
+	}
+	for _, it := range items {
+		fmt.Printf("%d\t%s\n", it.ChannelID, it.State)
+	}
+	return nil
+}
+
+// runErase xoá user khỏi mọi channel (chạy lại để tiếp tục nếu bị ngắt), hoặc in report đã lưu với -report.
+func runErase(args []string) error {
+	fs := flag.NewFlagSet("erase", flag.ContinueOnError)
+	user := fs.Int("user", 0, "user id cần xoá")
+	onlyReport := fs.Bool("report", false, "chỉ in report đã lưu")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *user <= 0 {
+		return fmt.Errorf("-user is required")
+	}
+
+	eraser := repo.NewUserEraser(elaC, redisC, store, ERASURE_DIR)
+	var (
+		report *repo.EraseReport
+		err    error
+	)
+	if *onlyReport {
+		if report, err = eraser.LoadReport(int32(*user)); err != nil {
+			return err
+		}
+		if report == nil {
+			return fmt.Errorf("no erase report for user %d", *user)
+		}
+	} else {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		report, err = eraser.EraseUser(ctx, int32(*user))
+		if report == nil {
+			return err
+		}
+	}
+
+	for _, c := range report.Channels {
+		fmt.Printf("channel=%d state=%s status=%s version=%d %s\n", c.ChannelID, c.State, c.Status, c.Version, c.Error)
+	}
+	for _, id := range report.OutboxRemaining {
+		fmt.Printf("outbox entry %s still holds the user, rerun after the relay finishes it\n", id)
+	}
+	fmt.Printf("user=%d runs=%d channels=%d erased=%d failed=%d blocked=%d completed=%v report=%s\n",
+		report.UserID, report.Runs, len(report.Channels), report.Count(repo.ERASE_STATUS_ERASED),
+		report.Count(repo.ERASE_STATUS_FAILED), report.Count(repo.ERASE_STATUS_BLOCKED), report.Completed,
+		eraser.ReportPath(report.UserID))
+	return err
+}
+
+// runModerate kick / ban / unban tập user trên nhiều channel qua một bulk pipeline dùng chung.
+func runModerate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: moderate kick|ban|unban -channels 1,2,3 -users 4,5 ...")
+	}
+	fs := flag.NewFlagSet("moderate "+args[0], flag.ContinueOnError)
+	channels := fs.String("channels", "", "danh sách channel id phân cách bằng dấu phẩy")
+	users := fs.String("users", "", "danh sách user id phân cách bằng dấu phẩy")
+	actor := fs.Int("actor", 0, "user id của moderator")
+	rights := fs.String("rights", "view_messages", "quyền bị cấm khi ban (số hoặc tên, phân cách bằng |)")
+	until := fs.Duration("until", 0, "thời hạn ban (0 = vĩnh viễn)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	channelIDs, err := parseUserIDs(*channels)
+	if err != nil {
+		return fmt.Errorf("-channels: %w", err)
+	}
+	userIDs, err := parseUserIDs(*users)
+	if err != nil {
+		return err
+	}
+
+	action := &repo.ParticipantActionDO{Action: args[0], ActorID: int32(*actor)}
+	switch args[0] {
+	case repo.PARTICIPANT_ACTION_KICK, repo.PARTICIPANT_ACTION_UNBAN:
+	case repo.PARTICIPANT_ACTION_BAN:
+		mask, err := repo.ParseBannedRights(*rights)
+		if err != nil {
+			return err
+		}
+		action.BannedRights = int32(mask)
+		if *until > 0 {
+			action.BannedUntilDate = int32(time.Now().Add(*until).Unix())
+		}
+	default:
+		return fmt.Errorf("unknown moderate action %q", args[0])
+	}
+
+	results, err := store.ModerateChannels(action, channelIDs, userIDs)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Status == repo.MODERATION_STATUS_FAILED {
+			failed++
+		}
+		fmt.Printf("channel=%d status=%s users=%d version=%d %s\n", r.ChannelID, r.Status, len(r.UserIDs), r.Version, r.Error)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d/%d channels failed", failed, len(results))
+	}
+	return nil
+}
+
+// runChannel xoá / sao chép / gộp channel trên ES và Redis.
+func runChannel(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: channel drop|copy|merge ...")
+	}
+	fs := flag.NewFlagSet("channel "+args[0], flag.ContinueOnError)
+	channel := fs.Int("channel", 0, "channel id cần xoá")
+	src := fs.Int("src", 0, "channel nguồn")
+	dst := fs.Int("dst", 0, "channel đích")
+	policy := fs.String("policy", repo.MERGE_CONFLICT_KEEP_DST, "xử lý user có ở cả hai channel: keep_dst|keep_src|highest_role")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "drop":
+		if *channel <= 0 {
+			return fmt.Errorf("-channel is required")
+		}
+		deleted, err := store.DropChannel(int32(*channel))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dropped channel %d, deleted %d participants\n", *channel, deleted)
+		return nil
+
+	case "copy":
+		n, err := store.CopyChannel(int32(*src), int32(*dst))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Copied %d participants from channel %d to %d\n", n, *src, *dst)
+		return nil
+
+	case "merge":
+		r, err := store.MergeChannels(int32(*src), int32(*dst), *policy)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Merged channel %d into %d: added=%d replaced=%d kept=%d demoted=%d version=%d\n",
+			r.SrcChannelID, r.DstChannelID, r.Added, r.Replaced, r.Kept, r.Demoted, r.Version)
+		return nil
+	}
+	return fmt.Errorf("unknown channel command %q", args[0])
+}
+
+// runStats in bộ đếm participant của các channel, -verify so sánh với aggregation trên ES.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	channels := fs.String("channels", strconv.Itoa(int(channelID)), "danh sách channel id phân cách bằng dấu phẩy")
+	verify := fs.Bool("verify", false, "so sánh bộ đếm Redis với aggregation ES")
+	repair := fs.Bool("repair", false, "dựng lại bộ đếm của channel bị lệch (kèm -verify)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	channelIDs, err := parseUserIDs(*channels)
+	if err != nil {
+		return fmt.Errorf("-channels: %w", err)
+	}
+
+	printStats := func(prefix string, st *repo.ChannelStatsDO) {
+		fmt.Printf("%s\ttotal=%d active=%d admins=%d creators=%d banned=%d kicked=%d left=%d hidden=%d pending=%d\n",
+			prefix, st.Total, st.Active, st.Admins, st.Creators, st.Banned, st.Kicked, st.Left, st.Hidden, st.Pending)
+	}
+
+	if !*verify {
+		stats, err := statsService.GetChannelStatsBatch(channelIDs)
+		if err != nil {
+			return err
+		}
+		for _, cid := range channelIDs {
+			printStats(strconv.Itoa(int(cid)), stats[cid])
+		}
+		return nil
+	}
+
+	checks, err := statsService.Verify(channelIDs, *repair)
+	if err != nil {
+		return err
+	}
+	mismatched := 0
+	for _, c := range checks {
+		if c.Match {
+			printStats(fmt.Sprintf("%d\tok", c.ChannelID), c.Elastic)
+			continue
+		}
+		mismatched++
+		if c.Cached != nil {
+			printStats(fmt.Sprintf("%d\tredis", c.ChannelID), c.Cached)
+		} else {
+			fmt.Printf("%d\tredis\tmissing\n", c.ChannelID)
+		}
+		printStats(fmt.Sprintf("%d\telastic", c.ChannelID), c.Elastic)
+		if c.Repaired {
+			fmt.Printf("%d\trepaired\n", c.ChannelID)
+		}
+	}
+	fmt.Printf("Checked %d channels, %d mismatched\n", len(checks), mismatched)
+	return nil
+}
+
+// runActivity xuất chuỗi thời gian join / leave / kick / ban / promote của các channel ra CSV hoặc JSON.
+func runActivity(args []string) error {
+	fs := flag.NewFlagSet("activity", flag.ContinueOnError)
+	channels := fs.String("channels", strconv.Itoa(int(channelID)), "danh sách channel id phân cách bằng dấu phẩy")
+	interval := fs.String("interval", repo.ACTIVITY_INTERVAL_DAY, "hour|day|week")
+	fromStr := fs.String("from", "", "thời điểm bắt đầu (RFC3339 hoặc 2006-01-02, mặc định 7 ngày trước -to)")
+	toStr := fs.String("to", "", "thời điểm kết thúc, không bao gồm (RFC3339 hoặc 2006-01-02, mặc định hiện tại)")
+	format := fs.String("format", "csv", "csv|json")
+	out := fs.String("out", "", "file xuất kết quả (mặc định stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	channelIDs, err := parseUserIDs(*channels)
+	if err != nil {
+		return fmt.Errorf("-channels: %w", err)
+	}
+
+	to := time.Now()
+	if *toStr != "" {
+		if to, err = parseTime(*toStr); err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+	}
+	from := to.Add(-7 * 24 * time.Hour)
+	if *fromStr != "" {
+		if from, err = parseTime(*fromStr); err != nil {
+			return fmt.Errorf("-from: %w", err)
+		}
+	}
+
+	series, err := elaC.GetActivity(channelIDs, *interval, from.Unix(), to.Unix())
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(series)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"start", "joins", "leaves", "kicks", "bans", "promotions"})
+		for _, b := range series.Buckets {
+			cw.Write([]string{
+				time.Unix(b.Start, 0).UTC().Format(time.RFC3339),
+				strconv.FormatInt(b.Joins, 10),
+				strconv.FormatInt(b.Leaves, 10),
+				strconv.FormatInt(b.Kicks, 10),
+				strconv.FormatInt(b.Bans, 10),
+				strconv.FormatInt(b.Promotions, 10),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q (csv|json)", *format)
+}
+
+// parseTime nhận RFC3339 hoặc ngày dạng 2006-01-02 (UTC).
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// runServe chạy HTTP/JSON API (và gRPC nếu có -grpc) đến khi nhận SIGINT / SIGTERM,
+// sau đó ngừng nhận mutation mới, chờ request và bulk đang chạy rồi thoát.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", getEnv("HTTP_ADDR", ":8080"), "địa chỉ lắng nghe của HTTP API")
+	grpcAddr := fs.String("grpc", os.Getenv("GRPC_ADDR"), "địa chỉ lắng nghe của gRPC API, rỗng = tắt")
+	drainGrace := fs.Duration("drain-grace", repo.HTTP_DRAIN_GRACE, "thời gian readyz trả 503 trước khi HTTP API ngừng nhận kết nối")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	repairInterrupted()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// một server lỗi thì dừng luôn server còn lại
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		<-ctx.Done()
+		// trong drain grace API vẫn nhận mutation như bình thường
+		time.Sleep(*drainGrace)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), repo.SHUTDOWN_DRAIN_TIMEOUT)
+		defer cancel()
+		return lifecycle.Shutdown(shutdownCtx)
+	})
+	g.Go(func() error {
+		fmt.Printf("HTTP API listening on %s\n", *addr)
+		return repo.NewHTTPAPI(store, rehydrator, statsService, health).WithDrainGrace(*drainGrace).ListenAndServe(ctx, *addr)
+	})
+	if *grpcAddr != "" {
+		g.Go(func() error {
+			fmt.Printf("gRPC API listening on %s\n", *grpcAddr)
+			return repo.NewGRPCAPI(store, health).ListenAndServe(ctx, *grpcAddr)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	fmt.Println("API stopped")
+	return nil
+}
+
+// runHealth kiểm tra ES / Redis trực tiếp, hoặc hỏi /readyz của server đang chạy nếu có -url.
+// Trả lỗi khi not_ready, -watch kiểm tra lặp lại đến khi nhận SIGINT / SIGTERM.
+func runHealth(args []string) error {
+	fs := flag.NewFlagSet("health", flag.ContinueOnError)
+	url := fs.String("url", "", "địa chỉ HTTP API, rỗng = kiểm tra trực tiếp từ process này")
+	watch := fs.Duration("watch", 0, "kiểm tra định kỳ, 0 = một lần")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	check := func() (*repo.HealthDO, error) {
+		if *url == "" {
+			return health.Check(ctx), nil
+		}
+		return fetchHealth(ctx, strings.TrimRight(*url, "/")+"/readyz")
+	}
+	for {
+		h, err := check()
+		if err != nil {
+			return err
+		}
+		printHealth(h)
+		if *watch <= 0 {
+			if h.Status == repo.HEALTH_NOT_READY {
+				return fmt.Errorf("service not ready")
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*watch):
+		}
+	}
+}
+
+// fetchHealth đọc HealthDO từ /readyz, 503 vẫn có body nên không coi là lỗi.
+func fetchHealth(ctx context.Context, url string) (*repo.HealthDO, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+	h := &repo.HealthDO{}
+	if err := json.NewDecoder(resp.Body).Decode(h); err != nil {
+		return nil, fmt.Errorf("decode %s (status %d) failed: %w", url, resp.StatusCode, err)
+	}
+	return h, nil
+}
+
+func printHealth(h *repo.HealthDO) {
+	fmt.Printf("%s status=%s\n", h.CheckedAt.Format(time.RFC3339), h.Status)
+	for _, b := range h.Backends {
+		fmt.Printf("  %-8s %-8s since=%s failures=%d latency=%dms", b.Backend, b.Status, b.Since.Format(time.RFC3339), b.Failures, b.LatencyMs)
+		if b.Breaker != "" {
+			fmt.Printf(" breaker=%s", b.Breaker)
+		}
+		if b.Error != "" {
+			fmt.Printf(" err=%s", b.Error)
+		}
+		fmt.Println()
+	}
+}
+
+// runInterrupted liệt kê / sửa các channel có mutation bị ngắt khi tắt.
+func runInterrupted(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: interrupted list|repair")
+	}
+	switch args[0] {
+	case "list":
+		list := lifecycle.Interrupted()
+		for _, m := range list {
+			fmt.Printf("channel=%d op=%s started=%s interrupted=%s err=%s\n", m.ChannelID, m.Op,
+				time.Unix(m.StartedAt, 0).Format(time.RFC3339), time.Unix(m.InterruptedAt, 0).Format(time.RFC3339), m.Error)
+		}
+		fmt.Printf("%d interrupted mutations\n", len(list))
+		return nil
+	case "repair":
+		results, err := lifecycle.Repair(store)
+		failed := 0
+		for _, m := range results {
+			status := "repaired"
+			if m.Error != "" {
+				status, failed = "failed: "+m.Error, failed+1
+			}
+			fmt.Printf("channel=%d op=%s %s\n", m.ChannelID, m.Op, status)
+		}
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d interrupted mutations not repaired", failed)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown interrupted command %q", args[0])
+}
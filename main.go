@@ -1,23 +1,123 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"log/slog"
 	"math/rand"
+	"os"
+	"os/signal"
+	"slices"
 	"sync"
+	"syscall"
 	"time"
 	"tool_cache/repo"
+
+	"github.com/go-redis/redis"
+	"github.com/olivere/elastic/v7"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 var (
-	elaC      *repo.ElasticChannelParticipantsDAO
-	redisC    *repo.ChannelParticipantsCacheDAO
-	channelID int32
+	elaC         *repo.ElasticChannelParticipantsDAO
+	redisC       *repo.ChannelParticipantsCacheDAO
+	store        *repo.ChannelParticipantsStore
+	rehydrator   *repo.CacheRehydrator
+	userIndex    *repo.UserChannelsIndex
+	statsService *repo.ChannelStatsService
+	health       *repo.HealthMonitor
+	lifecycle    *repo.MutationLifecycle
+	channelID    int32
+
+	tracerProvider *sdktrace.TracerProvider // nil khi TRACE_EXPORTER=none
+)
+
+const (
+	OUTBOX_FILE = "outbox.log"
+	ERASURE_DIR = "erasure" // report / checkpoint của các yêu cầu xoá user
+
+	INTERRUPTED_FILE = "interrupted.json" // channel có mutation bị ngắt khi tắt, được sửa ở lần chạy sau
 )
 
 func init() {
-	client := repo.ConnectElastic()
-	elaC = repo.NewElasticChannelParticipantsDAO(client)
-	redisC = repo.NewChannelParticipantsCacheDAO()
+	// LOG_LEVEL=debug|info|warn|error, LOG_FORMAT=text|json. Mặc định debug để vẫn thấy thời gian thực thi từng hàm.
+	logger, err := repo.NewLogger(os.Stdout, getEnv("LOG_LEVEL", "debug"), getEnv("LOG_FORMAT", "text"))
+	if err != nil {
+		log.Fatalf("init logger err: %v", err)
+	}
+	slog.SetDefault(logger)
+
+	// METRICS_ADDR (ví dụ :9100) bật endpoint /metrics cho Prometheus.
+	metrics := repo.NewMetrics(nil)
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		if _, err := repo.ServeMetrics(addr, nil); err != nil {
+			log.Fatalf("serve metrics err: %v", err)
+		}
+	}
+
+	// TRACE_EXPORTER=none|stdout|otlp bật OpenTelemetry tracing cho DAO và từng request ES / Redis.
+	exporter, err := repo.NewSpanExporter(context.Background(), getEnv("TRACE_EXPORTER", repo.TRACE_EXPORTER_NONE), os.Stdout)
+	if err != nil {
+		log.Fatalf("init trace exporter err: %v", err)
+	}
+	if exporter != nil {
+		tracerProvider = repo.NewTracerProvider(exporter, "tool_cache")
+		otel.SetTracerProvider(tracerProvider)
+	}
+
+	// Timeout theo op, thử lại request / lệnh idempotent và circuit breaker cho từng backend.
+	resilience := repo.NewResilience(repo.DefaultResilienceConfig())
+
+	// CONNECT_MODE=eager|lazy|background: eager chờ ES / Redis lúc khởi động (có retry),
+	// lazy / background khởi động ngay kể cả khi backend đang lỗi, trạng thái xem bằng lệnh health hoặc /readyz.
+	esOptions := []elastic.ClientOptionFunc{
+		elastic.SetHttpClient(repo.TracedHTTPClient(metrics.HTTPClient(nil))),
+		elastic.SetRetrier(resilience.ElasticRetrier()),
+		elastic.SetRetryStatusCodes(429, 502, 503, 504),
+	}
+	var client *elastic.Client
+	var rdb *redis.Client
+	mode := getEnv("CONNECT_MODE", repo.CONNECT_MODE_EAGER)
+	switch mode {
+	case repo.CONNECT_MODE_EAGER:
+		if client, err = repo.ConnectElastic(context.Background(), repo.DefaultConnectPolicy(), esOptions...); err != nil {
+			log.Fatalf("connect elastic err: %v", err)
+		}
+		if rdb, err = repo.ConnectRedis(context.Background(), repo.DefaultConnectPolicy()); err != nil {
+			log.Fatalf("connect redis err: %v", err)
+		}
+	case repo.CONNECT_MODE_LAZY, repo.CONNECT_MODE_BACKGROUND:
+		if client, err = repo.NewElasticClient(esOptions...); err != nil {
+			log.Fatalf("create elastic client err: %v", err)
+		}
+		rdb = repo.NewRedisClient()
+	default:
+		log.Fatalf("invalid CONNECT_MODE %q (eager|lazy|background)", mode)
+	}
+	health = repo.NewHealthMonitor(client, rdb, repo.HealthConfig{Resilience: resilience, Logger: logger})
+	if mode == repo.CONNECT_MODE_BACKGROUND {
+		go health.Run(context.Background())
+	}
+
+	// Khi tắt: ngừng nhận mutation mới, chờ BulkProcessor đang chạy, channel chưa xong được ghi vào INTERRUPTED_FILE
+	lifecycle, err = repo.OpenMutationLifecycle(INTERRUPTED_FILE)
+	if err != nil {
+		log.Fatalf("open mutation lifecycle err: %v", err)
+	}
+
+	elaC = repo.NewElasticChannelParticipantsDAO(client).WithLogger(logger).WithMetrics(metrics).WithResilience(resilience).WithLifecycle(lifecycle)
+	redisC = repo.NewChannelParticipantsCacheDAO(rdb).WithLogger(logger).WithMetrics(metrics).WithResilience(resilience)
+
+	outbox, err := repo.OpenFileOutbox(OUTBOX_FILE)
+	if err != nil {
+		log.Fatalf("open outbox err: %v", err)
+	}
+	store = repo.NewChannelParticipantsStore(elaC, redisC, outbox)
+	rehydrator = repo.NewCacheRehydrator(elaC, redisC)
+	userIndex = repo.NewUserChannelsIndex(elaC, redisC)
+	statsService = repo.NewChannelStatsService(elaC, redisC)
 
 	channelID = int32(1001)
 
@@ -25,9 +125,92 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// shutdownTracing đẩy nốt các span còn trong batch trước khi thoát.
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("shutdown tracer provider failed", repo.LOG_KEY_ERROR, err)
+	}
+}
+
+// repairInterrupted sửa các channel có mutation bị ngắt khi tắt ở lần chạy trước.
+// Channel sửa lỗi vẫn được giữ lại để thử lại ở lần chạy sau.
+func repairInterrupted() {
+	if len(lifecycle.Interrupted()) == 0 {
+		return
+	}
+	results, err := lifecycle.Repair(store)
+	for _, m := range results {
+		if m.Error != "" {
+			slog.Warn("repair interrupted channel failed", repo.LOG_KEY_CHANNEL_ID, m.ChannelID, repo.LOG_KEY_OP, m.Op, repo.LOG_KEY_ERROR, m.Error)
+		}
+	}
+	if err != nil {
+		slog.Warn("save interrupted mutations failed", repo.LOG_KEY_ERROR, err)
+	}
+}
+
+// drainMutations ngừng nhận mutation mới rồi chờ mutation đang chạy và done trong SHUTDOWN_DRAIN_TIMEOUT.
+func drainMutations(done <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), repo.SHUTDOWN_DRAIN_TIMEOUT)
+	defer cancel()
+	if err := lifecycle.Shutdown(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for pending work to stop")
+	}
+}
+
 func main() {
-	// migrate dữ liệu
-	LoadAllData()
+	defer shutdownTracing()
+
+	// Chạy lệnh CLI nếu có tham số, ví dụ: go run . outbox list failed
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Println("Err: ", err)
+			shutdownTracing()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// sửa các channel bị ngắt giữa chừng ở lần chạy trước
+	repairInterrupted()
+
+	// migrate dữ liệu, SIGINT / SIGTERM thì chờ bulk đang chạy xong rồi mới thoát
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		LoadAllData()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		stop() // tín hiệu thứ hai thoát ngay
+		fmt.Println("Shutting down, waiting for in-flight mutations ...")
+		if err := drainMutations(done); err != nil {
+			fmt.Println("Err: ", err)
+			shutdownTracing()
+			os.Exit(1)
+		}
+	}
 
 	// Lấy dữ liệu
 	// GetData()
@@ -40,61 +223,82 @@ func main() {
 }
 
 // ===================================================================================
-// sampleData tạo ra 10 documents mẫu
-func sampleData(channelID int32, size int, idStart int) ([]repo.ElasticChannelParticipantsDO, []int32) {
+// sampleData tạo ra documents mẫu hợp lệ: mỗi user được gán một state ngẫu nhiên,
+// các cờ được điền theo state rồi field top-level được suy ra bằng repo.NewElasticParticipant.
+// User đầu tiên (idStart) là creator duy nhất của channel.
+func sampleData(channelID int32, size int, idStart int, withCreator bool) ([]repo.ElasticChannelParticipantsDO, []int32) {
 	now := int32(time.Now().Unix())
 
+	// tỉ lệ các state của user không phải creator
+	states := []repo.ParticipantState{
+		repo.PARTICIPANT_STATE_MEMBER, repo.PARTICIPANT_STATE_MEMBER, repo.PARTICIPANT_STATE_MEMBER,
+		repo.PARTICIPANT_STATE_MEMBER, repo.PARTICIPANT_STATE_MEMBER, repo.PARTICIPANT_STATE_MEMBER,
+		repo.PARTICIPANT_STATE_ADMIN, repo.PARTICIPANT_STATE_RESTRICTED, repo.PARTICIPANT_STATE_LEFT,
+		repo.PARTICIPANT_STATE_KICKED, repo.PARTICIPANT_STATE_BANNED, repo.PARTICIPANT_STATE_WAITING_APPROVAL,
+	}
+
 	data := []repo.ElasticChannelParticipantsDO{}
 	litsUserID := []int32{}
 
 	for i := idStart; i <= idStart+size; i++ {
-		doc := &repo.ElasticChannelParticipantsDO{
+		p := &repo.ChannelParticipantsDO{
 			ID:                int64(i),
 			ChannelID:         channelID,
 			UserID:            int32(i),
-			IsCreator:         rand.Int31n(2),           // 0 hoặc 1
-			AdminRights:       rand.Int31n(5),           // 0..4
-			ParticipantType:   int8(rand.Intn(3) + 1),   // 1..3
-			HiddenParticipant: int8(rand.Intn(2)),       // 0 hoặc 1
-			IsLeft:            int8(rand.Intn(2)),       // 0 hoặc 1
-			LeftAt:            now - rand.Int31n(10000), // thời điểm rời (nếu có)
-			IsKicked:          int8(rand.Intn(2)),       // 0 hoặc 1
-			BannedRights:      rand.Int31n(10),          // số random
-			BannedUntilDate:   now + rand.Int31n(10000), // future
-			Data: &repo.ChannelParticipantsDO{
-				ID:                int64(i),
-				ChannelID:         channelID,
-				UserID:            int32(i),
-				IsCreator:         rand.Int31n(5),
-				ParticipantType:   int8(rand.Intn(3) + 1),
-				InviterUserID:     int32(rand.Intn(9000) + 1000),
-				InvitedAt:         now - rand.Int31n(10000),
-				JoinedAt:          now - rand.Int31n(5000),
-				IsWaitingAprrove:  int8(rand.Intn(2)),
-				HiddenParticipant: int8(rand.Intn(2)),
-				IsLeft:            int8(rand.Intn(2)),
-				LeftAt:            now - rand.Int31n(10000),
-				IsKicked:          int8(rand.Intn(2)),
-				KickedBy:          int32(rand.Intn(9000) + 1000),
-				KickedAt:          now - rand.Int31n(10000),
-				HiddenPrehistory:  int8(rand.Intn(2)),
-				AdminRights:       rand.Int31n(5),
-				PromotedBy:        int32(rand.Intn(9000) + 1000),
-				PromotedAt:        now - rand.Int31n(10000),
-				Rank:              fmt.Sprintf("member-%d", rand.Intn(100)),
-				BannedRights:      rand.Int31n(10),
-				BannedUntilDate:   now + rand.Int31n(10000),
-				BannedAt:          now - rand.Int31n(10000),
-				ReadInboxMaxID:    rand.Int31n(10000),
-				ReadOutboxMaxID:   rand.Int31n(10000),
-				Date:              now - rand.Int31n(10000),
-				State:             int8(rand.Intn(3)), // 0..2
-				CreatedAt:         time.Now().Add(-time.Duration(rand.Intn(3600)) * time.Second).Format(time.RFC3339),
-				UpdatedAt:         time.Now().Format(time.RFC3339),
-			},
+			ParticipantType:   int8(rand.Intn(3) + 1), // 1..3
+			InviterUserID:     int32(rand.Intn(9000) + 1000),
+			InvitedAt:         now - rand.Int31n(10000),
+			JoinedAt:          now - rand.Int31n(5000),
+			HiddenParticipant: int8(rand.Intn(2)),
+			HiddenPrehistory:  int8(rand.Intn(2)),
+			ReadInboxMaxID:    rand.Int31n(10000),
+			ReadOutboxMaxID:   rand.Int31n(10000),
+			Date:              now - rand.Int31n(10000),
+			CreatedAt:         time.Now().Add(-time.Duration(rand.Intn(3600)) * time.Second).Format(time.RFC3339),
+			UpdatedAt:         time.Now().Format(time.RFC3339),
+		}
+
+		state := states[rand.Intn(len(states))]
+		if withCreator && i == idStart {
+			state = repo.PARTICIPANT_STATE_CREATOR
+		}
+		switch state {
+		case repo.PARTICIPANT_STATE_CREATOR:
+			p.IsCreator = 1
+			p.Rank = "owner"
+		case repo.PARTICIPANT_STATE_ADMIN:
+			p.AdminRights = rand.Int31n(4) + 1 // 1..4
+			p.PromotedBy = int32(idStart)
+			p.PromotedAt = now - rand.Int31n(10000)
+			p.Rank = fmt.Sprintf("admin-%d", rand.Intn(100))
+		case repo.PARTICIPANT_STATE_RESTRICTED:
+			p.BannedRights = rand.Int31n(9) + 1 // 1..9
+			p.BannedUntilDate = now + rand.Int31n(10000)
+			p.BannedAt = now - rand.Int31n(10000)
+		case repo.PARTICIPANT_STATE_LEFT:
+			p.IsLeft = 1
+			p.LeftAt = now - rand.Int31n(10000)
+		case repo.PARTICIPANT_STATE_KICKED:
+			p.IsKicked = 1
+			p.KickedBy = int32(idStart)
+			p.KickedAt = now - rand.Int31n(10000)
+		case repo.PARTICIPANT_STATE_BANNED:
+			p.IsKicked = 1
+			p.KickedBy = int32(idStart)
+			p.KickedAt = now - rand.Int31n(10000)
+			p.BannedRights = rand.Int31n(9) + 1
+			p.BannedUntilDate = now + rand.Int31n(10000) // future
+			p.BannedAt = p.KickedAt
+		case repo.PARTICIPANT_STATE_WAITING_APPROVAL:
+			p.IsWaitingAprrove = 1
+			p.JoinedAt = 0
+		}
+
+		doc := repo.NewElasticParticipant(p)
+		data = append(data, doc)
+		if repo.IsActiveParticipant(&doc) {
+			litsUserID = append(litsUserID, doc.UserID)
 		}
-		data = append(data, *doc)
-		litsUserID = append(litsUserID, int32(doc.UserID))
 	}
 
 	return data, litsUserID
@@ -121,15 +325,13 @@ func LoadAllData() {
 		go func(index int) {
 			defer wg.Done()
 
-			docs, listUsers := sampleData(channelID, 20000, 1)
-			err := elaC.SaveAllUsers(channelID+int32(i), -1, docs)
-			if err != nil {
-				fmt.Println("SaveAllUsers Err: ", err)
-				return
+			cid := channelID + int32(index)
+			docs, _ := sampleData(cid, 20000, 1, true)
+			// qua outbox như mọi mutation khác: ES, 2 key Redis, hàng chờ duyệt, version,
+			// reverse index user:<uid>:channels và bộ đếm được cập nhật cùng nhau
+			if err := store.SaveAll(cid, -1, docs); err != nil {
+				fmt.Println("SaveAll Err: ", err)
 			}
-
-			redisC.SaveAllData(channelID+int32(i), listUsers)
-			redisC.SaveString(channelID+int32(i), listUsers)
 		}(i)
 	}
 	wg.Wait()
@@ -145,19 +347,32 @@ func DeleteUser() {
 		// Xoá 50K user - time:  3.4990352s
 		// Xoá 100K user - time:  6.3435948s
 	*/
-	_, deleteDataID := sampleData(channelID, 100000, 95001)
-	println("Deleted 1000 users")
-	err := elaC.DeleteUsers(channelID+3, -1, deleteDataID)
+	// Lấy user đang active trong channel để cho rời nhóm
+	members, err := rehydrator.GetList(channelID + 3)
 	if err != nil {
-		fmt.Println("DeleteUsers Err: ", err)
+		fmt.Println("GetList Err: ", err)
 		return
 	}
-
-	if ok := redisC.DeleteUsers(channelID, deleteDataID); !ok {
-		fmt.Println("DeleteUsers Err!")
+	// creator không được rời nhóm khi chưa chuyển quyền sở hữu
+	creators, err := elaC.GetCreatorIDs(channelID + 3)
+	if err != nil {
+		fmt.Println("GetCreatorIDs Err: ", err)
+		return
+	}
+	deleteDataID := make([]int32, 0, 5000)
+	for _, uid := range members {
+		if len(deleteDataID) == 5000 {
+			break
+		}
+		if !slices.Contains(creators, uid) {
+			deleteDataID = append(deleteDataID, uid)
+		}
 	}
-	if err := redisC.DeleteString(channelID, deleteDataID); err != nil {
-		fmt.Println("DeleteUsersString Err!")
+	println("Deleted 5000 users")
+	// Ghi vào outbox trước, relay áp dụng lần lượt lên ES và 2 key Redis.
+	// Dùng Leave thay vì xoá cứng để giữ lịch sử, xoá cứng chạy riêng bằng lệnh purge.
+	if err := store.Leave(channelID+3, deleteDataID); err != nil {
+		fmt.Println("Leave Err: ", err)
 	}
 }
 
@@ -181,51 +396,56 @@ func UpdateUser() {
 			- 40K user	time: 2.6665839s - redisADD: 61.8861ms - redisString: 4.0308ms
 	*/
 
-	newData, newDataID := sampleData(channelID, 30000, 500001)
-	updateData, newUpdateID := sampleData(channelID, 30000, 1)
+	// span gốc của kịch bản: bulk, refresh, SetVersion và các lệnh Redis bên dưới là span con
+	ctx, span := otel.Tracer("tool_cache").Start(context.Background(), "UpdateUser")
+	defer span.End()
+	store := store.WithContext(ctx)
+	elaC := elaC.WithContext(ctx)
 
-	// Thêm với version tự động tăng
-	println("Added new 1000 users")
-	err := elaC.AddDataToCache(channelID, -1, newData)
+	// user mới không có creator: mỗi channel chỉ có đúng một creator
+	newData, _ := sampleData(channelID, 30000, 500001, false)
+
+	// Cập nhật thông tin không đổi state của user đã có: phải đọc document hiện tại rồi sửa,
+	// ghi đè bằng state ngẫu nhiên sẽ bị chặn bởi kiểm tra chuyển trạng thái.
+	updateIDs := make([]int32, 0, 30000)
+	for uid := int32(1); uid <= 30000; uid++ {
+		updateIDs = append(updateIDs, uid)
+	}
+	current, err := elaC.GetParticipants(channelID+1, updateIDs)
 	if err != nil {
-		fmt.Println("AddDataToCache Err: ", err)
+		fmt.Println("GetParticipants Err: ", err)
+		return
 	}
-	if ok := redisC.AddUsers(channelID, newDataID); !ok {
-		fmt.Println("AddUsers Err!")
+	updateData := make([]repo.ElasticChannelParticipantsDO, 0, len(current))
+	for _, doc := range current {
+		if doc.Data == nil {
+			continue
+		}
+		doc.Data.ReadInboxMaxID += rand.Int31n(100)
+		doc.Data.UpdatedAt = time.Now().Format(time.RFC3339)
+		updateData = append(updateData, *doc)
 	}
-	if err := redisC.AddUsersString(channelID, newDataID); err != nil {
-		fmt.Println("AddUsersString Err!")
+
+	// Thêm với version tự động tăng
+	println("Added new 1000 users")
+	if err := store.Upsert(channelID, -1, newData); err != nil {
+		fmt.Println("AddDataToCache Err: ", err)
 	}
 
 	// update với version
 	println("Updated 1000 existing users")
-	err = elaC.AddDataToCache(channelID+1, 10, updateData)
-	if err != nil {
+	if err := store.Upsert(channelID+1, 10, updateData); err != nil {
 		fmt.Println("AddDataToCache Err: ", err)
 		return
 	}
 
-	if ok := redisC.AddUsers(channelID+1, newUpdateID); !ok {
-		fmt.Println("AddUsers Err!")
-	}
-	if err := redisC.AddUsersString(channelID+1, newUpdateID); err != nil {
-		fmt.Println("AddUsersString Err!")
-	}
-
 	// update với dữ liệu mới (reset lại toàn bảng)
 	println("reset 1000 existing users")
-	reloadData, reloadDataID := sampleData(channelID+2, 60000, 32001)
-	err = elaC.SaveAllUsers(channelID+3, -1, reloadData)
-	if err != nil {
+	reloadData, _ := sampleData(channelID+3, 60000, 32001, true)
+	if err := store.SaveAll(channelID+3, -1, reloadData); err != nil {
 		fmt.Println("SaveAllUsers Err: ", err)
 		return
 	}
-	if ok := redisC.SaveAllData(channelID+3, reloadDataID); !ok {
-		fmt.Println("SaveAllData Err!")
-	}
-	if err := redisC.SaveString(channelID+3, reloadDataID); err != nil {
-		fmt.Println("SaveString Err!")
-	}
 }
 
 // Triển khai kịch bản
@@ -244,13 +464,21 @@ func GetData() {
 		fmt.Println("err get list: ", err)
 	}
 
-	_, ok := redisC.GetList(channelID)
-	if !ok {
-		fmt.Println("err get list!")
+	// Cache miss sẽ được dựng lại từ ES
+	if _, err := rehydrator.GetList(channelID); err != nil {
+		fmt.Println("err get list: ", err)
 	}
 
-	if _, err := redisC.GetString(channelID); err != nil {
-		fmt.Println("err get list!")
+	if _, err := rehydrator.GetString(channelID); err != nil {
+		fmt.Println("err get list: ", err)
+	}
+
+	// Client đang giữ version cũ chỉ cần lấy phần thay đổi
+	changes, err := elaC.GetChangesSince(channelID, 1)
+	if err != nil {
+		fmt.Println("err get changes: ", err)
+	} else if changes.Resync {
+		fmt.Println("change log không đủ, cần tải lại toàn bộ danh sách")
 	}
 	// fmt.Println("Time to Get Data: ", time.Since(timeStart).Milliseconds(), "ms")
 }
@@ -0,0 +1,193 @@
+package repo
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	ACTIVITY_INTERVAL_HOUR = "hour"
+	ACTIVITY_INTERVAL_DAY  = "day"
+	ACTIVITY_INTERVAL_WEEK = "week"
+
+	ACTIVITY_MAX_BUCKETS = 5000 // giới hạn số bucket của một lần truy vấn
+)
+
+// activityEvents sự kiện được thống kê và field thời điểm (epoch second) tương ứng trong data.
+// Mỗi document chỉ giữ thời điểm của lần gần nhất nên user join lại chỉ được tính ở lần join cuối.
+// Ban cũng ghi KickedAt nên kicks bao gồm cả các lần ban.
+var activityEvents = []struct {
+	name  string
+	field string
+}{
+	{"joins", "data.JoinedAt"},
+	{"leaves", "data.LeftAt"},
+	{"kicks", "data.KickedAt"},
+	{"bans", "data.BannedAt"},
+	{"promotions", "data.PromotedAt"},
+}
+
+// ActivityBucketDO số sự kiện trong một khoảng [Start, Start + interval).
+type ActivityBucketDO struct {
+	Start      int64 `json:"start"`
+	Joins      int64 `json:"joins"`
+	Leaves     int64 `json:"leaves"`
+	Kicks      int64 `json:"kicks"`
+	Bans       int64 `json:"bans"`
+	Promotions int64 `json:"promotions"`
+}
+
+func (b *ActivityBucketDO) set(event string, count int64) {
+	switch event {
+	case "joins":
+		b.Joins = count
+	case "leaves":
+		b.Leaves = count
+	case "kicks":
+		b.Kicks = count
+	case "bans":
+		b.Bans = count
+	case "promotions":
+		b.Promotions = count
+	}
+}
+
+// ActivitySeriesDO chuỗi thời gian join / leave / kick / ban / promote của một hoặc nhiều channel.
+type ActivitySeriesDO struct {
+	ChannelIDs []int32            `json:"channel_ids"`
+	Interval   string             `json:"interval"`
+	From       int64              `json:"from"`
+	To         int64              `json:"to"`
+	Buckets    []ActivityBucketDO `json:"buckets"`
+}
+
+// activityInterval độ dài bucket và offset (giây, UTC). Tuần bắt đầu từ thứ Hai:
+// epoch 0 là thứ Năm nên lệch 4 ngày.
+func activityInterval(interval string) (int64, int64, error) {
+	switch interval {
+	case ACTIVITY_INTERVAL_HOUR:
+		return 3600, 0, nil
+	case ACTIVITY_INTERVAL_DAY:
+		return 86400, 0, nil
+	case ACTIVITY_INTERVAL_WEEK:
+		return 7 * 86400, 4 * 86400, nil
+	}
+	return 0, 0, invalidInputf("unknown activity interval %q (hour|day|week)", interval)
+}
+
+// GetActivity thống kê sự kiện của các channel theo interval trong khoảng [from, to) (epoch second, UTC).
+// Các field thời điểm được map động thành số (epoch second) nên dùng histogram số với interval tính bằng giây,
+// tương đương date_histogram fixed interval. Bucket không có sự kiện vẫn được trả về với giá trị 0.
+func (e *ElasticChannelParticipantsDAO) GetActivity(channelIDs []int32, interval string, from, to int64) (_ *ActivitySeriesDO, err error) {
+	e, span := e.startSpan("GetActivity", attrCount(len(channelIDs)))
+	defer e.observe(span, "GetActivity", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return nil, errElasticNil
+	}
+	if len(channelIDs) == 0 {
+		return nil, invalidInputf("channel list is required")
+	}
+	if from >= to {
+		return nil, invalidInputf("invalid range: from %d >= to %d", from, to)
+	}
+	step, offset, err := activityInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	first := floorBucket(from, step, offset)
+	if n := (to - first + step - 1) / step; n > ACTIVITY_MAX_BUCKETS {
+		return nil, invalidInputf("range too large: %d buckets (max %d)", n, ACTIVITY_MAX_BUCKETS)
+	}
+
+	indexSet := map[string]bool{}
+	routes := make([]string, 0, len(channelIDs))
+	ids := make([]interface{}, 0, len(channelIDs))
+	for _, cid := range channelIDs {
+		indexName := GetElasticChannelIndex(cid, ELASTIC_SIZE_INDEX)
+		if indexName == "" {
+			return nil, errEmptyIndex
+		}
+		indexSet[indexName] = true
+		routes = append(routes, strconv.Itoa(int(cid)))
+		ids = append(ids, cid)
+	}
+	indices := make([]string, 0, len(indexSet))
+	for name := range indexSet {
+		indices = append(indices, name)
+	}
+	sort.Strings(indices)
+
+	search := e.client.Search().
+		Index(indices...).
+		Routing(routes...).
+		Query(elastic.NewBoolQuery().Filter(
+			elastic.NewTermsQuery("channel_id", ids...),
+			elastic.NewExistsQuery("user_id"),
+		)).
+		Size(0)
+	for _, ev := range activityEvents {
+		histogram := elastic.NewHistogramAggregation().
+			Field(ev.field).
+			Interval(float64(step)).
+			Offset(float64(offset)).
+			MinDocCount(0).
+			ExtendedBounds(float64(first), float64(to-1))
+		search = search.Aggregation(ev.name, elastic.NewFilterAggregation().
+			Filter(elastic.NewRangeQuery(ev.field).Gte(from).Lt(to)).
+			SubAggregation("histogram", histogram))
+	}
+
+	res, err := search.Do(e.Context())
+	if err != nil && !elastic.IsNotFound(err) {
+		return nil, elasticError("activity aggregation failed", err)
+	}
+
+	series := &ActivitySeriesDO{ChannelIDs: channelIDs, Interval: interval, From: from, To: to}
+	index := map[int64]int{}
+	for start := first; start < to; start += step {
+		index[start] = len(series.Buckets)
+		series.Buckets = append(series.Buckets, ActivityBucketDO{Start: start})
+	}
+	if res != nil {
+		for _, ev := range activityEvents {
+			f, ok := res.Aggregations.Filter(ev.name)
+			if !ok {
+				continue
+			}
+			h, ok := f.Aggregations.Histogram("histogram")
+			if !ok {
+				continue
+			}
+			for _, b := range h.Buckets {
+				if i, ok := index[int64(b.Key)]; ok {
+					series.Buckets[i].set(ev.name, b.DocCount)
+				}
+			}
+		}
+	}
+
+	logTiming(e.Logger(), "GetActivity", timeStart, "channels", len(channelIDs), LOG_KEY_COUNT, len(series.Buckets))
+	return series, nil
+}
+
+// GetChannelActivity thống kê sự kiện của một channel.
+func (e *ElasticChannelParticipantsDAO) GetChannelActivity(channelID int32, interval string, from, to int64) (*ActivitySeriesDO, error) {
+	return e.GetActivity([]int32{channelID}, interval, from, to)
+}
+
+// floorBucket thời điểm bắt đầu của bucket chứa ts.
+func floorBucket(ts, step, offset int64) int64 {
+	v := ts - offset
+	q := v / step
+	if v%step < 0 {
+		q--
+	}
+	return q*step + offset
+}
@@ -0,0 +1,231 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	BAN_EXPIRY_LOCK_TTL = 2 * time.Minute // thời gian giữ khoá mỗi channel khi gỡ cấm
+	BAN_EXPIRY_BATCH    = 1000            // số user tối đa mỗi lần gỡ cấm
+)
+
+// IsBanExpired lệnh cấm có thời hạn và đã hết hạn tại thời điểm now (BannedUntilDate = 0 là vĩnh viễn).
+func IsBanExpired(p *ChannelParticipantsDO, now int32) bool {
+	return p.BannedRights != 0 && p.BannedUntilDate > 0 && p.BannedUntilDate <= now
+}
+
+// EffectiveBannedRights quyền bị cấm còn hiệu lực, lệnh cấm đã hết hạn được coi như đã gỡ.
+func EffectiveBannedRights(p *ChannelParticipantsDO, now int32) BannedRights {
+	if IsBanExpired(p, now) {
+		return 0
+	}
+	return BannedRights(p.BannedRights)
+}
+
+// LiftExpiredBan trả về bản sao document đã gỡ lệnh cấm hết hạn (state suy ra lại),
+// dùng ở phía đọc trong lúc worker chưa kịp ghi lại. Document không hết hạn được trả về nguyên trạng.
+func LiftExpiredBan(doc *ElasticChannelParticipantsDO, now int32) *ElasticChannelParticipantsDO {
+	data := participantData(doc)
+	if !IsBanExpired(data, now) {
+		return doc
+	}
+	lifted := *data
+	lifted.BannedRights, lifted.BannedUntilDate = 0, 0
+	out := NewElasticParticipant(&lifted)
+	return &out
+}
+
+// bannedAtQuery participant có lệnh cấm còn hiệu lực tại now (vĩnh viễn hoặc chưa hết hạn).
+func bannedAtQuery(now int32) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(elastic.NewRangeQuery("banned_rights").Gt(0)).
+		Should(
+			elastic.NewTermQuery("banned_until_date", 0),
+			elastic.NewRangeQuery("banned_until_date").Gt(now),
+		).
+		MinimumShouldMatch("1")
+}
+
+// expiredBansQuery participant có lệnh cấm có thời hạn và đã hết hạn tại now.
+func expiredBansQuery(now int32) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(
+			elastic.NewRangeQuery("banned_rights").Gt(0),
+			elastic.NewRangeQuery("banned_until_date").Gt(0).Lte(now),
+		)
+}
+
+// ScrollExpiredBans scroll toàn bộ index channel_participants_* tìm lệnh cấm đã hết hạn,
+// gọi fn theo từng nhóm user cùng channel trong mỗi batch.
+func (e *ElasticChannelParticipantsDAO) ScrollExpiredBans(now int32, fn func(channelID int32, userIDs []int32) error) (err error) {
+	e, span := e.startSpan("ScrollExpiredBans")
+	defer e.observe(span, "ScrollExpiredBans", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+
+	ctx := e.Context()
+	scroll := e.client.Scroll("channel_participants_*").
+		Query(expiredBansQuery(now)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("channel_id", "user_id")).
+		Size(BAN_EXPIRY_BATCH).
+		Sort("channel_id", true).
+		Scroll("1m")
+	defer scroll.Clear(ctx)
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil
+			}
+			return elasticError("scroll expired bans failed", err)
+		}
+		if res == nil || res.Hits == nil || len(res.Hits.Hits) == 0 {
+			return nil
+		}
+
+		var (
+			order  []int32
+			byChan = map[int32][]int32{}
+		)
+		for _, h := range res.Hits.Hits {
+			var doc struct {
+				ChannelID int32 `json:"channel_id"`
+				UserID    int32 `json:"user_id"`
+			}
+			if err := json.Unmarshal(h.Source, &doc); err != nil {
+				continue
+			}
+			if _, ok := byChan[doc.ChannelID]; !ok {
+				order = append(order, doc.ChannelID)
+			}
+			byChan[doc.ChannelID] = append(byChan[doc.ChannelID], doc.UserID)
+		}
+		for _, cid := range order {
+			if err := fn(cid, byChan[cid]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// BanExpiryReport kết quả một lượt gỡ cấm hết hạn.
+type BanExpiryReport struct {
+	Channels int      // số channel đã xử lý
+	Lifted   int      // số user đã được gỡ cấm
+	Skipped  int      // số channel bỏ qua vì process khác đang giữ khoá
+	Errors   []string // lỗi theo từng channel, không dừng cả lượt
+}
+
+// BanExpiryWorker tìm lệnh cấm đã hết hạn và gỡ qua store (outbox -> ES -> Redis),
+// nên version channel được tăng và change log được ghi như mọi mutation khác.
+// Mỗi channel được khoá bằng Redis SET NX nên có thể chạy song song ở nhiều process.
+type BanExpiryWorker struct {
+	es    *ElasticChannelParticipantsDAO
+	cache *ChannelParticipantsCacheDAO
+	store *ChannelParticipantsStore
+}
+
+func NewBanExpiryWorker(es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO, store *ChannelParticipantsStore) *BanExpiryWorker {
+	return &BanExpiryWorker{es: es, cache: cache, store: store}
+}
+
+// RunOnce quét và gỡ toàn bộ lệnh cấm đã hết hạn tại thời điểm gọi.
+func (w *BanExpiryWorker) RunOnce(ctx context.Context) (*BanExpiryReport, error) {
+	timeStart := time.Now()
+	now := int32(timeStart.Unix())
+	report := &BanExpiryReport{}
+	seen := map[int32]bool{}
+
+	err := w.es.ScrollExpiredBans(now, func(channelID int32, userIDs []int32) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !seen[channelID] {
+			seen[channelID] = true
+			report.Channels++
+		}
+		lifted, locked, err := w.liftChannel(channelID, userIDs, now)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("channel %d: %v", channelID, err))
+			return nil
+		}
+		if !locked {
+			report.Skipped++
+		}
+		report.Lifted += lifted
+		return nil
+	})
+
+	logCompleted(w.es.Logger(), "BanExpiry", timeStart,
+		"channels", report.Channels, "lifted", report.Lifted, "skipped", report.Skipped, "errors", len(report.Errors))
+	return report, err
+}
+
+// Run gọi RunOnce theo chu kỳ every cho tới khi ctx bị huỷ.
+func (w *BanExpiryWorker) Run(ctx context.Context, every time.Duration, onReport func(*BanExpiryReport)) error {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		report, err := w.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			logError(w.es.Logger(), "BanExpiry", err)
+		}
+		if onReport != nil && report != nil {
+			onReport(report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// liftChannel giữ khoá của channel, đọc lại document để chỉ gỡ những lệnh cấm vẫn còn hết hạn
+// (process khác có thể đã gỡ hoặc admin đã cấm lại) rồi Unban qua store.
+func (w *BanExpiryWorker) liftChannel(channelID int32, userIDs []int32, now int32) (int, bool, error) {
+	lockName := fmt.Sprintf("channel:%d:ban_expiry", channelID)
+	token, err := w.cache.AcquireLock(lockName, BAN_EXPIRY_LOCK_TTL)
+	if err != nil {
+		return 0, false, err
+	}
+	if token == "" {
+		return 0, false, nil
+	}
+	defer w.cache.ReleaseLock(lockName, token)
+
+	current, err := w.es.GetParticipants(channelID, userIDs)
+	if err != nil {
+		return 0, true, err
+	}
+	expired := make([]int32, 0, len(userIDs))
+	for _, uid := range userIDs {
+		if doc, ok := current[uid]; ok && IsBanExpired(participantData(doc), now) {
+			expired = append(expired, uid)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, true, nil
+	}
+
+	if err := w.store.Unban(channelID, 0, expired); err != nil {
+		return 0, true, err
+	}
+	return len(expired), true, nil
+}
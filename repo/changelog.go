@@ -0,0 +1,324 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	ELASTIC_CHANGE_RETENTION  = 1000 // số version gần nhất được giữ lại trong change log
+	ELASTIC_CHANGE_TRIM_EVERY = 100  // cứ mỗi N version thì dọn log cũ một lần
+)
+
+func GetElasticChangeIndex(channelID int32, sizeIndex int32) string {
+	if channelID <= 0 {
+		return ""
+	}
+
+	shard := channelID % sizeIndex
+	return fmt.Sprintf("channel_changes_%03d", shard)
+}
+
+func GetChannelChangeID(channelID int32, version int32) string {
+	return fmt.Sprintf("channel:%d:change:%d", channelID, version)
+}
+
+// bumpVersionWithChange cập nhật version rồi ghi change record dưới version mới.
+// version = 0 không tăng version nên cũng không ghi change log.
+// Khi chạy lại cùng idempotency key thì giữ nguyên change record đã ghi lần trước.
+func (e *ElasticChannelParticipantsDAO) bumpVersionWithChange(ctx context.Context, channelID int32, version int32, change ElasticChannelChangeDO) error {
+	prev, cur, err := e.updateVersion(ctx, channelID, version)
+	if err != nil {
+		return err
+	}
+	if version == 0 || prev == cur {
+		// không tăng version hoặc đã áp dụng trước đó (idempotency key trùng)
+		return nil
+	}
+
+	change.ChannelID = channelID
+	change.FromVersion = prev
+	change.Version = cur
+	change.CreatedAt = time.Now().Unix()
+	return e.appendChange(ctx, change)
+}
+
+// appendChange ghi change record vào channel_changes_NNN.
+// Doc id theo version nên ghi lại cùng version là idempotent.
+func (e *ElasticChannelParticipantsDAO) appendChange(ctx context.Context, change ElasticChannelChangeDO) error {
+	indexName := GetElasticChangeIndex(change.ChannelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return errEmptyIndex
+	}
+	if err := e.ensureIndexExists(ctx, indexName); err != nil {
+		return err
+	}
+	route := strconv.Itoa(int(change.ChannelID))
+
+	_, err := e.client.Index().
+		Index(indexName).
+		Id(GetChannelChangeID(change.ChannelID, change.Version)).
+		Routing(route).
+		BodyJson(change).
+		Do(ctx)
+	if err != nil {
+		return elasticError("append change failed", err)
+	}
+
+	// Dọn bớt log cũ, không đợi kết quả
+	if change.Version%ELASTIC_CHANGE_TRIM_EVERY == 0 && change.Version > ELASTIC_CHANGE_RETENTION {
+		q := elastic.NewBoolQuery().
+			Filter(
+				elastic.NewTermQuery("channel_id", change.ChannelID),
+				elastic.NewRangeQuery("version").Lte(change.Version-ELASTIC_CHANGE_RETENTION),
+			)
+		_, err := e.client.DeleteByQuery(indexName).
+			Query(q).
+			Routing(route).
+			Conflicts("proceed").
+			WaitForCompletion(false).
+			Do(ctx)
+		if err != nil {
+			e.Logger().Warn("trim change log failed", LOG_KEY_OP, "appendChange", LOG_KEY_CHANNEL_ID, change.ChannelID, LOG_KEY_ERROR, err)
+		}
+	}
+	return nil
+}
+
+// scrubUserChangeScript gỡ user khỏi added / updated / removed của change record. Record bị sửa được đánh dấu
+// reset để client đang giữ version trước đó tải lại toàn bộ thay vì áp dụng delta đã bị cắt.
+const scrubUserChangeScript = `
+for (f in ['added', 'updated', 'removed']) {
+	if (ctx._source[f] != null) {
+		ctx._source[f].removeIf(u -> u == params.user_id);
+	}
+}
+ctx._source.reset = true;
+`
+
+// ScrubUserChanges gỡ user khỏi mọi change record trên channel_changes_* (xoá dữ liệu user),
+// trả về số record đã sửa.
+func (e *ElasticChannelParticipantsDAO) ScrubUserChanges(userID int32) (_ int64, err error) {
+	e, span := e.startSpan("ScrubUserChanges", attrUser(userID))
+	defer e.observe(span, "ScrubUserChanges", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return 0, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return 0, errElasticNil
+	}
+
+	q := elastic.NewBoolQuery().
+		Should(
+			elastic.NewTermQuery("added", userID),
+			elastic.NewTermQuery("updated", userID),
+			elastic.NewTermQuery("removed", userID),
+		).
+		MinimumShouldMatch("1")
+	resp, err := e.client.UpdateByQuery("channel_changes_*").
+		Query(q).
+		Script(elastic.NewScript(scrubUserChangeScript).Param("user_id", userID)).
+		Conflicts("proceed").
+		Refresh("true").
+		WaitForCompletion(true).
+		Do(e.Context())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, elasticError("scrub user changes failed", err)
+	}
+	if resp == nil {
+		return 0, fmt.Errorf("scrub user changes: empty response")
+	}
+	if len(resp.Failures) > 0 {
+		return resp.Updated, newPartialFailure("scrub user changes", int(resp.Total), deleteByQueryFailures(resp))
+	}
+	if resp.VersionConflicts > 0 {
+		// record bị ghi đè giữa chừng (trim / ghi lại cùng version), lần chạy lại sẽ gỡ tiếp
+		return resp.Updated, newPartialFailure("scrub user changes", int(resp.Total), []string{fmt.Sprintf("%d version conflicts", resp.VersionConflicts)})
+	}
+
+	logCompleted(e.Logger(), "ScrubUserChanges", timeStart, LOG_KEY_USER_ID, userID, LOG_KEY_COUNT, resp.Updated)
+	return resp.Updated, nil
+}
+
+// MarkResync tăng version kèm change record reset, client đang giữ version cũ sẽ phải tải lại toàn bộ.
+// Dùng khi không biết chính xác mutation đã áp dụng được đến đâu (ví dụ bị ngắt lúc tắt).
+func (e *ElasticChannelParticipantsDAO) MarkResync(channelID int32) (err error) {
+	e, span := e.startSpan("MarkResync", attrChannel(channelID))
+	defer e.observe(span, "MarkResync", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+	if err := e.bumpVersionWithChange(e.Context(), channelID, -1, ElasticChannelChangeDO{Reset: true}); err != nil {
+		return elasticError("mark resync failed", err)
+	}
+	return nil
+}
+
+// GetChangesSince trả về delta participants từ version client đang giữ đến version hiện tại.
+// Nếu log đã bị cắt, bị đứt đoạn hoặc có lần reload toàn bộ thì trả về Resync = true.
+func (e *ElasticChannelParticipantsDAO) GetChangesSince(channelID int32, version int32) (_ *ChannelChangesDO, err error) {
+	e, span := e.startSpan("GetChangesSince", attrChannel(channelID))
+	defer e.observe(span, "GetChangesSince", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return nil, errElasticNil
+	}
+	indexName := GetElasticChangeIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return nil, errEmptyIndex
+	}
+
+	meta, err := e.GetVersion(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ChannelChangesDO{
+		ChannelID:   channelID,
+		FromVersion: version,
+		Version:     meta.Version,
+		Added:       []int32{},
+		Updated:     []int32{},
+		Removed:     []int32{},
+	}
+	if version == meta.Version {
+		return out, nil
+	}
+	if version > meta.Version || version < 0 {
+		out.Resync = true
+		return out, nil
+	}
+
+	if meta.Version-version > ELASTIC_CHANGE_RETENTION {
+		// log cũ hơn retention có thể đã bị dọn
+		out.Resync = true
+		return out, nil
+	}
+
+	// Lấy change record theo id bằng Mget (realtime): Search chỉ thấy record mới sau lần refresh kế tiếp,
+	// change vừa ghi sẽ bị thiếu và client bị bắt resync oan.
+	ctx := e.Context()
+	route := strconv.Itoa(int(channelID))
+	changes := make([]ElasticChannelChangeDO, 0, meta.Version-version)
+	const chunkSize = 1000
+	for from := version + 1; from <= meta.Version; from += chunkSize {
+		to := min(from+chunkSize-1, meta.Version)
+		mget := e.client.Mget()
+		for v := from; v <= to; v++ {
+			mget.Add(elastic.NewMultiGetItem().Index(indexName).Id(GetChannelChangeID(channelID, v)).Routing(route))
+		}
+		resp, err := mget.Do(ctx)
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				out.Resync = true
+				return out, nil
+			}
+			return nil, elasticError("mget changes failed", err)
+		}
+		for _, d := range resp.Docs {
+			if d == nil || !d.Found {
+				// thiếu một version: log bị cắt hoặc đứt đoạn
+				out.Resync = true
+				return out, nil
+			}
+			var c ElasticChannelChangeDO
+			if err := json.Unmarshal(d.Source, &c); err != nil {
+				return nil, fmt.Errorf("unmarshal change failed: %w", err)
+			}
+			changes = append(changes, c)
+		}
+	}
+
+	// Chuỗi change phải liền mạch: version -> ... -> meta.Version
+	prev := version
+	for _, c := range changes {
+		if c.Reset || c.FromVersion != prev {
+			out.Resync = true
+			return out, nil
+		}
+		prev = c.Version
+	}
+	if prev != meta.Version {
+		out.Resync = true
+		return out, nil
+	}
+
+	out.Added, out.Updated, out.Removed = mergeChanges(changes)
+	logTiming(e.Logger(), "GetChangesSince", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(changes))
+	return out, nil
+}
+
+// mergeChanges gộp nhiều change record liên tiếp thành một delta duy nhất.
+func mergeChanges(changes []ElasticChannelChangeDO) (added, updated, removed []int32) {
+	const (
+		opAdded = iota + 1
+		opUpdated
+		opRemoved
+	)
+	// existed: user đã có ở version client đang giữ hay chưa
+	type state struct {
+		op      int
+		existed bool
+	}
+	// upsert: user chưa có ở version cũ thì vẫn là added, ngược lại là updated
+	upsert := func(s *state) {
+		if s.existed {
+			s.op = opUpdated
+		} else {
+			s.op = opAdded
+		}
+	}
+	users := make(map[int32]*state)
+	get := func(uid int32, op int) *state {
+		s, ok := users[uid]
+		if !ok {
+			s = &state{existed: op != opAdded}
+			users[uid] = s
+		}
+		return s
+	}
+
+	for _, c := range changes {
+		for _, uid := range c.Added {
+			upsert(get(uid, opAdded))
+		}
+		for _, uid := range c.Updated {
+			upsert(get(uid, opUpdated))
+		}
+		for _, uid := range c.Removed {
+			get(uid, opRemoved).op = opRemoved
+		}
+	}
+
+	added, updated, removed = []int32{}, []int32{}, []int32{}
+	for uid, s := range users {
+		switch {
+		case s.op == opRemoved && s.existed:
+			removed = append(removed, uid)
+		case s.op == opAdded:
+			added = append(added, uid)
+		case s.op == opUpdated:
+			updated = append(updated, uid)
+		}
+	}
+	for _, l := range [][]int32{added, updated, removed} {
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	}
+	return added, updated, removed
+}
@@ -5,9 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/olivere/elastic/v7"
@@ -15,11 +15,24 @@ import (
 
 const (
 	ELASTIC_SIZE_INDEX = 1000 // số shard index
+
+	// Thay đổi URL và thông tin đăng nhập cho phù hợp
+	// ELASTIC_URL = "http://10.8.14.55:9200"
+	ELASTIC_URL      = "http://localhost:9200"
+	ELASTIC_USERNAME = "elastic"     // nếu bạn tắt security, để ""
+	ELASTIC_PASSWORD = "changeme123" // nếu bạn tắt security, để ""
 )
 
 // ElasticMessagesDAO type
 type ElasticChannelParticipantsDAO struct {
-	client *elastic.Client
+	client     *elastic.Client
+	opKey      string             // idempotency key, lần cập nhật version trùng key sẽ bị bỏ qua
+	logger     *slog.Logger       // nil = slog.Default()
+	metrics    *Metrics           // nil = tắt metrics
+	ctx        context.Context    // nil = context.Background()
+	resilience *Resilience        // nil = không timeout / breaker
+	cancel     context.CancelFunc // huỷ timeout của op đang chạy, gọi trong observe
+	lifecycle  *MutationLifecycle // nil = không theo dõi mutation khi tắt
 }
 
 func GetElasticChannelIndex(channelID int32, sizeIndex int32) string {
@@ -42,22 +55,63 @@ func GetChannelMeta(channelID int32) string {
 // -------------------------------------------------------------------------------------------
 // NewElasticMessagesDAO func
 func NewElasticChannelParticipantsDAO(client *elastic.Client) *ElasticChannelParticipantsDAO {
-	return &ElasticChannelParticipantsDAO{client}
+	return &ElasticChannelParticipantsDAO{client: client}
+}
+
+// WithIdempotencyKey trả về bản sao DAO gắn idempotency key.
+// Meta version lưu key của lần cập nhật cuối, chạy lại cùng key sẽ không tăng version lần nữa.
+func (e *ElasticChannelParticipantsDAO) WithIdempotencyKey(key string) *ElasticChannelParticipantsDAO {
+	if e == nil {
+		return nil
+	}
+	cp := *e
+	cp.opKey = key
+	return &cp
+}
+
+// Lifecycle trình quản lý mutation khi tắt của DAO, nil nếu không gắn.
+func (e *ElasticChannelParticipantsDAO) Lifecycle() *MutationLifecycle {
+	if e == nil {
+		return nil
+	}
+	return e.lifecycle
+}
+
+// WithLifecycle trả về bản sao DAO đăng ký các mutation dùng BulkProcessor với l:
+// khi l đang tắt, mutation mới trả về ErrShuttingDown.
+func (e *ElasticChannelParticipantsDAO) WithLifecycle(l *MutationLifecycle) *ElasticChannelParticipantsDAO {
+	if e == nil {
+		return nil
+	}
+	cp := *e
+	cp.lifecycle = l
+	return &cp
 }
 
 // SaveAllUsers reload lại toàn bộ data lên elastic.
 // Đặt version = -1 nếu không muốn cập nhật version.
 // Đặt version = 0 nếu không muốn cập nhật version.
-func (e *ElasticChannelParticipantsDAO) SaveAllUsers(channelID int32, version int32, list []ElasticChannelParticipantsDO) error {
+func (e *ElasticChannelParticipantsDAO) SaveAllUsers(channelID int32, version int32, list []ElasticChannelParticipantsDO) (err error) {
+	e, span := e.startSpan("SaveAllUsers", attrChannel(channelID), attrCount(len(list)))
+	defer e.observe(span, "SaveAllUsers", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if e == nil || e.client == nil {
-		return fmt.Errorf("DAO/client is nil")
+		return errElasticNil
+	}
+	// xoá xong mà chưa ghi lại đủ thì channel bị thiếu participants, phải được ghi nhận nếu bị ngắt
+	run, err := e.lifecycle.beginIn(e.Context(), "SaveAllUsers", channelID)
+	if err != nil {
+		return err
 	}
+	defer func() { run.End(err) }()
 	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
 	if indexName == "" {
-		return fmt.Errorf("index is empty")
+		return errEmptyIndex
 	}
-	ctx := context.Background()
+	ctx := e.Context()
 	if err := e.ensureIndexExists(ctx, indexName); err != nil {
 		return err
 	}
@@ -71,7 +125,7 @@ func (e *ElasticChannelParticipantsDAO) SaveAllUsers(channelID int32, version in
 		Filter(elastic.NewTermQuery("channel_id", channelID)).
 		MustNot(elastic.NewIdsQuery().Ids(metaID))
 
-	_, err := e.client.DeleteByQuery(indexName).
+	_, err = e.client.DeleteByQuery(indexName).
 		Query(q).
 		Conflicts("proceed"). // tiếp tục chạy nếu có xung đột version
 		Routing(route).       // request đến đúng shard, không cần broadcast toàn cluster.
@@ -79,11 +133,15 @@ func (e *ElasticChannelParticipantsDAO) SaveAllUsers(channelID int32, version in
 		RequestsPerSecond(5000). // -1 không throttle, tốc độ xử lý docs/giây.
 		Do(ctx)
 	if err != nil && !elastic.IsNotFound(err) {
-		return fmt.Errorf("delete participants failed: %w", err)
+		return elasticError("delete participants failed", err)
 	}
 
 	// 2. Tạo BulkProcessor
-	bp, err := e.client.BulkProcessor().
+	var (
+		mu       sync.Mutex
+		failures []string
+	)
+	svc := e.client.BulkProcessor().
 		Name(fmt.Sprintf("bp-channel-%d", channelID)).
 		Workers(3).                     // số goroutine xử lý bulk song song
 		BulkActions(4000).              // tối đa 4000 req/batch
@@ -91,28 +149,33 @@ func (e *ElasticChannelParticipantsDAO) SaveAllUsers(channelID int32, version in
 		FlushInterval(1 * time.Second). // auto flush sau 1s nếu chưa đủ batch
 		Backoff(elastic.NewExponentialBackoff(
 			200*time.Millisecond, 1*time.Second, // retry từ 200ms đến 1s
-		)). // retry backoff
-		After(func(execID int64, reqs []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
-			if err != nil {
-				// glog.V(1).Infof("bulk batch error: %v", err)
-				fmt.Printf("bulk batch error: %v\n", err)
-				return
-			}
-			// if resp != nil && resp.Errors {
-			// 	for _, item := range resp.Items {
-			// 		for _, r := range item {
-			// 			if r.Error != nil {
-			// 				glog.V(3).Infof("bulk item failed: id=%s reason=%s", r.Id, r.Error.Reason)
-			// 			}
-			// 		}
-			// 	}
-			// }
-		}).
-		Do(context.Background())
+		)) // retry backoff
+	bp, err := e.Metrics().instrumentBulk(svc, "SaveAllUsers", func(execID int64, reqs []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			// glog.V(1).Infof("bulk batch error: %v", err)
+			logError(e.Logger(), "SaveAllUsers.bulk", err, LOG_KEY_CHANNEL_ID, channelID, "exec_id", execID, LOG_KEY_COUNT, len(reqs))
+			failures = append(failures, err.Error())
+			return
+		}
+		failures = append(failures, bulkFailures(resp)...)
+		// if resp != nil && resp.Errors {
+		// 	for _, item := range resp.Items {
+		// 		for _, r := range item {
+		// 			if r.Error != nil {
+		// 				glog.V(3).Infof("bulk item failed: id=%s reason=%s", r.Id, r.Error.Reason)
+		// 			}
+		// 		}
+		// 	}
+		// }
+	}).Do(e.Context())
 	if err != nil {
-		return err
+		return elasticError("start bulk processor failed", err)
 	}
 	defer bp.Close()
+	run.Track(bp)
+	defer run.Untrack(bp)
 
 	for _, p := range list {
 		id := GetParicipantID(channelID, p.UserID)
@@ -127,17 +190,19 @@ func (e *ElasticChannelParticipantsDAO) SaveAllUsers(channelID int32, version in
 
 	// 3. Flush và đợi hoàn tất
 	if err := bp.Flush(); err != nil {
-		return err
+		return elasticError("bulk flush failed", err)
+	}
+	if len(failures) > 0 {
+		return newPartialFailure("SaveAllUsers", len(list), failures)
 	}
 
-	// 4. Upsert META (channel:<cid>:meta) với version nếu có
-	if err := e.SetVersion(channelID, version); err != nil {
-		return fmt.Errorf("set version failed: %w", err)
+	// 4. Upsert META (channel:<cid>:meta) với version nếu có, reload toàn bộ -> client phải resync
+	if err := e.bumpVersionWithChange(ctx, channelID, version, ElasticChannelChangeDO{Reset: true}); err != nil {
+		return elasticError("set version failed", err)
 	}
 
 	// fmt.Println("Bulk index completed.")
-	duration := time.Since(timeStart)
-	fmt.Printf("SaveAllUsers completed. Time: %s - total: %d\n", duration, len(list))
+	logCompleted(e.Logger(), "SaveAllUsers", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(list))
 	return nil
 }
 
@@ -145,45 +210,86 @@ func (e *ElasticChannelParticipantsDAO) SaveAllUsers(channelID int32, version in
 // Nếu muốn cập nhật kích thước, số lượng participants khi có người rời nhóm -> dùng SaveAllUser hoặc DeleteUser.
 // Đặt version = -1 nếu muốn tự động tăng version.
 // Đặt version = 0 nếu không muốn cập nhật lại version.
-func (e *ElasticChannelParticipantsDAO) AddDataToCache(channelID int32, version int32, list []ElasticChannelParticipantsDO) error {
+func (e *ElasticChannelParticipantsDAO) AddDataToCache(channelID int32, version int32, list []ElasticChannelParticipantsDO) (err error) {
+	e, span := e.startSpan("AddDataToCache", attrChannel(channelID), attrCount(len(list)))
+	defer e.observe(span, "AddDataToCache", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if e == nil || e.client == nil {
-		return fmt.Errorf("DAO/client is nil")
+		return errElasticNil
 	}
+	run, err := e.lifecycle.beginIn(e.Context(), "AddDataToCache", channelID)
+	if err != nil {
+		return err
+	}
+	defer func() { run.End(err) }()
 	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
 	if indexName == "" {
-		return fmt.Errorf("index is empty")
+		return errEmptyIndex
+	}
+
+	// Gom lại user được thêm mới / cập nhật để ghi change log
+	userByID := make(map[string]int32, len(list))
+	for _, p := range list {
+		userByID[GetParicipantID(channelID, p.UserID)] = p.UserID
 	}
+	var (
+		mu       sync.Mutex
+		change   ElasticChannelChangeDO
+		failures []string
+	)
 
 	// 1. Tạo BulkProcessor
-	bp, err := e.client.BulkProcessor().
+	svc := e.client.BulkProcessor().
 		Name(fmt.Sprintf("bp-channel-add-%d", channelID)).
-		Workers(3).                                                                  // số goroutine xử lý bulk song song
-		BulkActions(4000).                                                           // tối đa 4000 req/batch
-		BulkSize(15 << 20).                                                          // tối đa 15MB/batch
-		FlushInterval(1 * time.Second).                                              // auto flush sau 1s nếu chưa đủ batch
-		Backoff(elastic.NewExponentialBackoff(200*time.Millisecond, 1*time.Second)). // retry backoff
-		After(func(execID int64, reqs []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
-			if err != nil {
-				// glog.V(3).Info("bulk batch error: %v", err)
-				fmt.Printf("bulk batch error: %v\n", err)
-				return
+		Workers(3).                                                                 // số goroutine xử lý bulk song song
+		BulkActions(4000).                                                          // tối đa 4000 req/batch
+		BulkSize(15 << 20).                                                         // tối đa 15MB/batch
+		FlushInterval(1 * time.Second).                                             // auto flush sau 1s nếu chưa đủ batch
+		Backoff(elastic.NewExponentialBackoff(200*time.Millisecond, 1*time.Second)) // retry backoff
+	bp, err := e.Metrics().instrumentBulk(svc, "AddDataToCache", func(execID int64, reqs []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			// glog.V(3).Info("bulk batch error: %v", err)
+			logError(e.Logger(), "AddDataToCache.bulk", err, LOG_KEY_CHANNEL_ID, channelID, "exec_id", execID, LOG_KEY_COUNT, len(reqs))
+			failures = append(failures, err.Error())
+			return
+		}
+		failures = append(failures, bulkFailures(resp)...)
+		if resp != nil {
+			for _, item := range resp.Items {
+				for _, r := range item {
+					if r.Error != nil {
+						continue
+					}
+					switch r.Result {
+					case "created":
+						change.Added = append(change.Added, userByID[r.Id])
+					case "updated":
+						change.Updated = append(change.Updated, userByID[r.Id])
+					}
+				}
 			}
-			// if resp != nil && resp.Errors {
-			// 	for _, item := range resp.Items {
-			// 		for _, r := range item {
-			// 			if r.Error != nil {
-			// 				glog.V(3).Info("bulk item failed: id=%s reason=%s", r.Id, r.Error.Reason)
-			// 			}
-			// 		}
-			// 	}
-			// }
-		}).
-		Do(context.Background())
+		}
+		// if resp != nil && resp.Errors {
+		// 	for _, item := range resp.Items {
+		// 		for _, r := range item {
+		// 			if r.Error != nil {
+		// 				glog.V(3).Info("bulk item failed: id=%s reason=%s", r.Id, r.Error.Reason)
+		// 			}
+		// 		}
+		// 	}
+		// }
+	}).Do(e.Context())
 	if err != nil {
-		return err
+		return elasticError("start bulk processor failed", err)
 	}
 	defer bp.Close()
+	run.Track(bp)
+	defer run.Untrack(bp)
 
 	for _, p := range list {
 		id := GetParicipantID(channelID, p.UserID)
@@ -199,27 +305,35 @@ func (e *ElasticChannelParticipantsDAO) AddDataToCache(channelID int32, version
 	}
 
 	if err := bp.Flush(); err != nil {
-		return err
+		return elasticError("bulk flush failed", err)
+	}
+	if len(failures) > 0 {
+		// item lỗi không bump version để client không bỏ sót thay đổi, relay sẽ retry cả batch
+		return newPartialFailure("AddDataToCache", len(list), failures)
 	}
 
-	if err := e.SetVersion(channelID, version); err != nil {
-		return fmt.Errorf("set version after delete failed: %w", err)
+	if err := e.bumpVersionWithChange(e.Context(), channelID, version, change); err != nil {
+		return elasticError("set version after delete failed", err)
 	}
 
 	// đảm bảo tài liệu hiển thị ngay cho search
-	if _, err := e.client.Refresh(indexName).Do(context.Background()); err != nil {
-		return fmt.Errorf("refresh failed: %w", err)
+	if _, err := e.client.Refresh(indexName).Do(e.Context()); err != nil {
+		return elasticError("refresh failed", err)
 	}
-	duration := time.Since(timeStart)
-	fmt.Printf("AddDataToCache completed. Time: %s - total: %d\n", duration, len(list))
+	logCompleted(e.Logger(), "AddDataToCache", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(list))
 	return nil
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
-func (e *ElasticChannelParticipantsDAO) GetUserAdmins(channelID int32, limit, offset int32) ([]ChannelParticipantsDO, int32, error) {
+func (e *ElasticChannelParticipantsDAO) GetUserAdmins(channelID int32, limit, offset int32) (_ []ChannelParticipantsDO, _ int32, err error) {
+	e, span := e.startSpan("GetUserAdmins", attrChannel(channelID))
+	defer e.observe(span, "GetUserAdmins", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, 0, err
+	}
 	timeStart := time.Now()
 	if e == nil || e.client == nil {
-		return nil, 0, fmt.Errorf("DAO/client is nil")
+		return nil, 0, errElasticNil
 	}
 	if offset < 0 {
 		offset = 0
@@ -227,25 +341,13 @@ func (e *ElasticChannelParticipantsDAO) GetUserAdmins(channelID int32, limit, of
 
 	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
 	if indexName == "" {
-		return nil, 0, fmt.Errorf("index is empty")
+		return nil, 0, errEmptyIndex
 	}
 
-	ctx := context.Background()
+	ctx := e.Context()
 	route := strconv.FormatInt(int64(channelID), 10)
 
-	// WHERE channel_id = ? AND is_left = 0 AND is_kicked = 0 AND hidden_participant = 0
-	boolQ := elastic.NewBoolQuery().
-		Filter(
-			elastic.NewTermQuery("channel_id", channelID),
-			elastic.NewTermQuery("is_left", 0),
-			elastic.NewTermQuery("is_kicked", 0),
-			elastic.NewTermQuery("hidden_participant", 0),
-		).
-		Should(
-			elastic.NewTermQuery("is_creator", 1),       // is_creator = 1
-			elastic.NewRangeQuery("admin_rights").Gt(0), // admin_rights > 0
-		).
-		MinimumShouldMatch("1")
+	boolQ := adminsQuery(channelID)
 
 	// --------- Lấy hết (limit == -1): dùng Scroll ----------
 	if limit == -1 || int(offset)+int(limit) > 10000 {
@@ -269,7 +371,7 @@ func (e *ElasticChannelParticipantsDAO) GetUserAdmins(channelID int32, limit, of
 				break
 			}
 			if err != nil {
-				return nil, 0, fmt.Errorf("scroll failed: %w", err)
+				return nil, 0, elasticError("scroll failed", err)
 			}
 			if res == nil || res.Hits == nil || len(res.Hits.Hits) == 0 {
 				break
@@ -292,8 +394,7 @@ func (e *ElasticChannelParticipantsDAO) GetUserAdmins(channelID int32, limit, of
 				}
 			}
 		}
-		duration := time.Since(timeStart)
-		fmt.Printf("Thời gian thực thi của hàm GetUserAdmins (scroll): %s - total: %d \n", duration, total)
+		logTiming(e.Logger(), "GetUserAdmins", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, total, "scroll", true)
 		return items, int32(total), nil
 	}
 
@@ -308,7 +409,7 @@ func (e *ElasticChannelParticipantsDAO) GetUserAdmins(channelID int32, limit, of
 		Routing(route).
 		Do(ctx)
 	if err != nil {
-		return nil, 0, fmt.Errorf("search failed: %w", err)
+		return nil, 0, elasticError("search failed", err)
 	}
 
 	var total int64
@@ -320,29 +421,242 @@ func (e *ElasticChannelParticipantsDAO) GetUserAdmins(channelID int32, limit, of
 	for _, h := range res.Hits.Hits {
 		var doc ChannelParticipantsDO
 		if err := json.Unmarshal(h.Source, &doc); err != nil {
-			fmt.Println("Unmarshal data err:", err)
+			e.Logger().Warn("unmarshal participant failed", LOG_KEY_OP, "GetUserAdmins", LOG_KEY_CHANNEL_ID, channelID, "id", h.Id, LOG_KEY_ERROR, err)
 			continue
 		}
 		items = append(items, doc)
 	}
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm GetUserAdmins: %s - total: %d \n", duration, total)
+	logTiming(e.Logger(), "GetUserAdmins", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, total)
 	return items, int32(total), nil
 }
 
+// adminsQuery WHERE channel_id = ? AND is_left = 0 AND is_kicked = 0 AND hidden_participant = 0
+// AND (is_creator = 1 OR admin_rights > 0)
+func adminsQuery(channelID int32) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("channel_id", channelID),
+			elastic.NewTermQuery("is_left", 0),
+			elastic.NewTermQuery("is_kicked", 0),
+			elastic.NewTermQuery("hidden_participant", 0),
+		).
+		Should(
+			elastic.NewTermQuery("is_creator", 1),       // is_creator = 1
+			elastic.NewRangeQuery("admin_rights").Gt(0), // admin_rights > 0
+		).
+		MinimumShouldMatch("1")
+}
+
+// ScrollAdmins duyệt toàn bộ creator / admin đang hiển thị của channel theo từng batch (sắp xếp user_id giảm dần),
+// dùng cho channel lớn thay vì GetUserAdmins(limit = -1) gom hết vào một slice.
+func (e *ElasticChannelParticipantsDAO) ScrollAdmins(channelID int32, fn func(docs []ElasticChannelParticipantsDO) error) (err error) {
+	e, span := e.startSpan("ScrollAdmins", attrChannel(channelID))
+	defer e.observe(span, "ScrollAdmins", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return errEmptyIndex
+	}
+
+	ctx := e.Context()
+	scroll := e.client.Scroll(indexName).
+		Query(adminsQuery(channelID)).
+		Size(2000).
+		Sort("user_id", false).
+		Routing(strconv.Itoa(int(channelID))).
+		Scroll("1m")
+	defer scroll.Clear(ctx)
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil
+			}
+			return elasticError("scroll admins failed", err)
+		}
+		if res == nil || res.Hits == nil || len(res.Hits.Hits) == 0 {
+			return nil
+		}
+
+		docs := make([]ElasticChannelParticipantsDO, 0, len(res.Hits.Hits))
+		for _, h := range res.Hits.Hits {
+			var doc ElasticChannelParticipantsDO
+			if err := json.Unmarshal(h.Source, &doc); err != nil {
+				return fmt.Errorf("unmarshal participant failed: %w", err)
+			}
+			docs = append(docs, doc)
+		}
+		if err := fn(docs); err != nil {
+			return err
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// IsActiveParticipant participant còn trong nhóm (member / admin / creator / restricted) -> có mặt trong các key Redis.
+func IsActiveParticipant(p *ElasticChannelParticipantsDO) bool {
+	return DeriveState(participantData(p)).IsActive()
+}
+
+// activeParticipantsQuery WHERE channel_id = ? AND is_left = 0 AND is_kicked = 0, bỏ qua user đang chờ duyệt / mới được mời.
+func activeParticipantsQuery(channelID int32) *elastic.BoolQuery {
+	return activeParticipantsFilter().
+		Filter(elastic.NewTermQuery("channel_id", channelID))
+}
+
+// activeParticipantsFilter điều kiện active không gắn với channel, dùng khi quét nhiều channel.
+func activeParticipantsFilter() *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("is_left", 0),
+			elastic.NewTermQuery("is_kicked", 0),
+		).
+		MustNot(
+			elastic.NewTermQuery("data.IsWaitingAprrove", 1),
+			elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("data.JoinedAt", 0),
+				elastic.NewRangeQuery("data.InvitedAt").Gt(0),
+			),
+		)
+}
+
+// GetParticipants lấy document hiện tại của các user trong channel (MultiGet theo id), user chưa có sẽ không nằm trong map.
+func (e *ElasticChannelParticipantsDAO) GetParticipants(channelID int32, userIDs []int32) (_ map[int32]*ElasticChannelParticipantsDO, err error) {
+	e, span := e.startSpan("GetParticipants", attrChannel(channelID), attrCount(len(userIDs)))
+	defer e.observe(span, "GetParticipants", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
+	if e == nil || e.client == nil {
+		return nil, errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return nil, errEmptyIndex
+	}
+
+	ctx := e.Context()
+	route := strconv.Itoa(int(channelID))
+	out := make(map[int32]*ElasticChannelParticipantsDO, len(userIDs))
+
+	const chunkSize = 1000
+	for i := 0; i < len(userIDs); i += chunkSize {
+		end := min(i+chunkSize, len(userIDs))
+
+		mget := e.client.Mget()
+		for _, uid := range userIDs[i:end] {
+			mget.Add(elastic.NewMultiGetItem().Index(indexName).Id(GetParicipantID(channelID, uid)).Routing(route))
+		}
+		resp, err := mget.Do(ctx)
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return out, nil
+			}
+			return nil, elasticError("mget participants failed", err)
+		}
+		for _, d := range resp.Docs {
+			if d == nil || !d.Found {
+				continue
+			}
+			var doc ElasticChannelParticipantsDO
+			if err := json.Unmarshal(d.Source, &doc); err != nil {
+				return nil, fmt.Errorf("unmarshal participant failed: %w", err)
+			}
+			out[doc.UserID] = &doc
+		}
+	}
+	return out, nil
+}
+
+// ScrollActiveUserIDs duyệt user_id của các participant đang active theo từng batch, không giữ toàn bộ trong bộ nhớ.
+func (e *ElasticChannelParticipantsDAO) ScrollActiveUserIDs(channelID int32, fn func(userIDs []int32) error) (err error) {
+	e, span := e.startSpan("ScrollActiveUserIDs", attrChannel(channelID))
+	defer e.observe(span, "ScrollActiveUserIDs", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	return e.scrollUserIDs(channelID, activeParticipantsQuery(channelID), fn)
+}
+
+// scrollUserIDs duyệt user_id của các document khớp query trong channel theo từng batch.
+func (e *ElasticChannelParticipantsDAO) scrollUserIDs(channelID int32, q elastic.Query, fn func(userIDs []int32) error) error {
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return errEmptyIndex
+	}
+
+	ctx := e.Context()
+	const batch = 5000
+	scroll := e.client.Scroll(indexName).
+		Query(q).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("user_id")).
+		Size(batch).
+		Sort("_doc", true).
+		Routing(strconv.Itoa(int(channelID))).
+		Scroll("1m")
+	defer scroll.Clear(ctx)
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil
+			}
+			return elasticError("scroll failed", err)
+		}
+		if res == nil || res.Hits == nil || len(res.Hits.Hits) == 0 {
+			return nil
+		}
+
+		ids := make([]int32, 0, len(res.Hits.Hits))
+		for _, h := range res.Hits.Hits {
+			var doc struct {
+				UserID int32 `json:"user_id"`
+			}
+			if err := json.Unmarshal(h.Source, &doc); err != nil {
+				continue
+			}
+			ids = append(ids, doc.UserID)
+		}
+		if err := fn(ids); err != nil {
+			return err
+		}
+	}
+}
+
 // ------------------------------------------------------------------------------------------------------------------------
 // Lấy version hiện tại của channel
-func (e *ElasticChannelParticipantsDAO) GetVersion(channelID int32) (*ElasticChannelParticipantMetaDO, error) {
+func (e *ElasticChannelParticipantsDAO) GetVersion(channelID int32) (_ *ElasticChannelParticipantMetaDO, err error) {
+	e, span := e.startSpan("GetVersion", attrChannel(channelID))
+	defer e.observe(span, "GetVersion", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
 	if e == nil || e.client == nil {
-		return nil, fmt.Errorf("DAO/client is nil")
+		return nil, errElasticNil
 	}
 
 	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
 	if indexName == "" {
-		return nil, fmt.Errorf("index is empty")
+		return nil, errEmptyIndex
 	}
 
-	ctx := context.Background()
+	ctx := e.Context()
 	route := strconv.Itoa(int(channelID)) // request đến đúng shard, tránh broadcast toàn cluster.
 	metaID := GetChannelMeta(channelID)   // ví dụ: "channel:123:meta"
 
@@ -360,7 +674,7 @@ func (e *ElasticChannelParticipantsDAO) GetVersion(channelID int32) (*ElasticCha
 			// chưa có version → mặc định 0
 			return &meta, nil
 		}
-		return nil, fmt.Errorf("get meta failed: %w", err)
+		return nil, elasticError("get meta failed", err)
 	}
 	if !resp.Found {
 		return &meta, nil
@@ -375,99 +689,129 @@ func (e *ElasticChannelParticipantsDAO) GetVersion(channelID int32) (*ElasticCha
 
 // Đặt version = -1 để tự động tăng.
 // Đặt version = 0 để bỏ qua update version.
-func (e *ElasticChannelParticipantsDAO) SetVersion(channelID int32, version int32) error {
+func (e *ElasticChannelParticipantsDAO) SetVersion(channelID int32, version int32) (err error) {
+	e, span := e.startSpan("SetVersion", attrChannel(channelID))
+	defer e.observe(span, "SetVersion", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	_, _, err = e.updateVersion(e.Context(), channelID, version)
+	return err
+}
+
+// updateVersion cập nhật meta version và trả về (version trước đó, version mới).
+// Khi version = 0 thì không cập nhật, trả về (0, 0).
+// Khi trùng idempotency key thì không cập nhật, trả về (version hiện tại, version hiện tại).
+func (e *ElasticChannelParticipantsDAO) updateVersion(ctx context.Context, channelID int32, version int32) (int32, int32, error) {
 	if e == nil || e.client == nil {
-		return fmt.Errorf("DAO/client is nil")
+		return 0, 0, errElasticNil
 	}
 	if version == 0 {
-		return nil
+		return 0, 0, nil
 	}
 
 	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
 	if indexName == "" {
-		return fmt.Errorf("index is empty")
+		return 0, 0, errEmptyIndex
 	}
 
-	ctx := context.Background()
 	route := strconv.Itoa(int(channelID))
 	metaID := GetChannelMeta(channelID)
 
 	now := time.Now().UTC()
 
+	var script *elastic.Script
 	if version == -1 {
-		// Atomic increment: nếu chưa có doc → upsert version=1
-		script := elastic.NewScript(`
-			if (ctx._source.version == null) {
-				ctx._source.version = params.start;
+		// Atomic increment: nếu chưa có doc → upsert version=0 rồi script tăng lên 1
+		script = elastic.NewScript(`
+			if (params.op != '' && ctx._source.last_op == params.op) {
+				ctx.op = 'noop';
 			} else {
-				ctx._source.version += params.inc;
+				if (ctx._source.version == null) {
+					ctx._source.prev_version = 0;
+					ctx._source.version = params.start;
+				} else {
+					ctx._source.prev_version = ctx._source.version;
+					ctx._source.version += params.inc;
+				}
+				ctx._source.updated = params.now;
+				ctx._source.last_op = params.op;
 			}
-			ctx._source.updated = params.now;
 		`).
 			Param("start", 1).
 			Param("inc", 1).
-			Param("now", now)
-
-		_, err := e.client.Update().
-			Index(indexName).
-			Id(metaID).
-			Routing(route).
-			Script(script).
-			// scripted upsert bảo đảm chạy script cả khi doc chưa tồn tại
-			ScriptedUpsert(true).
-			// Upsert body chỉ cần tối thiểu để init; script sẽ set lại updated
-			Upsert(ElasticChannelParticipantMetaDO{
-				ChannelID: channelID,
-				Version:   1,
-				UpdateAt:  now.Unix(),
-			}).
-			Refresh("wait_for").
-			RetryOnConflict(3).
-			Do(ctx)
-		if err != nil {
-			return fmt.Errorf("update (increment) failed: %w", err)
-		}
-		return nil
-	}
-
-	meta := ElasticChannelParticipantMetaDO{
-		ChannelID: channelID,
-		Version:   version,
-		UpdateAt:  now.Unix(),
+			Param("now", now).
+			Param("op", e.opKey)
+	} else {
+		script = elastic.NewScript(`
+			if (params.op != '' && ctx._source.last_op == params.op) {
+				ctx.op = 'noop';
+			} else {
+				ctx._source.prev_version = ctx._source.version == null ? 0 : ctx._source.version;
+				ctx._source.version = params.version;
+				ctx._source.update_at = params.update_at;
+				ctx._source.last_op = params.op;
+			}
+		`).
+			Param("version", version).
+			Param("update_at", now.Unix()).
+			Param("op", e.opKey)
 	}
 
-	_, err := e.client.Update().
+	resp, err := e.client.Update().
 		Index(indexName).
 		Id(metaID).
 		Routing(route).
-		Doc(meta).         // partial update các field trong struct
-		DocAsUpsert(true). // nếu chưa có thì upsert
+		Script(script).
+		// scripted upsert bảo đảm chạy script cả khi doc chưa tồn tại
+		ScriptedUpsert(true).
+		// Upsert body chỉ cần tối thiểu để init; script sẽ set lại version
+		Upsert(ElasticChannelParticipantMetaDO{
+			ChannelID: channelID,
+			UpdateAt:  now.Unix(),
+		}).
+		FetchSource(true). // lấy lại meta sau khi update để biết version mới
 		Refresh("wait_for").
 		RetryOnConflict(3).
 		Do(ctx)
 	if err != nil {
-		return fmt.Errorf("update meta failed: %w", err)
+		return 0, 0, elasticError("update meta failed", err)
 	}
 
-	return nil
+	meta := ElasticChannelParticipantMetaDO{}
+	if resp.GetResult != nil && resp.GetResult.Source != nil {
+		if err := json.Unmarshal(resp.GetResult.Source, &meta); err != nil {
+			return 0, 0, fmt.Errorf("unmarshal meta failed: %w", err)
+		}
+	}
+	if resp.Result == "noop" {
+		// đã áp dụng với cùng idempotency key trước đó
+		return meta.Version, meta.Version, nil
+	}
+	return meta.PrevVersion, meta.Version, nil
 }
 
 // Đặt version = -1 để tự động tăng.
 // Đặt version = 0 để bỏ qua.
-func (e *ElasticChannelParticipantsDAO) DeleteUsers(channelID int32, version int32, listUserID []int32) error {
+func (e *ElasticChannelParticipantsDAO) DeleteUsers(channelID int32, version int32, listUserID []int32) (err error) {
+	e, span := e.startSpan("DeleteUsers", attrChannel(channelID), attrCount(len(listUserID)))
+	defer e.observe(span, "DeleteUsers", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if e == nil || e.client == nil {
-		return fmt.Errorf("DAO/client is nil")
+		return errElasticNil
 	}
 	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
 	if indexName == "" {
-		return fmt.Errorf("index is empty")
+		return errEmptyIndex
 	}
 	if len(listUserID) == 0 {
-		return fmt.Errorf("listUserID empty")
+		return invalidInputf("listUserID empty")
 	}
 
-	ctx := context.Background()
+	ctx := e.Context()
 	route := strconv.Itoa(int(channelID))
 
 	const chunkSize = 1000
@@ -501,52 +845,64 @@ func (e *ElasticChannelParticipantsDAO) DeleteUsers(channelID int32, version int
 			// Slices(4).
 			Do(ctx)
 		if err != nil {
-			return fmt.Errorf("delete by query failed: %w", err)
+			return elasticError("delete by query failed", err)
 		}
 		if resp == nil || len(resp.Failures) > 0 {
-			return fmt.Errorf("delete by query has %d failures", len(resp.Failures))
+			return newPartialFailure("delete by query", len(listUserID), deleteByQueryFailures(resp))
 		}
 	}
 
 	// cập nhật meta version (hỗ trợ version = -1 để auto-increment)
-	if err := e.SetVersion(channelID, version); err != nil {
-		return fmt.Errorf("set version after delete failed: %w", err)
+	if err := e.bumpVersionWithChange(ctx, channelID, version, ElasticChannelChangeDO{Removed: listUserID}); err != nil {
+		return elasticError("set version after delete failed", err)
 	}
-	fmt.Printf("DeleteUsers completed. Time: %s\n", time.Since(timeStart))
+	logCompleted(e.Logger(), "DeleteUsers", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(listUserID))
 	return nil
 }
 
 // ---------------------------------------------------------------------------------------------
-func ConnectElastic() *elastic.Client {
-	// Thay đổi URL và thông tin đăng nhập cho phù hợp
-	// esURL := "http://10.8.14.55:9200"
-	esURL := "http://localhost:9200"
-	username := "elastic"     // nếu bạn tắt security, để ""
-	password := "changeme123" // nếu bạn tắt security, để ""
-
-	client, err := elastic.NewClient(
-		elastic.SetURL(esURL),
+// NewElasticClient tạo client ES không kết nối ngay (lazy): bỏ healthcheck lúc khởi tạo, request đầu tiên mới mở kết nối.
+// Options bổ sung (ví dụ elastic.SetHttpClient(metrics.HTTPClient(nil))) được áp dụng sau cấu hình mặc định.
+// Node lỗi được client tự đánh dấu sống lại (sniff tắt), trạng thái ES do HealthMonitor theo dõi.
+func NewElasticClient(options ...elastic.ClientOptionFunc) (*elastic.Client, error) {
+	client, err := elastic.NewClient(append([]elastic.ClientOptionFunc{
+		elastic.SetURL(ELASTIC_URL),
 		elastic.SetSniff(false), // disable sniff khi chạy local / docker
-		elastic.SetBasicAuth(username, password),
-	)
+		elastic.SetHealthcheck(false),
+		elastic.SetBasicAuth(ELASTIC_USERNAME, ELASTIC_PASSWORD),
+	}, options...)...)
 	if err != nil {
-		log.Fatalf("Error creating the client: %s", err)
+		return nil, elasticError("create elastic client failed", err)
 	}
+	return client, nil
+}
 
-	// Kiểm tra kết nối
-	info, code, err := client.Ping(esURL).Do(context.Background())
+// ConnectElastic tạo client rồi ping ES, lỗi thì thử lại theo policy (xem DefaultConnectPolicy)
+// đến khi thành công, hết số lần thử hoặc ctx bị huỷ.
+func ConnectElastic(ctx context.Context, policy OpPolicy, options ...elastic.ClientOptionFunc) (*elastic.Client, error) {
+	client, err := NewElasticClient(options...)
 	if err != nil {
-		log.Fatalf("Error pinging ES: %s", err)
+		return nil, err
 	}
-	fmt.Printf("✅ Kết nối Elasticsearch thành công - code %d and version %s\n", code, info.Version.Number)
-
-	return client
+	err = retryConnect(ctx, METRICS_BACKEND_ELASTIC, policy, func(ctx context.Context) error {
+		info, code, err := client.Ping(ELASTIC_URL).Do(ctx)
+		if err != nil {
+			return elasticError("ping elastic failed", err)
+		}
+		slog.Info("✅ Kết nối Elasticsearch thành công", "code", code, "version", info.Version.Number)
+		return nil
+	})
+	if err != nil {
+		client.Stop()
+		return nil, err
+	}
+	return client, nil
 }
 
 func (e *ElasticChannelParticipantsDAO) ensureIndexExists(ctx context.Context, indexName string) error {
 	exists, err := e.client.IndexExists(indexName).Do(ctx)
 	if err != nil {
-		return fmt.Errorf("check index exists failed: %w", err)
+		return elasticError("check index exists failed", err)
 	}
 	if exists {
 		return nil
@@ -578,13 +934,13 @@ func (e *ElasticChannelParticipantsDAO) ensureIndexExists(ctx context.Context, i
 	resp, err := e.client.CreateIndex(indexName).BodyJson(body).Do(ctx)
 	if err != nil {
 		// Bỏ qua nếu 2 tiến trình cùng lúc tạo => "resource_already_exists_exception"
-		if strings.Contains(err.Error(), "resource_already_exists_exception") {
+		if isElasticErrorType(err, "resource_already_exists_exception") {
 			return nil
 		}
-		return fmt.Errorf("create index %s failed: %w", indexName, err)
+		return elasticError(fmt.Sprintf("create index %s failed", indexName), err)
 	}
 	if !resp.Acknowledged {
-		return fmt.Errorf("create index %s not acknowledged", indexName)
+		return &Error{Kind: ErrUnavailable, Backend: METRICS_BACKEND_ELASTIC, Msg: fmt.Sprintf("create index %s not acknowledged", indexName)}
 	}
 	return nil
 }
@@ -0,0 +1,253 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	ERASE_STATUS_PENDING = "pending" // chưa xử lý
+	ERASE_STATUS_ERASED  = "erased"  // đã xoá document + Redis, version đã tăng
+	ERASE_STATUS_FAILED  = "failed"  // lỗi, lần chạy lại sẽ thử tiếp
+	ERASE_STATUS_BLOCKED = "blocked" // user là creator, cần TransferOwnership trước khi xoá
+)
+
+// EraseChannelResult kết quả xoá user khỏi một channel.
+type EraseChannelResult struct {
+	ChannelID int32            `json:"channel_id"`
+	State     ParticipantState `json:"state"` // state của user trước khi xoá
+	Status    string           `json:"status"`
+	Version   int32            `json:"version,omitempty"` // version channel sau khi xoá
+	Error     string           `json:"error,omitempty"`
+	ErasedAt  int64            `json:"erased_at,omitempty"`
+}
+
+// EraseReport báo cáo (audit) của một yêu cầu xoá user, đồng thời là checkpoint để chạy tiếp khi bị ngắt.
+type EraseReport struct {
+	UserID          int32                `json:"user_id"`
+	StartedAt       int64                `json:"started_at"`
+	UpdatedAt       int64                `json:"updated_at"`
+	FinishedAt      int64                `json:"finished_at,omitempty"`
+	Runs            int                  `json:"runs"` // số lần chạy (lớn hơn 1 nếu đã resume)
+	Channels        []EraseChannelResult `json:"channels"`
+	UserIndexErased bool                 `json:"user_index_erased"`
+	ChangesScrubbed bool                 `json:"changes_scrubbed"` // user đã được gỡ khỏi change log
+	OutboxCompacted bool                 `json:"outbox_compacted"`
+	OutboxRemaining []string             `json:"outbox_remaining,omitempty"` // entry outbox chưa xong còn chứa user
+	Completed       bool                 `json:"completed"`
+}
+
+// Count đếm số channel theo status.
+func (r *EraseReport) Count(status string) int {
+	n := 0
+	for _, c := range r.Channels {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// UserEraser xoá một user khỏi mọi channel: document ES, set / CSV Redis, hàng chờ duyệt và reverse index.
+// Mỗi channel đi qua store.Delete (outbox) nên version tăng và change log được ghi như mọi mutation.
+// Report được ghi xuống dir/<uid>.json sau từng channel, chạy lại sẽ tiếp tục từ các channel chưa xong.
+type UserEraser struct {
+	es    *ElasticChannelParticipantsDAO
+	cache *ChannelParticipantsCacheDAO
+	store *ChannelParticipantsStore
+	dir   string
+}
+
+func NewUserEraser(es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO, store *ChannelParticipantsStore, dir string) *UserEraser {
+	return &UserEraser{es: es, cache: cache, store: store, dir: dir}
+}
+
+// ReportPath đường dẫn file report / checkpoint của user.
+func (u *UserEraser) ReportPath(userID int32) string {
+	return filepath.Join(u.dir, fmt.Sprintf("%d.json", userID))
+}
+
+// LoadReport đọc report đã lưu, trả về (nil, nil) nếu chưa có.
+func (u *UserEraser) LoadReport(userID int32) (*EraseReport, error) {
+	b, err := os.ReadFile(u.ReportPath(userID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read erase report failed: %w", err)
+	}
+	var r EraseReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("decode erase report failed: %w", err)
+	}
+	return &r, nil
+}
+
+// EraseUser xoá user khỏi mọi channel. Channel lỗi / bị chặn không dừng cả lượt,
+// report chỉ Completed khi mọi channel đã được xoá, user đã được gỡ khỏi change log và không còn entry outbox
+// chưa xong nào chứa user (chạy lại sau khi relay xử lý xong).
+func (u *UserEraser) EraseUser(ctx context.Context, userID int32) (*EraseReport, error) {
+	timeStart := time.Now()
+	report, err := u.LoadReport(userID)
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		report = &EraseReport{UserID: userID, StartedAt: time.Now().Unix()}
+	}
+	report.Runs++
+
+	// ES là nguồn dữ liệu gốc: gộp channel tìm thấy với channel đã có trong checkpoint
+	known := make(map[int32]int, len(report.Channels))
+	for i, c := range report.Channels {
+		known[c.ChannelID] = i
+	}
+	err = u.es.ScrollUserChannels(userID, func(items []UserChannelDO) error {
+		for _, it := range items {
+			if i, ok := known[it.ChannelID]; ok {
+				// user có document lại sau lần xoá trước (ví dụ join lại) -> xử lý lại
+				if report.Channels[i].Status == ERASE_STATUS_ERASED {
+					report.Channels[i].Status = ERASE_STATUS_PENDING
+				}
+				report.Channels[i].State = it.State
+				continue
+			}
+			known[it.ChannelID] = len(report.Channels)
+			report.Channels = append(report.Channels, EraseChannelResult{
+				ChannelID: it.ChannelID,
+				State:     it.State,
+				Status:    ERASE_STATUS_PENDING,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	sort.Slice(report.Channels, func(i, j int) bool { return report.Channels[i].ChannelID < report.Channels[j].ChannelID })
+	if err := u.saveReport(report); err != nil {
+		return report, err
+	}
+
+	for i := range report.Channels {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		c := &report.Channels[i]
+		if c.Status == ERASE_STATUS_ERASED {
+			continue
+		}
+		u.eraseChannel(userID, c)
+		if err := u.saveReport(report); err != nil {
+			return report, err
+		}
+	}
+
+	if report.Count(ERASE_STATUS_ERASED) == len(report.Channels) {
+		if err := u.cache.SaveUserChannels(userID, nil); err != nil {
+			return report, err
+		}
+		report.UserIndexErased = true
+
+		// change record vẫn liệt kê user trong added / updated / removed
+		if _, err := u.es.ScrubUserChanges(userID); err != nil {
+			return report, err
+		}
+		report.ChangesScrubbed = true
+
+		// entry outbox đã xong vẫn chứa document của user, compact để loại bỏ. Entry chưa xong (pending / failed)
+		// không được sửa vì relay còn phải áp dụng, report chưa Completed cho tới khi chúng xong và lần chạy sau compact
+		if err := u.store.Outbox().Compact(); err != nil {
+			return report, err
+		}
+		report.OutboxCompacted = true
+		report.OutboxRemaining = outboxEntriesOf(u.store.Outbox(), userID)
+		if len(report.OutboxRemaining) == 0 {
+			report.Completed = true
+			report.FinishedAt = time.Now().Unix()
+		}
+	}
+	if err := u.saveReport(report); err != nil {
+		return report, err
+	}
+
+	logCompleted(u.es.Logger(), "EraseUser", timeStart, LOG_KEY_USER_ID, userID, "channels", len(report.Channels),
+		"erased", report.Count(ERASE_STATUS_ERASED), "failed", report.Count(ERASE_STATUS_FAILED),
+		"blocked", report.Count(ERASE_STATUS_BLOCKED), "outbox_remaining", len(report.OutboxRemaining))
+	return report, nil
+}
+
+// outboxEntriesOf ID các entry outbox (sau compact chỉ còn entry chưa xong) còn chứa user.
+func outboxEntriesOf(outbox Outbox, userID int32) []string {
+	var out []string
+	for _, entry := range outbox.List("") {
+		if entry.Status == OUTBOX_STATUS_DONE {
+			continue
+		}
+		for _, uid := range entry.Users() {
+			if uid == userID {
+				out = append(out, entry.ID)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (u *UserEraser) eraseChannel(userID int32, c *EraseChannelResult) {
+	c.Error = ""
+	if c.State == PARTICIPANT_STATE_CREATOR {
+		c.Status = ERASE_STATUS_BLOCKED
+		c.Error = "user is the creator, transfer ownership first"
+		return
+	}
+	if err := u.store.Delete(c.ChannelID, -1, []int32{userID}); err != nil {
+		c.Status = ERASE_STATUS_FAILED
+		c.Error = err.Error()
+		return
+	}
+	if meta, err := u.es.GetVersion(c.ChannelID); err == nil {
+		c.Version = meta.Version
+	}
+	c.Status = ERASE_STATUS_ERASED
+	c.ErasedAt = time.Now().Unix()
+}
+
+// saveReport ghi report qua file tạm + rename để không bao giờ để lại checkpoint dở dang.
+func (u *UserEraser) saveReport(r *EraseReport) error {
+	if err := os.MkdirAll(u.dir, 0o755); err != nil {
+		return fmt.Errorf("create erase report dir failed: %w", err)
+	}
+	r.UpdatedAt = time.Now().Unix()
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := u.ReportPath(r.UserID)
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("create erase report tmp failed: %w", err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write erase report tmp failed: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync erase report tmp failed: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("rename erase report failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/olivere/elastic/v7"
+)
+
+// Nhóm lỗi trả về từ DAO / store, người gọi phân nhánh bằng errors.Is(err, ErrNotFound) ...
+// Lỗi gốc của backend vẫn lấy được bằng errors.As (ví dụ *elastic.Error).
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrVersionConflict = errors.New("version conflict")
+	ErrUnavailable     = errors.New("backend unavailable")
+	ErrPartialFailure  = errors.New("partial failure")
+	ErrInvalidInput    = errors.New("invalid input")
+	ErrTimeout         = errors.New("timeout")
+)
+
+// PARTIAL_FAILURE_MAX_REASONS số lý do lỗi tối đa giữ lại trong PartialFailureError.
+const PARTIAL_FAILURE_MAX_REASONS = 5
+
+var (
+	errElasticNil = &Error{Kind: ErrUnavailable, Backend: METRICS_BACKEND_ELASTIC, Msg: "DAO/client is nil"}
+	errRedisNil   = &Error{Kind: ErrUnavailable, Backend: METRICS_BACKEND_REDIS, Msg: "redis client is nil"}
+	errEmptyIndex = &Error{Kind: ErrInvalidInput, Msg: "index is empty"} // channelID <= 0
+)
+
+// Error lỗi của một thao tác, Kind là một trong các Err* ở trên (nil nếu không phân loại được).
+// Message giữ nguyên dạng "<Msg>: <lỗi gốc>".
+type Error struct {
+	Kind    error
+	Backend string // elastic | redis, rỗng nếu lỗi không đến từ backend
+	Msg     string
+	Err     error // lỗi gốc, có thể nil
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	errs := make([]error, 0, 2)
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// invalidInputf lỗi tham số / dữ liệu đầu vào không hợp lệ.
+func invalidInputf(format string, args ...any) error {
+	return &Error{Kind: ErrInvalidInput, Msg: fmt.Sprintf(format, args...)}
+}
+
+// notFoundf lỗi không tìm thấy participant / entry ...
+func notFoundf(format string, args ...any) error {
+	return &Error{Kind: ErrNotFound, Msg: fmt.Sprintf(format, args...)}
+}
+
+// elasticError bọc lỗi ES kèm phân loại theo status / lỗi kết nối.
+func elasticError(msg string, err error) error {
+	return &Error{Kind: classifyElastic(err), Backend: METRICS_BACKEND_ELASTIC, Msg: msg, Err: err}
+}
+
+// redisError bọc lỗi Redis kèm phân loại, redis.Nil được coi là ErrNotFound.
+func redisError(msg string, err error) error {
+	return &Error{Kind: classifyRedis(err), Backend: METRICS_BACKEND_REDIS, Msg: msg, Err: err}
+}
+
+func classifyElastic(err error) error {
+	if kind := classifyCommon(err); kind != nil {
+		return kind
+	}
+	switch {
+	case elastic.IsTimeout(err):
+		return ErrTimeout
+	case elastic.IsNotFound(err):
+		return ErrNotFound
+	case elastic.IsConflict(err):
+		return ErrVersionConflict
+	case elastic.IsConnErr(err), elastic.IsStatusCode(err, 429), elastic.IsStatusCode(err, 502),
+		elastic.IsStatusCode(err, 503), elastic.IsStatusCode(err, 504):
+		return ErrUnavailable
+	case elastic.IsStatusCode(err, 400):
+		return ErrInvalidInput
+	}
+	return nil
+}
+
+func classifyRedis(err error) error {
+	if err == redis.Nil {
+		return ErrNotFound
+	}
+	return classifyCommon(err)
+}
+
+// classifyCommon lỗi đã được phân loại, hết hạn context và lỗi mạng.
+func classifyCommon(err error) error {
+	var typed *Error
+	if errors.As(err, &typed) && typed.Kind != nil {
+		return typed.Kind
+	}
+	if errors.Is(err, ErrPartialFailure) {
+		return ErrPartialFailure
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrTimeout
+		}
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// PartialFailureError một phần item của thao tác batch (bulk, delete by query ...) bị lỗi,
+// các item còn lại đã được áp dụng.
+type PartialFailureError struct {
+	Msg     string
+	Total   int      // số item của thao tác, 0 nếu không biết
+	Failed  int      // số item lỗi
+	Reasons []string // tối đa PARTIAL_FAILURE_MAX_REASONS lý do đầu tiên
+}
+
+func newPartialFailure(msg string, total int, reasons []string) *PartialFailureError {
+	return &PartialFailureError{
+		Msg:     msg,
+		Total:   total,
+		Failed:  len(reasons),
+		Reasons: reasons[:min(len(reasons), PARTIAL_FAILURE_MAX_REASONS)],
+	}
+}
+
+func (e *PartialFailureError) Error() string {
+	s := fmt.Sprintf("%s has %d failures", e.Msg, e.Failed)
+	if e.Total > 0 {
+		s = fmt.Sprintf("%s has %d/%d failures", e.Msg, e.Failed, e.Total)
+	}
+	if len(e.Reasons) > 0 {
+		s += ": " + strings.Join(e.Reasons, "; ")
+	}
+	return s
+}
+
+func (e *PartialFailureError) Is(target error) bool {
+	return target == ErrPartialFailure
+}
+
+// bulkFailures lý do lỗi của từng item trong bulk response.
+func bulkFailures(resp *elastic.BulkResponse) []string {
+	if resp == nil || !resp.Errors {
+		return nil
+	}
+	var out []string
+	for _, item := range resp.Failed() {
+		if item.Error != nil {
+			out = append(out, fmt.Sprintf("%s: %s", item.Id, item.Error.Reason))
+		}
+	}
+	return out
+}
+
+// deleteByQueryFailures mô tả từng document xoá lỗi trong response delete by query.
+func deleteByQueryFailures(resp *elastic.BulkIndexByScrollResponse) []string {
+	out := make([]string, 0, len(resp.Failures))
+	for _, f := range resp.Failures {
+		out = append(out, fmt.Sprintf("%s: status %d", f.Id, f.Status))
+	}
+	return out
+}
+
+// isElasticErrorType lỗi ES có type (ví dụ resource_already_exists_exception).
+func isElasticErrorType(err error, typ string) bool {
+	var esErr *elastic.Error
+	return errors.As(err, &esErr) && esErr.Details != nil && esErr.Details.Type == typ
+}
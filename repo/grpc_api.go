@@ -0,0 +1,341 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	pb "tool_cache/repo/participantspb"
+)
+
+const (
+	GRPC_WATCH_POLL_INTERVAL = time.Second // chu kỳ đọc change log của WatchChannel
+	GRPC_STREAM_BATCH_SIZE   = 1000        // số user id tối đa mỗi message của StreamActiveUserIDs
+)
+
+// GRPCAPI server gRPC ChannelParticipants: mutation đi qua ChannelParticipantsStore (outbox),
+// đọc channel lớn bằng scroll ES và đẩy từng batch xuống stream.
+type GRPCAPI struct {
+	pb.UnimplementedChannelParticipantsServer
+
+	store    *ChannelParticipantsStore
+	health   *HealthMonitor // nil = grpc.health.v1 luôn SERVING
+	stopping chan struct{}  // đóng khi tắt server để WatchChannel kết thúc
+}
+
+func NewGRPCAPI(store *ChannelParticipantsStore, health *HealthMonitor) *GRPCAPI {
+	return &GRPCAPI{store: store, health: health, stopping: make(chan struct{})}
+}
+
+// Serve phục vụ gRPC (kèm grpc.health.v1) trên ln đến khi ctx bị huỷ, sau đó đóng các watch stream
+// và chờ RPC đang chạy tối đa HTTP_SHUTDOWN_TIMEOUT trước khi ngắt hẳn.
+func (a *GRPCAPI) Serve(ctx context.Context, ln net.Listener) error {
+	srv := grpc.NewServer()
+	pb.RegisterChannelParticipantsServer(srv, a)
+	hs := grpchealth.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go a.reportHealth(ctx, hs)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	hs.Shutdown()
+	close(a.stopping)
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(HTTP_SHUTDOWN_TIMEOUT):
+		srv.Stop()
+	}
+	return nil
+}
+
+// reportHealth cập nhật trạng thái grpc.health.v1 theo HealthMonitor: NOT_SERVING khi not_ready.
+func (a *GRPCAPI) reportHealth(ctx context.Context, hs *grpchealth.Server) {
+	ticker := time.NewTicker(GRPC_WATCH_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		status := healthpb.HealthCheckResponse_SERVING
+		if a.health != nil && a.health.Status(ctx).Status == HEALTH_NOT_READY {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		hs.SetServingStatus("", status)
+		hs.SetServingStatus(pb.ChannelParticipants_ServiceDesc.ServiceName, status)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ListenAndServe mở addr rồi gọi Serve.
+func (a *GRPCAPI) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen grpc api %s failed: %w", addr, err)
+	}
+	return a.Serve(ctx, ln)
+}
+
+func (a *GRPCAPI) SaveAllUsers(ctx context.Context, req *pb.SaveParticipantsRequest) (*pb.MutationResponse, error) {
+	return a.mutate(ctx, req, (*ChannelParticipantsStore).SaveAll)
+}
+
+func (a *GRPCAPI) AddDataToCache(ctx context.Context, req *pb.SaveParticipantsRequest) (*pb.MutationResponse, error) {
+	return a.mutate(ctx, req, (*ChannelParticipantsStore).Upsert)
+}
+
+func (a *GRPCAPI) mutate(ctx context.Context, req *pb.SaveParticipantsRequest,
+	apply func(s *ChannelParticipantsStore, channelID int32, version int32, list []ElasticChannelParticipantsDO) error) (*pb.MutationResponse, error) {
+	if req.GetVersion() == 0 {
+		return nil, grpcError(invalidInputf("version 0 is not allowed, use -1 to auto increment"))
+	}
+	list := make([]ElasticChannelParticipantsDO, 0, len(req.GetParticipants()))
+	for _, p := range req.GetParticipants() {
+		list = append(list, ElasticChannelParticipantsDO{Data: participantFromProto(p)})
+	}
+	if err := apply(a.store.WithContext(ctx), req.GetChannelId(), req.GetVersion(), list); err != nil {
+		return nil, grpcError(err)
+	}
+	return a.mutationResponse(ctx, req.GetChannelId())
+}
+
+func (a *GRPCAPI) DeleteUsers(ctx context.Context, req *pb.DeleteUsersRequest) (*pb.MutationResponse, error) {
+	if req.GetVersion() == 0 {
+		return nil, grpcError(invalidInputf("version 0 is not allowed, use -1 to auto increment"))
+	}
+	if len(req.GetUserIds()) == 0 {
+		return nil, grpcError(invalidInputf("user_ids is required"))
+	}
+	if err := a.store.WithContext(ctx).Delete(req.GetChannelId(), req.GetVersion(), req.GetUserIds()); err != nil {
+		return nil, grpcError(err)
+	}
+	return a.mutationResponse(ctx, req.GetChannelId())
+}
+
+func (a *GRPCAPI) mutationResponse(ctx context.Context, channelID int32) (*pb.MutationResponse, error) {
+	v, err := a.GetVersion(ctx, &pb.ChannelRequest{ChannelId: channelID})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MutationResponse{Version: v}, nil
+}
+
+func (a *GRPCAPI) GetVersion(ctx context.Context, req *pb.ChannelRequest) (*pb.ChannelVersion, error) {
+	meta, err := a.store.es.WithContext(ctx).GetVersion(req.GetChannelId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.ChannelVersion{
+		ChannelId:   meta.ChannelID,
+		Version:     meta.Version,
+		PrevVersion: meta.PrevVersion,
+		UpdateAt:    meta.UpdateAt,
+	}, nil
+}
+
+func (a *GRPCAPI) StreamAdmins(req *pb.ChannelRequest, stream grpc.ServerStreamingServer[pb.ParticipantBatch]) error {
+	es := a.store.es.WithContext(stream.Context())
+	return grpcError(es.ScrollAdmins(req.GetChannelId(), func(docs []ElasticChannelParticipantsDO) error {
+		return stream.Send(participantBatch(docs))
+	}))
+}
+
+func (a *GRPCAPI) StreamParticipants(req *pb.ChannelRequest, stream grpc.ServerStreamingServer[pb.ParticipantBatch]) error {
+	es := a.store.es.WithContext(stream.Context())
+	return grpcError(es.ScrollParticipants(req.GetChannelId(), func(docs []ElasticChannelParticipantsDO) error {
+		return stream.Send(participantBatch(docs))
+	}))
+}
+
+func (a *GRPCAPI) StreamActiveUserIDs(req *pb.ChannelRequest, stream grpc.ServerStreamingServer[pb.UserIDBatch]) error {
+	es := a.store.es.WithContext(stream.Context())
+	return grpcError(es.ScrollActiveUserIDs(req.GetChannelId(), func(ids []int32) error {
+		for len(ids) > 0 {
+			n := min(len(ids), GRPC_STREAM_BATCH_SIZE)
+			if err := stream.Send(&pb.UserIDBatch{UserIds: ids[:n]}); err != nil {
+				return err
+			}
+			ids = ids[n:]
+		}
+		return nil
+	}))
+}
+
+// WatchChannel đọc change log mỗi GRPC_WATCH_POLL_INTERVAL và đẩy delta mỗi khi version đổi.
+// Lỗi tạm thời của ES (unavailable / timeout) không đóng stream, lần poll sau đọc lại từ version cũ.
+func (a *GRPCAPI) WatchChannel(req *pb.WatchChannelRequest, stream grpc.ServerStreamingServer[pb.ChannelChange]) error {
+	ctx := stream.Context()
+	es := a.store.es.WithContext(ctx)
+	channelID, version := req.GetChannelId(), req.GetFromVersion()
+	if version < 0 {
+		meta, err := es.GetVersion(channelID)
+		if err != nil {
+			return grpcError(err)
+		}
+		version = meta.Version
+	}
+
+	ticker := time.NewTicker(GRPC_WATCH_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		changes, err := es.GetChangesSince(channelID, version)
+		switch {
+		case isDegradable(err) && ctx.Err() == nil:
+			es.Logger().Warn("watch channel poll failed", LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_ERROR, err)
+		case err != nil:
+			return grpcError(err)
+		case changes.Version != version:
+			if err := stream.Send(channelChangeToProto(changes)); err != nil {
+				return err
+			}
+			version = changes.Version
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-a.stopping:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-ticker.C:
+		}
+	}
+}
+
+func participantBatch(docs []ElasticChannelParticipantsDO) *pb.ParticipantBatch {
+	out := &pb.ParticipantBatch{Participants: make([]*pb.ChannelParticipant, 0, len(docs))}
+	for i := range docs {
+		out.Participants = append(out.Participants, participantToProto(participantData(&docs[i])))
+	}
+	return out
+}
+
+func participantToProto(p *ChannelParticipantsDO) *pb.ChannelParticipant {
+	return &pb.ChannelParticipant{
+		Id:                        p.ID,
+		ChannelId:                 p.ChannelID,
+		UserId:                    p.UserID,
+		IsCreator:                 p.IsCreator,
+		ParticipantType:           int32(p.ParticipantType),
+		InviterUserId:             p.InviterUserID,
+		InvitedAt:                 p.InvitedAt,
+		JoinedAt:                  p.JoinedAt,
+		IsWaitingApprove:          int32(p.IsWaitingAprrove),
+		HiddenParticipant:         int32(p.HiddenParticipant),
+		IsLeft:                    int32(p.IsLeft),
+		LeftAt:                    p.LeftAt,
+		IsKicked:                  int32(p.IsKicked),
+		KickedBy:                  p.KickedBy,
+		KickedAt:                  p.KickedAt,
+		HiddenPrehistory:          int32(p.HiddenPrehistory),
+		HiddenPrehistoryMessageId: p.HiddenPrehistoryMessageID,
+		AdminRights:               p.AdminRights,
+		PromotedBy:                p.PromotedBy,
+		PromotedAt:                p.PromotedAt,
+		Rank:                      p.Rank,
+		BannedRights:              p.BannedRights,
+		BannedUntilDate:           p.BannedUntilDate,
+		BannedAt:                  p.BannedAt,
+		ReadInboxMaxId:            p.ReadInboxMaxID,
+		ReadOutboxMaxId:           p.ReadOutboxMaxID,
+		Date:                      p.Date,
+		State:                     int32(p.State),
+		CreatedAt:                 p.CreatedAt,
+		UpdatedAt:                 p.UpdatedAt,
+	}
+}
+
+func participantFromProto(p *pb.ChannelParticipant) *ChannelParticipantsDO {
+	return &ChannelParticipantsDO{
+		ID:                        p.GetId(),
+		ChannelID:                 p.GetChannelId(),
+		UserID:                    p.GetUserId(),
+		IsCreator:                 p.GetIsCreator(),
+		ParticipantType:           int8(p.GetParticipantType()),
+		InviterUserID:             p.GetInviterUserId(),
+		InvitedAt:                 p.GetInvitedAt(),
+		JoinedAt:                  p.GetJoinedAt(),
+		IsWaitingAprrove:          int8(p.GetIsWaitingApprove()),
+		HiddenParticipant:         int8(p.GetHiddenParticipant()),
+		IsLeft:                    int8(p.GetIsLeft()),
+		LeftAt:                    p.GetLeftAt(),
+		IsKicked:                  int8(p.GetIsKicked()),
+		KickedBy:                  p.GetKickedBy(),
+		KickedAt:                  p.GetKickedAt(),
+		HiddenPrehistory:          int8(p.GetHiddenPrehistory()),
+		HiddenPrehistoryMessageID: p.GetHiddenPrehistoryMessageId(),
+		AdminRights:               p.GetAdminRights(),
+		PromotedBy:                p.GetPromotedBy(),
+		PromotedAt:                p.GetPromotedAt(),
+		Rank:                      p.GetRank(),
+		BannedRights:              p.GetBannedRights(),
+		BannedUntilDate:           p.GetBannedUntilDate(),
+		BannedAt:                  p.GetBannedAt(),
+		ReadInboxMaxID:            p.GetReadInboxMaxId(),
+		ReadOutboxMaxID:           p.GetReadOutboxMaxId(),
+		Date:                      p.GetDate(),
+		State:                     int8(p.GetState()),
+		CreatedAt:                 p.GetCreatedAt(),
+		UpdatedAt:                 p.GetUpdatedAt(),
+	}
+}
+
+func channelChangeToProto(c *ChannelChangesDO) *pb.ChannelChange {
+	return &pb.ChannelChange{
+		ChannelId:   c.ChannelID,
+		FromVersion: c.FromVersion,
+		Version:     c.Version,
+		Resync:      c.Resync,
+		Added:       c.Added,
+		Updated:     c.Updated,
+		Removed:     c.Removed,
+	}
+}
+
+// grpcError ánh xạ nhóm lỗi sang gRPC status code, nil giữ nguyên nil.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch classifyCommon(err) {
+	case ErrNotFound:
+		code = codes.NotFound
+	case ErrInvalidInput:
+		code = codes.InvalidArgument
+	case ErrVersionConflict:
+		code = codes.Aborted
+	case ErrUnavailable:
+		code = codes.Unavailable
+	case ErrTimeout:
+		code = codes.DeadlineExceeded
+	}
+	if errors.Is(err, context.Canceled) {
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
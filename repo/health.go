@@ -0,0 +1,369 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	CONNECT_MODE_EAGER      = "eager"      // chờ kết nối lúc khởi động (có retry), lỗi thì không khởi động
+	CONNECT_MODE_LAZY       = "lazy"       // tạo client ngay, chỉ kiểm tra khi có người hỏi trạng thái
+	CONNECT_MODE_BACKGROUND = "background" // tạo client ngay, HealthMonitor kiểm tra định kỳ và thử lại khi backend lỗi
+
+	HEALTH_STATUS_UNKNOWN  = "unknown" // chưa kiểm tra lần nào
+	HEALTH_STATUS_UP       = "up"
+	HEALTH_STATUS_DEGRADED = "degraded" // vẫn phục vụ được nhưng có vấn đề (cluster red, thiếu index, Redis gần đầy bộ nhớ, breaker mở)
+	HEALTH_STATUS_DOWN     = "down"
+
+	HEALTH_READY     = "ready"
+	HEALTH_DEGRADED  = "degraded" // Redis lỗi: đọc chuyển sang ES
+	HEALTH_NOT_READY = "not_ready"
+
+	HEALTH_HISTORY_SIZE       = 20  // số lần chuyển trạng thái giữ lại của mỗi backend
+	HEALTH_REDIS_MEMORY_LIMIT = 0.9 // used_memory / maxmemory từ mức này trở lên là degraded
+)
+
+// DefaultConnectPolicy thử kết nối 5 lần, mỗi lần tối đa 5s, backoff 500ms → 10s có jitter.
+// MaxRetries < 0 thử lại đến khi ctx bị huỷ.
+func DefaultConnectPolicy() OpPolicy {
+	return OpPolicy{Timeout: 5 * time.Second, MaxRetries: 5, BaseBackoff: 500 * time.Millisecond, MaxBackoff: 10 * time.Second}
+}
+
+// retryConnect gọi connect đến khi thành công hoặc hết số lần thử theo policy.
+func retryConnect(ctx context.Context, backend string, policy OpPolicy, connect func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := connectAttempt(ctx, policy.Timeout, connect)
+		if err == nil {
+			return nil
+		}
+		if policy.MaxRetries >= 0 && attempt >= policy.MaxRetries {
+			return fmt.Errorf("connect %s failed after %d attempts: %w", backend, attempt+1, err)
+		}
+		wait := policy.backoff(attempt + 1)
+		slog.Warn("connect backend failed, retrying", "backend", backend, "attempt", attempt+1, "wait", wait, LOG_KEY_ERROR, err)
+		if !sleepRetry(ctx, wait) {
+			return fmt.Errorf("connect %s canceled: %w", backend, err)
+		}
+	}
+}
+
+func connectAttempt(ctx context.Context, timeout time.Duration, connect func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return connect(ctx)
+}
+
+// HealthTransitionDO một lần backend chuyển trạng thái.
+type HealthTransitionDO struct {
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	At    time.Time `json:"at"`
+	Error string    `json:"error,omitempty"`
+}
+
+// BackendHealthDO trạng thái của một backend theo thời gian.
+type BackendHealthDO struct {
+	Backend     string               `json:"backend"`
+	Status      string               `json:"status"`
+	Since       time.Time            `json:"since"` // thời điểm chuyển sang Status
+	LastCheck   time.Time            `json:"last_check"`
+	LastSuccess time.Time            `json:"last_success"`
+	Failures    int                  `json:"failures"` // số lần kiểm tra lỗi liên tiếp
+	LatencyMs   int64                `json:"latency_ms"`
+	Error       string               `json:"error,omitempty"`
+	Breaker     string               `json:"breaker,omitempty"`
+	Details     map[string]any       `json:"details,omitempty"`
+	History     []HealthTransitionDO `json:"history,omitempty"`
+}
+
+// HealthDO trạng thái chung: not_ready nếu ES down hoặc chưa kiểm tra, degraded nếu có backend
+// degraded hoặc Redis down (đọc chuyển sang ES), còn lại ready.
+type HealthDO struct {
+	Status    string            `json:"status"`
+	CheckedAt time.Time         `json:"checked_at"`
+	Backends  []BackendHealthDO `json:"backends"`
+}
+
+// HealthConfig cấu hình HealthMonitor.
+type HealthConfig struct {
+	Interval        time.Duration // chu kỳ kiểm tra khi mọi backend up, mặc định 10s
+	Retry           OpPolicy      // backoff giữa các lần kiểm tra khi có backend lỗi, Timeout là timeout mỗi lần kiểm tra
+	RequiredIndices []string      // index ES bắt buộc phải có, thiếu thì ES degraded
+	Resilience      *Resilience   // trạng thái breaker được đưa vào báo cáo, breaker mở thì backend degraded
+	Logger          *slog.Logger  // nil = slog.Default()
+}
+
+// HealthMonitor theo dõi trạng thái ES (cluster health, index) và Redis (ping, bộ nhớ).
+type HealthMonitor struct {
+	es    *elastic.Client
+	redis *redis.Client
+	cfg   HealthConfig
+
+	mu        sync.RWMutex
+	checkedAt time.Time
+	backends  map[string]*BackendHealthDO
+}
+
+func NewHealthMonitor(es *elastic.Client, rdb *redis.Client, cfg HealthConfig) *HealthMonitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Retry == (OpPolicy{}) {
+		cfg.Retry = DefaultConnectPolicy()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	m := &HealthMonitor{es: es, redis: rdb, cfg: cfg, backends: map[string]*BackendHealthDO{}}
+	for _, backend := range []string{METRICS_BACKEND_ELASTIC, METRICS_BACKEND_REDIS} {
+		m.backends[backend] = &BackendHealthDO{Backend: backend, Status: HEALTH_STATUS_UNKNOWN}
+	}
+	return m
+}
+
+// Check kiểm tra song song cả 2 backend rồi trả về trạng thái mới.
+func (m *HealthMonitor) Check(ctx context.Context) *HealthDO {
+	if m.cfg.Retry.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.Retry.Timeout)
+		defer cancel()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		timeStart := time.Now()
+		status, details, err := m.checkElastic(ctx)
+		m.record(METRICS_BACKEND_ELASTIC, status, details, time.Since(timeStart), err)
+	}()
+	go func() {
+		defer wg.Done()
+		timeStart := time.Now()
+		status, details, err := m.checkRedis()
+		m.record(METRICS_BACKEND_REDIS, status, details, time.Since(timeStart), err)
+	}()
+	wg.Wait()
+
+	m.mu.Lock()
+	m.checkedAt = time.Now()
+	m.mu.Unlock()
+	return m.Snapshot()
+}
+
+// Snapshot trạng thái của lần kiểm tra gần nhất, không gọi backend.
+func (m *HealthMonitor) Snapshot() *HealthDO {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := &HealthDO{CheckedAt: m.checkedAt}
+	for _, b := range m.backends {
+		cp := *b
+		cp.History = append([]HealthTransitionDO(nil), b.History...)
+		if m.cfg.Resilience != nil {
+			cp.Breaker = m.cfg.Resilience.Breaker(b.Backend).State()
+		}
+		if cp.Breaker == BREAKER_STATE_OPEN && cp.Status == HEALTH_STATUS_UP {
+			cp.Status = HEALTH_STATUS_DEGRADED
+		}
+		out.Backends = append(out.Backends, cp)
+	}
+	sort.Slice(out.Backends, func(i, j int) bool { return out.Backends[i].Backend < out.Backends[j].Backend })
+	out.Status = overallHealth(out.Backends)
+	return out
+}
+
+// Status kiểm tra lại nếu lần kiểm tra gần nhất cũ hơn Interval (chế độ lazy, không có Run),
+// ngược lại trả về Snapshot.
+func (m *HealthMonitor) Status(ctx context.Context) *HealthDO {
+	m.mu.RLock()
+	stale := time.Since(m.checkedAt) > m.cfg.Interval
+	m.mu.RUnlock()
+	if stale {
+		return m.Check(ctx)
+	}
+	return m.Snapshot()
+}
+
+// Run kiểm tra mỗi Interval khi mọi backend up, khi có backend lỗi thì kiểm tra lại theo backoff của Retry
+// (kết nối nền). Dừng khi ctx bị huỷ.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	attempt := 0
+	for {
+		health := m.Check(ctx)
+		wait := m.cfg.Interval
+		if health.Status == HEALTH_READY {
+			attempt = 0
+		} else {
+			attempt++
+			wait = min(m.cfg.Retry.backoff(attempt), m.cfg.Interval)
+		}
+		if !sleepRetry(ctx, wait) {
+			return
+		}
+	}
+}
+
+// WaitReady chờ đến khi trạng thái không còn not_ready (cần Run đang chạy), hoặc ctx bị huỷ.
+func (m *HealthMonitor) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if health := m.Snapshot(); health.Status != HEALTH_NOT_READY {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return &Error{Kind: ErrUnavailable, Msg: "wait backends ready", Err: ctx.Err()}
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *HealthMonitor) checkElastic(ctx context.Context) (string, map[string]any, error) {
+	if m.es == nil {
+		return HEALTH_STATUS_DOWN, nil, errElasticNil
+	}
+	res, err := m.es.ClusterHealth().Do(ctx)
+	if err != nil {
+		return HEALTH_STATUS_DOWN, nil, elasticError("cluster health failed", err)
+	}
+	status := HEALTH_STATUS_UP
+	details := map[string]any{
+		"cluster_status":        res.Status,
+		"number_of_nodes":       res.NumberOfNodes,
+		"active_shards_percent": res.ActiveShardsPercentAsNumber,
+	}
+	var problems []string
+	if res.Status == "red" {
+		status = HEALTH_STATUS_DEGRADED
+		problems = append(problems, "cluster status red")
+	}
+
+	// index channel_participants_NNN được tạo khi ghi lần đầu nên chỉ đếm, không bắt buộc
+	indices, err := m.es.CatIndices().Index("channel_participants_*").Columns("index").Do(ctx)
+	if err != nil {
+		return HEALTH_STATUS_DEGRADED, details, elasticError("cat indices failed", err)
+	}
+	details["participant_indices"] = len(indices)
+
+	var missing []string
+	for _, index := range m.cfg.RequiredIndices {
+		exists, err := m.es.IndexExists(index).Do(ctx)
+		if err != nil {
+			return HEALTH_STATUS_DEGRADED, details, elasticError("check index exists failed", err)
+		}
+		if !exists {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		status = HEALTH_STATUS_DEGRADED
+		details["missing_indices"] = missing
+		problems = append(problems, "missing indices "+strings.Join(missing, ","))
+	}
+	if len(problems) > 0 {
+		return status, details, &Error{Kind: ErrUnavailable, Backend: METRICS_BACKEND_ELASTIC, Msg: strings.Join(problems, "; ")}
+	}
+	return status, details, nil
+}
+
+// checkRedis ping và đọc INFO memory (go-redis cũ không dùng context, mỗi lệnh bị giới hạn bởi ReadTimeout).
+func (m *HealthMonitor) checkRedis() (string, map[string]any, error) {
+	if m.redis == nil {
+		return HEALTH_STATUS_DOWN, nil, errRedisNil
+	}
+	if err := m.redis.Ping().Err(); err != nil {
+		return HEALTH_STATUS_DOWN, nil, redisError("redis PING error", err)
+	}
+	info, err := m.redis.Info("memory").Result()
+	if err != nil {
+		return HEALTH_STATUS_DEGRADED, nil, redisError("redis INFO error", err)
+	}
+	mem := parseRedisInfo(info)
+	used, _ := strconv.ParseInt(mem["used_memory"], 10, 64)
+	limit, _ := strconv.ParseInt(mem["maxmemory"], 10, 64)
+	details := map[string]any{"used_memory": used, "used_memory_human": mem["used_memory_human"], "maxmemory": limit}
+	if limit > 0 {
+		ratio := float64(used) / float64(limit)
+		details["memory_ratio"] = ratio
+		if ratio >= HEALTH_REDIS_MEMORY_LIMIT {
+			return HEALTH_STATUS_DEGRADED, details, &Error{Kind: ErrUnavailable, Backend: METRICS_BACKEND_REDIS,
+				Msg: fmt.Sprintf("redis memory usage %.0f%% of maxmemory", ratio*100)}
+		}
+	}
+	return HEALTH_STATUS_UP, details, nil
+}
+
+// parseRedisInfo đọc các dòng "key:value" của INFO, bỏ qua dòng tiêu đề "# Memory".
+func parseRedisInfo(info string) map[string]string {
+	out := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// record cập nhật trạng thái backend, ghi lịch sử và log khi trạng thái đổi.
+func (m *HealthMonitor) record(backend, status string, details map[string]any, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.backends[backend]
+	now := time.Now()
+	b.LastCheck, b.LatencyMs, b.Details = now, latency.Milliseconds(), details
+	b.Error = ""
+	if err != nil {
+		b.Error = err.Error()
+	}
+	if status == HEALTH_STATUS_DOWN {
+		b.Failures++
+	} else {
+		b.Failures = 0
+		b.LastSuccess = now
+	}
+	if status == b.Status {
+		return
+	}
+
+	b.History = append(b.History, HealthTransitionDO{From: b.Status, To: status, At: now, Error: b.Error})
+	if len(b.History) > HEALTH_HISTORY_SIZE {
+		b.History = b.History[len(b.History)-HEALTH_HISTORY_SIZE:]
+	}
+	level := slog.LevelInfo
+	if status != HEALTH_STATUS_UP {
+		level = slog.LevelWarn
+	}
+	m.cfg.Logger.Log(context.Background(), level, "backend health changed", "backend", backend, "from", b.Status, "to", status, LOG_KEY_ERROR, b.Error)
+	b.Status, b.Since = status, now
+}
+
+func overallHealth(backends []BackendHealthDO) string {
+	out := HEALTH_READY
+	for _, b := range backends {
+		switch {
+		case b.Status == HEALTH_STATUS_UNKNOWN:
+			return HEALTH_NOT_READY
+		case b.Status == HEALTH_STATUS_DOWN && b.Backend == METRICS_BACKEND_ELASTIC:
+			return HEALTH_NOT_READY
+		case b.Status != HEALTH_STATUS_UP:
+			out = HEALTH_DEGRADED
+		}
+	}
+	return out
+}
@@ -0,0 +1,520 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HTTP_API_PREFIX         = "/v1"
+	HTTP_SHUTDOWN_TIMEOUT   = 15 * time.Second // thời gian chờ request đang chạy khi tắt server
+	HTTP_DRAIN_GRACE        = 5 * time.Second  // thời gian readyz trả 503 trước khi ngừng nhận kết nối
+	HTTP_MAX_BODY_SIZE      = 64 << 20         // body mutation tối đa 64MB
+	HTTP_DEFAULT_PAGE_LIMIT = 100
+)
+
+// HTTPAPI phục vụ participants qua HTTP/JSON cho service không dùng package repo.
+// Đọc có ETag theo version của channel (meta trên ES), ghi đi qua ChannelParticipantsStore (outbox).
+//
+//	GET    /v1/channels/{id}/participants            danh sách user active
+//	PUT    /v1/channels/{id}/participants            reload toàn bộ (SaveAll)
+//	POST   /v1/channels/{id}/participants            thêm / cập nhật (Upsert)
+//	DELETE /v1/channels/{id}/participants?users=1,2  xoá (Delete)
+//	GET    /v1/channels/{id}/participants/{uid}      kiểm tra membership
+//	GET    /v1/channels/{id}/admins?limit=&offset=
+//	GET    /v1/channels/{id}/version
+//	GET    /v1/channels/{id}/stats
+//	GET    /v1/channels/{id}/changes?since=<version>
+//	GET    /healthz, /readyz
+type HTTPAPI struct {
+	store      *ChannelParticipantsStore
+	rehydrator *CacheRehydrator
+	stats      *ChannelStatsService
+	health     *HealthMonitor // nil = readyz chỉ dựa vào circuit breaker
+	draining   atomic.Bool    // đang tắt: readyz trả 503 để load balancer ngừng gửi request
+	drainGrace time.Duration  // chờ sau khi bật draining để readiness probe kịp thấy 503
+}
+
+func NewHTTPAPI(store *ChannelParticipantsStore, rehydrator *CacheRehydrator, stats *ChannelStatsService, health *HealthMonitor) *HTTPAPI {
+	return &HTTPAPI{store: store, rehydrator: rehydrator, stats: stats, health: health, drainGrace: HTTP_DRAIN_GRACE}
+}
+
+// WithDrainGrace đổi thời gian chờ giữa lúc readyz chuyển 503 và lúc ngừng nhận kết nối (0 = tắt ngay).
+// Nên lớn hơn chu kỳ readiness probe của load balancer.
+func (a *HTTPAPI) WithDrainGrace(d time.Duration) *HTTPAPI {
+	a.drainGrace = max(d, 0)
+	return a
+}
+
+// Handler router của API.
+func (a *HTTPAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	ch := HTTP_API_PREFIX + "/channels/{id}"
+	mux.HandleFunc("GET "+ch+"/participants", a.handleList)
+	mux.HandleFunc("PUT "+ch+"/participants", a.handleSaveAll)
+	mux.HandleFunc("POST "+ch+"/participants", a.handleUpsert)
+	mux.HandleFunc("DELETE "+ch+"/participants", a.handleDelete)
+	mux.HandleFunc("GET "+ch+"/participants/{uid}", a.handleMembership)
+	mux.HandleFunc("GET "+ch+"/admins", a.handleAdmins)
+	mux.HandleFunc("GET "+ch+"/version", a.handleVersion)
+	mux.HandleFunc("GET "+ch+"/stats", a.handleStats)
+	mux.HandleFunc("GET "+ch+"/changes", a.handleChanges)
+	mux.HandleFunc("GET /healthz", a.handleHealth)
+	mux.HandleFunc("GET /readyz", a.handleReady)
+	return mux
+}
+
+// Serve phục vụ API trên ln đến khi ctx bị huỷ. Khi tắt, readyz trả 503 trong drainGrace
+// (server vẫn phục vụ bình thường để load balancer kịp rút instance), sau đó ngừng nhận kết nối mới
+// và chờ request đang chạy tối đa HTTP_SHUTDOWN_TIMEOUT.
+func (a *HTTPAPI) Serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{Handler: a.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	a.draining.Store(true)
+	if a.drainGrace > 0 {
+		select {
+		case err := <-errc:
+			return err
+		case <-time.After(a.drainGrace):
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown http api failed: %w", err)
+	}
+	return nil
+}
+
+// ListenAndServe mở addr rồi gọi Serve.
+func (a *HTTPAPI) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen http api %s failed: %w", addr, err)
+	}
+	return a.Serve(ctx, ln)
+}
+
+// ParticipantListDO danh sách user active của channel tại version.
+type ParticipantListDO struct {
+	ChannelID int32   `json:"channel_id"`
+	Version   int32   `json:"version"`
+	UserIDs   []int32 `json:"user_ids"`
+}
+
+// MembershipDO kết quả kiểm tra membership, Participant nil nếu user chưa từng ở trong channel.
+type MembershipDO struct {
+	ChannelID   int32                  `json:"channel_id"`
+	UserID      int32                  `json:"user_id"`
+	Member      bool                   `json:"member"`
+	State       string                 `json:"state"`
+	Participant *ChannelParticipantsDO `json:"participant,omitempty"`
+}
+
+// AdminListDO một trang admin của channel.
+type AdminListDO struct {
+	ChannelID int32                   `json:"channel_id"`
+	Total     int32                   `json:"total"`
+	Admins    []ChannelParticipantsDO `json:"admins"`
+}
+
+// ParticipantsMutationDO body của PUT / POST participants. Version bỏ trống = -1 (tự tăng),
+// version 0 không được chấp nhận vì không đổi ETag.
+type ParticipantsMutationDO struct {
+	Version      *int32                  `json:"version,omitempty"`
+	Participants []ChannelParticipantsDO `json:"participants"`
+}
+
+func (a *HTTPAPI) handleList(w http.ResponseWriter, r *http.Request) {
+	channelID, version, ok := a.channelVersion(w, r)
+	if !ok {
+		return
+	}
+	list, err := a.rehydrator.GetList(channelID)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if a.cacheNotModified(w, r, channelID, version) {
+		return
+	}
+	writeJSON(w, http.StatusOK, &ParticipantListDO{ChannelID: channelID, Version: version, UserIDs: list})
+}
+
+func (a *HTTPAPI) handleMembership(w http.ResponseWriter, r *http.Request) {
+	channelID, _, ok := a.versioned(w, r)
+	if !ok {
+		return
+	}
+	userID, err := parsePathID(r, "uid")
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	docs, err := a.store.es.WithContext(r.Context()).GetParticipants(channelID, []int32{userID})
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	out := &MembershipDO{ChannelID: channelID, UserID: userID, State: PARTICIPANT_STATE_UNKNOWN.String()}
+	if doc := docs[userID]; doc != nil {
+		data := participantData(doc)
+		state := DeriveState(data)
+		out.Member, out.State, out.Participant = state.IsActive(), state.String(), data
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *HTTPAPI) handleAdmins(w http.ResponseWriter, r *http.Request) {
+	channelID, _, ok := a.versioned(w, r)
+	if !ok {
+		return
+	}
+	limit, err := queryInt32(r, "limit", HTTP_DEFAULT_PAGE_LIMIT)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	offset, err := queryInt32(r, "offset", 0)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	admins, total, err := a.store.es.WithContext(r.Context()).GetUserAdmins(channelID, limit, offset)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &AdminListDO{ChannelID: channelID, Total: total, Admins: admins})
+}
+
+func (a *HTTPAPI) handleVersion(w http.ResponseWriter, r *http.Request) {
+	channelID, err := parsePathID(r, "id")
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	meta, err := a.store.es.WithContext(r.Context()).GetVersion(channelID)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if notModified(w, r, meta.Version) {
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+func (a *HTTPAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	channelID, version, ok := a.channelVersion(w, r)
+	if !ok {
+		return
+	}
+	stats, err := a.stats.GetChannelStats(channelID)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if a.cacheNotModified(w, r, channelID, version) {
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *HTTPAPI) handleChanges(w http.ResponseWriter, r *http.Request) {
+	channelID, _, ok := a.versioned(w, r)
+	if !ok {
+		return
+	}
+	since, err := queryInt32(r, "since", -1)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if since < 0 {
+		writeHTTPError(w, invalidInputf("query since is required"))
+		return
+	}
+	changes, err := a.store.es.WithContext(r.Context()).GetChangesSince(channelID, since)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+func (a *HTTPAPI) handleSaveAll(w http.ResponseWriter, r *http.Request) {
+	a.mutateParticipants(w, r, (*ChannelParticipantsStore).SaveAll)
+}
+
+func (a *HTTPAPI) handleUpsert(w http.ResponseWriter, r *http.Request) {
+	a.mutateParticipants(w, r, (*ChannelParticipantsStore).Upsert)
+}
+
+func (a *HTTPAPI) mutateParticipants(w http.ResponseWriter, r *http.Request,
+	apply func(s *ChannelParticipantsStore, channelID int32, version int32, list []ElasticChannelParticipantsDO) error) {
+	channelID, err := parsePathID(r, "id")
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	var body ParticipantsMutationDO
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, HTTP_MAX_BODY_SIZE))
+	if err := dec.Decode(&body); err != nil {
+		writeHTTPError(w, invalidInputf("decode body failed: %v", err))
+		return
+	}
+	version, err := mutationVersion(body.Version)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	list := make([]ElasticChannelParticipantsDO, 0, len(body.Participants))
+	for i := range body.Participants {
+		list = append(list, ElasticChannelParticipantsDO{Data: &body.Participants[i]})
+	}
+	store := a.store.WithContext(r.Context())
+	if err := apply(store, channelID, version, list); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	a.writeMutationResult(w, r, channelID)
+}
+
+func (a *HTTPAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
+	channelID, err := parsePathID(r, "id")
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	userIDs, err := queryIDs(r, "users")
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if len(userIDs) == 0 {
+		writeHTTPError(w, invalidInputf("query users is required"))
+		return
+	}
+	var v *int32
+	if r.URL.Query().Has("version") {
+		n, err := queryInt32(r, "version", 0)
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		v = &n
+	}
+	version, err := mutationVersion(v)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if err := a.store.WithContext(r.Context()).Delete(channelID, version, userIDs); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	a.writeMutationResult(w, r, channelID)
+}
+
+// writeMutationResult trả về meta version mới kèm ETag để client cập nhật cache của mình.
+func (a *HTTPAPI) writeMutationResult(w http.ResponseWriter, r *http.Request, channelID int32) {
+	meta, err := a.store.es.WithContext(r.Context()).GetVersion(channelID)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.Header().Set("ETag", versionETag(meta.Version))
+	writeJSON(w, http.StatusOK, meta)
+}
+
+func (a *HTTPAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady 503 khi server đang tắt hoặc HealthMonitor báo not_ready (ES down),
+// degraded (Redis down, đọc chuyển sang ES) vẫn trả 200. Không có HealthMonitor thì dựa vào circuit breaker.
+func (a *HTTPAPI) handleReady(w http.ResponseWriter, r *http.Request) {
+	if a.health != nil {
+		health := a.health.Status(r.Context())
+		status := http.StatusOK
+		if health.Status == HEALTH_NOT_READY {
+			status = http.StatusServiceUnavailable
+		}
+		if a.draining.Load() {
+			status, health.Status = http.StatusServiceUnavailable, "draining"
+		}
+		writeJSON(w, status, health)
+		return
+	}
+
+	status := http.StatusOK
+	out := map[string]any{"status": "ready"}
+	if a.draining.Load() {
+		status, out["status"] = http.StatusServiceUnavailable, "draining"
+	}
+	breakers := a.store.es.Resilience().BreakerStates()
+	for _, state := range breakers {
+		if state == BREAKER_STATE_OPEN {
+			status, out["status"] = http.StatusServiceUnavailable, "degraded"
+		}
+	}
+	out["breakers"] = breakers
+	writeJSON(w, status, out)
+}
+
+// versioned đọc channel id và version hiện tại, đặt ETag. Trả về ok = false nếu đã trả lời
+// (lỗi hoặc 304 Not Modified khi If-None-Match khớp version).
+func (a *HTTPAPI) versioned(w http.ResponseWriter, r *http.Request) (channelID int32, version int32, ok bool) {
+	channelID, version, ok = a.channelVersion(w, r)
+	if !ok || notModified(w, r, version) {
+		return 0, 0, false
+	}
+	return channelID, version, true
+}
+
+// channelVersion đọc channel id và version hiện tại trên ES, chưa đặt ETag.
+func (a *HTTPAPI) channelVersion(w http.ResponseWriter, r *http.Request) (channelID int32, version int32, ok bool) {
+	channelID, err := parsePathID(r, "id")
+	if err != nil {
+		writeHTTPError(w, err)
+		return 0, 0, false
+	}
+	meta, err := a.store.es.WithContext(r.Context()).GetVersion(channelID)
+	if err != nil {
+		writeHTTPError(w, err)
+		return 0, 0, false
+	}
+	return channelID, meta.Version, true
+}
+
+// cacheNotModified dùng cho resource đọc từ Redis: body có thể trễ hơn ES (relay chưa ghi Redis),
+// nên ETag lấy theo channel:<id>:participants:version đọc sau body (relay ghi cùng bước với set).
+// Version Redis khác version ES thì không đặt ETag để client không cache body cũ dưới version mới.
+func (a *HTTPAPI) cacheNotModified(w http.ResponseWriter, r *http.Request, channelID int32, version int32) bool {
+	cached, err := a.store.cache.WithContext(r.Context()).GetVersion(channelID)
+	if err != nil || cached != version {
+		return false
+	}
+	return notModified(w, r, version)
+}
+
+// versionETag ETag của mọi resource đọc theo channel: mỗi mutation (version != 0) đổi version nên đổi ETag.
+func versionETag(version int32) string {
+	return `"v` + strconv.Itoa(int(version)) + `"`
+}
+
+// notModified đặt ETag, trả 304 nếu If-None-Match chứa ETag hiện tại (hoặc *).
+func notModified(w http.ResponseWriter, r *http.Request, version int32) bool {
+	etag := versionETag(version)
+	w.Header().Set("ETag", etag)
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(v), "W/"))
+		if v == etag || v == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func mutationVersion(v *int32) (int32, error) {
+	if v == nil {
+		return -1, nil
+	}
+	if *v == 0 {
+		return 0, invalidInputf("version 0 is not allowed, use -1 to auto increment")
+	}
+	return *v, nil
+}
+
+func parsePathID(r *http.Request, name string) (int32, error) {
+	n, err := strconv.ParseInt(r.PathValue(name), 10, 32)
+	if err != nil || n <= 0 {
+		return 0, invalidInputf("invalid %s %q", name, r.PathValue(name))
+	}
+	return int32(n), nil
+}
+
+func queryInt32(r *http.Request, name string, def int32) (int32, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, invalidInputf("invalid query %s %q", name, s)
+	}
+	return int32(n), nil
+}
+
+// queryIDs đọc danh sách id phân cách bằng dấu phẩy.
+func queryIDs(r *http.Request, name string) ([]int32, error) {
+	var out []int32
+	for _, s := range strings.Split(r.URL.Query().Get(name), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n <= 0 {
+			return nil, invalidInputf("invalid query %s: id %q", name, s)
+		}
+		out = append(out, int32(n))
+	}
+	return out, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// HTTPErrorDO body lỗi, Kind là tên nhóm lỗi (not found, invalid input ...).
+type HTTPErrorDO struct {
+	Error   string   `json:"error"`
+	Kind    string   `json:"kind,omitempty"`
+	Reasons []string `json:"reasons,omitempty"` // lý do lỗi của partial failure
+}
+
+// writeHTTPError ánh xạ nhóm lỗi sang HTTP status.
+func writeHTTPError(w http.ResponseWriter, err error) {
+	status, kind := http.StatusInternalServerError, classifyCommon(err)
+	switch kind {
+	case ErrNotFound:
+		status = http.StatusNotFound
+	case ErrInvalidInput:
+		status = http.StatusBadRequest
+	case ErrVersionConflict:
+		status = http.StatusConflict
+	case ErrUnavailable:
+		status = http.StatusServiceUnavailable
+	case ErrTimeout:
+		status = http.StatusGatewayTimeout
+	}
+	out := &HTTPErrorDO{Error: err.Error()}
+	if kind != nil {
+		out.Kind = kind.Error()
+	}
+	var partial *PartialFailureError
+	if errors.As(err, &partial) {
+		out.Reasons = partial.Reasons
+	}
+	writeJSON(w, status, out)
+}
@@ -0,0 +1,122 @@
+package repo
+
+import (
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// pendingParticipantsQuery participant đang chờ duyệt yêu cầu tham gia của channel.
+func pendingParticipantsQuery(channelID int32) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("channel_id", channelID),
+			elastic.NewTermQuery("is_left", 0),
+			elastic.NewTermQuery("is_kicked", 0),
+			elastic.NewTermQuery("data.IsWaitingAprrove", 1),
+		)
+}
+
+// GetPendingParticipants danh sách yêu cầu tham gia đang chờ duyệt, sắp xếp theo data.InvitedAt
+// (cũ trước, newestFirst = true thì mới trước), cùng thời điểm thì theo user_id.
+func (e *ElasticChannelParticipantsDAO) GetPendingParticipants(channelID int32, limit, offset int32, newestFirst bool) (_ []ElasticChannelParticipantsDO, _ int32, err error) {
+	e, span := e.startSpan("GetPendingParticipants", attrChannel(channelID))
+	defer e.observe(span, "GetPendingParticipants", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, 0, err
+	}
+	return e.searchParticipants(channelID, pendingParticipantsQuery(channelID), limit, offset,
+		elastic.NewFieldSort("data.InvitedAt").Order(!newestFirst),
+		elastic.NewFieldSort("user_id").Asc(),
+	)
+}
+
+// ScrollPendingUserIDs duyệt user_id của các yêu cầu tham gia đang chờ duyệt theo từng batch.
+func (e *ElasticChannelParticipantsDAO) ScrollPendingUserIDs(channelID int32, fn func(userIDs []int32) error) (err error) {
+	e, span := e.startSpan("ScrollPendingUserIDs", attrChannel(channelID))
+	defer e.observe(span, "ScrollPendingUserIDs", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	return e.scrollUserIDs(channelID, pendingParticipantsQuery(channelID), fn)
+}
+
+// RequestJoin đưa user vào hàng chờ duyệt của channel (IsWaitingAprrove = 1, InvitedAt = thời điểm gửi yêu cầu).
+// User chưa có document được tạo mới, user đã rời / bị kick được chuyển sang chờ duyệt,
+// user đang chờ duyệt sẵn được giữ nguyên để không mất thứ tự trong hàng chờ.
+func (s *ChannelParticipantsStore) RequestJoin(channelID int32, userIDs []int32) error {
+	if len(userIDs) == 0 {
+		return invalidInputf("listUserID empty")
+	}
+	current, err := s.es.GetParticipants(channelID, userIDs)
+	if err != nil {
+		return err
+	}
+	if current, err = s.liftExpiredBans(channelID, current, userIDs); err != nil {
+		return err
+	}
+
+	now := int32(time.Now().Unix())
+	updatedAt := time.Unix(int64(now), 0).Format(time.RFC3339)
+	docs := make([]ElasticChannelParticipantsDO, 0, len(userIDs))
+	for _, uid := range userIDs {
+		var data ChannelParticipantsDO
+		if doc, ok := current[uid]; ok {
+			data = *participantData(doc)
+			if DeriveState(&data) == PARTICIPANT_STATE_WAITING_APPROVAL {
+				continue
+			}
+		} else {
+			data = ChannelParticipantsDO{
+				ChannelID: channelID,
+				UserID:    uid,
+				Date:      now,
+				CreatedAt: updatedAt,
+			}
+		}
+		data.IsLeft, data.IsKicked, data.IsWaitingAprrove = 0, 0, 1
+		data.InvitedAt, data.JoinedAt = now, 0
+		data.State = int8(PARTICIPANT_STATE_UNKNOWN)
+		data.UpdatedAt = updatedAt
+		docs = append(docs, ElasticChannelParticipantsDO{Data: &data})
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	return s.Upsert(channelID, -1, docs)
+}
+
+// ApproveJoinRequests duyệt yêu cầu tham gia: user trở thành member và được chuyển từ pending sang participants.
+func (s *ChannelParticipantsStore) ApproveJoinRequests(channelID int32, actorID int32, userIDs []int32) error {
+	return s.applyAction(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_APPROVE, ActorID: actorID}, userIDs)
+}
+
+// DeclineJoinRequests từ chối yêu cầu tham gia: user bị gỡ khỏi pending và được đánh dấu đã rời.
+func (s *ChannelParticipantsStore) DeclineJoinRequests(channelID int32, actorID int32, userIDs []int32) error {
+	return s.applyAction(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_DECLINE, ActorID: actorID}, userIDs)
+}
+
+// ApproveAllJoinRequests duyệt toàn bộ hàng chờ của channel, trả về số user đã duyệt.
+func (s *ChannelParticipantsStore) ApproveAllJoinRequests(channelID int32, actorID int32) (int, error) {
+	return s.resolveAllJoinRequests(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_APPROVE, ActorID: actorID})
+}
+
+// DeclineAllJoinRequests từ chối toàn bộ hàng chờ của channel, trả về số user đã từ chối.
+func (s *ChannelParticipantsStore) DeclineAllJoinRequests(channelID int32, actorID int32) (int, error) {
+	return s.resolveAllJoinRequests(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_DECLINE, ActorID: actorID})
+}
+
+// resolveAllJoinRequests xử lý hàng chờ theo từng batch của scroll, mỗi batch là một entry outbox.
+func (s *ChannelParticipantsStore) resolveAllJoinRequests(channelID int32, action *ParticipantActionDO) (int, error) {
+	timeStart := time.Now()
+	total := 0
+	err := s.es.ScrollPendingUserIDs(channelID, func(ids []int32) error {
+		if err := s.applyAction(channelID, action, ids); err != nil {
+			return err
+		}
+		total += len(ids)
+		return nil
+	})
+	logCompleted(s.es.Logger(), action.Action+"AllJoinRequests", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, total)
+	return total, err
+}
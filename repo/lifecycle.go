@@ -0,0 +1,371 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	MERGE_CONFLICT_KEEP_DST     = "keep_dst"     // user có ở cả hai channel: giữ document của dst
+	MERGE_CONFLICT_KEEP_SRC     = "keep_src"     // user có ở cả hai channel: ghi đè bằng document của src
+	MERGE_CONFLICT_HIGHEST_ROLE = "highest_role" // giữ document có vai trò cao hơn, lệnh ban ở bất kỳ bên nào luôn được giữ
+)
+
+// mergeStateRank thứ tự ưu tiên của MERGE_CONFLICT_HIGHEST_ROLE, số lớn thắng.
+var mergeStateRank = map[ParticipantState]int{
+	PARTICIPANT_STATE_LEFT:             1,
+	PARTICIPANT_STATE_KICKED:           2,
+	PARTICIPANT_STATE_INVITED:          3,
+	PARTICIPANT_STATE_WAITING_APPROVAL: 4,
+	PARTICIPANT_STATE_RESTRICTED:       5,
+	PARTICIPANT_STATE_MEMBER:           6,
+	PARTICIPANT_STATE_ADMIN:            7,
+	PARTICIPANT_STATE_CREATOR:          8,
+	PARTICIPANT_STATE_BANNED:           9,
+}
+
+// MergeReportDO kết quả MergeChannels.
+type MergeReportDO struct {
+	SrcChannelID int32 `json:"src_channel_id"`
+	DstChannelID int32 `json:"dst_channel_id"`
+	Added        int   `json:"added"`    // user chỉ có ở src, được thêm vào dst
+	Replaced     int   `json:"replaced"` // user có ở cả hai, document của src thắng
+	Kept         int   `json:"kept"`     // user có ở cả hai, document của dst được giữ
+	Demoted      int   `json:"demoted"`  // creator của src trở thành admin ở dst
+	Version      int32 `json:"version"`  // version của dst sau khi merge
+}
+
+// CountParticipants số document participant (mọi state) của channel.
+func (e *ElasticChannelParticipantsDAO) CountParticipants(channelID int32) (_ int64, err error) {
+	e, span := e.startSpan("CountParticipants", attrChannel(channelID))
+	defer e.observe(span, "CountParticipants", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return 0, err
+	}
+	if e == nil || e.client == nil {
+		return 0, errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return 0, errEmptyIndex
+	}
+
+	n, err := e.client.Count(indexName).
+		Query(allParticipantsQuery(channelID)).
+		Routing(strconv.Itoa(int(channelID))).
+		Do(e.Context())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, elasticError("count participants failed", err)
+	}
+	return n, nil
+}
+
+// ScrollParticipants duyệt toàn bộ document participant (mọi state) của channel theo từng batch.
+func (e *ElasticChannelParticipantsDAO) ScrollParticipants(channelID int32, fn func(docs []ElasticChannelParticipantsDO) error) (err error) {
+	e, span := e.startSpan("ScrollParticipants", attrChannel(channelID))
+	defer e.observe(span, "ScrollParticipants", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return errEmptyIndex
+	}
+
+	ctx := e.Context()
+	scroll := e.client.Scroll(indexName).
+		Query(allParticipantsQuery(channelID)).
+		Size(5000).
+		Sort("_doc", true).
+		Routing(strconv.Itoa(int(channelID))).
+		Scroll("1m")
+	defer scroll.Clear(ctx)
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil
+			}
+			return elasticError("scroll participants failed", err)
+		}
+		if res == nil || res.Hits == nil || len(res.Hits.Hits) == 0 {
+			return nil
+		}
+
+		docs := make([]ElasticChannelParticipantsDO, 0, len(res.Hits.Hits))
+		for _, h := range res.Hits.Hits {
+			var doc ElasticChannelParticipantsDO
+			if err := json.Unmarshal(h.Source, &doc); err != nil {
+				return fmt.Errorf("unmarshal participant failed: %w", err)
+			}
+			docs = append(docs, doc)
+		}
+		if err := fn(docs); err != nil {
+			return err
+		}
+	}
+}
+
+// DropChannel xoá toàn bộ document của channel trên channel_participants_NNN (participant + meta)
+// và change log trên channel_changes_NNN, trả về số document participant đã xoá.
+func (e *ElasticChannelParticipantsDAO) DropChannel(channelID int32) (_ int64, err error) {
+	e, span := e.startSpan("DropChannel", attrChannel(channelID))
+	defer e.observe(span, "DropChannel", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return 0, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return 0, errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return 0, errEmptyIndex
+	}
+
+	ctx := e.Context()
+	route := strconv.Itoa(int(channelID))
+	deleted := int64(0)
+
+	// document meta cũng có channel_id nên bị xoá cùng lượt
+	for _, index := range []string{indexName, GetElasticChangeIndex(channelID, ELASTIC_SIZE_INDEX)} {
+		resp, err := e.client.DeleteByQuery(index).
+			Query(elastic.NewTermQuery("channel_id", channelID)).
+			Routing(route).
+			Conflicts("proceed").
+			Refresh("true").
+			WaitForCompletion(true).
+			Do(ctx)
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				continue
+			}
+			return deleted, elasticError(fmt.Sprintf("drop channel %s failed", index), err)
+		}
+		if resp == nil {
+			return deleted, fmt.Errorf("drop channel %s: empty response", index)
+		}
+		if len(resp.Failures) > 0 {
+			return deleted, newPartialFailure(fmt.Sprintf("drop channel %s", index), int(resp.Total), deleteByQueryFailures(resp))
+		}
+		if index == indexName {
+			deleted = resp.Deleted
+		}
+	}
+
+	logCompleted(e.Logger(), "DropChannel", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, deleted)
+	return deleted, nil
+}
+
+// DropChannel xoá channel trên ES (participant, meta, change log), các key Redis của channel
+// và channel trong user:<uid>:channels của mọi user. Không đi qua outbox vì channel không còn version:
+// entry outbox chưa xong của channel bị huỷ trước để replay không ghi lại channel đã xoá.
+// Chạy trong MutationRun và giữ khoá cache của channel để relay / rehydrate không ghi xen vào.
+func (s *ChannelParticipantsStore) DropChannel(channelID int32) (_ int64, err error) {
+	s, run, err := s.beginMutation("drop_channel", channelID)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { run.End(err) }()
+	unlock, err := s.cache.LockChannelCache(channelID)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	if err := s.cancelOutbox(channelID, "channel dropped"); err != nil {
+		return 0, err
+	}
+	var userIDs []int32
+	if err := s.es.ScrollAllUserIDs(channelID, func(ids []int32) error {
+		userIDs = append(userIDs, ids...)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	deleted, err := s.es.DropChannel(channelID)
+	if err != nil {
+		return deleted, err
+	}
+	if err := s.cache.DropChannel(channelID); err != nil {
+		return deleted, err
+	}
+	if err := s.cache.RemoveUserChannel(channelID, userIDs); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// cancelOutbox đánh dấu xong (kèm lý do trong LastError) các entry outbox chưa xong của channel,
+// entry đã huỷ không còn bị replay và được loại bỏ ở lần compact sau.
+func (s *ChannelParticipantsStore) cancelOutbox(channelID int32, reason string) error {
+	for _, entry := range s.outbox.List("") {
+		if entry.ChannelID != channelID || entry.Status == OUTBOX_STATUS_DONE {
+			continue
+		}
+		entry.Status = OUTBOX_STATUS_DONE
+		entry.LastError = "canceled: " + reason
+		if err := s.outbox.Save(entry); err != nil {
+			return err
+		}
+		s.es.Logger().Warn("outbox entry canceled", LOG_KEY_OP, "cancelOutbox", LOG_KEY_CHANNEL_ID, channelID, "entry", entry.ID, "reason", reason)
+	}
+	return nil
+}
+
+// CopyChannel sao chép toàn bộ participant của src sang dst (dst phải chưa có participant).
+// Hai channel có thể nằm ở hai index channel_participants_NNN khác nhau: đọc theo routing src, ghi theo routing dst.
+func (s *ChannelParticipantsStore) CopyChannel(srcChannelID int32, dstChannelID int32) (int, error) {
+	if srcChannelID == dstChannelID {
+		return 0, invalidInputf("copy channel: src and dst are the same channel %d", srcChannelID)
+	}
+	n, err := s.es.CountParticipants(dstChannelID)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, invalidInputf("copy channel: dst channel %d already has %d participants, use MergeChannels", dstChannelID, n)
+	}
+
+	var docs []ElasticChannelParticipantsDO
+	err = s.es.ScrollParticipants(srcChannelID, func(batch []ElasticChannelParticipantsDO) error {
+		for i := range batch {
+			docs = append(docs, moveParticipant(&batch[i], dstChannelID))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(docs) == 0 {
+		return 0, notFoundf("copy channel: src channel %d has no participants", srcChannelID)
+	}
+	if err := s.SaveAll(dstChannelID, -1, docs); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// MergeChannels gộp participant của src vào dst theo conflictPolicy, src được giữ nguyên
+// (gọi DropChannel(src) sau nếu cần). dst giữ creator của mình, creator của src trở thành admin đầy đủ quyền;
+// nếu dst chưa có creator thì creator của src được giữ. Toàn bộ thay đổi là một entry outbox / một version của dst.
+func (s *ChannelParticipantsStore) MergeChannels(srcChannelID int32, dstChannelID int32, conflictPolicy string) (*MergeReportDO, error) {
+	timeStart := time.Now()
+	if srcChannelID == dstChannelID {
+		return nil, invalidInputf("merge channels: src and dst are the same channel %d", srcChannelID)
+	}
+	switch conflictPolicy {
+	case MERGE_CONFLICT_KEEP_DST, MERGE_CONFLICT_KEEP_SRC, MERGE_CONFLICT_HIGHEST_ROLE:
+	default:
+		return nil, invalidInputf("merge channels: unknown conflict policy %q", conflictPolicy)
+	}
+	unlock, err := s.lockCreators(dstChannelID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dstCreators, err := s.es.GetCreatorIDs(dstChannelID)
+	if err != nil {
+		return nil, err
+	}
+	report := &MergeReportDO{SrcChannelID: srcChannelID, DstChannelID: dstChannelID}
+	keepSrcCreator := len(dstCreators) == 0
+	now := int32(time.Now().Unix())
+
+	var docs []ElasticChannelParticipantsDO
+	err = s.es.ScrollParticipants(srcChannelID, func(batch []ElasticChannelParticipantsDO) error {
+		userIDs := make([]int32, len(batch))
+		for i := range batch {
+			userIDs[i] = batch[i].UserID
+		}
+		existing, err := s.es.GetParticipants(dstChannelID, userIDs)
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			src := moveParticipant(&batch[i], dstChannelID)
+			if dst, ok := existing[src.UserID]; ok {
+				// creator của dst luôn được giữ để dst vẫn có đúng một creator
+				if DeriveState(participantData(dst)) == PARTICIPANT_STATE_CREATOR ||
+					!mergeSrcWins(conflictPolicy, participantData(&src), participantData(dst)) {
+					report.Kept++
+					continue
+				}
+				report.Replaced++
+			} else {
+				report.Added++
+			}
+
+			if src.Data.IsCreator == 1 && !keepSrcCreator {
+				src.Data.IsCreator, src.Data.AdminRights = 0, int32(ADMIN_RIGHTS_ALL)
+				src.Data.PromotedAt = now
+				src.Data.State = int8(PARTICIPANT_STATE_UNKNOWN)
+				src = NewElasticParticipant(src.Data)
+				report.Demoted++
+			}
+			docs = append(docs, src)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(docs) > 0 {
+		// merge không phải chuyển trạng thái của user nên bỏ qua kiểm tra transition của Upsert
+		docs, err = normalizeParticipants(dstChannelID, docs)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.validateCreators(dstChannelID, docs, false); err != nil {
+			return nil, err
+		}
+		entry := NewOutboxEntry(dstChannelID, OUTBOX_OP_UPSERT, -1)
+		entry.Docs = docs
+		if err := s.submit(entry); err != nil {
+			return nil, err
+		}
+		report.Version = entry.AppliedVersion
+	}
+
+	logCompleted(s.es.Logger(), "MergeChannels", timeStart, LOG_KEY_CHANNEL_ID, dstChannelID, "src_channel_id", srcChannelID,
+		"added", report.Added, "replaced", report.Replaced, "kept", report.Kept)
+	return report, nil
+}
+
+// mergeSrcWins document của src có ghi đè document của dst hay không.
+func mergeSrcWins(policy string, src, dst *ChannelParticipantsDO) bool {
+	switch policy {
+	case MERGE_CONFLICT_KEEP_SRC:
+		return true
+	case MERGE_CONFLICT_HIGHEST_ROLE:
+		return mergeStateRank[DeriveState(src)] > mergeStateRank[DeriveState(dst)]
+	}
+	return false
+}
+
+// moveParticipant bản sao document với channel_id mới, field top-level và State được dựng lại.
+func moveParticipant(doc *ElasticChannelParticipantsDO, channelID int32) ElasticChannelParticipantsDO {
+	data := *participantData(doc)
+	data.ChannelID = channelID
+	data.UpdatedAt = time.Now().Format(time.RFC3339)
+	return NewElasticParticipant(&data)
+}
@@ -0,0 +1,92 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Key chung của các bản ghi log, service dùng để lọc / chuyển log vào pipeline riêng.
+const (
+	LOG_KEY_OP         = "op"
+	LOG_KEY_CHANNEL_ID = "channel_id"
+	LOG_KEY_USER_ID    = "user_id"
+	LOG_KEY_COUNT      = "count"
+	LOG_KEY_DURATION   = "duration"
+	LOG_KEY_ERROR      = "error"
+)
+
+// NewLogger tạo logger slog ghi ra w với level debug|info|warn|error và format text|json.
+// Các dòng đo thời gian thực thi của DAO ở level debug, tắt được bằng level info trở lên.
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lv}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q (text|json)", format)
+}
+
+// DiscardLogger logger bỏ qua mọi bản ghi.
+func DiscardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// Logger logger của DAO, mặc định slog.Default().
+func (e *ElasticChannelParticipantsDAO) Logger() *slog.Logger {
+	if e == nil || e.logger == nil {
+		return slog.Default()
+	}
+	return e.logger
+}
+
+// WithLogger trả về bản sao DAO ghi log qua l.
+func (e *ElasticChannelParticipantsDAO) WithLogger(l *slog.Logger) *ElasticChannelParticipantsDAO {
+	if e == nil {
+		return nil
+	}
+	cp := *e
+	cp.logger = l
+	return &cp
+}
+
+// Logger logger của DAO, mặc định slog.Default().
+func (r *ChannelParticipantsCacheDAO) Logger() *slog.Logger {
+	if r == nil || r.logger == nil {
+		return slog.Default()
+	}
+	return r.logger
+}
+
+// WithLogger trả về bản sao DAO ghi log qua l.
+func (r *ChannelParticipantsCacheDAO) WithLogger(l *slog.Logger) *ChannelParticipantsCacheDAO {
+	if r == nil {
+		return nil
+	}
+	cp := *r
+	cp.logger = l
+	return &cp
+}
+
+// logTiming ghi thời gian thực thi của op (level debug) kèm các field bổ sung.
+func logTiming(l *slog.Logger, op string, timeStart time.Time, args ...any) {
+	l.Debug("completed", append([]any{LOG_KEY_OP, op, LOG_KEY_DURATION, time.Since(timeStart)}, args...)...)
+}
+
+// logCompleted ghi kết quả của một mutation (level info) kèm thời gian thực thi.
+func logCompleted(l *slog.Logger, op string, timeStart time.Time, args ...any) {
+	l.Info("completed", append([]any{LOG_KEY_OP, op, LOG_KEY_DURATION, time.Since(timeStart)}, args...)...)
+}
+
+// logError ghi lỗi của op (level error) kèm các field bổ sung.
+func logError(l *slog.Logger, op string, err error, args ...any) {
+	l.Error("failed", append([]any{LOG_KEY_OP, op, LOG_KEY_ERROR, err}, args...)...)
+}
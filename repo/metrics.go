@@ -0,0 +1,416 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/olivere/elastic/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	METRICS_NAMESPACE = "channel_participants"
+
+	METRICS_BACKEND_ELASTIC = "elastic"
+	METRICS_BACKEND_REDIS   = "redis"
+
+	METRICS_OUTCOME_OK    = "ok"
+	METRICS_OUTCOME_ERROR = "error"
+	METRICS_OUTCOME_MISS  = "miss" // Redis trả về nil / ES trả về 404
+
+	METRICS_CACHE_HIT  = "hit"
+	METRICS_CACHE_MISS = "miss"
+)
+
+// Metrics bộ đếm / histogram Prometheus của DAO. Mọi method chấp nhận receiver nil (tắt metrics).
+type Metrics struct {
+	opTotal           *prometheus.CounterVec   // backend, op, outcome - mỗi lần gọi method DAO
+	opDuration        *prometheus.HistogramVec // backend, op, outcome
+	requestTotal      *prometheus.CounterVec   // backend, op, outcome - mỗi request ES / lệnh Redis
+	requestDuration   *prometheus.HistogramVec // backend, op
+	bulkBatchSize     *prometheus.HistogramVec // op - số request trong một batch của BulkProcessor
+	bulkBatchDuration *prometheus.HistogramVec // op
+	bulkItemFailures  *prometheus.CounterVec   // op
+	retries           *prometheus.CounterVec   // backend, op
+	cacheTotal        *prometheus.CounterVec   // cache, result
+	redisPayload      *prometheus.HistogramVec // command, direction (request|reply)
+
+	mu           sync.Mutex
+	bulkStarts   map[string]time.Time // op/execution id -> thời điểm bắt đầu batch
+	instrumented map[*redis.Client]bool
+}
+
+// NewMetrics tạo và đăng ký metrics vào reg (nil = prometheus.DefaultRegisterer).
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	m := &Metrics{
+		opTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Name: "dao_operations_total",
+			Help: "Số lần gọi method DAO theo backend, op và kết quả.",
+		}, []string{"backend", "op", "outcome"}),
+		opDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE, Name: "dao_operation_duration_seconds",
+			Help:    "Thời gian thực thi method DAO.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+		}, []string{"backend", "op", "outcome"}),
+		requestTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Name: "backend_requests_total",
+			Help: "Số request ES / lệnh Redis theo endpoint / command và kết quả.",
+		}, []string{"backend", "op", "outcome"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE, Name: "backend_request_duration_seconds",
+			Help:    "Thời gian của một request ES / lệnh Redis.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"backend", "op"}),
+		bulkBatchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE, Name: "bulk_batch_size",
+			Help:    "Số request trong một batch của BulkProcessor.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 13),
+		}, []string{"op"}),
+		bulkBatchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE, Name: "bulk_batch_duration_seconds",
+			Help:    "Thời gian commit một batch của BulkProcessor.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, []string{"op"}),
+		bulkItemFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Name: "bulk_item_failures_total",
+			Help: "Số item lỗi trong các batch của BulkProcessor (cả batch lỗi thì tính mọi item).",
+		}, []string{"op"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Name: "retries_total",
+			Help: "Số lần thử lại theo backend và op.",
+		}, []string{"backend", "op"}),
+		cacheTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Name: "cache_requests_total",
+			Help: "Số lần đọc cache Redis theo loại cache và kết quả hit / miss.",
+		}, []string{"cache", "result"}),
+		redisPayload: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE, Name: "redis_payload_bytes",
+			Help:    "Kích thước tham số gửi đi / kết quả nhận về của lệnh Redis.",
+			Buckets: prometheus.ExponentialBuckets(16, 4, 12),
+		}, []string{"command", "direction"}),
+		bulkStarts:   map[string]time.Time{},
+		instrumented: map[*redis.Client]bool{},
+	}
+	reg.MustRegister(m.opTotal, m.opDuration, m.requestTotal, m.requestDuration, m.bulkBatchSize,
+		m.bulkBatchDuration, m.bulkItemFailures, m.retries, m.cacheTotal, m.redisPayload)
+	return m
+}
+
+// ServeMetrics mở endpoint /metrics trên addr, trả về server để Shutdown khi tắt.
+func ServeMetrics(addr string, g prometheus.Gatherer) (*http.Server, error) {
+	if g == nil {
+		g = prometheus.DefaultGatherer
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen metrics %s failed: %w", addr, err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go srv.Serve(ln)
+	return srv, nil
+}
+
+func outcomeOf(err error) string {
+	switch {
+	case err == nil:
+		return METRICS_OUTCOME_OK
+	case errors.Is(err, redis.Nil), errors.Is(err, ErrNotFound), elastic.IsNotFound(err):
+		return METRICS_OUTCOME_MISS
+	}
+	return METRICS_OUTCOME_ERROR
+}
+
+// observeOp ghi một lần gọi method DAO, dùng với defer và named error result.
+func (m *Metrics) observeOp(backend, op string, timeStart time.Time, err *error) {
+	if m == nil {
+		return
+	}
+	outcome := METRICS_OUTCOME_OK
+	if err != nil {
+		// not found (ví dụ GetList khi key chưa có) là miss, không tính vào tỉ lệ lỗi
+		outcome = outcomeOf(*err)
+	}
+	m.opTotal.WithLabelValues(backend, op, outcome).Inc()
+	m.opDuration.WithLabelValues(backend, op, outcome).Observe(time.Since(timeStart).Seconds())
+}
+
+func (m *Metrics) observeRequest(backend, op string, timeStart time.Time, outcome string) {
+	if m == nil {
+		return
+	}
+	m.requestTotal.WithLabelValues(backend, op, outcome).Inc()
+	m.requestDuration.WithLabelValues(backend, op).Observe(time.Since(timeStart).Seconds())
+}
+
+// IncRetry đếm một lần thử lại.
+func (m *Metrics) IncRetry(backend, op string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(backend, op).Inc()
+}
+
+// cacheResult đếm hit / miss của một loại cache (participants, string, user_channels, stats ...).
+func (m *Metrics) cacheResult(cache string, hit bool) {
+	if m == nil {
+		return
+	}
+	result := METRICS_CACHE_MISS
+	if hit {
+		result = METRICS_CACHE_HIT
+	}
+	m.cacheTotal.WithLabelValues(cache, result).Inc()
+}
+
+// instrumentBulk gắn metrics vào BulkProcessor của op: kích thước / thời gian mỗi batch và số item lỗi.
+func (m *Metrics) instrumentBulk(s *elastic.BulkProcessorService, op string, after elastic.BulkAfterFunc) *elastic.BulkProcessorService {
+	if m == nil {
+		return s.After(after)
+	}
+	// execution id chỉ duy nhất trong một BulkProcessor nên key gắn thêm con trỏ service
+	key := func(execID int64) string { return fmt.Sprintf("%p/%d", s, execID) }
+	return s.
+		Before(func(execID int64, reqs []elastic.BulkableRequest) {
+			m.mu.Lock()
+			m.bulkStarts[key(execID)] = time.Now()
+			m.mu.Unlock()
+		}).
+		After(func(execID int64, reqs []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
+			m.mu.Lock()
+			start, ok := m.bulkStarts[key(execID)]
+			delete(m.bulkStarts, key(execID))
+			m.mu.Unlock()
+			if ok {
+				m.bulkBatchDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+			}
+			m.bulkBatchSize.WithLabelValues(op).Observe(float64(len(reqs)))
+			switch {
+			case err != nil:
+				m.bulkItemFailures.WithLabelValues(op).Add(float64(len(reqs)))
+			case resp != nil:
+				if failed := len(resp.Failed()); failed > 0 {
+					m.bulkItemFailures.WithLabelValues(op).Add(float64(failed))
+				}
+			}
+			if after != nil {
+				after(execID, reqs, resp, err)
+			}
+		})
+}
+
+// HTTPClient http.Client cho elastic.SetHttpClient, đo mọi request ES theo endpoint và status.
+func (m *Metrics) HTTPClient(base *http.Client) *http.Client {
+	if base == nil {
+		base = http.DefaultClient
+	}
+	if m == nil {
+		return base
+	}
+	cp := *base
+	next := cp.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	cp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		timeStart := time.Now()
+		resp, err := next.RoundTrip(req)
+		outcome := METRICS_OUTCOME_OK
+		switch {
+		case err != nil, resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+			outcome = METRICS_OUTCOME_ERROR
+		case resp.StatusCode == http.StatusNotFound:
+			outcome = METRICS_OUTCOME_MISS
+		case resp.StatusCode >= 400:
+			outcome = METRICS_OUTCOME_ERROR
+		}
+		m.observeRequest(METRICS_BACKEND_ELASTIC, elasticEndpoint(req.Method, req.URL.Path), timeStart, outcome)
+		return resp, err
+	})
+	return &cp
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// elasticEndpoint tên endpoint ES (search, bulk, scroll, doc_get ...) từ path, không chứa tên index / id.
+func elasticEndpoint(method, path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, p := range parts {
+		if !strings.HasPrefix(p, "_") {
+			continue
+		}
+		name := strings.TrimPrefix(p, "_")
+		switch {
+		case name == "search" && i+1 < len(parts) && parts[i+1] == "scroll":
+			return "scroll"
+		case name == "doc" || name == "create":
+			return name + "_" + strings.ToLower(method)
+		}
+		return name
+	}
+	switch {
+	case path == "" || path == "/":
+		return "ping"
+	case method == http.MethodHead:
+		return "index_exists"
+	case method == http.MethodPut:
+		return "create_index"
+	}
+	return "index_" + strings.ToLower(method)
+}
+
+// instrumentRedis bọc Process / ProcessPipeline của client để đo từng lệnh Redis và kích thước payload.
+// Mỗi client chỉ được bọc một lần dù có nhiều DAO dùng chung.
+func (m *Metrics) instrumentRedis(c *redis.Client) {
+	if m == nil || c == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.instrumented[c] {
+		return
+	}
+	m.instrumented[c] = true
+
+	c.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			timeStart := time.Now()
+			err := old(cmd)
+			m.observeRedisCmd(cmd, timeStart)
+			return err
+		}
+	})
+	c.WrapProcessPipeline(func(old func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			timeStart := time.Now()
+			err := old(cmds)
+			m.observeRequest(METRICS_BACKEND_REDIS, "pipeline", timeStart, outcomeOf(err))
+			for _, cmd := range cmds {
+				m.requestTotal.WithLabelValues(METRICS_BACKEND_REDIS, cmd.Name(), outcomeOf(cmd.Err())).Inc()
+				m.observeRedisPayload(cmd)
+			}
+			return err
+		}
+	})
+}
+
+func (m *Metrics) observeRedisCmd(cmd redis.Cmder, timeStart time.Time) {
+	m.observeRequest(METRICS_BACKEND_REDIS, cmd.Name(), timeStart, outcomeOf(cmd.Err()))
+	m.observeRedisPayload(cmd)
+}
+
+func (m *Metrics) observeRedisPayload(cmd redis.Cmder) {
+	name := cmd.Name()
+	req := 0
+	for _, a := range cmd.Args() {
+		req += payloadSize(a)
+	}
+	m.redisPayload.WithLabelValues(name, "request").Observe(float64(req))
+
+	reply := -1
+	switch c := cmd.(type) {
+	case *redis.StringCmd:
+		reply = len(c.Val())
+	case *redis.StringSliceCmd:
+		reply = 0
+		for _, v := range c.Val() {
+			reply += len(v)
+		}
+	case *redis.StringStringMapCmd:
+		reply = 0
+		for k, v := range c.Val() {
+			reply += len(k) + len(v)
+		}
+	}
+	if reply >= 0 {
+		m.redisPayload.WithLabelValues(name, "reply").Observe(float64(reply))
+	}
+}
+
+func payloadSize(v interface{}) int {
+	switch a := v.(type) {
+	case string:
+		return len(a)
+	case []byte:
+		return len(a)
+	case int32:
+		return len(strconv.Itoa(int(a)))
+	case int:
+		return len(strconv.Itoa(a))
+	case int64:
+		return len(strconv.FormatInt(a, 10))
+	}
+	return len(fmt.Sprint(v))
+}
+
+// Metrics metrics của DAO (nil = tắt).
+func (e *ElasticChannelParticipantsDAO) Metrics() *Metrics {
+	if e == nil {
+		return nil
+	}
+	return e.metrics
+}
+
+// WithMetrics trả về bản sao DAO ghi metrics vào m. Đo từng request ES cần thêm
+// elastic.SetHttpClient(m.HTTPClient(nil)) khi tạo client (xem ConnectElastic).
+func (e *ElasticChannelParticipantsDAO) WithMetrics(m *Metrics) *ElasticChannelParticipantsDAO {
+	if e == nil {
+		return nil
+	}
+	cp := *e
+	cp.metrics = m
+	return &cp
+}
+
+// Metrics metrics của DAO (nil = tắt).
+func (r *ChannelParticipantsCacheDAO) Metrics() *Metrics {
+	if r == nil {
+		return nil
+	}
+	return r.metrics
+}
+
+// WithMetrics trả về bản sao DAO ghi metrics vào m, đồng thời đo từng lệnh Redis của client.
+func (r *ChannelParticipantsCacheDAO) WithMetrics(m *Metrics) *ChannelParticipantsCacheDAO {
+	if r == nil {
+		return nil
+	}
+	cp := *r
+	cp.metrics = m
+	m.instrumentRedis(cp.conn)
+	return &cp
+}
+
+// observe kết thúc span của op (xem startSpan) và ghi metrics của lần gọi.
+func (e *ElasticChannelParticipantsDAO) observe(span trace.Span, op string, timeStart time.Time, err *error) {
+	if e != nil && e.cancel != nil {
+		e.cancel()
+	}
+	e.breaker().Record(*err)
+	endSpan(span, *err)
+	e.Metrics().observeOp(METRICS_BACKEND_ELASTIC, op, timeStart, err)
+}
+
+func (r *ChannelParticipantsCacheDAO) observe(span trace.Span, op string, timeStart time.Time, err *error) {
+	if r != nil && r.cancel != nil {
+		r.cancel()
+	}
+	r.breaker().Record(*err)
+	endSpan(span, *err)
+	r.Metrics().observeOp(METRICS_BACKEND_REDIS, op, timeStart, err)
+}
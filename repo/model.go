@@ -59,7 +59,33 @@ type ElasticChannelParticipantsDO struct {
 }
 
 type ElasticChannelParticipantMetaDO struct {
-	ChannelID int32 `json:"channel_id"`
-	Version   int32 `json:"version"`
-	UpdateAt  int64 `json:"update_at"`
+	ChannelID   int32  `json:"channel_id"`
+	Version     int32  `json:"version"`
+	PrevVersion int32  `json:"prev_version"`
+	UpdateAt    int64  `json:"update_at"`
+	LastOp      string `json:"last_op,omitempty"` // idempotency key của lần cập nhật version cuối
+}
+
+// ElasticChannelChangeDO bản ghi thay đổi participants của channel khi version tăng từ FromVersion lên Version.
+type ElasticChannelChangeDO struct {
+	ChannelID   int32   `json:"channel_id"`
+	FromVersion int32   `json:"from_version"`
+	Version     int32   `json:"version"`
+	Reset       bool    `json:"reset"` // reload toàn bộ (SaveAllUsers)
+	Added       []int32 `json:"added,omitempty"`
+	Updated     []int32 `json:"updated,omitempty"`
+	Removed     []int32 `json:"removed,omitempty"`
+	CreatedAt   int64   `json:"created_at"`
+}
+
+// ChannelChangesDO delta trả về cho client đang giữ version FromVersion.
+// Resync = true nghĩa là log không đủ để tính delta, client phải tải lại toàn bộ.
+type ChannelChangesDO struct {
+	ChannelID   int32   `json:"channel_id"`
+	FromVersion int32   `json:"from_version"`
+	Version     int32   `json:"version"`
+	Resync      bool    `json:"resync"`
+	Added       []int32 `json:"added"`
+	Updated     []int32 `json:"updated"`
+	Removed     []int32 `json:"removed"`
 }
@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	MODERATION_STATUS_APPLIED = "applied" // đã áp dụng lên ES và Redis
+	MODERATION_STATUS_SKIPPED = "skipped" // không user nào trong danh sách thuộc channel
+	MODERATION_STATUS_FAILED  = "failed"  // lỗi kiểm tra hoặc áp dụng, xem Error
+)
+
+// ActionBatchDO phần việc của một channel trong thao tác moderation nhiều channel.
+// OpKey là idempotency key khi tăng version (ID entry outbox của channel).
+type ActionBatchDO struct {
+	ChannelID int32
+	UserIDs   []int32
+	OpKey     string
+}
+
+// ActionBatchResultDO kết quả áp dụng lên ES của một channel.
+type ActionBatchResultDO struct {
+	ChannelID int32
+	Changed   []int32
+	Version   int32
+	Err       error
+}
+
+// ModerationResultDO kết quả moderation của một channel.
+type ModerationResultDO struct {
+	ChannelID int32   `json:"channel_id"`
+	UserIDs   []int32 `json:"user_ids,omitempty"` // user thuộc channel và được áp dụng action
+	Status    string  `json:"status"`
+	Version   int32   `json:"version,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ApplyActionBatches áp dụng cùng một action cho nhiều channel qua một BulkProcessor dùng chung,
+// mỗi request được gửi tới index / routing của channel tương ứng. Sau đó tăng version và ghi change log
+// riêng cho từng channel không có lỗi, cuối cùng refresh các index bị ảnh hưởng một lần.
+func (e *ElasticChannelParticipantsDAO) ApplyActionBatches(action *ParticipantActionDO, batches []ActionBatchDO) (_ []ActionBatchResultDO, err error) {
+	e, span := e.startSpan("ApplyActionBatches", attrCount(len(batches)))
+	defer e.observe(span, "ApplyActionBatches", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return nil, errElasticNil
+	}
+	top, data, err := action.fields(int32(time.Now().Unix()))
+	if err != nil {
+		return nil, err
+	}
+	script := participantFieldsScript(top, data)
+
+	channelIDs := make([]int32, 0, len(batches))
+	for _, b := range batches {
+		channelIDs = append(channelIDs, b.ChannelID)
+	}
+	run, err := e.lifecycle.beginIn(e.Context(), "ApplyActionBatches", channelIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { run.End(err) }()
+
+	type target struct {
+		channelID int32
+		userID    int32
+	}
+	targets := map[string]target{}
+	for _, b := range batches {
+		for _, uid := range b.UserIDs {
+			targets[GetParicipantID(b.ChannelID, uid)] = target{b.ChannelID, uid}
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		changed  = map[int32][]int32{}
+		failures = map[int32][]string{}
+		bulkErrs []error
+	)
+	ctx := e.Context()
+	bp, err := e.newBulkProcessor(ctx, "moderation_"+action.Action, "bp-moderation-"+action.Action,
+		func(execID int64, reqs []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// không biết request nào lỗi, coi như mọi channel đều lỗi để relay thử lại từng channel
+				bulkErrs = append(bulkErrs, err)
+				return
+			}
+			if resp == nil {
+				return
+			}
+			for _, item := range resp.Items {
+				for _, r := range item {
+					t, ok := targets[r.Id]
+					if !ok {
+						continue
+					}
+					if r.Error != nil {
+						failures[t.channelID] = append(failures[t.channelID], fmt.Sprintf("%s: %s", r.Id, r.Error.Reason))
+						continue
+					}
+					if r.Result == "updated" {
+						changed[t.channelID] = append(changed[t.channelID], t.userID)
+					}
+				}
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	run.Track(bp)
+
+	indices := map[string]bool{}
+	for _, b := range batches {
+		indexName := GetElasticChannelIndex(b.ChannelID, ELASTIC_SIZE_INDEX)
+		indices[indexName] = true
+		route := strconv.Itoa(int(b.ChannelID))
+		for _, uid := range b.UserIDs {
+			bp.Add(elastic.NewBulkUpdateRequest().
+				Index(indexName).
+				Id(GetParicipantID(b.ChannelID, uid)).
+				Routing(route).
+				Script(script).
+				RetryOnConflict(3))
+		}
+	}
+	flushErr := bp.Flush()
+	run.Untrack(bp)
+	bp.Close()
+
+	results := make([]ActionBatchResultDO, 0, len(batches))
+	for _, b := range batches {
+		res := ActionBatchResultDO{ChannelID: b.ChannelID, Changed: changed[b.ChannelID]}
+		switch {
+		case flushErr != nil:
+			res.Err = elasticError("bulk flush failed", flushErr)
+		case len(bulkErrs) > 0:
+			res.Err = elasticError("bulk failed", bulkErrs[0])
+		case len(failures[b.ChannelID]) > 0:
+			res.Err = newPartialFailure(action.Action, len(b.UserIDs), failures[b.ChannelID])
+		}
+		if res.Err == nil {
+			res.Version, res.Err = e.bumpBatchVersion(ctx, action, b, res.Changed)
+		}
+		results = append(results, res)
+	}
+
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		if _, err := e.client.Refresh(names...).Do(ctx); err != nil {
+			return results, elasticError("refresh failed", err)
+		}
+	}
+
+	logCompleted(e.Logger(), "ApplyActionBatches", timeStart, "action", action.Action, "channels", len(batches), LOG_KEY_COUNT, len(targets))
+	return results, nil
+}
+
+// bumpBatchVersion tăng version và ghi change log của một channel giống ApplyAction.
+func (e *ElasticChannelParticipantsDAO) bumpBatchVersion(ctx context.Context, action *ParticipantActionDO, b ActionBatchDO, changed []int32) (int32, error) {
+	change := ElasticChannelChangeDO{}
+	switch {
+	case action.RemovesMember():
+		change.Removed = changed
+	case action.AddsMember():
+		change.Added = changed
+	default:
+		change.Updated = changed
+	}
+	es := e.WithIdempotencyKey(b.OpKey)
+	if err := es.bumpVersionWithChange(ctx, b.ChannelID, -1, change); err != nil {
+		return 0, elasticError(fmt.Sprintf("set version after %s failed", action.Action), err)
+	}
+	meta, err := es.GetVersion(b.ChannelID)
+	if err != nil {
+		return 0, err
+	}
+	return meta.Version, nil
+}
+
+// KickFromChannels kick các user khỏi nhiều channel cùng lúc.
+func (s *ChannelParticipantsStore) KickFromChannels(actorID int32, channelIDs []int32, userIDs []int32) ([]ModerationResultDO, error) {
+	return s.ModerateChannels(&ParticipantActionDO{Action: PARTICIPANT_ACTION_KICK, ActorID: actorID}, channelIDs, userIDs)
+}
+
+// BanFromChannels ban các user khỏi nhiều channel cùng lúc tới untilDate (0 = vĩnh viễn).
+func (s *ChannelParticipantsStore) BanFromChannels(actorID int32, rights int32, untilDate int32, channelIDs []int32, userIDs []int32) ([]ModerationResultDO, error) {
+	return s.ModerateChannels(&ParticipantActionDO{
+		Action:          PARTICIPANT_ACTION_BAN,
+		ActorID:         actorID,
+		BannedRights:    rights,
+		BannedUntilDate: untilDate,
+	}, channelIDs, userIDs)
+}
+
+// ModerateChannels áp dụng action cho tập user trên tập channel. Mỗi channel chỉ áp dụng cho những user
+// thực sự thuộc channel và vẫn được kiểm tra như applyAction; channel lỗi không chặn các channel khác.
+// Mỗi channel có một entry outbox riêng, phần ES của mọi channel đi qua một bulk pipeline dùng chung,
+// channel nào ES lỗi sẽ được relay thử lại theo đường một channel.
+func (s *ChannelParticipantsStore) ModerateChannels(action *ParticipantActionDO, channelIDs []int32, userIDs []int32) (_ []ModerationResultDO, err error) {
+	timeStart := time.Now()
+	if len(channelIDs) == 0 || len(userIDs) == 0 {
+		return nil, invalidInputf("channel list and user list are required")
+	}
+	if _, _, err := action.fields(0); err != nil {
+		return nil, err
+	}
+	// ghi outbox trực tiếp thay vì qua submit nên cũng phải từ chối khi đang tắt như submit
+	s, run, err := s.beginMutation("moderation_"+action.Action, channelIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { run.End(err) }()
+
+	results := make([]ModerationResultDO, 0, len(channelIDs))
+	entries := map[int32]*OutboxEntry{}
+	var batches []ActionBatchDO
+
+	seen := make(map[int32]bool, len(channelIDs))
+	for _, cid := range channelIDs {
+		if seen[cid] {
+			continue
+		}
+		seen[cid] = true
+		res := ModerationResultDO{ChannelID: cid}
+		current, err := s.es.GetParticipants(cid, userIDs)
+		if err != nil {
+			res.Status, res.Error = MODERATION_STATUS_FAILED, err.Error()
+			results = append(results, res)
+			continue
+		}
+		for _, uid := range userIDs {
+			if _, ok := current[uid]; ok {
+				res.UserIDs = append(res.UserIDs, uid)
+			}
+		}
+		if len(res.UserIDs) == 0 {
+			res.Status = MODERATION_STATUS_SKIPPED
+			results = append(results, res)
+			continue
+		}
+
+		entry, err := s.prepareAction(cid, action, res.UserIDs, current)
+		if err == nil {
+			err = s.outbox.Save(entry)
+		}
+		if err != nil {
+			res.Status, res.Error = MODERATION_STATUS_FAILED, err.Error()
+			results = append(results, res)
+			continue
+		}
+		entries[cid] = entry
+		batches = append(batches, ActionBatchDO{ChannelID: cid, UserIDs: res.UserIDs, OpKey: entry.ID})
+		results = append(results, res)
+	}
+
+	if len(batches) > 0 {
+		esResults, err := s.es.ApplyActionBatches(action, batches)
+		if err != nil {
+			// channel chưa áp dụng được lên ES sẽ được relay thử lại bên dưới
+			logError(s.es.Logger(), "ApplyActionBatches", err, "action", action.Action)
+		}
+		for _, r := range esResults {
+			if r.Err != nil {
+				continue
+			}
+			entry := entries[r.ChannelID]
+			entry.Attempts++
+			entry.Applied = map[string]bool{OUTBOX_BACKEND_ELASTIC: true}
+			entry.AppliedVersion = r.Version
+		}
+	}
+
+	// Redis (và ES của channel lỗi) đi qua relay như mọi mutation khác
+	for i := range results {
+		entry, ok := entries[results[i].ChannelID]
+		if !ok {
+			continue
+		}
+		if err := s.relay.Process(entry); err != nil {
+			results[i].Status, results[i].Error = MODERATION_STATUS_FAILED, err.Error()
+			continue
+		}
+		results[i].Status = MODERATION_STATUS_APPLIED
+		results[i].Version = entry.AppliedVersion
+	}
+
+	logCompleted(s.es.Logger(), "ModerateChannels", timeStart, "action", action.Action, "channels", len(channelIDs), "batched", len(batches))
+	return results, nil
+}
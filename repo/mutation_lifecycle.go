@@ -0,0 +1,434 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	SHUTDOWN_DRAIN_TIMEOUT = 30 * time.Second // thời gian tối đa chờ mutation đang chạy khi tắt
+	SHUTDOWN_FLUSH_TIMEOUT = 5 * time.Second  // hết hạn drain: thời gian tối đa flush BulkProcessor còn hàng đợi
+)
+
+// ErrShuttingDown mutation bị từ chối vì process đang tắt, errors.Is(err, ErrUnavailable) cũng đúng.
+var ErrShuttingDown error = &Error{Kind: ErrUnavailable, Msg: "shutting down, mutation rejected"}
+
+// InterruptedMutationDO mutation chưa hoàn tất khi process tắt, channel cần được sửa ở lần khởi động sau.
+type InterruptedMutationDO struct {
+	ChannelID     int32  `json:"channel_id"`
+	Op            string `json:"op"`
+	StartedAt     int64  `json:"started_at"`
+	InterruptedAt int64  `json:"interrupted_at"`
+	Error         string `json:"error,omitempty"` // lỗi của mutation, hoặc lỗi của lần sửa gần nhất
+	RepairedAt    int64  `json:"repaired_at,omitempty"`
+}
+
+// MutationRun một mutation đang chạy, nil an toàn (DAO không gắn MutationLifecycle).
+type MutationRun struct {
+	l          *MutationLifecycle
+	parent     *MutationRun // khác nil: op lồng trong mutation của store, dùng chung run của store
+	id         int64
+	op         string
+	channelIDs []int32
+	startedAt  time.Time
+
+	mu  sync.Mutex // giữ trong lúc flush lúc tắt để BulkProcessor không bị Close giữa chừng
+	bps []*elastic.BulkProcessor
+}
+
+// MutationLifecycle theo dõi các mutation: mutation của store (ES và Redis là một đơn vị) và các op DAO
+// ghi ES bằng BulkProcessor gọi trực tiếp. Khi tắt, ngừng nhận mutation mới,
+// chờ mutation đang chạy xong trong thời hạn, hết hạn thì flush BulkProcessor còn hàng đợi rồi ghi lại
+// channel chưa hoàn tất vào file (ghi qua file tạm + rename) để sửa ở lần khởi động sau.
+type MutationLifecycle struct {
+	mu          sync.Mutex
+	path        string
+	draining    bool
+	nextID      int64
+	active      map[int64]*MutationRun
+	changed     chan struct{} // đóng mỗi khi một mutation kết thúc
+	interrupted []InterruptedMutationDO
+}
+
+// OpenMutationLifecycle đọc danh sách mutation bị ngắt của lần chạy trước từ path (chưa có file thì rỗng).
+func OpenMutationLifecycle(path string) (*MutationLifecycle, error) {
+	l := &MutationLifecycle{path: path, active: map[int64]*MutationRun{}, changed: make(chan struct{})}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read interrupted mutations failed: %w", err)
+	}
+	if err := json.Unmarshal(b, &l.interrupted); err != nil {
+		return nil, fmt.Errorf("decode interrupted mutations failed: %w", err)
+	}
+	return l, nil
+}
+
+// Draining true khi đã bắt đầu tắt, mutation mới bị từ chối với ErrShuttingDown.
+func (l *MutationLifecycle) Draining() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.draining
+}
+
+// Begin đăng ký mutation op trên các channel, trả về ErrShuttingDown nếu đang tắt.
+// Người gọi phải gọi End khi mutation kết thúc.
+func (l *MutationLifecycle) Begin(op string, channelIDs ...int32) (*MutationRun, error) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining {
+		return nil, ErrShuttingDown
+	}
+	l.nextID++
+	run := &MutationRun{l: l, id: l.nextID, op: op, channelIDs: channelIDs, startedAt: time.Now()}
+	l.active[run.id] = run
+	return run, nil
+}
+
+type mutationRunKey struct{}
+
+// withMutationRun gắn run vào ctx, op DAO chạy trong ctx này được tính vào run thay vì mở run mới.
+func withMutationRun(ctx context.Context, run *MutationRun) context.Context {
+	if run == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, mutationRunKey{}, run)
+}
+
+func mutationRunFrom(ctx context.Context) *MutationRun {
+	run, _ := ctx.Value(mutationRunKey{}).(*MutationRun)
+	return run
+}
+
+// beginIn như Begin, nhưng nếu ctx đã mang run (op lồng trong mutation của store) thì trả về run con
+// dùng chung run đó: không bị từ chối giữa chừng khi bắt đầu tắt, End của run con không làm gì.
+func (l *MutationLifecycle) beginIn(ctx context.Context, op string, channelIDs ...int32) (*MutationRun, error) {
+	if parent := mutationRunFrom(ctx); parent != nil {
+		return &MutationRun{parent: parent}, nil
+	}
+	return l.Begin(op, channelIDs...)
+}
+
+// Track gắn BulkProcessor vào mutation để được flush khi hết hạn drain.
+// Phải gọi Untrack trước khi Close bp.
+func (r *MutationRun) Track(bp *elastic.BulkProcessor) {
+	if r == nil {
+		return
+	}
+	if r.parent != nil {
+		r.parent.Track(bp)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bps = append(r.bps, bp)
+}
+
+// Untrack gỡ bp khỏi mutation, chờ nếu bp đang được flush lúc tắt.
+func (r *MutationRun) Untrack(bp *elastic.BulkProcessor) {
+	if r == nil {
+		return
+	}
+	if r.parent != nil {
+		r.parent.Untrack(bp)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, b := range r.bps {
+		if b == bp {
+			r.bps = append(r.bps[:i], r.bps[i+1:]...)
+			break
+		}
+	}
+}
+
+// End kết thúc mutation. Lỗi trong lúc đang tắt thì channel được ghi lại là chưa hoàn tất,
+// mutation đã bị ghi lại lúc hết hạn drain mà sau đó xong thì được gỡ khỏi danh sách.
+func (r *MutationRun) End(err error) {
+	if r == nil || r.parent != nil {
+		return
+	}
+	l := r.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.active[r.id]; !ok {
+		// đã bị ghi lại lúc hết hạn drain
+		if err == nil {
+			l.resolveLocked(r.op, r.channelIDs, r.startedAt.Unix())
+			l.saveLogged()
+		}
+		return
+	}
+	delete(l.active, r.id)
+	close(l.changed)
+	l.changed = make(chan struct{})
+	if err != nil && l.draining {
+		l.recordLocked(r, err.Error())
+		l.saveLogged()
+	}
+}
+
+// Shutdown ngừng nhận mutation mới và chờ mutation đang chạy kết thúc đến khi ctx hết hạn.
+// Hết hạn thì flush BulkProcessor còn hàng đợi (tối đa SHUTDOWN_FLUSH_TIMEOUT) rồi ghi các channel
+// chưa hoàn tất xuống file, trả về lỗi kèm số mutation bị ngắt.
+func (l *MutationLifecycle) Shutdown(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	timeStart := time.Now()
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+
+	if l.waitIdle(ctx) {
+		slog.Info("mutations drained", LOG_KEY_OP, "Shutdown", LOG_KEY_DURATION, time.Since(timeStart))
+		return nil
+	}
+	l.flushActive()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	runs := make([]*MutationRun, 0, len(l.active))
+	for id, run := range l.active {
+		runs = append(runs, run)
+		delete(l.active, id)
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	for _, run := range runs {
+		l.recordLocked(run, "interrupted by shutdown")
+	}
+	if err := l.saveLocked(); err != nil {
+		return err
+	}
+	slog.Warn("mutations interrupted by shutdown", LOG_KEY_OP, "Shutdown", LOG_KEY_COUNT, len(runs), "path", l.path)
+	return fmt.Errorf("shutdown interrupted %d mutations, recorded in %s", len(runs), l.path)
+}
+
+// waitIdle chờ đến khi không còn mutation nào chạy, false nếu ctx hết hạn trước.
+func (l *MutationLifecycle) waitIdle(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		n, changed := len(l.active), l.changed
+		l.mu.Unlock()
+		if n == 0 {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// flushActive flush BulkProcessor của các mutation còn chạy để request đã xếp hàng không bị mất.
+func (l *MutationLifecycle) flushActive() {
+	l.mu.Lock()
+	runs := make([]*MutationRun, 0, len(l.active))
+	for _, run := range l.active {
+		runs = append(runs, run)
+	}
+	l.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for _, run := range runs {
+			wg.Add(1)
+			go func(run *MutationRun) {
+				defer wg.Done()
+				run.mu.Lock()
+				defer run.mu.Unlock()
+				for _, bp := range run.bps {
+					_ = bp.Flush()
+				}
+			}(run)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(SHUTDOWN_FLUSH_TIMEOUT):
+		slog.Warn("flush bulk processors timed out", LOG_KEY_OP, "Shutdown", LOG_KEY_COUNT, len(runs))
+	}
+}
+
+// Interrupted danh sách mutation bị ngắt chưa được sửa, sắp theo channel.
+func (l *MutationLifecycle) Interrupted() []InterruptedMutationDO {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := append([]InterruptedMutationDO(nil), l.interrupted...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].ChannelID < out[j].ChannelID })
+	return out
+}
+
+// Repair sửa các channel có mutation bị ngắt: chạy lại outbox entry chưa xong của channel,
+// đánh dấu client phải tải lại toàn bộ (reload dở có thể đã xoá một phần participants),
+// ghi lại Redis theo ES và xoá bộ đếm. Channel sửa xong được gỡ khỏi danh sách,
+// channel lỗi giữ lại kèm lỗi để thử lại lần sau. Trả về kết quả của từng channel.
+func (l *MutationLifecycle) Repair(store *ChannelParticipantsStore) ([]InterruptedMutationDO, error) {
+	list := l.Interrupted()
+	if len(list) == 0 {
+		return nil, nil
+	}
+	timeStart := time.Now()
+	reconciler := NewReconciler(store.es, store.cache)
+
+	errs := map[int32]error{}
+	for _, m := range list {
+		if _, ok := errs[m.ChannelID]; !ok {
+			errs[m.ChannelID] = repairChannel(store, reconciler, m.ChannelID)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	kept := l.interrupted[:0]
+	for i := range list {
+		if err := errs[list[i].ChannelID]; err != nil {
+			list[i].Error = err.Error()
+		} else {
+			list[i].Error, list[i].RepairedAt = "", now
+		}
+	}
+	for _, m := range l.interrupted {
+		err, ok := errs[m.ChannelID]
+		if !ok || err != nil {
+			if err != nil {
+				m.Error = err.Error()
+			}
+			kept = append(kept, m)
+		}
+	}
+	l.interrupted = kept
+	if err := l.saveLocked(); err != nil {
+		return list, err
+	}
+	logCompleted(store.es.Logger(), "RepairInterrupted", timeStart, "channels", len(errs), "remaining", len(kept))
+	return list, nil
+}
+
+func repairChannel(store *ChannelParticipantsStore, reconciler *Reconciler, channelID int32) error {
+	for _, entry := range store.outbox.List("") {
+		if entry.ChannelID != channelID || entry.Status == OUTBOX_STATUS_DONE {
+			continue
+		}
+		if err := store.relay.Replay(entry.ID); err != nil {
+			return fmt.Errorf("replay outbox entry %s failed: %w", entry.ID, err)
+		}
+	}
+	if err := store.es.MarkResync(channelID); err != nil {
+		return err
+	}
+	if _, err := reconciler.Check(channelID, true); err != nil {
+		return err
+	}
+	return store.cache.InvalidateStats(channelID)
+}
+
+// recordLocked ghi các channel của run vào danh sách bị ngắt, bỏ qua nếu đã có cùng channel / op / thời điểm bắt đầu.
+func (l *MutationLifecycle) recordLocked(run *MutationRun, reason string) {
+	now := time.Now().Unix()
+	for _, channelID := range run.channelIDs {
+		m := InterruptedMutationDO{
+			ChannelID:     channelID,
+			Op:            run.op,
+			StartedAt:     run.startedAt.Unix(),
+			InterruptedAt: now,
+			Error:         reason,
+		}
+		dup := false
+		for _, cur := range l.interrupted {
+			if cur.ChannelID == m.ChannelID && cur.Op == m.Op && cur.StartedAt == m.StartedAt {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			l.interrupted = append(l.interrupted, m)
+		}
+	}
+}
+
+// resolveLocked gỡ bản ghi của mutation đã hoàn tất sau khi bị ghi lại.
+func (l *MutationLifecycle) resolveLocked(op string, channelIDs []int32, startedAt int64) {
+	kept := l.interrupted[:0]
+	for _, m := range l.interrupted {
+		if m.Op == op && m.StartedAt == startedAt && slices.Contains(channelIDs, m.ChannelID) {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	l.interrupted = kept
+}
+
+// saveLogged như saveLocked, lỗi chỉ được log vì người gọi không trả lỗi về được.
+func (l *MutationLifecycle) saveLogged() {
+	if err := l.saveLocked(); err != nil {
+		slog.Warn("save interrupted mutations failed", LOG_KEY_OP, "MutationLifecycle", "path", l.path, LOG_KEY_ERROR, err)
+	}
+}
+
+// saveLocked ghi danh sách qua file tạm + rename, danh sách rỗng thì xoá file.
+func (l *MutationLifecycle) saveLocked() error {
+	if l.path == "" {
+		return nil
+	}
+	if len(l.interrupted) == 0 {
+		if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove interrupted mutations failed: %w", err)
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(l.interrupted, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("create interrupted mutations tmp failed: %w", err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write interrupted mutations tmp failed: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync interrupted mutations tmp failed: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return fmt.Errorf("rename interrupted mutations failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package repo
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	OUTBOX_OP_SAVE_ALL = "save_all" // reload toàn bộ participants của channel
+	OUTBOX_OP_UPSERT   = "upsert"   // thêm / cập nhật participants
+	OUTBOX_OP_DELETE   = "delete"   // xoá participants
+	OUTBOX_OP_ACTION   = "action"   // leave / kick / ban / unban / rejoin
+	OUTBOX_OP_RIGHTS   = "rights"   // bật / tắt bit quyền admin / banned
+
+	OUTBOX_BACKEND_ELASTIC   = "elastic"
+	OUTBOX_BACKEND_REDIS_SET = "redis_set" // channel:<id>:participants
+	OUTBOX_BACKEND_REDIS_STR = "redis_str" // channel:<id>:participants:str
+	OUTBOX_BACKEND_USER_IDX  = "user_idx"  // user:<uid>:channels
+	OUTBOX_BACKEND_STATS     = "stats"     // channel:<id>:stats
+
+	OUTBOX_STATUS_PENDING = "pending"
+	OUTBOX_STATUS_DONE    = "done"
+	OUTBOX_STATUS_FAILED  = "failed"
+)
+
+// Thứ tự áp dụng: elastic trước để có version mới, sau đó mới tới Redis.
+var outboxBackends = []string{OUTBOX_BACKEND_ELASTIC, OUTBOX_BACKEND_REDIS_SET, OUTBOX_BACKEND_REDIS_STR, OUTBOX_BACKEND_USER_IDX, OUTBOX_BACKEND_STATS}
+
+// OutboxEntry một mutation dự định áp dụng lên ES và Redis.
+// ID đồng thời là idempotency key khi áp dụng lên từng backend.
+type OutboxEntry struct {
+	ID             string                         `json:"id"`
+	ChannelID      int32                          `json:"channel_id"`
+	Op             string                         `json:"op"`
+	Version        int32                          `json:"version"`
+	Docs           []ElasticChannelParticipantsDO `json:"docs,omitempty"`
+	UserIDs        []int32                        `json:"user_ids,omitempty"`
+	Removed        []int32                        `json:"removed,omitempty"` // save_all: user có trước khi reset nhưng không còn trong Docs
+	Action         *ParticipantActionDO           `json:"action,omitempty"`
+	Rights         *RightsUpdateDO                `json:"rights,omitempty"`
+	Status         string                         `json:"status"`
+	Applied        map[string]bool                `json:"applied,omitempty"`
+	AppliedVersion int32                          `json:"applied_version,omitempty"`
+	Attempts       int                            `json:"attempts"`
+	LastError      string                         `json:"last_error,omitempty"`
+	CreatedAt      int64                          `json:"created_at"`
+	UpdatedAt      int64                          `json:"updated_at"`
+}
+
+// Users danh sách user bị ảnh hưởng bởi mutation.
+func (o *OutboxEntry) Users() []int32 {
+	if len(o.UserIDs) > 0 || len(o.Docs) == 0 {
+		return o.UserIDs
+	}
+	out := make([]int32, 0, len(o.Docs))
+	for _, d := range o.Docs {
+		out = append(out, d.UserID)
+	}
+	return out
+}
+
+// splitUsers tách user còn trong nhóm (thêm vào Redis) và user đã rời / bị xoá (gỡ khỏi Redis).
+func (o *OutboxEntry) splitUsers() (active []int32, inactive []int32) {
+	switch o.Op {
+	case OUTBOX_OP_DELETE:
+		return nil, o.UserIDs
+	case OUTBOX_OP_ACTION:
+		switch {
+		case o.Action.AddsMember():
+			return o.UserIDs, nil
+		case o.Action.RemovesMember():
+			return nil, o.UserIDs
+		}
+		return nil, nil
+	case OUTBOX_OP_RIGHTS:
+		// đổi quyền không làm thay đổi membership
+		return nil, nil
+	}
+	for i := range o.Docs {
+		if IsActiveParticipant(&o.Docs[i]) {
+			active = append(active, o.Docs[i].UserID)
+		} else {
+			inactive = append(inactive, o.Docs[i].UserID)
+		}
+	}
+	return active, inactive
+}
+
+// pendingUsers tách user đang chờ duyệt (thêm vào channel:<id>:pending) và user không còn chờ (gỡ khỏi pending).
+func (o *OutboxEntry) pendingUsers() (pending []int32, resolved []int32) {
+	switch o.Op {
+	case OUTBOX_OP_DELETE, OUTBOX_OP_ACTION:
+		// mọi action (approve, decline, leave, ban, ...) đều kết thúc trạng thái chờ duyệt
+		return nil, o.UserIDs
+	case OUTBOX_OP_RIGHTS:
+		return nil, nil
+	}
+	for i := range o.Docs {
+		if DeriveState(participantData(&o.Docs[i])) == PARTICIPANT_STATE_WAITING_APPROVAL {
+			pending = append(pending, o.Docs[i].UserID)
+		} else {
+			resolved = append(resolved, o.Docs[i].UserID)
+		}
+	}
+	return pending, resolved
+}
+
+func (o *OutboxEntry) clone() *OutboxEntry {
+	cp := *o
+	cp.Applied = make(map[string]bool, len(o.Applied))
+	for k, v := range o.Applied {
+		cp.Applied[k] = v
+	}
+	return &cp
+}
+
+func NewOutboxEntry(channelID int32, op string, version int32) *OutboxEntry {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	now := time.Now().Unix()
+	return &OutboxEntry{
+		ID:        fmt.Sprintf("%d-%d-%s", channelID, time.Now().UnixNano(), hex.EncodeToString(b)),
+		ChannelID: channelID,
+		Op:        op,
+		Version:   version,
+		Status:    OUTBOX_STATUS_PENDING,
+		Applied:   map[string]bool{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// Outbox lưu bền các mutation trước khi áp dụng.
+type Outbox interface {
+	Save(entry *OutboxEntry) error
+	Get(id string) (*OutboxEntry, bool)
+	List(status string) []*OutboxEntry // status = "" để lấy tất cả
+	Compact() error
+	Close() error
+}
+
+// -------------------------------------------------------------------------------------------
+// FileOutbox: file append-only. Lần Save đầu của entry ghi snapshot JSON đầy đủ, các lần sau chỉ ghi
+// dòng delta (status / applied / attempts ...) để không ghi lại Docs sau mỗi bước. Entry done không giữ Docs
+// trong bộ nhớ, file được compact tự động khi vượt OUTBOX_COMPACT_SIZE.
+type FileOutbox struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	entries  map[string]*OutboxEntry
+	size     int64 // kích thước file hiện tại
+	liveSize int64 // kích thước file sau lần compact gần nhất
+}
+
+// OUTBOX_COMPACT_SIZE file lớn hơn ngưỡng này (và gấp đôi kích thước sau lần compact trước) thì tự compact.
+const OUTBOX_COMPACT_SIZE = 64 << 20
+
+// outboxDelta dòng cập nhật trạng thái của entry đã ghi snapshot trước đó.
+type outboxDelta struct {
+	ID             string          `json:"id"`
+	Delta          bool            `json:"delta"`
+	Status         string          `json:"status"`
+	Applied        map[string]bool `json:"applied,omitempty"`
+	AppliedVersion int32           `json:"applied_version,omitempty"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	UpdatedAt      int64           `json:"updated_at"`
+}
+
+func newOutboxDelta(entry *OutboxEntry) *outboxDelta {
+	return &outboxDelta{
+		ID:             entry.ID,
+		Delta:          true,
+		Status:         entry.Status,
+		Applied:        entry.Applied,
+		AppliedVersion: entry.AppliedVersion,
+		Attempts:       entry.Attempts,
+		LastError:      entry.LastError,
+		UpdatedAt:      entry.UpdatedAt,
+	}
+}
+
+// apply cập nhật entry trong bộ nhớ theo delta, entry done bỏ Docs để không giữ mãi trong bộ nhớ.
+func (d *outboxDelta) apply(entry *OutboxEntry) {
+	entry.Status = d.Status
+	entry.Applied = make(map[string]bool, len(d.Applied))
+	for k, v := range d.Applied {
+		entry.Applied[k] = v
+	}
+	entry.AppliedVersion = d.AppliedVersion
+	entry.Attempts = d.Attempts
+	entry.LastError = d.LastError
+	entry.UpdatedAt = d.UpdatedAt
+	if entry.Status == OUTBOX_STATUS_DONE {
+		entry.Docs = nil
+	}
+}
+
+func OpenFileOutbox(path string) (*FileOutbox, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open outbox failed: %w", err)
+	}
+
+	o := &FileOutbox{path: path, f: f, entries: map[string]*OutboxEntry{}}
+
+	// Đọc lại toàn bộ file, dòng ghi dở (crash giữa chừng) sẽ bị cắt bỏ
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var good int64
+	for {
+		var line json.RawMessage
+		err := dec.Decode(&line)
+		var delta outboxDelta
+		if err == nil {
+			err = json.Unmarshal(line, &delta)
+		}
+		var entry OutboxEntry
+		if err == nil && !delta.Delta {
+			err = json.Unmarshal(line, &entry)
+		}
+		if err != nil {
+			if err != io.EOF {
+				slog.Warn("bỏ phần ghi dở của outbox", LOG_KEY_OP, "OpenFileOutbox", "path", path, "offset", good, LOG_KEY_ERROR, err)
+			}
+			break
+		}
+		good = dec.InputOffset()
+		if !delta.Delta {
+			if entry.Status == OUTBOX_STATUS_DONE {
+				entry.Docs = nil
+			}
+			o.entries[entry.ID] = &entry
+		} else if cur, ok := o.entries[delta.ID]; ok {
+			delta.apply(cur)
+		}
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("truncate outbox failed: %w", err)
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("seek outbox failed: %w", err)
+	}
+	o.size, o.liveSize = good, good
+	return o, nil
+}
+
+func (o *FileOutbox) Save(entry *OutboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry.UpdatedAt = time.Now().Unix()
+	cur, exists := o.entries[entry.ID]
+	var line any = entry
+	if exists {
+		line = newOutboxDelta(entry)
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("marshal outbox entry failed: %w", err)
+	}
+	b = append(b, '\n')
+	if _, err := o.f.Write(b); err != nil {
+		return fmt.Errorf("write outbox failed: %w", err)
+	}
+	if err := o.f.Sync(); err != nil {
+		return fmt.Errorf("sync outbox failed: %w", err)
+	}
+	o.size += int64(len(b))
+
+	if exists {
+		newOutboxDelta(entry).apply(cur)
+	} else {
+		stored := entry.clone()
+		if stored.Status == OUTBOX_STATUS_DONE {
+			stored.Docs = nil
+		}
+		o.entries[entry.ID] = stored
+	}
+
+	if o.size >= OUTBOX_COMPACT_SIZE && o.size >= 2*o.liveSize {
+		if err := o.compactLocked(); err != nil {
+			// entry đã được ghi bền, compact lỗi thì lần Save sau thử lại
+			slog.Warn("auto compact outbox failed", LOG_KEY_OP, "FileOutbox.Save", "path", o.path, LOG_KEY_ERROR, err)
+		}
+	}
+	return nil
+}
+
+func (o *FileOutbox) Get(id string) (*OutboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry, ok := o.entries[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.clone(), true
+}
+
+func (o *FileOutbox) List(status string) []*OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	out := make([]*OutboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		if status != "" && entry.Status != status {
+			continue
+		}
+		out = append(out, entry.clone())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CreatedAt != out[j].CreatedAt {
+			return out[i].CreatedAt < out[j].CreatedAt
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Compact ghi lại file chỉ với các entry chưa xong (pending / failed).
+func (o *FileOutbox) Compact() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.compactLocked()
+}
+
+func (o *FileOutbox) compactLocked() error {
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("create outbox tmp failed: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for id, entry := range o.entries {
+		if entry.Status == OUTBOX_STATUS_DONE {
+			delete(o.entries, id)
+			continue
+		}
+		if err := enc.Encode(entry); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write outbox tmp failed: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("flush outbox tmp failed: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync outbox tmp failed: %w", err)
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		tmp.Close()
+		return fmt.Errorf("rename outbox failed: %w", err)
+	}
+
+	o.f.Close()
+	o.f = tmp
+	size, err := o.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seek outbox failed: %w", err)
+	}
+	o.size, o.liveSize = size, size
+	return nil
+}
+
+func (o *FileOutbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f.Close()
+}
@@ -0,0 +1,395 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	OUTBOX_MAX_ATTEMPTS = 5 // số lần thử tối đa cho mỗi backend trước khi đánh dấu failed
+)
+
+// OutboxRelay đọc entry từ outbox và áp dụng lần lượt lên từng backend.
+// Backend nào đã áp dụng thành công sẽ được đánh dấu để lần chạy lại bỏ qua.
+type OutboxRelay struct {
+	outbox  Outbox
+	es      *ElasticChannelParticipantsDAO
+	cache   *ChannelParticipantsCacheDAO
+	backoff elastic.Backoff
+}
+
+func NewOutboxRelay(outbox Outbox, es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:  outbox,
+		es:      es,
+		cache:   cache,
+		backoff: elastic.NewExponentialBackoff(200*time.Millisecond, 5*time.Second),
+	}
+}
+
+// Process áp dụng một entry lên tất cả backend chưa xong, có retry.
+func (r *OutboxRelay) Process(entry *OutboxEntry) error {
+	return r.process(entry, false)
+}
+
+// process áp dụng entry, replay = true khi chạy lại entry pending / failed: các bước Redis lấy membership
+// từ document hiện tại trên ES thay vì snapshot trong entry, vì entry mới hơn có thể đã áp dụng sau đó.
+func (r *OutboxRelay) process(entry *OutboxEntry, replay bool) error {
+	if entry.Applied == nil {
+		entry.Applied = map[string]bool{}
+	}
+
+	for _, backend := range outboxBackends {
+		if entry.Applied[backend] {
+			continue
+		}
+
+		var err error
+		for retry := 0; retry < OUTBOX_MAX_ATTEMPTS; retry++ {
+			entry.Attempts++
+			if err = r.apply(backend, entry, replay); err == nil {
+				break
+			}
+			r.es.Logger().Warn("outbox apply failed", LOG_KEY_OP, "OutboxRelay.Process", LOG_KEY_CHANNEL_ID, entry.ChannelID,
+				"entry", entry.ID, "backend", backend, "attempt", retry+1, LOG_KEY_ERROR, err)
+			if retry == OUTBOX_MAX_ATTEMPTS-1 || !retryableOutboxError(err) {
+				break
+			}
+
+			wait, ok := r.backoff.Next(retry)
+			if !ok {
+				break
+			}
+			time.Sleep(wait)
+			r.es.Metrics().IncRetry(backend, "outbox_"+entry.Op)
+		}
+
+		if err != nil {
+			entry.Status = OUTBOX_STATUS_FAILED
+			entry.LastError = fmt.Sprintf("%s: %v", backend, err)
+			if saveErr := r.outbox.Save(entry); saveErr != nil {
+				return fmt.Errorf("save outbox entry failed: %w", saveErr)
+			}
+			return fmt.Errorf("outbox %s apply %s failed: %w", entry.ID, backend, err)
+		}
+
+		entry.Applied[backend] = true
+		entry.LastError = ""
+		if err := r.outbox.Save(entry); err != nil {
+			return fmt.Errorf("save outbox entry failed: %w", err)
+		}
+	}
+
+	entry.Status = OUTBOX_STATUS_DONE
+	return r.outbox.Save(entry)
+}
+
+// retryableOutboxError chỉ thử lại lỗi tạm thời của backend (unavailable / timeout).
+// Lỗi dữ liệu, not found, đang tắt hoặc người gọi đã huỷ thì đánh dấu failed ngay để không chặn người gọi.
+func retryableOutboxError(err error) bool {
+	if errors.Is(err, ErrShuttingDown) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// Replay chạy lại một entry pending / failed theo ID.
+func (r *OutboxRelay) Replay(id string) error {
+	entry, ok := r.outbox.Get(id)
+	if !ok {
+		return notFoundf("outbox entry %s not found", id)
+	}
+	if entry.Status == OUTBOX_STATUS_DONE {
+		return nil
+	}
+	entry.Status = OUTBOX_STATUS_PENDING
+	return r.process(entry, true)
+}
+
+// ReplayAll chạy lại mọi entry có status tương ứng, trả về số entry xử lý thành công.
+func (r *OutboxRelay) ReplayAll(status string) (int, error) {
+	done := 0
+	for _, entry := range r.outbox.List(status) {
+		if entry.Status == OUTBOX_STATUS_DONE {
+			continue
+		}
+		entry.Status = OUTBOX_STATUS_PENDING
+		if err := r.process(entry, true); err != nil {
+			return done, err
+		}
+		done++
+	}
+	return done, nil
+}
+
+// apply áp dụng entry lên một backend. Các bước Redis giữ khoá cache của channel
+// để không xen vào giữa lúc reconciler / rehydrate / rebuild stats dựng lại key từ ES.
+func (r *OutboxRelay) apply(backend string, entry *OutboxEntry, replay bool) error {
+	if backend == OUTBOX_BACKEND_ELASTIC {
+		return r.applyElastic(entry)
+	}
+	unlock, err := r.cache.LockChannelCache(entry.ChannelID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	switch backend {
+	case OUTBOX_BACKEND_REDIS_SET:
+		return r.applyRedisSet(entry, replay)
+	case OUTBOX_BACKEND_REDIS_STR:
+		return r.applyRedisString(entry, replay)
+	case OUTBOX_BACKEND_USER_IDX:
+		return r.applyUserIndex(entry, replay)
+	case OUTBOX_BACKEND_STATS:
+		return r.applyStats(entry, replay)
+	}
+	return invalidInputf("unknown backend %s", backend)
+}
+
+func (r *OutboxRelay) applyElastic(entry *OutboxEntry) error {
+	es := r.es.WithIdempotencyKey(entry.ID)
+
+	var err error
+	switch entry.Op {
+	case OUTBOX_OP_SAVE_ALL:
+		err = es.SaveAllUsers(entry.ChannelID, entry.Version, entry.Docs)
+	case OUTBOX_OP_UPSERT:
+		err = es.AddDataToCache(entry.ChannelID, entry.Version, entry.Docs)
+	case OUTBOX_OP_DELETE:
+		err = es.DeleteUsers(entry.ChannelID, entry.Version, entry.UserIDs)
+	case OUTBOX_OP_ACTION:
+		err = es.ApplyAction(entry.ChannelID, entry.Version, entry.Action, entry.UserIDs)
+	case OUTBOX_OP_RIGHTS:
+		err = es.UpdateRights(entry.ChannelID, entry.Version, entry.Rights, entry.UserIDs)
+	default:
+		err = invalidInputf("unknown op %s", entry.Op)
+	}
+	if err != nil {
+		return err
+	}
+
+	meta, err := es.GetVersion(entry.ChannelID)
+	if err != nil {
+		return err
+	}
+	entry.AppliedVersion = meta.Version
+	return nil
+}
+
+func (r *OutboxRelay) applyRedisSet(entry *OutboxEntry, replay bool) error {
+	m, err := r.membership(entry, replay)
+	if err != nil {
+		return err
+	}
+	active, inactive, pending, resolved := m.active, m.inactive, m.pending, m.resolved
+
+	switch {
+	case entry.Op == OUTBOX_OP_SAVE_ALL:
+		if err := r.cache.SaveAllData(entry.ChannelID, active); err != nil {
+			return err
+		}
+		if err := r.cache.SavePending(entry.ChannelID, pending); err != nil {
+			return err
+		}
+	case entry.Op == OUTBOX_OP_ACTION && entry.Action.Action == PARTICIPANT_ACTION_APPROVE:
+		// user được duyệt chuyển thẳng từ pending sang participants
+		if err := r.cache.ApprovePending(entry.ChannelID, active); err != nil {
+			return err
+		}
+	case entry.Op == OUTBOX_OP_UPSERT, entry.Op == OUTBOX_OP_DELETE, entry.Op == OUTBOX_OP_ACTION, entry.Op == OUTBOX_OP_RIGHTS:
+		if err := r.cache.AddUsers(entry.ChannelID, active); err != nil {
+			return err
+		}
+		if err := r.cache.DeleteUsers(entry.ChannelID, inactive); err != nil {
+			return err
+		}
+		if err := r.cache.AddPending(entry.ChannelID, pending); err != nil {
+			return err
+		}
+		if err := r.cache.RemovePending(entry.ChannelID, resolved); err != nil {
+			return err
+		}
+	default:
+		return invalidInputf("unknown op %s", entry.Op)
+	}
+	if entry.AppliedVersion > 0 {
+		return r.cache.SetVersion(entry.ChannelID, entry.AppliedVersion)
+	}
+	return nil
+}
+
+func (r *OutboxRelay) applyRedisString(entry *OutboxEntry, replay bool) error {
+	m, err := r.membership(entry, replay)
+	if err != nil {
+		return err
+	}
+	active, inactive := m.active, m.inactive
+
+	switch entry.Op {
+	case OUTBOX_OP_SAVE_ALL:
+		return r.cache.SaveString(entry.ChannelID, active)
+	case OUTBOX_OP_UPSERT, OUTBOX_OP_DELETE, OUTBOX_OP_ACTION, OUTBOX_OP_RIGHTS:
+		if len(active) > 0 {
+			if err := r.cache.AddUsersString(entry.ChannelID, active); err != nil {
+				return err
+			}
+		}
+		if len(inactive) > 0 {
+			return r.cache.DeleteString(entry.ChannelID, inactive)
+		}
+		return nil
+	}
+	return invalidInputf("unknown op %s", entry.Op)
+}
+
+// applyUserIndex cập nhật reverse index user:<uid>:channels theo state mới của từng user.
+// Action / rights không mang document nên đọc lại state từ ES (đã được áp dụng ở bước trước).
+func (r *OutboxRelay) applyUserIndex(entry *OutboxEntry, replay bool) error {
+	docs, removed, err := r.entryDocs(entry, replay)
+	if err != nil {
+		return err
+	}
+	now := int32(time.Now().Unix())
+	channels := make(map[int32]UserChannelDO, len(docs))
+	for uid, doc := range docs {
+		channels[uid] = NewUserChannel(doc, now)
+	}
+	if err := r.cache.SetUserChannelStates(entry.ChannelID, channels); err != nil {
+		return err
+	}
+	return r.cache.RemoveUserChannel(entry.ChannelID, removed)
+}
+
+func (r *OutboxRelay) applyStats(entry *OutboxEntry, replay bool) error {
+	if replay && entry.Op == OUTBOX_OP_SAVE_ALL {
+		// reset theo snapshot cũ sẽ làm mất thay đổi mới hơn, xoá bộ đếm để lần đọc sau dựng lại từ ES
+		return r.cache.InvalidateStats(entry.ChannelID)
+	}
+	docs, removed, err := r.entryDocs(entry, replay)
+	if err != nil {
+		return err
+	}
+	masks := make(map[int32]int32, len(docs)+len(removed))
+	for uid, doc := range docs {
+		masks[uid] = StatsMask(doc)
+	}
+	for _, uid := range removed {
+		masks[uid] = 0
+	}
+	if entry.Op == OUTBOX_OP_SAVE_ALL {
+		return r.cache.ReplaceStats(entry.ChannelID, masks)
+	}
+	return r.cache.ApplyStats(entry.ChannelID, masks, false)
+}
+
+// entryMembership user cần thêm / gỡ khỏi channel:<id>:participants (active / inactive)
+// và khỏi channel:<id>:pending (pending / resolved).
+type entryMembership struct {
+	active, inactive  []int32
+	pending, resolved []int32
+}
+
+// membership tách user của entry theo membership. Lần chạy đầu dùng dữ liệu trong entry,
+// replay đọc lại document hiện tại trên ES; save_all khi replay lấy toàn bộ channel từ ES.
+func (r *OutboxRelay) membership(entry *OutboxEntry, replay bool) (*entryMembership, error) {
+	m := &entryMembership{}
+	if !replay {
+		m.active, m.inactive = entry.splitUsers()
+		m.pending, m.resolved = entry.pendingUsers()
+		return m, nil
+	}
+
+	if entry.Op == OUTBOX_OP_SAVE_ALL {
+		m.active, m.pending = []int32{}, []int32{}
+		err := r.es.ScrollActiveUserIDs(entry.ChannelID, func(ids []int32) error {
+			m.active = append(m.active, ids...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = r.es.ScrollPendingUserIDs(entry.ChannelID, func(ids []int32) error {
+			m.pending = append(m.pending, ids...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	docs, removed, err := r.entryDocs(entry, true)
+	if err != nil {
+		return nil, err
+	}
+	for uid, doc := range docs {
+		if IsActiveParticipant(doc) {
+			m.active = append(m.active, uid)
+		} else {
+			m.inactive = append(m.inactive, uid)
+		}
+		if DeriveState(participantData(doc)) == PARTICIPANT_STATE_WAITING_APPROVAL {
+			m.pending = append(m.pending, uid)
+		} else {
+			m.resolved = append(m.resolved, uid)
+		}
+	}
+	m.inactive = append(m.inactive, removed...)
+	m.resolved = append(m.resolved, removed...)
+	return m, nil
+}
+
+// entryDocs document sau mutation của các user bị ảnh hưởng và danh sách user đã bị xoá khỏi channel.
+// action / rights chỉ lưu tham số nên đọc lại document từ ES (backend elastic đã áp dụng trước),
+// replay = true thì mọi op đều đọc lại từ ES để không ghi đè trạng thái mới hơn bằng snapshot cũ.
+func (r *OutboxRelay) entryDocs(entry *OutboxEntry, replay bool) (map[int32]*ElasticChannelParticipantsDO, []int32, error) {
+	docs := map[int32]*ElasticChannelParticipantsDO{}
+	var removed []int32
+
+	if replay {
+		userIDs := slices.Concat(entry.Users(), entry.Removed)
+		current, err := r.es.GetParticipants(entry.ChannelID, userIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, uid := range userIDs {
+			if doc, ok := current[uid]; ok {
+				docs[uid] = doc
+			} else {
+				removed = append(removed, uid)
+			}
+		}
+		return docs, removed, nil
+	}
+
+	switch entry.Op {
+	case OUTBOX_OP_SAVE_ALL, OUTBOX_OP_UPSERT:
+		for i := range entry.Docs {
+			docs[entry.Docs[i].UserID] = &entry.Docs[i]
+		}
+		removed = entry.Removed
+	case OUTBOX_OP_DELETE:
+		removed = entry.UserIDs
+	case OUTBOX_OP_ACTION, OUTBOX_OP_RIGHTS:
+		current, err := r.es.GetParticipants(entry.ChannelID, entry.UserIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, uid := range entry.UserIDs {
+			if doc, ok := current[uid]; ok {
+				docs[uid] = doc
+			} else {
+				removed = append(removed, uid)
+			}
+		}
+	default:
+		return nil, nil, invalidInputf("unknown op %s", entry.Op)
+	}
+	return docs, removed, nil
+}
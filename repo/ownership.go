@@ -0,0 +1,233 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// CreatorViolationDO channel không có đúng một creator.
+type CreatorViolationDO struct {
+	ChannelID int32 `json:"channel_id"`
+	Members   int64 `json:"members"`  // số participant đang active
+	Creators  int64 `json:"creators"` // số participant có is_creator = 1
+}
+
+// GetCreatorIDs danh sách user_id có is_creator = 1 của channel (bình thường chỉ có một).
+func (e *ElasticChannelParticipantsDAO) GetCreatorIDs(channelID int32) (_ []int32, err error) {
+	e, span := e.startSpan("GetCreatorIDs", attrChannel(channelID))
+	defer e.observe(span, "GetCreatorIDs", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
+	if e == nil || e.client == nil {
+		return nil, errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return nil, errEmptyIndex
+	}
+
+	q := elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("channel_id", channelID),
+			elastic.NewTermQuery("is_creator", 1),
+		)
+	res, err := e.client.Search().
+		Index(indexName).
+		Query(q).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("user_id")).
+		Size(100).
+		Routing(strconv.Itoa(int(channelID))).
+		Do(e.Context())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, elasticError("search creators failed", err)
+	}
+
+	ids := make([]int32, 0, len(res.Hits.Hits))
+	for _, h := range res.Hits.Hits {
+		var doc struct {
+			UserID int32 `json:"user_id"`
+		}
+		if err := json.Unmarshal(h.Source, &doc); err != nil {
+			continue
+		}
+		ids = append(ids, doc.UserID)
+	}
+	return ids, nil
+}
+
+// ScanCreatorViolations quét toàn bộ channel_participants_* bằng composite aggregation theo channel_id,
+// gọi fn cho mỗi channel có participant active nhưng không có hoặc có nhiều hơn một creator.
+func (e *ElasticChannelParticipantsDAO) ScanCreatorViolations(ctx context.Context, fn func(v CreatorViolationDO) error) (_ int, err error) {
+	e, span := e.WithContext(ctx).startSpan("ScanCreatorViolations")
+	defer e.observe(span, "ScanCreatorViolations", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return 0, err
+	}
+	ctx = e.Context()
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return 0, errElasticNil
+	}
+
+	scanned := 0
+	var after map[string]interface{}
+	for {
+		agg := elastic.NewCompositeAggregation().
+			Size(1000).
+			Sources(elastic.NewCompositeAggregationTermsValuesSource("channel_id").Field("channel_id")).
+			SubAggregation("creators", elastic.NewFilterAggregation().Filter(elastic.NewTermQuery("is_creator", 1)))
+		if after != nil {
+			agg = agg.AggregateAfter(after)
+		}
+
+		res, err := e.client.Search().
+			Index("channel_participants_*").
+			Query(activeParticipantsFilter()).
+			Size(0).
+			Aggregation("by_channel", agg).
+			Do(ctx)
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return scanned, nil
+			}
+			return scanned, elasticError("scan creators failed", err)
+		}
+
+		items, ok := res.Aggregations.Composite("by_channel")
+		if !ok || len(items.Buckets) == 0 {
+			break
+		}
+		for _, b := range items.Buckets {
+			scanned++
+			var creators int64
+			if c, ok := b.Aggregations.Filter("creators"); ok {
+				creators = c.DocCount
+			}
+			if creators == 1 {
+				continue
+			}
+			cid, _ := b.Key["channel_id"].(float64)
+			if err := fn(CreatorViolationDO{ChannelID: int32(cid), Members: b.DocCount, Creators: creators}); err != nil {
+				return scanned, err
+			}
+		}
+		if items.AfterKey == nil {
+			break
+		}
+		after = items.AfterKey
+	}
+
+	logTiming(e.Logger(), "ScanCreatorViolations", timeStart, "channels", scanned)
+	return scanned, nil
+}
+
+// TransferOwnership chuyển quyền creator từ from sang to trong một lần ghi (một entry outbox, một version):
+// to trở thành creator với toàn bộ quyền admin, from trở thành admin đầy đủ quyền.
+func (s *ChannelParticipantsStore) TransferOwnership(channelID int32, fromUserID int32, toUserID int32) error {
+	if fromUserID == toUserID {
+		return invalidInputf("transfer ownership: from and to are the same user %d", fromUserID)
+	}
+	unlock, err := s.lockCreators(channelID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := s.es.GetParticipants(channelID, []int32{fromUserID, toUserID})
+	if err != nil {
+		return err
+	}
+	fromDoc, ok := current[fromUserID]
+	if !ok || DeriveState(participantData(fromDoc)) != PARTICIPANT_STATE_CREATOR {
+		return invalidInputf("transfer ownership: user %d is not the creator of channel %d", fromUserID, channelID)
+	}
+	toDoc, ok := current[toUserID]
+	if !ok {
+		return notFoundf("transfer ownership: user %d is not a participant of channel %d", toUserID, channelID)
+	}
+	if state := DeriveState(participantData(toDoc)); state != PARTICIPANT_STATE_MEMBER && state != PARTICIPANT_STATE_ADMIN {
+		return invalidInputf("transfer ownership: user %d is %s, must be member or admin", toUserID, state)
+	}
+
+	now := int32(time.Now().Unix())
+	updatedAt := time.Unix(int64(now), 0).Format(time.RFC3339)
+
+	from := *participantData(fromDoc)
+	from.IsCreator, from.AdminRights = 0, int32(ADMIN_RIGHTS_ALL)
+	from.PromotedBy, from.PromotedAt = toUserID, now
+	from.State, from.UpdatedAt = int8(PARTICIPANT_STATE_UNKNOWN), updatedAt
+
+	to := *participantData(toDoc)
+	to.IsCreator, to.AdminRights = 1, int32(ADMIN_RIGHTS_ALL)
+	to.PromotedBy, to.PromotedAt = fromUserID, now
+	to.State, to.UpdatedAt = int8(PARTICIPANT_STATE_UNKNOWN), updatedAt
+
+	return s.upsert(channelID, -1, []ElasticChannelParticipantsDO{{Data: &from}, {Data: &to}})
+}
+
+// lockCreators giữ khoá creator của channel (xem LockChannelCreators), người gọi phải gọi hàm nhả khoá trả về.
+// Redis không dùng được thì vẫn cho ghi để mutation không phụ thuộc cache, channel lệch creator
+// khi đó sẽ được lệnh scan báo lại.
+func (s *ChannelParticipantsStore) lockCreators(channelID int32) (func(), error) {
+	unlock, err := s.cache.LockChannelCreators(channelID)
+	if errors.Is(err, ErrUnavailable) {
+		s.es.Logger().Warn("creator lock unavailable, validating without lock", LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_ERROR, err)
+		return func() {}, nil
+	}
+	return unlock, err
+}
+
+// validateCreators kiểm tra sau khi ghi docs channel vẫn có đúng một creator, gọi trong lockCreators.
+// reset = true (SaveAll) thì docs là toàn bộ channel, ngược lại docs được gộp với creator hiện có trên ES.
+// Channel vốn chưa có creator (dữ liệu cũ) không bị chặn khi ghi, chỉ bị báo bởi lệnh scan.
+func (s *ChannelParticipantsStore) validateCreators(channelID int32, docs []ElasticChannelParticipantsDO, reset bool) error {
+	creators := map[int32]bool{}
+	hadCreator := false
+	if !reset {
+		existing, err := s.es.GetCreatorIDs(channelID)
+		if err != nil {
+			return err
+		}
+		for _, uid := range existing {
+			creators[uid] = true
+		}
+		hadCreator = len(existing) > 0
+	}
+
+	active := 0
+	for i := range docs {
+		delete(creators, docs[i].UserID)
+		if docs[i].IsCreator == 1 {
+			creators[docs[i].UserID] = true
+		}
+		if IsActiveParticipant(&docs[i]) {
+			active++
+		}
+	}
+	if reset {
+		hadCreator = active > 0
+	}
+
+	if len(creators) > 1 {
+		ids := make([]int, 0, len(creators))
+		for uid := range creators {
+			ids = append(ids, int(uid))
+		}
+		sort.Ints(ids)
+		return invalidInputf("channel %d would have %d creators %v, use TransferOwnership", channelID, len(ids), ids)
+	}
+	if len(creators) == 0 && hadCreator {
+		return invalidInputf("channel %d would have no creator, use TransferOwnership", channelID)
+	}
+	return nil
+}
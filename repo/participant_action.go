@@ -0,0 +1,358 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	PARTICIPANT_ACTION_LEAVE  = "leave"  // user tự rời nhóm
+	PARTICIPANT_ACTION_KICK   = "kick"   // bị kick, được phép vào lại
+	PARTICIPANT_ACTION_BAN    = "ban"    // bị kick + cấm quyền tới BannedUntilDate (0 = vĩnh viễn)
+	PARTICIPANT_ACTION_UNBAN  = "unban"  // gỡ cấm, user vẫn ở ngoài nhóm cho tới khi rejoin
+	PARTICIPANT_ACTION_REJOIN = "rejoin" // vào lại nhóm sau khi rời / bị kick
+
+	PARTICIPANT_ACTION_APPROVE = "approve" // duyệt yêu cầu tham gia, user trở thành member
+	PARTICIPANT_ACTION_DECLINE = "decline" // từ chối yêu cầu tham gia, user được đánh dấu đã rời
+)
+
+// ParticipantActionDO thao tác nghiệp vụ trên participant, thay cho việc xoá cứng document.
+type ParticipantActionDO struct {
+	Action          string `json:"action"`
+	ActorID         int32  `json:"actor_id,omitempty"`
+	BannedRights    int32  `json:"banned_rights,omitempty"`
+	BannedUntilDate int32  `json:"banned_until_date,omitempty"`
+}
+
+// RemovesMember user bị gỡ khỏi các key Redis sau thao tác.
+func (a *ParticipantActionDO) RemovesMember() bool {
+	switch a.Action {
+	case PARTICIPANT_ACTION_LEAVE, PARTICIPANT_ACTION_KICK, PARTICIPANT_ACTION_BAN:
+		return true
+	}
+	return false
+}
+
+// AddsMember user được thêm lại vào các key Redis sau thao tác.
+func (a *ParticipantActionDO) AddsMember() bool {
+	return a.Action == PARTICIPANT_ACTION_REJOIN || a.Action == PARTICIPANT_ACTION_APPROVE
+}
+
+// ResolvesJoinRequest action chỉ áp dụng cho user đang chờ duyệt.
+func (a *ParticipantActionDO) ResolvesJoinRequest() bool {
+	return a.Action == PARTICIPANT_ACTION_APPROVE || a.Action == PARTICIPANT_ACTION_DECLINE
+}
+
+// fields trả về các field cần ghi ở top-level và trong data (tên field của ChannelParticipantsDO).
+func (a *ParticipantActionDO) fields(now int32) (map[string]interface{}, map[string]interface{}, error) {
+	top := map[string]interface{}{}
+	data := map[string]interface{}{}
+
+	switch a.Action {
+	case PARTICIPANT_ACTION_LEAVE:
+		top["is_left"], top["left_at"] = 1, now
+		data["IsLeft"], data["LeftAt"] = 1, now
+		clearAdmin(top, data)
+	case PARTICIPANT_ACTION_KICK:
+		top["is_kicked"] = 1
+		data["IsKicked"], data["KickedBy"], data["KickedAt"] = 1, a.ActorID, now
+		clearAdmin(top, data)
+	case PARTICIPANT_ACTION_BAN:
+		if a.BannedRights == 0 {
+			return nil, nil, invalidInputf("ban requires banned rights")
+		}
+		clearAdmin(top, data)
+		top["is_kicked"], top["banned_rights"], top["banned_until_date"] = 1, a.BannedRights, a.BannedUntilDate
+		data["IsKicked"], data["KickedBy"], data["KickedAt"] = 1, a.ActorID, now
+		data["BannedRights"], data["BannedUntilDate"], data["BannedAt"] = a.BannedRights, a.BannedUntilDate, now
+	case PARTICIPANT_ACTION_UNBAN:
+		top["banned_rights"], top["banned_until_date"] = 0, 0
+		data["BannedRights"], data["BannedUntilDate"] = 0, 0
+	case PARTICIPANT_ACTION_REJOIN:
+		top["is_left"], top["is_kicked"] = 0, 0
+		data["IsLeft"], data["IsKicked"], data["JoinedAt"] = 0, 0, now
+	case PARTICIPANT_ACTION_APPROVE:
+		data["IsWaitingAprrove"], data["JoinedAt"] = 0, now
+	case PARTICIPANT_ACTION_DECLINE:
+		top["is_left"], top["left_at"] = 1, now
+		data["IsWaitingAprrove"], data["IsLeft"], data["LeftAt"] = 0, 1, now
+	default:
+		return nil, nil, invalidInputf("unknown participant action %q", a.Action)
+	}
+	data["UpdatedAt"] = time.Unix(int64(now), 0).Format(time.RFC3339)
+	return top, data, nil
+}
+
+// clearAdmin user rời khỏi nhóm thì mất quyền admin / creator và rank.
+func clearAdmin(top, data map[string]interface{}) {
+	top["is_creator"], top["admin_rights"] = 0, 0
+	data["IsCreator"], data["AdminRights"], data["Rank"] = 0, 0, ""
+}
+
+// participantFieldsScript ghi đè các field ở top-level và trong data của document participant,
+// sau đó tính lại data.State theo các cờ mới.
+func participantFieldsScript(top, data map[string]interface{}) *elastic.Script {
+	return elastic.NewScript(`
+		for (entry in params.top.entrySet()) {
+			ctx._source[entry.getKey()] = entry.getValue();
+		}
+		if (ctx._source.data != null) {
+			for (entry in params.data.entrySet()) {
+				ctx._source.data[entry.getKey()] = entry.getValue();
+			}
+		}
+	`+deriveStatePainless).
+		Param("top", top).
+		Param("data", data)
+}
+
+// newBulkProcessor tạo BulkProcessor với cấu hình chung của DAO.
+// op là nhãn metrics của BulkProcessor, name là tên riêng (có thể chứa channel id).
+func (e *ElasticChannelParticipantsDAO) newBulkProcessor(ctx context.Context, op string, name string, after elastic.BulkAfterFunc) (*elastic.BulkProcessor, error) {
+	s := e.client.BulkProcessor().
+		Name(name).
+		Workers(3).                                                                 // số goroutine xử lý bulk song song
+		BulkActions(4000).                                                          // tối đa 4000 req/batch
+		BulkSize(15 << 20).                                                         // tối đa 15MB/batch
+		FlushInterval(1 * time.Second).                                             // auto flush sau 1s nếu chưa đủ batch
+		Backoff(elastic.NewExponentialBackoff(200*time.Millisecond, 1*time.Second)) // retry backoff
+	bp, err := e.Metrics().instrumentBulk(s, op, after).Do(ctx)
+	if err != nil {
+		return nil, elasticError("start bulk processor failed", err)
+	}
+	return bp, nil
+}
+
+// scriptUpdateUsers chạy cùng một script update cho document của từng user qua BulkProcessor,
+// trả về danh sách user thực sự được cập nhật. Document không tồn tại được tính là lỗi.
+func (e *ElasticChannelParticipantsDAO) scriptUpdateUsers(ctx context.Context, channelID int32, name string, script *elastic.Script, userIDs []int32) (_ []int32, err error) {
+	run, err := e.lifecycle.beginIn(ctx, name, channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { run.End(err) }()
+
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	route := strconv.Itoa(int(channelID))
+
+	userByID := make(map[string]int32, len(userIDs))
+	for _, uid := range userIDs {
+		userByID[GetParicipantID(channelID, uid)] = uid
+	}
+	var (
+		mu       sync.Mutex
+		changed  []int32
+		failures []string
+	)
+
+	bp, err := e.newBulkProcessor(ctx, name, fmt.Sprintf("bp-channel-%s-%d", name, channelID),
+		func(execID int64, reqs []elastic.BulkableRequest, resp *elastic.BulkResponse, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, err.Error())
+				return
+			}
+			if resp == nil {
+				return
+			}
+			for _, item := range resp.Items {
+				for _, r := range item {
+					if r.Error != nil {
+						failures = append(failures, fmt.Sprintf("%s: %s", r.Id, r.Error.Reason))
+						continue
+					}
+					if r.Result == "updated" {
+						changed = append(changed, userByID[r.Id])
+					}
+				}
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer bp.Close()
+	run.Track(bp)
+	defer run.Untrack(bp)
+
+	for _, uid := range userIDs {
+		req := elastic.NewBulkUpdateRequest().
+			Index(indexName).
+			Id(GetParicipantID(channelID, uid)).
+			Routing(route).
+			Script(script).
+			RetryOnConflict(3)
+		bp.Add(req)
+	}
+	if err := bp.Flush(); err != nil {
+		return nil, elasticError("bulk flush failed", err)
+	}
+	if len(failures) > 0 {
+		return nil, newPartialFailure(name, len(userIDs), failures)
+	}
+	return changed, nil
+}
+
+// ApplyAction thực hiện leave / kick / ban / unban / rejoin cho danh sách user:
+// cập nhật cả field top-level lẫn data, không xoá document để giữ lịch sử.
+// Đặt version = -1 để tự động tăng, version = 0 để bỏ qua.
+func (e *ElasticChannelParticipantsDAO) ApplyAction(channelID int32, version int32, action *ParticipantActionDO, userIDs []int32) (err error) {
+	e, span := e.startSpan("ApplyAction", attrChannel(channelID), attrCount(len(userIDs)))
+	defer e.observe(span, "ApplyAction", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return errEmptyIndex
+	}
+	if len(userIDs) == 0 {
+		return invalidInputf("listUserID empty")
+	}
+	top, data, err := action.fields(int32(time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+
+	ctx := e.Context()
+	changed, err := e.scriptUpdateUsers(ctx, channelID, action.Action, participantFieldsScript(top, data), userIDs)
+	if err != nil {
+		return err
+	}
+
+	// Ghi change log theo ảnh hưởng lên membership
+	change := ElasticChannelChangeDO{}
+	switch {
+	case action.RemovesMember():
+		change.Removed = changed
+	case action.AddsMember():
+		change.Added = changed
+	default:
+		change.Updated = changed
+	}
+	if err := e.bumpVersionWithChange(ctx, channelID, version, change); err != nil {
+		return elasticError(fmt.Sprintf("set version after %s failed", action.Action), err)
+	}
+
+	if _, err := e.client.Refresh(indexName).Do(ctx); err != nil {
+		return elasticError("refresh failed", err)
+	}
+	logCompleted(e.Logger(), "ApplyAction", timeStart, "action", action.Action, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs), "changed", len(changed))
+	return nil
+}
+
+// PurgeDeparted là thao tác retention: xoá cứng document của user đã rời / bị kick trước thời điểm before.
+// User đang bị ban (còn hạn hoặc vĩnh viễn) được giữ lại để không mất thông tin cấm.
+// Chỉ xoá trong userIDs (lấy từ ScrollDepartedUserIDs) và kiểm tra lại điều kiện ngay lúc xoá, user join lại
+// giữa chừng không bị xoá. Trả về user thực sự đã bị xoá, version tăng kèm change record removed.
+func (e *ElasticChannelParticipantsDAO) PurgeDeparted(channelID int32, before int32, userIDs []int32) (_ []int32, err error) {
+	e, span := e.startSpan("PurgeDeparted", attrChannel(channelID), attrCount(len(userIDs)))
+	defer e.observe(span, "PurgeDeparted", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return nil, errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return nil, errEmptyIndex
+	}
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	ctx := e.Context()
+	now := int32(time.Now().Unix())
+
+	const chunkSize = 1000
+	for i := 0; i < len(userIDs); i += chunkSize {
+		part := userIDs[i:min(i+chunkSize, len(userIDs))]
+		terms := make([]interface{}, len(part))
+		for j, uid := range part {
+			terms[j] = uid
+		}
+
+		resp, err := e.client.DeleteByQuery(indexName).
+			Query(departedQuery(channelID, before, now).Filter(elastic.NewTermsQuery("user_id", terms...))).
+			Routing(strconv.Itoa(int(channelID))).
+			Conflicts("proceed").
+			Refresh("true").
+			WaitForCompletion(true).
+			Do(ctx)
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, elasticError("purge departed failed", err)
+		}
+		if resp == nil {
+			return nil, fmt.Errorf("purge departed: empty response")
+		}
+		if len(resp.Failures) > 0 {
+			return nil, newPartialFailure("purge departed", int(resp.Total), deleteByQueryFailures(resp))
+		}
+	}
+
+	// document còn lại là user đã join lại (không còn khớp query / bị ghi xen vào nên conflict)
+	remaining, err := e.GetParticipants(channelID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]int32, 0, len(userIDs))
+	for _, uid := range userIDs {
+		if _, ok := remaining[uid]; !ok {
+			removed = append(removed, uid)
+		}
+	}
+	if len(removed) > 0 {
+		if err := e.bumpVersionWithChange(ctx, channelID, -1, ElasticChannelChangeDO{Removed: removed}); err != nil {
+			return removed, err
+		}
+	}
+
+	logCompleted(e.Logger(), "PurgeDeparted", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(removed), "kept", len(userIDs)-len(removed))
+	return removed, nil
+}
+
+// departedQuery user đã rời / bị kick trước before và không còn bị ban tại now.
+func departedQuery(channelID int32, before int32, now int32) *elastic.BoolQuery {
+	departed := elastic.NewBoolQuery().
+		Should(
+			elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("is_left", 1),
+				elastic.NewRangeQuery("left_at").Lt(before),
+			),
+			elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("is_kicked", 1),
+				elastic.NewRangeQuery("data.KickedAt").Lt(before),
+			),
+		).
+		MinimumShouldMatch("1")
+	return elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("channel_id", channelID),
+			departed,
+		).
+		MustNot(bannedAtQuery(now))
+}
+
+// ScrollDepartedUserIDs duyệt user sẽ bị PurgeDeparted xoá, dùng để dọn các index phụ trước khi xoá.
+func (e *ElasticChannelParticipantsDAO) ScrollDepartedUserIDs(channelID int32, before int32, fn func(userIDs []int32) error) (err error) {
+	e, span := e.startSpan("ScrollDepartedUserIDs", attrChannel(channelID))
+	defer e.observe(span, "ScrollDepartedUserIDs", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	return e.scrollUserIDs(channelID, departedQuery(channelID, before, int32(time.Now().Unix())), fn)
+}
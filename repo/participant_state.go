@@ -0,0 +1,279 @@
+package repo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParticipantState trạng thái vòng đời của participant, lưu ở ChannelParticipantsDO.State.
+// 0 = chưa xác định (dữ liệu cũ), khi đó state được suy ra từ các cờ.
+type ParticipantState int8
+
+const (
+	PARTICIPANT_STATE_UNKNOWN ParticipantState = iota
+	PARTICIPANT_STATE_INVITED
+	PARTICIPANT_STATE_WAITING_APPROVAL
+	PARTICIPANT_STATE_MEMBER
+	PARTICIPANT_STATE_ADMIN
+	PARTICIPANT_STATE_CREATOR
+	PARTICIPANT_STATE_RESTRICTED // còn trong nhóm nhưng bị giới hạn quyền
+	PARTICIPANT_STATE_BANNED     // bị kick và cấm quay lại
+	PARTICIPANT_STATE_LEFT
+	PARTICIPANT_STATE_KICKED // bị kick, được phép vào lại
+)
+
+var participantStateNames = map[ParticipantState]string{
+	PARTICIPANT_STATE_UNKNOWN:          "unknown",
+	PARTICIPANT_STATE_INVITED:          "invited",
+	PARTICIPANT_STATE_WAITING_APPROVAL: "waiting_approval",
+	PARTICIPANT_STATE_MEMBER:           "member",
+	PARTICIPANT_STATE_ADMIN:            "admin",
+	PARTICIPANT_STATE_CREATOR:          "creator",
+	PARTICIPANT_STATE_RESTRICTED:       "restricted",
+	PARTICIPANT_STATE_BANNED:           "banned",
+	PARTICIPANT_STATE_LEFT:             "left",
+	PARTICIPANT_STATE_KICKED:           "kicked",
+}
+
+func (s ParticipantState) String() string {
+	if name, ok := participantStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state(%d)", int8(s))
+}
+
+// IsActive participant đang ở trong nhóm (có mặt trong các key Redis).
+func (s ParticipantState) IsActive() bool {
+	switch s {
+	case PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_RESTRICTED:
+		return true
+	}
+	return false
+}
+
+// participantTransitions các chuyển trạng thái hợp lệ. Giữ nguyên state (cập nhật thông tin) luôn hợp lệ.
+var participantTransitions = map[ParticipantState][]ParticipantState{
+	PARTICIPANT_STATE_UNKNOWN: {
+		PARTICIPANT_STATE_INVITED, PARTICIPANT_STATE_WAITING_APPROVAL, PARTICIPANT_STATE_MEMBER,
+		PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_RESTRICTED,
+		PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_KICKED,
+	},
+	PARTICIPANT_STATE_INVITED: {
+		PARTICIPANT_STATE_WAITING_APPROVAL, PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_LEFT,
+		PARTICIPANT_STATE_KICKED, PARTICIPANT_STATE_BANNED,
+	},
+	PARTICIPANT_STATE_WAITING_APPROVAL: {
+		PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_BANNED,
+	},
+	PARTICIPANT_STATE_MEMBER: {
+		PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_RESTRICTED,
+		PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_KICKED,
+	},
+	PARTICIPANT_STATE_ADMIN: {
+		PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_BANNED,
+		PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_KICKED,
+	},
+	PARTICIPANT_STATE_CREATOR: {
+		PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_LEFT,
+	},
+	PARTICIPANT_STATE_RESTRICTED: {
+		PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_KICKED,
+	},
+	PARTICIPANT_STATE_BANNED: {
+		PARTICIPANT_STATE_KICKED, // unban
+	},
+	PARTICIPANT_STATE_LEFT: {
+		PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_INVITED, PARTICIPANT_STATE_WAITING_APPROVAL, PARTICIPANT_STATE_BANNED,
+	},
+	PARTICIPANT_STATE_KICKED: {
+		PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_INVITED, PARTICIPANT_STATE_WAITING_APPROVAL, PARTICIPANT_STATE_BANNED,
+	},
+}
+
+// CanTransition kiểm tra có được chuyển từ from sang to hay không.
+func CanTransition(from, to ParticipantState) bool {
+	if from == to {
+		return true
+	}
+	for _, s := range participantTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// DeriveState suy ra state từ các cờ của participant.
+func DeriveState(p *ChannelParticipantsDO) ParticipantState {
+	switch {
+	case p.IsKicked == 1 && p.BannedRights != 0:
+		return PARTICIPANT_STATE_BANNED
+	case p.IsKicked == 1:
+		return PARTICIPANT_STATE_KICKED
+	case p.IsLeft == 1:
+		return PARTICIPANT_STATE_LEFT
+	case p.IsWaitingAprrove == 1:
+		return PARTICIPANT_STATE_WAITING_APPROVAL
+	case p.JoinedAt == 0 && p.InvitedAt != 0:
+		return PARTICIPANT_STATE_INVITED
+	case p.IsCreator == 1:
+		return PARTICIPANT_STATE_CREATOR
+	case p.AdminRights != 0:
+		return PARTICIPANT_STATE_ADMIN
+	case p.BannedRights != 0:
+		return PARTICIPANT_STATE_RESTRICTED
+	}
+	return PARTICIPANT_STATE_MEMBER
+}
+
+// ValidateParticipant từ chối các tổ hợp cờ mâu thuẫn nhau.
+func ValidateParticipant(p *ChannelParticipantsDO) error {
+	if p == nil {
+		return invalidInputf("participant is nil")
+	}
+
+	var errs []string
+	check := func(bad bool, msg string) {
+		if bad {
+			errs = append(errs, msg)
+		}
+	}
+
+	active := p.IsLeft == 0 && p.IsKicked == 0 && p.IsWaitingAprrove == 0 && !(p.JoinedAt == 0 && p.InvitedAt != 0)
+	check(p.IsCreator != 0 && p.IsCreator != 1, "is_creator must be 0 or 1")
+	check(p.IsLeft == 1 && p.IsKicked == 1, "participant cannot be both left and kicked")
+	check(p.IsWaitingAprrove == 1 && (p.IsLeft == 1 || p.IsKicked == 1), "waiting approval participant cannot be left or kicked")
+	check(!active && p.IsCreator == 1, "creator must be an active member")
+	check(!active && p.AdminRights != 0, "admin rights require an active member")
+	check(!active && p.Rank != "", "rank requires an active member")
+	check(p.IsCreator == 0 && p.AdminRights == 0 && p.Rank != "", "rank requires admin or creator")
+	check(p.BannedRights != 0 && (p.IsCreator == 1 || p.AdminRights != 0), "admin or creator cannot be restricted")
+	check(p.BannedRights == 0 && p.BannedUntilDate != 0, "banned_until_date requires banned rights")
+
+	if len(errs) == 0 && p.State != int8(PARTICIPANT_STATE_UNKNOWN) {
+		derived := DeriveState(p)
+		check(ParticipantState(p.State) != derived,
+			fmt.Sprintf("state %s does not match flags (%s)", ParticipantState(p.State), derived))
+	}
+
+	if len(errs) > 0 {
+		return invalidInputf("invalid participant channel=%d user=%d: %s", p.ChannelID, p.UserID, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// NewElasticParticipant dựng document ES từ dữ liệu chuẩn (ChannelParticipantsDO):
+// các field top-level và State đều được suy ra, không nhận giá trị tuỳ ý từ caller.
+func NewElasticParticipant(p *ChannelParticipantsDO) ElasticChannelParticipantsDO {
+	p.State = int8(DeriveState(p))
+	return ElasticChannelParticipantsDO{
+		ID:                p.ID,
+		ChannelID:         p.ChannelID,
+		UserID:            p.UserID,
+		IsCreator:         p.IsCreator,
+		AdminRights:       p.AdminRights,
+		ParticipantType:   p.ParticipantType,
+		HiddenParticipant: p.HiddenParticipant,
+		IsLeft:            p.IsLeft,
+		LeftAt:            p.LeftAt,
+		IsKicked:          p.IsKicked,
+		BannedRights:      p.BannedRights,
+		BannedUntilDate:   p.BannedUntilDate,
+		Data:              p,
+	}
+}
+
+// participantData trả về dữ liệu chuẩn của document, dựng từ field top-level nếu thiếu Data.
+func participantData(doc *ElasticChannelParticipantsDO) *ChannelParticipantsDO {
+	if doc.Data != nil {
+		return doc.Data
+	}
+	return &ChannelParticipantsDO{
+		ID:                doc.ID,
+		ChannelID:         doc.ChannelID,
+		UserID:            doc.UserID,
+		IsCreator:         doc.IsCreator,
+		AdminRights:       doc.AdminRights,
+		ParticipantType:   doc.ParticipantType,
+		HiddenParticipant: doc.HiddenParticipant,
+		IsLeft:            doc.IsLeft,
+		LeftAt:            doc.LeftAt,
+		IsKicked:          doc.IsKicked,
+		BannedRights:      doc.BannedRights,
+		BannedUntilDate:   doc.BannedUntilDate,
+	}
+}
+
+// TargetState state của participant đang ở trạng thái from sau khi thực hiện action.
+func (a *ParticipantActionDO) TargetState(from ParticipantState) ParticipantState {
+	switch a.Action {
+	case PARTICIPANT_ACTION_LEAVE:
+		return PARTICIPANT_STATE_LEFT
+	case PARTICIPANT_ACTION_KICK:
+		return PARTICIPANT_STATE_KICKED
+	case PARTICIPANT_ACTION_BAN:
+		return PARTICIPANT_STATE_BANNED
+	case PARTICIPANT_ACTION_UNBAN:
+		switch from {
+		case PARTICIPANT_STATE_BANNED:
+			return PARTICIPANT_STATE_KICKED
+		case PARTICIPANT_STATE_RESTRICTED:
+			return PARTICIPANT_STATE_MEMBER
+		}
+		return from
+	case PARTICIPANT_ACTION_REJOIN:
+		if from.IsActive() {
+			return from
+		}
+		return PARTICIPANT_STATE_MEMBER
+	case PARTICIPANT_ACTION_APPROVE:
+		return PARTICIPANT_STATE_MEMBER
+	case PARTICIPANT_ACTION_DECLINE:
+		return PARTICIPANT_STATE_LEFT
+	}
+	return PARTICIPANT_STATE_UNKNOWN
+}
+
+// ValidateTransitions kiểm tra mọi participant hiện có (current) được phép chuyển sang state mới (next).
+// User chưa có trong current được coi như state UNKNOWN.
+func ValidateTransitions(current map[int32]*ElasticChannelParticipantsDO, next func(userID int32, from ParticipantState) ParticipantState, userIDs []int32) error {
+	var errs []string
+	for _, uid := range userIDs {
+		from := PARTICIPANT_STATE_UNKNOWN
+		if doc, ok := current[uid]; ok {
+			from = DeriveState(participantData(doc))
+		}
+		to := next(uid, from)
+		if !CanTransition(from, to) {
+			errs = append(errs, fmt.Sprintf("user %d: %s -> %s", uid, from, to))
+		}
+	}
+	if len(errs) > 0 {
+		if len(errs) > 5 {
+			errs = append(errs[:5], fmt.Sprintf("... (%d more)", len(errs)-5))
+		}
+		return invalidInputf("invalid participant transitions: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// deriveStatePainless tính lại data.State theo các cờ, giống DeriveState. Dùng sau mỗi scripted update.
+var deriveStatePainless = fmt.Sprintf(`
+		def d = ctx._source.data;
+		if (d != null) {
+			int s;
+			if (d.IsKicked == 1 && d.BannedRights != 0) { s = %d; }
+			else if (d.IsKicked == 1) { s = %d; }
+			else if (d.IsLeft == 1) { s = %d; }
+			else if (d.IsWaitingAprrove == 1) { s = %d; }
+			else if (d.JoinedAt == 0 && d.InvitedAt != 0) { s = %d; }
+			else if (d.IsCreator == 1) { s = %d; }
+			else if (d.AdminRights != 0) { s = %d; }
+			else if (d.BannedRights != 0) { s = %d; }
+			else { s = %d; }
+			d.State = s;
+		}
+`,
+	PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_KICKED, PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_WAITING_APPROVAL,
+	PARTICIPANT_STATE_INVITED, PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_RESTRICTED,
+	PARTICIPANT_STATE_MEMBER)
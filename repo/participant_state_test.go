@@ -0,0 +1,200 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to ParticipantState
+		want     bool
+	}{
+		{PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_MEMBER, true},
+		{PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_BANNED, true},
+		{PARTICIPANT_STATE_UNKNOWN, PARTICIPANT_STATE_CREATOR, true},
+		{PARTICIPANT_STATE_UNKNOWN, PARTICIPANT_STATE_BANNED, true},
+		{PARTICIPANT_STATE_INVITED, PARTICIPANT_STATE_MEMBER, true},
+		{PARTICIPANT_STATE_INVITED, PARTICIPANT_STATE_ADMIN, false},
+		{PARTICIPANT_STATE_WAITING_APPROVAL, PARTICIPANT_STATE_MEMBER, true},
+		{PARTICIPANT_STATE_WAITING_APPROVAL, PARTICIPANT_STATE_KICKED, false},
+		{PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_ADMIN, true},
+		{PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_INVITED, false},
+		{PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_RESTRICTED, false},
+		{PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_ADMIN, true},
+		{PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_KICKED, false},
+		{PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_BANNED, false},
+		{PARTICIPANT_STATE_RESTRICTED, PARTICIPANT_STATE_MEMBER, true},
+		{PARTICIPANT_STATE_RESTRICTED, PARTICIPANT_STATE_ADMIN, false},
+		{PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_KICKED, true},
+		{PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_MEMBER, false},
+		{PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_MEMBER, true},
+		{PARTICIPANT_STATE_LEFT, PARTICIPANT_STATE_ADMIN, false},
+		{PARTICIPANT_STATE_KICKED, PARTICIPANT_STATE_WAITING_APPROVAL, true},
+		{PARTICIPANT_STATE_KICKED, PARTICIPANT_STATE_LEFT, false},
+		{PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_UNKNOWN, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveState(t *testing.T) {
+	tests := []struct {
+		name string
+		p    ChannelParticipantsDO
+		want ParticipantState
+	}{
+		{"member", ChannelParticipantsDO{JoinedAt: 1}, PARTICIPANT_STATE_MEMBER},
+		{"joined after invite", ChannelParticipantsDO{InvitedAt: 1, JoinedAt: 2}, PARTICIPANT_STATE_MEMBER},
+		{"invited", ChannelParticipantsDO{InvitedAt: 1}, PARTICIPANT_STATE_INVITED},
+		{"waiting approval", ChannelParticipantsDO{IsWaitingAprrove: 1}, PARTICIPANT_STATE_WAITING_APPROVAL},
+		{"admin", ChannelParticipantsDO{AdminRights: 1}, PARTICIPANT_STATE_ADMIN},
+		{"creator", ChannelParticipantsDO{IsCreator: 1}, PARTICIPANT_STATE_CREATOR},
+		{"restricted", ChannelParticipantsDO{BannedRights: 1}, PARTICIPANT_STATE_RESTRICTED},
+		{"left", ChannelParticipantsDO{IsLeft: 1}, PARTICIPANT_STATE_LEFT},
+		{"kicked", ChannelParticipantsDO{IsKicked: 1}, PARTICIPANT_STATE_KICKED},
+		{"banned", ChannelParticipantsDO{IsKicked: 1, BannedRights: 1}, PARTICIPANT_STATE_BANNED},
+
+		// thứ tự ưu tiên khi nhiều cờ cùng bật
+		{"kicked beats left", ChannelParticipantsDO{IsKicked: 1, IsLeft: 1}, PARTICIPANT_STATE_KICKED},
+		{"banned beats creator", ChannelParticipantsDO{IsKicked: 1, BannedRights: 1, IsCreator: 1}, PARTICIPANT_STATE_BANNED},
+		{"left beats waiting", ChannelParticipantsDO{IsLeft: 1, IsWaitingAprrove: 1}, PARTICIPANT_STATE_LEFT},
+		{"waiting beats invited", ChannelParticipantsDO{IsWaitingAprrove: 1, InvitedAt: 1}, PARTICIPANT_STATE_WAITING_APPROVAL},
+		{"invited beats creator", ChannelParticipantsDO{InvitedAt: 1, IsCreator: 1}, PARTICIPANT_STATE_INVITED},
+		{"creator beats admin", ChannelParticipantsDO{IsCreator: 1, AdminRights: 1}, PARTICIPANT_STATE_CREATOR},
+		{"admin beats restricted", ChannelParticipantsDO{AdminRights: 1, BannedRights: 1}, PARTICIPANT_STATE_ADMIN},
+		{"left ignores banned rights", ChannelParticipantsDO{IsLeft: 1, BannedRights: 1}, PARTICIPANT_STATE_LEFT},
+
+		// State đã lưu không ảnh hưởng, state luôn suy ra từ cờ
+		{"stored state ignored", ChannelParticipantsDO{JoinedAt: 1, State: int8(PARTICIPANT_STATE_ADMIN)}, PARTICIPANT_STATE_MEMBER},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DeriveState(&tt.p); got != tt.want {
+				t.Errorf("DeriveState() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+var (
+	painlessBranch = regexp.MustCompile(`(?:else )?if \((.+)\) \{ s = (\d+); \}`)
+	painlessElse   = regexp.MustCompile(`^else \{ s = (\d+); \}`)
+	painlessCond   = regexp.MustCompile(`^d\.(\w+) (==|!=) (\d+)$`)
+)
+
+// evalDeriveStatePainless chạy các nhánh if / else của deriveStatePainless trên p (chỉ hỗ trợ so sánh
+// field với hằng số nối bằng &&, đủ cho script hiện tại).
+func evalDeriveStatePainless(t *testing.T, p *ChannelParticipantsDO) ParticipantState {
+	t.Helper()
+	v := reflect.ValueOf(p).Elem()
+	for _, line := range strings.Split(deriveStatePainless, "\n") {
+		line = strings.TrimSpace(line)
+		if m := painlessElse.FindStringSubmatch(line); m != nil {
+			s, _ := strconv.Atoi(m[1])
+			return ParticipantState(s)
+		}
+		m := painlessBranch.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		match := true
+		for _, cond := range strings.Split(m[1], " && ") {
+			c := painlessCond.FindStringSubmatch(strings.TrimSpace(cond))
+			if c == nil {
+				t.Fatalf("unsupported painless condition %q", cond)
+			}
+			f := v.FieldByName(c[1])
+			if !f.IsValid() {
+				t.Fatalf("painless field %s not in ChannelParticipantsDO", c[1])
+			}
+			want, _ := strconv.ParseInt(c[3], 10, 64)
+			if (f.Int() == want) != (c[2] == "==") {
+				match = false
+				break
+			}
+		}
+		if match {
+			s, _ := strconv.Atoi(m[2])
+			return ParticipantState(s)
+		}
+	}
+	t.Fatal("deriveStatePainless has no else branch")
+	return PARTICIPANT_STATE_UNKNOWN
+}
+
+// TestDeriveStatePainless script ES phải suy ra cùng state với DeriveState cho mọi tổ hợp cờ.
+func TestDeriveStatePainless(t *testing.T) {
+	flags := []func(p *ChannelParticipantsDO){
+		func(p *ChannelParticipantsDO) { p.IsKicked = 1 },
+		func(p *ChannelParticipantsDO) { p.IsLeft = 1 },
+		func(p *ChannelParticipantsDO) { p.IsWaitingAprrove = 1 },
+		func(p *ChannelParticipantsDO) { p.JoinedAt = 1 },
+		func(p *ChannelParticipantsDO) { p.InvitedAt = 1 },
+		func(p *ChannelParticipantsDO) { p.IsCreator = 1 },
+		func(p *ChannelParticipantsDO) { p.AdminRights = 1 },
+		func(p *ChannelParticipantsDO) { p.BannedRights = 1 },
+	}
+	for mask := 0; mask < 1<<len(flags); mask++ {
+		p := &ChannelParticipantsDO{}
+		for i, set := range flags {
+			if mask&(1<<i) != 0 {
+				set(p)
+			}
+		}
+		if got, want := evalDeriveStatePainless(t, p), DeriveState(p); got != want {
+			t.Errorf("flags %+v: painless = %s, DeriveState = %s", *p, got, want)
+		}
+	}
+}
+
+func TestValidateParticipant(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       *ChannelParticipantsDO
+		wantErr string // rỗng = hợp lệ
+	}{
+		{"member", &ChannelParticipantsDO{JoinedAt: 1}, ""},
+		{"admin with rank", &ChannelParticipantsDO{JoinedAt: 1, AdminRights: 1, Rank: "mod"}, ""},
+		{"creator with rank", &ChannelParticipantsDO{JoinedAt: 1, IsCreator: 1, Rank: "owner"}, ""},
+		{"restricted until", &ChannelParticipantsDO{JoinedAt: 1, BannedRights: 1, BannedUntilDate: 100}, ""},
+		{"banned", &ChannelParticipantsDO{IsKicked: 1, BannedRights: 1}, ""},
+		{"matching state", &ChannelParticipantsDO{IsLeft: 1, State: int8(PARTICIPANT_STATE_LEFT)}, ""},
+
+		{"nil", nil, "participant is nil"},
+		{"creator flag out of range", &ChannelParticipantsDO{IsCreator: 2}, "is_creator must be 0 or 1"},
+		{"left and kicked", &ChannelParticipantsDO{IsLeft: 1, IsKicked: 1}, "both left and kicked"},
+		{"waiting and left", &ChannelParticipantsDO{IsWaitingAprrove: 1, IsLeft: 1}, "waiting approval participant cannot be left or kicked"},
+		{"creator left", &ChannelParticipantsDO{IsLeft: 1, IsCreator: 1}, "creator must be an active member"},
+		{"invited admin", &ChannelParticipantsDO{InvitedAt: 1, AdminRights: 1}, "admin rights require an active member"},
+		{"rank of kicked", &ChannelParticipantsDO{IsKicked: 1, Rank: "x"}, "rank requires an active member"},
+		{"rank without admin", &ChannelParticipantsDO{JoinedAt: 1, Rank: "x"}, "rank requires admin or creator"},
+		{"restricted admin", &ChannelParticipantsDO{AdminRights: 1, BannedRights: 1}, "admin or creator cannot be restricted"},
+		{"until without rights", &ChannelParticipantsDO{BannedUntilDate: 100}, "banned_until_date requires banned rights"},
+		{"state mismatch", &ChannelParticipantsDO{JoinedAt: 1, State: int8(PARTICIPANT_STATE_ADMIN)}, "does not match flags"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateParticipant(tt.p)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+			}
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("error %v is not ErrInvalidInput", err)
+			}
+		})
+	}
+}
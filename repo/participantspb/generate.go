@@ -0,0 +1,4 @@
+// Package participantspb code sinh từ participants.proto (gRPC ChannelParticipants).
+package participantspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative participants.proto
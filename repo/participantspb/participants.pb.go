@@ -0,0 +1,980 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: participants.proto
+
+package participantspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// ChannelParticipant tương ứng với repo.ChannelParticipantsDO.
+type ChannelParticipant struct {
+	state                     protoimpl.MessageState `protogen:"open.v1"`
+	Id                        int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	ChannelId                 int32                  `protobuf:"varint,2,opt,name=channel_id,json=channelId,proto3" json:"channel_id,omitempty"`
+	UserId                    int32                  `protobuf:"varint,3,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	IsCreator                 int32                  `protobuf:"varint,4,opt,name=is_creator,json=isCreator,proto3" json:"is_creator,omitempty"`
+	ParticipantType           int32                  `protobuf:"varint,5,opt,name=participant_type,json=participantType,proto3" json:"participant_type,omitempty"`
+	InviterUserId             int32                  `protobuf:"varint,6,opt,name=inviter_user_id,json=inviterUserId,proto3" json:"inviter_user_id,omitempty"`
+	InvitedAt                 int32                  `protobuf:"varint,7,opt,name=invited_at,json=invitedAt,proto3" json:"invited_at,omitempty"`
+	JoinedAt                  int32                  `protobuf:"varint,8,opt,name=joined_at,json=joinedAt,proto3" json:"joined_at,omitempty"`
+	IsWaitingApprove          int32                  `protobuf:"varint,9,opt,name=is_waiting_approve,json=isWaitingApprove,proto3" json:"is_waiting_approve,omitempty"`
+	HiddenParticipant         int32                  `protobuf:"varint,10,opt,name=hidden_participant,json=hiddenParticipant,proto3" json:"hidden_participant,omitempty"`
+	IsLeft                    int32                  `protobuf:"varint,11,opt,name=is_left,json=isLeft,proto3" json:"is_left,omitempty"`
+	LeftAt                    int32                  `protobuf:"varint,12,opt,name=left_at,json=leftAt,proto3" json:"left_at,omitempty"`
+	IsKicked                  int32                  `protobuf:"varint,13,opt,name=is_kicked,json=isKicked,proto3" json:"is_kicked,omitempty"`
+	KickedBy                  int32                  `protobuf:"varint,14,opt,name=kicked_by,json=kickedBy,proto3" json:"kicked_by,omitempty"`
+	KickedAt                  int32                  `protobuf:"varint,15,opt,name=kicked_at,json=kickedAt,proto3" json:"kicked_at,omitempty"`
+	HiddenPrehistory          int32                  `protobuf:"varint,16,opt,name=hidden_prehistory,json=hiddenPrehistory,proto3" json:"hidden_prehistory,omitempty"`
+	HiddenPrehistoryMessageId int32                  `protobuf:"varint,17,opt,name=hidden_prehistory_message_id,json=hiddenPrehistoryMessageId,proto3" json:"hidden_prehistory_message_id,omitempty"`
+	AdminRights               int32                  `protobuf:"varint,18,opt,name=admin_rights,json=adminRights,proto3" json:"admin_rights,omitempty"`
+	PromotedBy                int32                  `protobuf:"varint,19,opt,name=promoted_by,json=promotedBy,proto3" json:"promoted_by,omitempty"`
+	PromotedAt                int32                  `protobuf:"varint,20,opt,name=promoted_at,json=promotedAt,proto3" json:"promoted_at,omitempty"`
+	Rank                      string                 `protobuf:"bytes,21,opt,name=rank,proto3" json:"rank,omitempty"`
+	BannedRights              int32                  `protobuf:"varint,22,opt,name=banned_rights,json=bannedRights,proto3" json:"banned_rights,omitempty"`
+	BannedUntilDate           int32                  `protobuf:"varint,23,opt,name=banned_until_date,json=bannedUntilDate,proto3" json:"banned_until_date,omitempty"`
+	BannedAt                  int32                  `protobuf:"varint,24,opt,name=banned_at,json=bannedAt,proto3" json:"banned_at,omitempty"`
+	ReadInboxMaxId            int32                  `protobuf:"varint,25,opt,name=read_inbox_max_id,json=readInboxMaxId,proto3" json:"read_inbox_max_id,omitempty"`
+	ReadOutboxMaxId           int32                  `protobuf:"varint,26,opt,name=read_outbox_max_id,json=readOutboxMaxId,proto3" json:"read_outbox_max_id,omitempty"`
+	Date                      int32                  `protobuf:"varint,27,opt,name=date,proto3" json:"date,omitempty"`
+	State                     int32                  `protobuf:"varint,28,opt,name=state,proto3" json:"state,omitempty"`
+	CreatedAt                 string                 `protobuf:"bytes,29,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	UpdatedAt                 string                 `protobuf:"bytes,30,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	unknownFields             protoimpl.UnknownFields
+	sizeCache                 protoimpl.SizeCache
+}
+
+func (x *ChannelParticipant) Reset() {
+	*x = ChannelParticipant{}
+	mi := &file_participants_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChannelParticipant) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChannelParticipant) ProtoMessage() {}
+
+func (x *ChannelParticipant) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChannelParticipant.ProtoReflect.Descriptor instead.
+func (*ChannelParticipant) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ChannelParticipant) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetChannelId() int32 {
+	if x != nil {
+		return x.ChannelId
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetUserId() int32 {
+	if x != nil {
+		return x.UserId
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetIsCreator() int32 {
+	if x != nil {
+		return x.IsCreator
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetParticipantType() int32 {
+	if x != nil {
+		return x.ParticipantType
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetInviterUserId() int32 {
+	if x != nil {
+		return x.InviterUserId
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetInvitedAt() int32 {
+	if x != nil {
+		return x.InvitedAt
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetJoinedAt() int32 {
+	if x != nil {
+		return x.JoinedAt
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetIsWaitingApprove() int32 {
+	if x != nil {
+		return x.IsWaitingApprove
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetHiddenParticipant() int32 {
+	if x != nil {
+		return x.HiddenParticipant
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetIsLeft() int32 {
+	if x != nil {
+		return x.IsLeft
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetLeftAt() int32 {
+	if x != nil {
+		return x.LeftAt
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetIsKicked() int32 {
+	if x != nil {
+		return x.IsKicked
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetKickedBy() int32 {
+	if x != nil {
+		return x.KickedBy
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetKickedAt() int32 {
+	if x != nil {
+		return x.KickedAt
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetHiddenPrehistory() int32 {
+	if x != nil {
+		return x.HiddenPrehistory
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetHiddenPrehistoryMessageId() int32 {
+	if x != nil {
+		return x.HiddenPrehistoryMessageId
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetAdminRights() int32 {
+	if x != nil {
+		return x.AdminRights
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetPromotedBy() int32 {
+	if x != nil {
+		return x.PromotedBy
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetPromotedAt() int32 {
+	if x != nil {
+		return x.PromotedAt
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetRank() string {
+	if x != nil {
+		return x.Rank
+	}
+	return ""
+}
+
+func (x *ChannelParticipant) GetBannedRights() int32 {
+	if x != nil {
+		return x.BannedRights
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetBannedUntilDate() int32 {
+	if x != nil {
+		return x.BannedUntilDate
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetBannedAt() int32 {
+	if x != nil {
+		return x.BannedAt
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetReadInboxMaxId() int32 {
+	if x != nil {
+		return x.ReadInboxMaxId
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetReadOutboxMaxId() int32 {
+	if x != nil {
+		return x.ReadOutboxMaxId
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetDate() int32 {
+	if x != nil {
+		return x.Date
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetState() int32 {
+	if x != nil {
+		return x.State
+	}
+	return 0
+}
+
+func (x *ChannelParticipant) GetCreatedAt() string {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return ""
+}
+
+func (x *ChannelParticipant) GetUpdatedAt() string {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return ""
+}
+
+type ChannelRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChannelId     int32                  `protobuf:"varint,1,opt,name=channel_id,json=channelId,proto3" json:"channel_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChannelRequest) Reset() {
+	*x = ChannelRequest{}
+	mi := &file_participants_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChannelRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChannelRequest) ProtoMessage() {}
+
+func (x *ChannelRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChannelRequest.ProtoReflect.Descriptor instead.
+func (*ChannelRequest) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ChannelRequest) GetChannelId() int32 {
+	if x != nil {
+		return x.ChannelId
+	}
+	return 0
+}
+
+// SaveParticipantsRequest version = -1 tự tăng, 0 không được chấp nhận.
+type SaveParticipantsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChannelId     int32                  `protobuf:"varint,1,opt,name=channel_id,json=channelId,proto3" json:"channel_id,omitempty"`
+	Version       int32                  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	Participants  []*ChannelParticipant  `protobuf:"bytes,3,rep,name=participants,proto3" json:"participants,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SaveParticipantsRequest) Reset() {
+	*x = SaveParticipantsRequest{}
+	mi := &file_participants_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SaveParticipantsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SaveParticipantsRequest) ProtoMessage() {}
+
+func (x *SaveParticipantsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SaveParticipantsRequest.ProtoReflect.Descriptor instead.
+func (*SaveParticipantsRequest) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SaveParticipantsRequest) GetChannelId() int32 {
+	if x != nil {
+		return x.ChannelId
+	}
+	return 0
+}
+
+func (x *SaveParticipantsRequest) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *SaveParticipantsRequest) GetParticipants() []*ChannelParticipant {
+	if x != nil {
+		return x.Participants
+	}
+	return nil
+}
+
+type DeleteUsersRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChannelId     int32                  `protobuf:"varint,1,opt,name=channel_id,json=channelId,proto3" json:"channel_id,omitempty"`
+	Version       int32                  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	UserIds       []int32                `protobuf:"varint,3,rep,packed,name=user_ids,json=userIds,proto3" json:"user_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteUsersRequest) Reset() {
+	*x = DeleteUsersRequest{}
+	mi := &file_participants_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteUsersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteUsersRequest) ProtoMessage() {}
+
+func (x *DeleteUsersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteUsersRequest.ProtoReflect.Descriptor instead.
+func (*DeleteUsersRequest) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *DeleteUsersRequest) GetChannelId() int32 {
+	if x != nil {
+		return x.ChannelId
+	}
+	return 0
+}
+
+func (x *DeleteUsersRequest) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *DeleteUsersRequest) GetUserIds() []int32 {
+	if x != nil {
+		return x.UserIds
+	}
+	return nil
+}
+
+type MutationResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Version       *ChannelVersion        `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MutationResponse) Reset() {
+	*x = MutationResponse{}
+	mi := &file_participants_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MutationResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MutationResponse) ProtoMessage() {}
+
+func (x *MutationResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MutationResponse.ProtoReflect.Descriptor instead.
+func (*MutationResponse) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *MutationResponse) GetVersion() *ChannelVersion {
+	if x != nil {
+		return x.Version
+	}
+	return nil
+}
+
+// ChannelVersion tương ứng với repo.ElasticChannelParticipantMetaDO.
+type ChannelVersion struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChannelId     int32                  `protobuf:"varint,1,opt,name=channel_id,json=channelId,proto3" json:"channel_id,omitempty"`
+	Version       int32                  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	PrevVersion   int32                  `protobuf:"varint,3,opt,name=prev_version,json=prevVersion,proto3" json:"prev_version,omitempty"`
+	UpdateAt      int64                  `protobuf:"varint,4,opt,name=update_at,json=updateAt,proto3" json:"update_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChannelVersion) Reset() {
+	*x = ChannelVersion{}
+	mi := &file_participants_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChannelVersion) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChannelVersion) ProtoMessage() {}
+
+func (x *ChannelVersion) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChannelVersion.ProtoReflect.Descriptor instead.
+func (*ChannelVersion) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ChannelVersion) GetChannelId() int32 {
+	if x != nil {
+		return x.ChannelId
+	}
+	return 0
+}
+
+func (x *ChannelVersion) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *ChannelVersion) GetPrevVersion() int32 {
+	if x != nil {
+		return x.PrevVersion
+	}
+	return 0
+}
+
+func (x *ChannelVersion) GetUpdateAt() int64 {
+	if x != nil {
+		return x.UpdateAt
+	}
+	return 0
+}
+
+type ParticipantBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Participants  []*ChannelParticipant  `protobuf:"bytes,1,rep,name=participants,proto3" json:"participants,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ParticipantBatch) Reset() {
+	*x = ParticipantBatch{}
+	mi := &file_participants_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ParticipantBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ParticipantBatch) ProtoMessage() {}
+
+func (x *ParticipantBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ParticipantBatch.ProtoReflect.Descriptor instead.
+func (*ParticipantBatch) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ParticipantBatch) GetParticipants() []*ChannelParticipant {
+	if x != nil {
+		return x.Participants
+	}
+	return nil
+}
+
+type UserIDBatch struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UserIds       []int32                `protobuf:"varint,1,rep,packed,name=user_ids,json=userIds,proto3" json:"user_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UserIDBatch) Reset() {
+	*x = UserIDBatch{}
+	mi := &file_participants_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UserIDBatch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UserIDBatch) ProtoMessage() {}
+
+func (x *UserIDBatch) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UserIDBatch.ProtoReflect.Descriptor instead.
+func (*UserIDBatch) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *UserIDBatch) GetUserIds() []int32 {
+	if x != nil {
+		return x.UserIds
+	}
+	return nil
+}
+
+// WatchChannelRequest from_version = -1 bắt đầu từ version hiện tại.
+type WatchChannelRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChannelId     int32                  `protobuf:"varint,1,opt,name=channel_id,json=channelId,proto3" json:"channel_id,omitempty"`
+	FromVersion   int32                  `protobuf:"varint,2,opt,name=from_version,json=fromVersion,proto3" json:"from_version,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchChannelRequest) Reset() {
+	*x = WatchChannelRequest{}
+	mi := &file_participants_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchChannelRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchChannelRequest) ProtoMessage() {}
+
+func (x *WatchChannelRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchChannelRequest.ProtoReflect.Descriptor instead.
+func (*WatchChannelRequest) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *WatchChannelRequest) GetChannelId() int32 {
+	if x != nil {
+		return x.ChannelId
+	}
+	return 0
+}
+
+func (x *WatchChannelRequest) GetFromVersion() int32 {
+	if x != nil {
+		return x.FromVersion
+	}
+	return 0
+}
+
+// ChannelChange tương ứng với repo.ChannelChangesDO, resync = true thì client phải tải lại toàn bộ.
+type ChannelChange struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChannelId     int32                  `protobuf:"varint,1,opt,name=channel_id,json=channelId,proto3" json:"channel_id,omitempty"`
+	FromVersion   int32                  `protobuf:"varint,2,opt,name=from_version,json=fromVersion,proto3" json:"from_version,omitempty"`
+	Version       int32                  `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	Resync        bool                   `protobuf:"varint,4,opt,name=resync,proto3" json:"resync,omitempty"`
+	Added         []int32                `protobuf:"varint,5,rep,packed,name=added,proto3" json:"added,omitempty"`
+	Updated       []int32                `protobuf:"varint,6,rep,packed,name=updated,proto3" json:"updated,omitempty"`
+	Removed       []int32                `protobuf:"varint,7,rep,packed,name=removed,proto3" json:"removed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ChannelChange) Reset() {
+	*x = ChannelChange{}
+	mi := &file_participants_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ChannelChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChannelChange) ProtoMessage() {}
+
+func (x *ChannelChange) ProtoReflect() protoreflect.Message {
+	mi := &file_participants_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChannelChange.ProtoReflect.Descriptor instead.
+func (*ChannelChange) Descriptor() ([]byte, []int) {
+	return file_participants_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ChannelChange) GetChannelId() int32 {
+	if x != nil {
+		return x.ChannelId
+	}
+	return 0
+}
+
+func (x *ChannelChange) GetFromVersion() int32 {
+	if x != nil {
+		return x.FromVersion
+	}
+	return 0
+}
+
+func (x *ChannelChange) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *ChannelChange) GetResync() bool {
+	if x != nil {
+		return x.Resync
+	}
+	return false
+}
+
+func (x *ChannelChange) GetAdded() []int32 {
+	if x != nil {
+		return x.Added
+	}
+	return nil
+}
+
+func (x *ChannelChange) GetUpdated() []int32 {
+	if x != nil {
+		return x.Updated
+	}
+	return nil
+}
+
+func (x *ChannelChange) GetRemoved() []int32 {
+	if x != nil {
+		return x.Removed
+	}
+	return nil
+}
+
+var File_participants_proto protoreflect.FileDescriptor
+
+const file_participants_proto_rawDesc = "" +
+	"\n" +
+	"\x12participants.proto\x12\x1atool_cache.participants.v1\"\x85\b\n" +
+	"\x12ChannelParticipant\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x1d\n" +
+	"\n" +
+	"channel_id\x18\x02 \x01(\x05R\tchannelId\x12\x17\n" +
+	"\auser_id\x18\x03 \x01(\x05R\x06userId\x12\x1d\n" +
+	"\n" +
+	"is_creator\x18\x04 \x01(\x05R\tisCreator\x12)\n" +
+	"\x10participant_type\x18\x05 \x01(\x05R\x0fparticipantType\x12&\n" +
+	"\x0finviter_user_id\x18\x06 \x01(\x05R\rinviterUserId\x12\x1d\n" +
+	"\n" +
+	"invited_at\x18\a \x01(\x05R\tinvitedAt\x12\x1b\n" +
+	"\tjoined_at\x18\b \x01(\x05R\bjoinedAt\x12,\n" +
+	"\x12is_waiting_approve\x18\t \x01(\x05R\x10isWaitingApprove\x12-\n" +
+	"\x12hidden_participant\x18\n" +
+	" \x01(\x05R\x11hiddenParticipant\x12\x17\n" +
+	"\ais_left\x18\v \x01(\x05R\x06isLeft\x12\x17\n" +
+	"\aleft_at\x18\f \x01(\x05R\x06leftAt\x12\x1b\n" +
+	"\tis_kicked\x18\r \x01(\x05R\bisKicked\x12\x1b\n" +
+	"\tkicked_by\x18\x0e \x01(\x05R\bkickedBy\x12\x1b\n" +
+	"\tkicked_at\x18\x0f \x01(\x05R\bkickedAt\x12+\n" +
+	"\x11hidden_prehistory\x18\x10 \x01(\x05R\x10hiddenPrehistory\x12?\n" +
+	"\x1chidden_prehistory_message_id\x18\x11 \x01(\x05R\x19hiddenPrehistoryMessageId\x12!\n" +
+	"\fadmin_rights\x18\x12 \x01(\x05R\vadminRights\x12\x1f\n" +
+	"\vpromoted_by\x18\x13 \x01(\x05R\n" +
+	"promotedBy\x12\x1f\n" +
+	"\vpromoted_at\x18\x14 \x01(\x05R\n" +
+	"promotedAt\x12\x12\n" +
+	"\x04rank\x18\x15 \x01(\tR\x04rank\x12#\n" +
+	"\rbanned_rights\x18\x16 \x01(\x05R\fbannedRights\x12*\n" +
+	"\x11banned_until_date\x18\x17 \x01(\x05R\x0fbannedUntilDate\x12\x1b\n" +
+	"\tbanned_at\x18\x18 \x01(\x05R\bbannedAt\x12)\n" +
+	"\x11read_inbox_max_id\x18\x19 \x01(\x05R\x0ereadInboxMaxId\x12+\n" +
+	"\x12read_outbox_max_id\x18\x1a \x01(\x05R\x0freadOutboxMaxId\x12\x12\n" +
+	"\x04date\x18\x1b \x01(\x05R\x04date\x12\x14\n" +
+	"\x05state\x18\x1c \x01(\x05R\x05state\x12\x1d\n" +
+	"\n" +
+	"created_at\x18\x1d \x01(\tR\tcreatedAt\x12\x1d\n" +
+	"\n" +
+	"updated_at\x18\x1e \x01(\tR\tupdatedAt\"/\n" +
+	"\x0eChannelRequest\x12\x1d\n" +
+	"\n" +
+	"channel_id\x18\x01 \x01(\x05R\tchannelId\"\xa6\x01\n" +
+	"\x17SaveParticipantsRequest\x12\x1d\n" +
+	"\n" +
+	"channel_id\x18\x01 \x01(\x05R\tchannelId\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\x05R\aversion\x12R\n" +
+	"\fparticipants\x18\x03 \x03(\v2..tool_cache.participants.v1.ChannelParticipantR\fparticipants\"h\n" +
+	"\x12DeleteUsersRequest\x12\x1d\n" +
+	"\n" +
+	"channel_id\x18\x01 \x01(\x05R\tchannelId\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\x05R\aversion\x12\x19\n" +
+	"\buser_ids\x18\x03 \x03(\x05R\auserIds\"X\n" +
+	"\x10MutationResponse\x12D\n" +
+	"\aversion\x18\x01 \x01(\v2*.tool_cache.participants.v1.ChannelVersionR\aversion\"\x89\x01\n" +
+	"\x0eChannelVersion\x12\x1d\n" +
+	"\n" +
+	"channel_id\x18\x01 \x01(\x05R\tchannelId\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\x05R\aversion\x12!\n" +
+	"\fprev_version\x18\x03 \x01(\x05R\vprevVersion\x12\x1b\n" +
+	"\tupdate_at\x18\x04 \x01(\x03R\bupdateAt\"f\n" +
+	"\x10ParticipantBatch\x12R\n" +
+	"\fparticipants\x18\x01 \x03(\v2..tool_cache.participants.v1.ChannelParticipantR\fparticipants\"(\n" +
+	"\vUserIDBatch\x12\x19\n" +
+	"\buser_ids\x18\x01 \x03(\x05R\auserIds\"W\n" +
+	"\x13WatchChannelRequest\x12\x1d\n" +
+	"\n" +
+	"channel_id\x18\x01 \x01(\x05R\tchannelId\x12!\n" +
+	"\ffrom_version\x18\x02 \x01(\x05R\vfromVersion\"\xcd\x01\n" +
+	"\rChannelChange\x12\x1d\n" +
+	"\n" +
+	"channel_id\x18\x01 \x01(\x05R\tchannelId\x12!\n" +
+	"\ffrom_version\x18\x02 \x01(\x05R\vfromVersion\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\x05R\aversion\x12\x16\n" +
+	"\x06resync\x18\x04 \x01(\bR\x06resync\x12\x14\n" +
+	"\x05added\x18\x05 \x03(\x05R\x05added\x12\x18\n" +
+	"\aupdated\x18\x06 \x03(\x05R\aupdated\x12\x18\n" +
+	"\aremoved\x18\a \x03(\x05R\aremoved2\x8a\a\n" +
+	"\x13ChannelParticipants\x12q\n" +
+	"\fSaveAllUsers\x123.tool_cache.participants.v1.SaveParticipantsRequest\x1a,.tool_cache.participants.v1.MutationResponse\x12s\n" +
+	"\x0eAddDataToCache\x123.tool_cache.participants.v1.SaveParticipantsRequest\x1a,.tool_cache.participants.v1.MutationResponse\x12k\n" +
+	"\vDeleteUsers\x12..tool_cache.participants.v1.DeleteUsersRequest\x1a,.tool_cache.participants.v1.MutationResponse\x12d\n" +
+	"\n" +
+	"GetVersion\x12*.tool_cache.participants.v1.ChannelRequest\x1a*.tool_cache.participants.v1.ChannelVersion\x12j\n" +
+	"\fStreamAdmins\x12*.tool_cache.participants.v1.ChannelRequest\x1a,.tool_cache.participants.v1.ParticipantBatch0\x01\x12p\n" +
+	"\x12StreamParticipants\x12*.tool_cache.participants.v1.ChannelRequest\x1a,.tool_cache.participants.v1.ParticipantBatch0\x01\x12l\n" +
+	"\x13StreamActiveUserIDs\x12*.tool_cache.participants.v1.ChannelRequest\x1a'.tool_cache.participants.v1.UserIDBatch0\x01\x12l\n" +
+	"\fWatchChannel\x12/.tool_cache.participants.v1.WatchChannelRequest\x1a).tool_cache.participants.v1.ChannelChange0\x01B Z\x1etool_cache/repo/participantspbb\x06proto3"
+
+var (
+	file_participants_proto_rawDescOnce sync.Once
+	file_participants_proto_rawDescData []byte
+)
+
+func file_participants_proto_rawDescGZIP() []byte {
+	file_participants_proto_rawDescOnce.Do(func() {
+		file_participants_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_participants_proto_rawDesc), len(file_participants_proto_rawDesc)))
+	})
+	return file_participants_proto_rawDescData
+}
+
+var file_participants_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_participants_proto_goTypes = []any{
+	(*ChannelParticipant)(nil),      // 0: tool_cache.participants.v1.ChannelParticipant
+	(*ChannelRequest)(nil),          // 1: tool_cache.participants.v1.ChannelRequest
+	(*SaveParticipantsRequest)(nil), // 2: tool_cache.participants.v1.SaveParticipantsRequest
+	(*DeleteUsersRequest)(nil),      // 3: tool_cache.participants.v1.DeleteUsersRequest
+	(*MutationResponse)(nil),        // 4: tool_cache.participants.v1.MutationResponse
+	(*ChannelVersion)(nil),          // 5: tool_cache.participants.v1.ChannelVersion
+	(*ParticipantBatch)(nil),        // 6: tool_cache.participants.v1.ParticipantBatch
+	(*UserIDBatch)(nil),             // 7: tool_cache.participants.v1.UserIDBatch
+	(*WatchChannelRequest)(nil),     // 8: tool_cache.participants.v1.WatchChannelRequest
+	(*ChannelChange)(nil),           // 9: tool_cache.participants.v1.ChannelChange
+}
+var file_participants_proto_depIdxs = []int32{
+	0,  // 0: tool_cache.participants.v1.SaveParticipantsRequest.participants:type_name -> tool_cache.participants.v1.ChannelParticipant
+	5,  // 1: tool_cache.participants.v1.MutationResponse.version:type_name -> tool_cache.participants.v1.ChannelVersion
+	0,  // 2: tool_cache.participants.v1.ParticipantBatch.participants:type_name -> tool_cache.participants.v1.ChannelParticipant
+	2,  // 3: tool_cache.participants.v1.ChannelParticipants.SaveAllUsers:input_type -> tool_cache.participants.v1.SaveParticipantsRequest
+	2,  // 4: tool_cache.participants.v1.ChannelParticipants.AddDataToCache:input_type -> tool_cache.participants.v1.SaveParticipantsRequest
+	3,  // 5: tool_cache.participants.v1.ChannelParticipants.DeleteUsers:input_type -> tool_cache.participants.v1.DeleteUsersRequest
+	1,  // 6: tool_cache.participants.v1.ChannelParticipants.GetVersion:input_type -> tool_cache.participants.v1.ChannelRequest
+	1,  // 7: tool_cache.participants.v1.ChannelParticipants.StreamAdmins:input_type -> tool_cache.participants.v1.ChannelRequest
+	1,  // 8: tool_cache.participants.v1.ChannelParticipants.StreamParticipants:input_type -> tool_cache.participants.v1.ChannelRequest
+	1,  // 9: tool_cache.participants.v1.ChannelParticipants.StreamActiveUserIDs:input_type -> tool_cache.participants.v1.ChannelRequest
+	8,  // 10: tool_cache.participants.v1.ChannelParticipants.WatchChannel:input_type -> tool_cache.participants.v1.WatchChannelRequest
+	4,  // 11: tool_cache.participants.v1.ChannelParticipants.SaveAllUsers:output_type -> tool_cache.participants.v1.MutationResponse
+	4,  // 12: tool_cache.participants.v1.ChannelParticipants.AddDataToCache:output_type -> tool_cache.participants.v1.MutationResponse
+	4,  // 13: tool_cache.participants.v1.ChannelParticipants.DeleteUsers:output_type -> tool_cache.participants.v1.MutationResponse
+	5,  // 14: tool_cache.participants.v1.ChannelParticipants.GetVersion:output_type -> tool_cache.participants.v1.ChannelVersion
+	6,  // 15: tool_cache.participants.v1.ChannelParticipants.StreamAdmins:output_type -> tool_cache.participants.v1.ParticipantBatch
+	6,  // 16: tool_cache.participants.v1.ChannelParticipants.StreamParticipants:output_type -> tool_cache.participants.v1.ParticipantBatch
+	7,  // 17: tool_cache.participants.v1.ChannelParticipants.StreamActiveUserIDs:output_type -> tool_cache.participants.v1.UserIDBatch
+	9,  // 18: tool_cache.participants.v1.ChannelParticipants.WatchChannel:output_type -> tool_cache.participants.v1.ChannelChange
+	11, // [11:19] is the sub-list for method output_type
+	3,  // [3:11] is the sub-list for method input_type
+	3,  // [3:3] is the sub-list for extension type_name
+	3,  // [3:3] is the sub-list for extension extendee
+	0,  // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_participants_proto_init() }
+func file_participants_proto_init() {
+	if File_participants_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_participants_proto_rawDesc), len(file_participants_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_participants_proto_goTypes,
+		DependencyIndexes: file_participants_proto_depIdxs,
+		MessageInfos:      file_participants_proto_msgTypes,
+	}.Build()
+	File_participants_proto = out.File
+	file_participants_proto_goTypes = nil
+	file_participants_proto_depIdxs = nil
+}
@@ -0,0 +1,422 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: participants.proto
+
+package participantspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ChannelParticipants_SaveAllUsers_FullMethodName        = "/tool_cache.participants.v1.ChannelParticipants/SaveAllUsers"
+	ChannelParticipants_AddDataToCache_FullMethodName      = "/tool_cache.participants.v1.ChannelParticipants/AddDataToCache"
+	ChannelParticipants_DeleteUsers_FullMethodName         = "/tool_cache.participants.v1.ChannelParticipants/DeleteUsers"
+	ChannelParticipants_GetVersion_FullMethodName          = "/tool_cache.participants.v1.ChannelParticipants/GetVersion"
+	ChannelParticipants_StreamAdmins_FullMethodName        = "/tool_cache.participants.v1.ChannelParticipants/StreamAdmins"
+	ChannelParticipants_StreamParticipants_FullMethodName  = "/tool_cache.participants.v1.ChannelParticipants/StreamParticipants"
+	ChannelParticipants_StreamActiveUserIDs_FullMethodName = "/tool_cache.participants.v1.ChannelParticipants/StreamActiveUserIDs"
+	ChannelParticipants_WatchChannel_FullMethodName        = "/tool_cache.participants.v1.ChannelParticipants/WatchChannel"
+)
+
+// ChannelParticipantsClient is the client API for ChannelParticipants service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ChannelParticipants gRPC cho service nội bộ, tương ứng với các DAO participants.
+// Mutation đi qua outbox giống ChannelParticipantsStore.
+type ChannelParticipantsClient interface {
+	// SaveAllUsers reload toàn bộ participants của channel.
+	SaveAllUsers(ctx context.Context, in *SaveParticipantsRequest, opts ...grpc.CallOption) (*MutationResponse, error)
+	// AddDataToCache thêm / cập nhật participants.
+	AddDataToCache(ctx context.Context, in *SaveParticipantsRequest, opts ...grpc.CallOption) (*MutationResponse, error)
+	// DeleteUsers xoá participants khỏi channel.
+	DeleteUsers(ctx context.Context, in *DeleteUsersRequest, opts ...grpc.CallOption) (*MutationResponse, error)
+	// GetVersion version hiện tại của channel.
+	GetVersion(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (*ChannelVersion, error)
+	// StreamAdmins creator / admin của channel theo từng batch.
+	StreamAdmins(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ParticipantBatch], error)
+	// StreamParticipants mọi participant của channel theo từng batch.
+	StreamParticipants(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ParticipantBatch], error)
+	// StreamActiveUserIDs user id đang active của channel theo từng batch.
+	StreamActiveUserIDs(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[UserIDBatch], error)
+	// WatchChannel đẩy thay đổi membership của channel từ from_version.
+	WatchChannel(ctx context.Context, in *WatchChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ChannelChange], error)
+}
+
+type channelParticipantsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChannelParticipantsClient(cc grpc.ClientConnInterface) ChannelParticipantsClient {
+	return &channelParticipantsClient{cc}
+}
+
+func (c *channelParticipantsClient) SaveAllUsers(ctx context.Context, in *SaveParticipantsRequest, opts ...grpc.CallOption) (*MutationResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MutationResponse)
+	err := c.cc.Invoke(ctx, ChannelParticipants_SaveAllUsers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *channelParticipantsClient) AddDataToCache(ctx context.Context, in *SaveParticipantsRequest, opts ...grpc.CallOption) (*MutationResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MutationResponse)
+	err := c.cc.Invoke(ctx, ChannelParticipants_AddDataToCache_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *channelParticipantsClient) DeleteUsers(ctx context.Context, in *DeleteUsersRequest, opts ...grpc.CallOption) (*MutationResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MutationResponse)
+	err := c.cc.Invoke(ctx, ChannelParticipants_DeleteUsers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *channelParticipantsClient) GetVersion(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (*ChannelVersion, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ChannelVersion)
+	err := c.cc.Invoke(ctx, ChannelParticipants_GetVersion_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *channelParticipantsClient) StreamAdmins(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ParticipantBatch], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ChannelParticipants_ServiceDesc.Streams[0], ChannelParticipants_StreamAdmins_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ChannelRequest, ParticipantBatch]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_StreamAdminsClient = grpc.ServerStreamingClient[ParticipantBatch]
+
+func (c *channelParticipantsClient) StreamParticipants(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ParticipantBatch], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ChannelParticipants_ServiceDesc.Streams[1], ChannelParticipants_StreamParticipants_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ChannelRequest, ParticipantBatch]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_StreamParticipantsClient = grpc.ServerStreamingClient[ParticipantBatch]
+
+func (c *channelParticipantsClient) StreamActiveUserIDs(ctx context.Context, in *ChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[UserIDBatch], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ChannelParticipants_ServiceDesc.Streams[2], ChannelParticipants_StreamActiveUserIDs_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ChannelRequest, UserIDBatch]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_StreamActiveUserIDsClient = grpc.ServerStreamingClient[UserIDBatch]
+
+func (c *channelParticipantsClient) WatchChannel(ctx context.Context, in *WatchChannelRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ChannelChange], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ChannelParticipants_ServiceDesc.Streams[3], ChannelParticipants_WatchChannel_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchChannelRequest, ChannelChange]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_WatchChannelClient = grpc.ServerStreamingClient[ChannelChange]
+
+// ChannelParticipantsServer is the server API for ChannelParticipants service.
+// All implementations must embed UnimplementedChannelParticipantsServer
+// for forward compatibility.
+//
+// ChannelParticipants gRPC cho service nội bộ, tương ứng với các DAO participants.
+// Mutation đi qua outbox giống ChannelParticipantsStore.
+type ChannelParticipantsServer interface {
+	// SaveAllUsers reload toàn bộ participants của channel.
+	SaveAllUsers(context.Context, *SaveParticipantsRequest) (*MutationResponse, error)
+	// AddDataToCache thêm / cập nhật participants.
+	AddDataToCache(context.Context, *SaveParticipantsRequest) (*MutationResponse, error)
+	// DeleteUsers xoá participants khỏi channel.
+	DeleteUsers(context.Context, *DeleteUsersRequest) (*MutationResponse, error)
+	// GetVersion version hiện tại của channel.
+	GetVersion(context.Context, *ChannelRequest) (*ChannelVersion, error)
+	// StreamAdmins creator / admin của channel theo từng batch.
+	StreamAdmins(*ChannelRequest, grpc.ServerStreamingServer[ParticipantBatch]) error
+	// StreamParticipants mọi participant của channel theo từng batch.
+	StreamParticipants(*ChannelRequest, grpc.ServerStreamingServer[ParticipantBatch]) error
+	// StreamActiveUserIDs user id đang active của channel theo từng batch.
+	StreamActiveUserIDs(*ChannelRequest, grpc.ServerStreamingServer[UserIDBatch]) error
+	// WatchChannel đẩy thay đổi membership của channel từ from_version.
+	WatchChannel(*WatchChannelRequest, grpc.ServerStreamingServer[ChannelChange]) error
+	mustEmbedUnimplementedChannelParticipantsServer()
+}
+
+// UnimplementedChannelParticipantsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedChannelParticipantsServer struct{}
+
+func (UnimplementedChannelParticipantsServer) SaveAllUsers(context.Context, *SaveParticipantsRequest) (*MutationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SaveAllUsers not implemented")
+}
+func (UnimplementedChannelParticipantsServer) AddDataToCache(context.Context, *SaveParticipantsRequest) (*MutationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddDataToCache not implemented")
+}
+func (UnimplementedChannelParticipantsServer) DeleteUsers(context.Context, *DeleteUsersRequest) (*MutationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUsers not implemented")
+}
+func (UnimplementedChannelParticipantsServer) GetVersion(context.Context, *ChannelRequest) (*ChannelVersion, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetVersion not implemented")
+}
+func (UnimplementedChannelParticipantsServer) StreamAdmins(*ChannelRequest, grpc.ServerStreamingServer[ParticipantBatch]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamAdmins not implemented")
+}
+func (UnimplementedChannelParticipantsServer) StreamParticipants(*ChannelRequest, grpc.ServerStreamingServer[ParticipantBatch]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamParticipants not implemented")
+}
+func (UnimplementedChannelParticipantsServer) StreamActiveUserIDs(*ChannelRequest, grpc.ServerStreamingServer[UserIDBatch]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamActiveUserIDs not implemented")
+}
+func (UnimplementedChannelParticipantsServer) WatchChannel(*WatchChannelRequest, grpc.ServerStreamingServer[ChannelChange]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChannel not implemented")
+}
+func (UnimplementedChannelParticipantsServer) mustEmbedUnimplementedChannelParticipantsServer() {}
+func (UnimplementedChannelParticipantsServer) testEmbeddedByValue()                             {}
+
+// UnsafeChannelParticipantsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChannelParticipantsServer will
+// result in compilation errors.
+type UnsafeChannelParticipantsServer interface {
+	mustEmbedUnimplementedChannelParticipantsServer()
+}
+
+func RegisterChannelParticipantsServer(s grpc.ServiceRegistrar, srv ChannelParticipantsServer) {
+	// If the following call pancis, it indicates UnimplementedChannelParticipantsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ChannelParticipants_ServiceDesc, srv)
+}
+
+func _ChannelParticipants_SaveAllUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SaveParticipantsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChannelParticipantsServer).SaveAllUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChannelParticipants_SaveAllUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChannelParticipantsServer).SaveAllUsers(ctx, req.(*SaveParticipantsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChannelParticipants_AddDataToCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SaveParticipantsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChannelParticipantsServer).AddDataToCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChannelParticipants_AddDataToCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChannelParticipantsServer).AddDataToCache(ctx, req.(*SaveParticipantsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChannelParticipants_DeleteUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChannelParticipantsServer).DeleteUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChannelParticipants_DeleteUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChannelParticipantsServer).DeleteUsers(ctx, req.(*DeleteUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChannelParticipants_GetVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChannelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChannelParticipantsServer).GetVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChannelParticipants_GetVersion_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChannelParticipantsServer).GetVersion(ctx, req.(*ChannelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChannelParticipants_StreamAdmins_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChannelRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChannelParticipantsServer).StreamAdmins(m, &grpc.GenericServerStream[ChannelRequest, ParticipantBatch]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_StreamAdminsServer = grpc.ServerStreamingServer[ParticipantBatch]
+
+func _ChannelParticipants_StreamParticipants_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChannelRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChannelParticipantsServer).StreamParticipants(m, &grpc.GenericServerStream[ChannelRequest, ParticipantBatch]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_StreamParticipantsServer = grpc.ServerStreamingServer[ParticipantBatch]
+
+func _ChannelParticipants_StreamActiveUserIDs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChannelRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChannelParticipantsServer).StreamActiveUserIDs(m, &grpc.GenericServerStream[ChannelRequest, UserIDBatch]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_StreamActiveUserIDsServer = grpc.ServerStreamingServer[UserIDBatch]
+
+func _ChannelParticipants_WatchChannel_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchChannelRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChannelParticipantsServer).WatchChannel(m, &grpc.GenericServerStream[WatchChannelRequest, ChannelChange]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ChannelParticipants_WatchChannelServer = grpc.ServerStreamingServer[ChannelChange]
+
+// ChannelParticipants_ServiceDesc is the grpc.ServiceDesc for ChannelParticipants service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChannelParticipants_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tool_cache.participants.v1.ChannelParticipants",
+	HandlerType: (*ChannelParticipantsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SaveAllUsers",
+			Handler:    _ChannelParticipants_SaveAllUsers_Handler,
+		},
+		{
+			MethodName: "AddDataToCache",
+			Handler:    _ChannelParticipants_AddDataToCache_Handler,
+		},
+		{
+			MethodName: "DeleteUsers",
+			Handler:    _ChannelParticipants_DeleteUsers_Handler,
+		},
+		{
+			MethodName: "GetVersion",
+			Handler:    _ChannelParticipants_GetVersion_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamAdmins",
+			Handler:       _ChannelParticipants_StreamAdmins_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamParticipants",
+			Handler:       _ChannelParticipants_StreamParticipants_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamActiveUserIDs",
+			Handler:       _ChannelParticipants_StreamActiveUserIDs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchChannel",
+			Handler:       _ChannelParticipants_WatchChannel_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "participants.proto",
+}
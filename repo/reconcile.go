@@ -0,0 +1,235 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ReconcileReport kết quả so khớp membership giữa ES và 2 key Redis của một channel.
+// Missing: có trong ES nhưng thiếu trong Redis. Extra: có trong Redis nhưng không còn trong ES.
+type ReconcileReport struct {
+	ChannelID    int32   `json:"channel_id"`
+	ESCount      int     `json:"es_count"`
+	SetCount     int     `json:"set_count"`
+	StrCount     int     `json:"str_count"`
+	MissingInSet []int32 `json:"missing_in_set"`
+	ExtraInSet   []int32 `json:"extra_in_set"`
+	MissingInStr []int32 `json:"missing_in_str"`
+	ExtraInStr   []int32 `json:"extra_in_str"`
+	ESVersion    int32   `json:"es_version"`
+	RedisVersion int32   `json:"redis_version"`
+	Repaired     bool    `json:"repaired"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// Consistent true nếu 3 nguồn khớp nhau và cùng version.
+func (r *ReconcileReport) Consistent() bool {
+	return r.Error == "" &&
+		len(r.MissingInSet) == 0 && len(r.ExtraInSet) == 0 &&
+		len(r.MissingInStr) == 0 && len(r.ExtraInStr) == 0 &&
+		r.ESVersion == r.RedisVersion
+}
+
+// Reconciler so khớp channel:<id>:participants, channel:<id>:participants:str với ES,
+// tuỳ chọn sửa Redis theo ES (ES là nguồn chuẩn).
+type Reconciler struct {
+	es    *ElasticChannelParticipantsDAO
+	cache *ChannelParticipantsCacheDAO
+}
+
+func NewReconciler(es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO) *Reconciler {
+	return &Reconciler{es: es, cache: cache}
+}
+
+// Check so khớp một channel, repair = true thì ghi lại Redis từ ES khi lệch.
+func (c *Reconciler) Check(channelID int32, repair bool) (*ReconcileReport, error) {
+	timeStart := time.Now()
+	report := &ReconcileReport{ChannelID: channelID}
+
+	meta, err := c.es.GetVersion(channelID)
+	if err != nil {
+		return nil, err
+	}
+	report.ESVersion = meta.Version
+
+	esUsers := make(map[int32]struct{})
+	err = c.es.ScrollActiveUserIDs(channelID, func(ids []int32) error {
+		for _, id := range ids {
+			esUsers[id] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.ESCount = len(esUsers)
+
+	setUsers := make(map[int32]struct{})
+	err = c.cache.ScanMembers(channelID, func(ids []int32) error {
+		for _, id := range ids {
+			setUsers[id] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.SetCount = len(setUsers)
+
+	strList, err := c.cache.GetString(channelID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	strUsers := make(map[int32]struct{}, len(strList))
+	for _, id := range strList {
+		strUsers[id] = struct{}{}
+	}
+	report.StrCount = len(strUsers)
+
+	if report.RedisVersion, err = c.cache.GetVersion(channelID); err != nil {
+		return nil, err
+	}
+
+	report.MissingInSet, report.ExtraInSet = diffUserSets(esUsers, setUsers)
+	report.MissingInStr, report.ExtraInStr = diffUserSets(esUsers, strUsers)
+
+	if repair && !report.Consistent() {
+		if err := c.repair(channelID); err != nil {
+			return report, err
+		}
+		report.Repaired = true
+	}
+
+	logTiming(c.es.Logger(), "Reconcile", timeStart, LOG_KEY_CHANNEL_ID, channelID,
+		"es", report.ESCount, "set", report.SetCount, "str", report.StrCount)
+	return report, nil
+}
+
+// CheckRange so khớp các channel trong [from, to], tối đa ratePerSecond channel mỗi giây (<= 0 là không giới hạn).
+// Lỗi của từng channel được ghi vào report, không dừng cả lượt.
+func (c *Reconciler) CheckRange(ctx context.Context, from, to int32, repair bool, ratePerSecond int) ([]*ReconcileReport, error) {
+	var tick <-chan time.Time
+	if ratePerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(ratePerSecond))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	reports := make([]*ReconcileReport, 0, to-from+1)
+	for channelID := from; channelID <= to; channelID++ {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return reports, ctx.Err()
+			case <-tick:
+			}
+		} else if ctx.Err() != nil {
+			return reports, ctx.Err()
+		}
+
+		report, err := c.Check(channelID, repair)
+		if err != nil {
+			if report == nil {
+				report = &ReconcileReport{ChannelID: channelID}
+			}
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Run chạy CheckRange định kỳ cho tới khi ctx bị huỷ, onReport nhận report của các channel bị lệch.
+func (c *Reconciler) Run(ctx context.Context, from, to int32, every time.Duration, repair bool, ratePerSecond int, onReport func(*ReconcileReport)) error {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		reports, err := c.CheckRange(ctx, from, to, repair, ratePerSecond)
+		for _, r := range reports {
+			if !r.Consistent() && onReport != nil {
+				onReport(r)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// repair ghi lại Redis từ ES trong khoá cache của channel. ES được đọc lại sau khi lấy khoá:
+// snapshot lúc Check có thể đã cũ nếu relay ghi xen vào, ghi đè bằng nó sẽ làm mất thay đổi đó.
+func (c *Reconciler) repair(channelID int32) error {
+	unlock, err := c.cache.LockChannelCache(channelID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	meta, err := c.es.GetVersion(channelID)
+	if err != nil {
+		return err
+	}
+	list := []int32{}
+	err = c.es.ScrollActiveUserIDs(channelID, func(ids []int32) error {
+		list = append(list, ids...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.cache.SaveAllData(channelID, list); err != nil {
+		return fmt.Errorf("repair redis set channel %d failed: %w", channelID, err)
+	}
+	if err := c.cache.SaveString(channelID, list); err != nil {
+		return fmt.Errorf("repair redis string channel %d failed: %w", channelID, err)
+	}
+
+	// hàng chờ duyệt cũng được dựng lại cùng lúc
+	pending := []int32{}
+	err = c.es.ScrollPendingUserIDs(channelID, func(ids []int32) error {
+		pending = append(pending, ids...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.cache.SavePending(channelID, pending); err != nil {
+		return fmt.Errorf("repair redis pending channel %d failed: %w", channelID, err)
+	}
+	if err := c.cache.SetVersion(channelID, meta.Version); err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return c.cache.MarkEmpty(channelID, meta.Version)
+	}
+	return nil
+}
+
+// diffUserSets trả về (có trong want nhưng thiếu trong got, có trong got nhưng không có trong want).
+func diffUserSets(want, got map[int32]struct{}) (missing []int32, extra []int32) {
+	missing, extra = []int32{}, []int32{}
+	for id := range want {
+		if _, ok := got[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	for id := range got {
+		if _, ok := want[id]; !ok {
+			extra = append(extra, id)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	sort.Slice(extra, func(i, j int) bool { return extra[i] < extra[j] })
+	return missing, extra
+}
@@ -1,8 +1,10 @@
 package repo
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -11,26 +13,39 @@ import (
 )
 
 type ChannelParticipantsCacheDAO struct {
-	conn *redis.Client
+	conn       *redis.Client
+	logger     *slog.Logger       // nil = slog.Default()
+	metrics    *Metrics           // nil = tắt metrics
+	ctx        context.Context    // nil = context.Background()
+	resilience *Resilience        // nil = không timeout / retry / breaker
+	cancel     context.CancelFunc // huỷ timeout của op đang chạy, gọi trong observe
 }
 
-func NewChannelParticipantsCacheDAO() *ChannelParticipantsCacheDAO {
-	rdb := ConnectRedis()
+// NewChannelParticipantsCacheDAO tạo DAO từ client Redis (xem NewRedisClient / ConnectRedis).
+func NewChannelParticipantsCacheDAO(rdb *redis.Client) *ChannelParticipantsCacheDAO {
 	return &ChannelParticipantsCacheDAO{conn: rdb}
 }
 
-func (r *ChannelParticipantsCacheDAO) SaveAllData(channelID int32, listUsers []int32) bool {
+func (r *ChannelParticipantsCacheDAO) SaveAllData(channelID int32, listUsers []int32) (err error) {
+	r, span := r.startSpan("SaveAllData", attrChannel(channelID), attrCount(len(listUsers)))
+	defer r.observe(span, "SaveAllData", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if r == nil || r.conn == nil {
-		log.Printf("redis client is nil")
-		return false
+		return errRedisNil
 	}
 	key := fmt.Sprintf("channel:%d:participants", channelID)
 
 	// Xóa key cũ để reset toàn bộ
 	if err := r.conn.Del(key).Err(); err != nil {
-		log.Printf("Redis DEL error: %v", err)
-		return false
+		return redisError("redis DEL error", err)
+	}
+
+	if len(listUsers) == 0 {
+		// channel rỗng, chỉ cần xoá key
+		return nil
 	}
 
 	// chuyển []int32 → []interface{}
@@ -41,23 +56,25 @@ func (r *ChannelParticipantsCacheDAO) SaveAllData(channelID int32, listUsers []i
 
 	// SADD: thêm toàn bộ user mới vào set
 	if err := r.conn.SAdd(key, members...).Err(); err != nil {
-		log.Printf("Redis SAdd error: %v", err)
-		return false
+		return redisError("redis SADD error", err)
 	}
 
 	// log.Printf("✅ Redis Reset and Inserted %d users into %s", len(listUsers), key)
 
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm SaveAllData: %s\n", duration)
-	return true
+	logTiming(r.Logger(), "SaveAllData", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(listUsers))
+	return nil
 }
 
-func (r *ChannelParticipantsCacheDAO) GetList(channelID int32) ([]int32, bool) {
+func (r *ChannelParticipantsCacheDAO) GetList(channelID int32) (_ []int32, err error) {
+	r, span := r.startSpan("GetList", attrChannel(channelID))
+	defer r.observe(span, "GetList", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return nil, err
+	}
 	timeStart := time.Now()
 
 	if r == nil || r.conn == nil {
-		log.Printf("redis client is nil")
-		return nil, false
+		return nil, errRedisNil
 	}
 
 	key := fmt.Sprintf("channel:%d:participants", channelID)
@@ -65,19 +82,18 @@ func (r *ChannelParticipantsCacheDAO) GetList(channelID int32) ([]int32, bool) {
 	// Kiểm tra key có tồn tại không
 	exists, err := r.conn.Exists(key).Result()
 	if err != nil {
-		log.Printf("Redis EXISTS error: %v", err)
-		return nil, false
+		return nil, redisError("redis EXISTS error", err)
 	}
+	r.Metrics().cacheResult("participants", exists != 0)
 	if exists == 0 {
 		// Key chưa có
-		return nil, false
+		return nil, &Error{Kind: ErrNotFound, Backend: METRICS_BACKEND_REDIS, Msg: fmt.Sprintf("redis key %s not found", key)}
 	}
 
 	// Lấy toàn bộ members
 	members, err := r.conn.SMembers(key).Result()
 	if err != nil {
-		log.Printf("Redis SMEMBERS error: %v", err)
-		return nil, false
+		return nil, redisError("redis SMEMBERS error", err)
 	}
 
 	// Convert []string -> []int32
@@ -88,26 +104,29 @@ func (r *ChannelParticipantsCacheDAO) GetList(channelID int32) ([]int32, bool) {
 		v, convErr := strconv.ParseInt(s, 10, 32)
 		if convErr != nil {
 			// Bỏ qua phần tử lỗi (hoặc bạn có thể return lỗi)
-			log.Printf("parse member '%s' to int32 error: %v", s, convErr)
+			r.Logger().Warn("parse member failed", LOG_KEY_OP, "GetList", LOG_KEY_CHANNEL_ID, channelID, "member", s, LOG_KEY_ERROR, convErr)
 			continue
 		}
 		out = append(out, int32(v))
 	}
 
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm GetList: %s\n", duration)
-	return out, true
+	logTiming(r.Logger(), "GetList", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(out))
+	return out, nil
 }
 
-func (r *ChannelParticipantsCacheDAO) DeleteUsers(channelID int32, userIDs []int32) bool {
+func (r *ChannelParticipantsCacheDAO) DeleteUsers(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("DeleteUsers", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "DeleteUsers", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if r == nil || r.conn == nil {
-		log.Printf("redis client is nil")
-		return false
+		return errRedisNil
 	}
 	if len(userIDs) == 0 {
 		// Không có gì để xóa → coi như thành công
-		return true
+		return nil
 	}
 
 	key := fmt.Sprintf("channel:%d:participants", channelID)
@@ -123,13 +142,12 @@ func (r *ChannelParticipantsCacheDAO) DeleteUsers(channelID int32, userIDs []int
 	srem := pipe.SRem(key, members...) // *IntCmd: số members thực sự bị xóa
 	scard := pipe.SCard(key)           // *IntCmd: số lượng còn lại
 	if _, err := pipe.Exec(); err != nil {
-		log.Printf("Redis pipeline SREM/SCARD error: %v", err)
-		return false
+		return redisError("redis pipeline SREM/SCARD error", err)
 	}
 
 	removed := srem.Val()
 	remain := scard.Val()
-	log.Printf("SREM %d users from %s -> removed=%d, remain=%d", len(userIDs), key, removed, remain)
+	r.Logger().Debug("srem", LOG_KEY_OP, "DeleteUsers", LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs), "removed", removed, "remain", remain)
 
 	// // Nếu set rỗng, xóa key để gọn dữ liệu (không bắt buộc)
 	// if remain == 0 {
@@ -142,58 +160,105 @@ func (r *ChannelParticipantsCacheDAO) DeleteUsers(channelID int32, userIDs []int
 	// 	}
 	// }
 
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm DeleteUsers: %s\n", duration)
-	return true
+	logTiming(r.Logger(), "DeleteUsers", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs))
+	return nil
 }
 
-func (r *ChannelParticipantsCacheDAO) AddUsers(channelID int32, userIDs []int32) bool {
+// addUsersScript chỉ thêm vào set đã có: set đã bị xoá / hết hạn thì SADD sẽ tạo ra một set thiếu user
+// mà GetList coi là hit, bỏ qua để lần đọc sau dựng lại từ ES.
+const addUsersScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+return redis.call("SADD", KEYS[1], unpack(ARGV))
+`
+
+func (r *ChannelParticipantsCacheDAO) AddUsers(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("AddUsers", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "AddUsers", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if r == nil || r.conn == nil {
-		log.Printf("redis client is nil")
-		return false
+		return errRedisNil
 	}
 	key := fmt.Sprintf("channel:%d:participants", channelID)
 
 	if len(userIDs) == 0 {
-		log.Printf("⚠️ AddUsers: empty input for key %s, skip SADD", key)
-		return true
+		r.Logger().Debug("empty input, skip SADD", LOG_KEY_OP, "AddUsers", LOG_KEY_CHANNEL_ID, channelID)
+		return nil
 	}
 
-	// chuyển []int32 → []interface{}
-	members := make([]interface{}, len(userIDs))
-	for i, u := range userIDs {
-		members[i] = u
+	// SADD chỉ khi set đã có, xem addUsersScript
+	if err := r.conn.Eval(addUsersScript, []string{key}, int32Members(userIDs)...).Err(); err != nil && err != redis.Nil {
+		return redisError("redis EVAL SADD error", err)
 	}
 
-	// SADD: thêm toàn bộ user mới vào set
-	if err := r.conn.SAdd(key, members...).Err(); err != nil {
-		log.Printf("Redis SAdd error: %v", err)
-		return false
+	logTiming(r.Logger(), "AddUsers", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs))
+	return nil
+}
+
+// ScanMembers duyệt set channel:<id>:participants bằng SSCAN theo từng batch, không block Redis như SMEMBERS.
+func (r *ChannelParticipantsCacheDAO) ScanMembers(channelID int32, fn func(userIDs []int32) error) (err error) {
+	r, span := r.startSpan("ScanMembers", attrChannel(channelID))
+	defer r.observe(span, "ScanMembers", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
 	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	key := fmt.Sprintf("channel:%d:participants", channelID)
 
-	log.Printf("✅ Redis Upserted %d users into %s", len(userIDs), key)
+	var cursor uint64
+	for {
+		members, next, err := r.conn.SScan(key, cursor, "", 5000).Result()
+		if err != nil {
+			return redisError("redis SSCAN error", err)
+		}
 
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm AddUsers: %s\n", duration)
-	return true
+		ids := make([]int32, 0, len(members))
+		for _, s := range members {
+			v, convErr := strconv.ParseInt(s, 10, 32)
+			if convErr != nil {
+				continue
+			}
+			ids = append(ids, int32(v))
+		}
+		if len(ids) > 0 {
+			if err := fn(ids); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
 }
 
 // key: channel:<id>:participants:str
-func (r *ChannelParticipantsCacheDAO) SaveString(channelID int32, userIDs []int32) error {
+func (r *ChannelParticipantsCacheDAO) SaveString(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("SaveString", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "SaveString", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if r == nil || r.conn == nil {
-		return fmt.Errorf("redis client is nil")
+		return errRedisNil
 	}
 	key := fmt.Sprintf("channel:%d:participants:str", channelID)
 
 	// Nếu key đã tồn tại thì xóa trước để "reset"
 	if exists, err := r.conn.Exists(key).Result(); err == nil && exists > 0 {
 		if delErr := r.conn.Del(key).Err(); delErr != nil {
-			return fmt.Errorf("redis DEL error: %w", delErr)
+			return redisError("redis DEL error", delErr)
 		}
 	} else if err != nil {
-		return fmt.Errorf("redis EXISTS error: %w", err)
+		return redisError("redis EXISTS error", err)
 	}
 
 	// Build CSV trong memory
@@ -208,27 +273,33 @@ func (r *ChannelParticipantsCacheDAO) SaveString(channelID int32, userIDs []int3
 	}
 
 	if err := r.conn.Set(key, b.String(), 0).Err(); err != nil {
-		return fmt.Errorf("redis SET error: %w", err)
+		return redisError("redis SET error", err)
 	}
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm SaveString: %s\n", duration)
+	logTiming(r.Logger(), "SaveString", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs))
 	return nil
 }
 
-func (r *ChannelParticipantsCacheDAO) GetString(channelID int32) ([]int32, error) {
+func (r *ChannelParticipantsCacheDAO) GetString(channelID int32) (_ []int32, err error) {
+	r, span := r.startSpan("GetString", attrChannel(channelID))
+	defer r.observe(span, "GetString", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return nil, err
+	}
 	timeStart := time.Now()
 
 	if r == nil || r.conn == nil {
-		return nil, fmt.Errorf("redis client is nil")
+		return nil, errRedisNil
 	}
 	key := fmt.Sprintf("channel:%d:participants:str", channelID)
 
 	raw, err := r.conn.Get(key).Result()
+	r.Metrics().cacheResult("participants_str", err != redis.Nil)
 	if err == redis.Nil {
-		return nil, nil // chưa có key
+		// Key chưa có, channel rỗng vẫn có key với giá trị ""
+		return nil, &Error{Kind: ErrNotFound, Backend: METRICS_BACKEND_REDIS, Msg: fmt.Sprintf("redis key %s not found", key)}
 	}
 	if err != nil {
-		return nil, fmt.Errorf("redis GET error: %w", err)
+		return nil, redisError("redis GET error", err)
 	}
 	if raw == "" {
 		return []int32{}, nil
@@ -247,22 +318,30 @@ func (r *ChannelParticipantsCacheDAO) GetString(channelID int32) ([]int32, error
 		}
 		out = append(out, int32(v))
 	}
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm GetString: %s\n", duration)
+	logTiming(r.Logger(), "GetString", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(out))
 	return out, nil
 }
 
-func (r *ChannelParticipantsCacheDAO) AddUsersString(channelID int32, userIDs []int32) error {
+func (r *ChannelParticipantsCacheDAO) AddUsersString(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("AddUsersString", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "AddUsersString", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 	if r == nil || r.conn == nil {
-		return fmt.Errorf("redis client is nil")
+		return errRedisNil
 	}
 	key := fmt.Sprintf("channel:%d:participants:str", channelID)
 
-	// Lấy dữ liệu cũ từ Redis
+	// Lấy dữ liệu cũ từ Redis, chưa có key thì bỏ qua: CSV chỉ gồm user mới sẽ bị GetString coi là hit,
+	// lần đọc sau dựng lại từ ES
 	raw, err := r.conn.Get(key).Result()
-	if err != nil && err != redis.Nil {
-		return fmt.Errorf("redis GET error: %w", err)
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return redisError("redis GET error", err)
 	}
 
 	// Parse dữ liệu cũ thành map để check trùng
@@ -299,21 +378,25 @@ func (r *ChannelParticipantsCacheDAO) AddUsersString(channelID int32, userIDs []
 		first = false
 	}
 
-	// Lưu lại vào Redis
-	if err := r.conn.Set(key, b.String(), 0).Err(); err != nil {
-		return fmt.Errorf("redis SET error: %w", err)
+	// Lưu lại vào Redis, SET XX để không tạo lại key đã bị xoá / hết hạn sau lần GET
+	if err := r.conn.SetXX(key, b.String(), 0).Err(); err != nil {
+		return redisError("redis SET error", err)
 	}
 
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm AddUsersString: %s\n", duration)
+	logTiming(r.Logger(), "AddUsersString", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs))
 	return nil
 }
 
-func (r *ChannelParticipantsCacheDAO) DeleteString(channelID int32, userIDs []int32) error {
+func (r *ChannelParticipantsCacheDAO) DeleteString(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("DeleteString", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "DeleteString", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
 	timeStart := time.Now()
 
 	if r == nil || r.conn == nil {
-		return fmt.Errorf("redis client is nil")
+		return errRedisNil
 	}
 	key := fmt.Sprintf("channel:%d:participants:str", channelID)
 
@@ -322,7 +405,7 @@ func (r *ChannelParticipantsCacheDAO) DeleteString(channelID int32, userIDs []in
 		return nil // chưa có key
 	}
 	if err != nil {
-		return fmt.Errorf("redis GET error: %w", err)
+		return redisError("redis GET error", err)
 	}
 	if raw == "" {
 		return nil
@@ -351,7 +434,7 @@ func (r *ChannelParticipantsCacheDAO) DeleteString(channelID int32, userIDs []in
 	if len(out) == 0 {
 		// Nếu không còn user nào → xóa luôn key
 		if delErr := r.conn.Del(key).Err(); delErr != nil {
-			return fmt.Errorf("redis DEL error: %w", delErr)
+			return redisError("redis DEL error", delErr)
 		}
 	} else {
 		var b strings.Builder
@@ -366,19 +449,114 @@ func (r *ChannelParticipantsCacheDAO) DeleteString(channelID int32, userIDs []in
 			first = false
 		}
 
-		if setErr := r.conn.Set(key, b.String(), 0).Err(); setErr != nil {
-			return fmt.Errorf("redis SET error: %w", setErr)
+		if setErr := r.conn.SetXX(key, b.String(), 0).Err(); setErr != nil {
+			return redisError("redis SET error", setErr)
 		}
 	}
 
-	duration := time.Since(timeStart)
-	fmt.Printf("Thời gian thực thi của hàm DeleteString: %s\n", duration)
+	logTiming(r.Logger(), "DeleteString", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs))
 	return nil
 }
 
-// ConnectRedis khởi tạo kết nối Redis (go-redis cũ, không dùng context trong Ping()).
-func ConnectRedis() *redis.Client {
-	rdb := redis.NewClient(&redis.Options{
+// setVersionScript chỉ ghi version khi lớn hơn version đang có, version của cache không bao giờ lùi
+// (ví dụ replay một entry cũ sau khi entry mới hơn đã áp dụng).
+const setVersionScript = `
+local cur = tonumber(redis.call("GET", KEYS[1]) or "0")
+if tonumber(ARGV[1]) > cur then
+	redis.call("SET", KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`
+
+// key: channel:<id>:participants:version - version của channel mà cache Redis đang phản ánh, chỉ tăng
+func (r *ChannelParticipantsCacheDAO) SetVersion(channelID int32, version int32) (err error) {
+	r, span := r.startSpan("SetVersion", attrChannel(channelID))
+	defer r.observe(span, "SetVersion", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	key := fmt.Sprintf("channel:%d:participants:version", channelID)
+
+	if err := r.conn.Eval(setVersionScript, []string{key}, version).Err(); err != nil && err != redis.Nil {
+		return redisError("redis EVAL set version error", err)
+	}
+	return nil
+}
+
+// GetVersion trả về 0 nếu chưa có key.
+func (r *ChannelParticipantsCacheDAO) GetVersion(channelID int32) (_ int32, err error) {
+	r, span := r.startSpan("GetVersion", attrChannel(channelID))
+	defer r.observe(span, "GetVersion", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return 0, err
+	}
+	if r == nil || r.conn == nil {
+		return 0, errRedisNil
+	}
+	key := fmt.Sprintf("channel:%d:participants:version", channelID)
+
+	v, err := r.conn.Get(key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, redisError("redis GET error", err)
+	}
+	return int32(v), nil
+}
+
+// key: channel:<id>:participants:empty - version mà channel được dựng lại và không có participant nào.
+// Channel rỗng không có key set, marker giúp lần đọc sau coi là đã cache thay vì rehydrate lại.
+func (r *ChannelParticipantsCacheDAO) MarkEmpty(channelID int32, version int32) (err error) {
+	r, span := r.startSpan("MarkEmpty", attrChannel(channelID))
+	defer r.observe(span, "MarkEmpty", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	key := fmt.Sprintf("channel:%d:participants:empty", channelID)
+
+	if err := r.conn.Set(key, version, 0).Err(); err != nil {
+		return redisError("redis SET error", err)
+	}
+	return nil
+}
+
+// IsEmpty true nếu marker rỗng còn khớp channel:<id>:participants:version.
+// Mọi mutation sau đó đều tăng version nên marker cũ tự mất hiệu lực.
+func (r *ChannelParticipantsCacheDAO) IsEmpty(channelID int32) (_ bool, err error) {
+	r, span := r.startSpan("IsEmpty", attrChannel(channelID))
+	defer r.observe(span, "IsEmpty", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return false, err
+	}
+	if r == nil || r.conn == nil {
+		return false, errRedisNil
+	}
+	keys := []string{
+		fmt.Sprintf("channel:%d:participants:empty", channelID),
+		fmt.Sprintf("channel:%d:participants:version", channelID),
+	}
+
+	vals, err := r.conn.MGet(keys...).Result()
+	if err != nil {
+		return false, redisError("redis MGET error", err)
+	}
+	if len(vals) != 2 || vals[0] == nil || vals[1] == nil {
+		return false, nil
+	}
+	return vals[0] == vals[1], nil
+}
+
+// NewRedisClient tạo client Redis không kết nối ngay (lazy), kết nối được mở khi có lệnh đầu tiên.
+func NewRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
 		Addr:         "localhost:6379", // host:port
 		Password:     "",               // để trống nếu không có password
 		DB:           0,                // 0–15
@@ -388,12 +566,743 @@ func ConnectRedis() *redis.Client {
 		PoolSize:     10,
 		MinIdleConns: 2,
 	})
+}
 
-	// test ping (KHÔNG context với go-redis import cũ)
-	if _, err := rdb.Ping().Result(); err != nil {
-		log.Fatalf("Không kết nối được Redis: %v", err)
-	} else {
-		fmt.Println("✅ Kết nối Redis thành công")
+// ConnectRedis tạo client rồi ping Redis, lỗi thì thử lại theo policy (xem DefaultConnectPolicy).
+// go-redis cũ không dùng context trong Ping(), mỗi lần thử bị giới hạn bởi DialTimeout / ReadTimeout.
+func ConnectRedis(ctx context.Context, policy OpPolicy) (*redis.Client, error) {
+	rdb := NewRedisClient()
+	err := retryConnect(ctx, METRICS_BACKEND_REDIS, policy, func(context.Context) error {
+		if err := rdb.Ping().Err(); err != nil {
+			return redisError("ping redis failed", err)
+		}
+		slog.Info("✅ Kết nối Redis thành công")
+		return nil
+	})
+	if err != nil {
+		rdb.Close()
+		return nil, err
+	}
+	return rdb, nil
+}
+
+// key: <name>:lock - khoá phân tán dùng SET NX PX, trả về token nếu lấy được khoá, "" nếu process khác đang giữ.
+func (r *ChannelParticipantsCacheDAO) AcquireLock(name string, ttl time.Duration) (_ string, err error) {
+	r, span := r.startSpan("AcquireLock")
+	defer r.observe(span, "AcquireLock", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return "", err
+	}
+	if r == nil || r.conn == nil {
+		return "", errRedisNil
+	}
+	key := name + ":lock"
+	token := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(rand.Int())
+
+	ok, err := r.conn.SetNX(key, token, ttl).Result()
+	if err != nil {
+		return "", redisError("redis SETNX error", err)
+	}
+	if !ok {
+		return "", nil
+	}
+	return token, nil
+}
+
+// ReleaseLock chỉ xoá khoá nếu token khớp, tránh xoá nhầm khoá của process khác khi khoá đã hết hạn.
+func (r *ChannelParticipantsCacheDAO) ReleaseLock(name string, token string) (err error) {
+	r, span := r.startSpan("ReleaseLock")
+	defer r.observe(span, "ReleaseLock", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	key := name + ":lock"
+
+	err = r.conn.Eval(`
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("DEL", KEYS[1])
+		end
+		return 0
+	`, []string{key}, token).Err()
+	if err != nil && err != redis.Nil {
+		return redisError("redis EVAL error", err)
+	}
+	return nil
+}
+
+const (
+	CHANNEL_LOCK_TTL  = time.Minute           // khoá tự hết hạn nếu process giữ khoá chết giữa chừng
+	CHANNEL_LOCK_WAIT = 10 * time.Second      // thời gian chờ tối đa khi process khác đang giữ khoá
+	CHANNEL_LOCK_POLL = 20 * time.Millisecond // chu kỳ thử lại khi chờ khoá
+)
+
+// GetChannelCacheLockName tên khoá ghi cache của channel (key channel:<id>:cache:lock).
+func GetChannelCacheLockName(channelID int32) string {
+	return fmt.Sprintf("channel:%d:cache", channelID)
+}
+
+// GetChannelCreatorsLockName tên khoá kiểm tra creator của channel (key channel:<id>:creators:lock).
+func GetChannelCreatorsLockName(channelID int32) string {
+	return fmt.Sprintf("channel:%d:creators", channelID)
+}
+
+// LockChannelCache chờ lấy khoá ghi cache của channel, trả về hàm nhả khoá.
+// Mọi thao tác ghi Redis của channel (relay, reconciler, rehydrate, rebuild stats) giữ chung khoá này
+// để việc dựng lại toàn bộ key từ ES không ghi đè thay đổi của relay đang chạy xen vào.
+func (r *ChannelParticipantsCacheDAO) LockChannelCache(channelID int32) (func(), error) {
+	return r.WaitLock(GetChannelCacheLockName(channelID), CHANNEL_LOCK_TTL, CHANNEL_LOCK_WAIT)
+}
+
+// LockChannelCreators chờ lấy khoá creator của channel, giữ quanh đoạn đọc creator - kiểm tra - ghi outbox
+// để hai mutation song song không cùng qua kiểm tra "đúng một creator" dựa trên cùng một snapshot.
+func (r *ChannelParticipantsCacheDAO) LockChannelCreators(channelID int32) (func(), error) {
+	return r.WaitLock(GetChannelCreatorsLockName(channelID), CHANNEL_LOCK_TTL, CHANNEL_LOCK_WAIT)
+}
+
+// WaitLock thử AcquireLock đến khi lấy được hoặc hết wait (lỗi ErrTimeout), trả về hàm nhả khoá.
+func (r *ChannelParticipantsCacheDAO) WaitLock(name string, ttl time.Duration, wait time.Duration) (func(), error) {
+	deadline := time.Now().Add(wait)
+	for {
+		token, err := r.AcquireLock(name, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			return func() {
+				if err := r.ReleaseLock(name, token); err != nil {
+					r.Logger().Warn("release lock failed", "lock", name, LOG_KEY_ERROR, err)
+				}
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, &Error{Kind: ErrTimeout, Backend: METRICS_BACKEND_REDIS, Msg: fmt.Sprintf("wait lock %s timed out", name)}
+		}
+		select {
+		case <-r.Context().Done():
+			return nil, redisError("wait lock canceled", r.Context().Err())
+		case <-time.After(CHANNEL_LOCK_POLL):
+		}
+	}
+}
+
+// key: channel:<id>:pending - user đang chờ duyệt yêu cầu tham gia
+func (r *ChannelParticipantsCacheDAO) SavePending(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("SavePending", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "SavePending", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	key := fmt.Sprintf("channel:%d:pending", channelID)
+
+	pipe := r.conn.TxPipeline()
+	pipe.Del(key)
+	if len(userIDs) > 0 {
+		pipe.SAdd(key, int32Members(userIDs)...)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return redisError("redis DEL/SADD pending error", err)
+	}
+	return nil
+}
+
+func (r *ChannelParticipantsCacheDAO) AddPending(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("AddPending", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "AddPending", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	key := fmt.Sprintf("channel:%d:pending", channelID)
+
+	if err := r.conn.SAdd(key, int32Members(userIDs)...).Err(); err != nil {
+		return redisError("redis SADD pending error", err)
+	}
+	return nil
+}
+
+func (r *ChannelParticipantsCacheDAO) RemovePending(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("RemovePending", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "RemovePending", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	key := fmt.Sprintf("channel:%d:pending", channelID)
+
+	if err := r.conn.SRem(key, int32Members(userIDs)...).Err(); err != nil {
+		return redisError("redis SREM pending error", err)
+	}
+	return nil
+}
+
+func (r *ChannelParticipantsCacheDAO) GetPending(channelID int32) (_ []int32, err error) {
+	r, span := r.startSpan("GetPending", attrChannel(channelID))
+	defer r.observe(span, "GetPending", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return nil, err
+	}
+	if r == nil || r.conn == nil {
+		return nil, errRedisNil
+	}
+	key := fmt.Sprintf("channel:%d:pending", channelID)
+
+	members, err := r.conn.SMembers(key).Result()
+	if err != nil {
+		return nil, redisError("redis SMEMBERS pending error", err)
+	}
+	out := make([]int32, 0, len(members))
+	for _, s := range members {
+		v, convErr := strconv.ParseInt(s, 10, 32)
+		if convErr != nil {
+			continue
+		}
+		out = append(out, int32(v))
+	}
+	return out, nil
+}
+
+// ApprovePending chuyển user từ channel:<id>:pending sang channel:<id>:participants trong một MULTI/EXEC,
+// không có thời điểm nào user nằm ở cả hai set hoặc không nằm ở set nào.
+func (r *ChannelParticipantsCacheDAO) ApprovePending(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("ApprovePending", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "ApprovePending", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
 	}
-	return rdb
+	timeStart := time.Now()
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	members := int32Members(userIDs)
+
+	pipe := r.conn.TxPipeline()
+	pipe.SRem(fmt.Sprintf("channel:%d:pending", channelID), members...)
+	pipe.Eval(addUsersScript, []string{fmt.Sprintf("channel:%d:participants", channelID)}, members...)
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return redisError("redis pipeline SREM/SADD approve error", err)
+	}
+
+	logTiming(r.Logger(), "ApprovePending", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs))
+	return nil
+}
+
+// int32Members chuyển []int32 → []interface{} cho SADD / SREM
+func int32Members(userIDs []int32) []interface{} {
+	members := make([]interface{}, len(userIDs))
+	for i, u := range userIDs {
+		members[i] = u
+	}
+	return members
+}
+
+// Reverse index user:<uid>:channels chỉ được coi là đầy đủ khi có field USER_CHANNELS_FIELD_COMPLETE (ghi bởi
+// SaveUserChannels / FinishUserChannels), hash chỉ có marker này là user không ở channel nào.
+// Trong lúc dựng lại từ ES, hash mang field USER_CHANNELS_FIELD_BUILDING = token của lần dựng: relay vẫn ghi vào,
+// channel bị xoá được đánh dấu USER_CHANNELS_REMOVED để snapshot ES cũ hơn không ghi đè lại.
+const (
+	USER_CHANNELS_FIELD_COMPLETE = "_"
+	USER_CHANNELS_FIELD_BUILDING = "_building"
+	USER_CHANNELS_REMOVED        = "-"
+)
+
+// setUserChannelScript chỉ ghi state khi index đã đầy đủ hoặc đang được dựng lại; chưa có key thì bỏ qua,
+// lần đọc sau sẽ dựng lại từ ES thay vì trả về một hash thiếu channel.
+const setUserChannelScript = `
+if redis.call("HEXISTS", KEYS[1], "_") == 1 or redis.call("HEXISTS", KEYS[1], "_building") == 1 then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`
+
+// removeUserChannelScript xoá field, nếu index đang được dựng lại thì để lại dấu xoá cho FinishUserChannels.
+const removeUserChannelScript = `
+if redis.call("HEXISTS", KEYS[1], "_building") == 1 then
+	redis.call("HSET", KEYS[1], ARGV[1], "-")
+	return 1
+end
+return redis.call("HDEL", KEYS[1], ARGV[1])
+`
+
+// finishUserChannelsScript gộp snapshot ES vào hash đang dựng (ARGV[1] = token): field relay đã ghi trong lúc
+// dựng là mới hơn snapshot nên giữ nguyên (HSETNX), dấu xoá bị dọn, cuối cùng đánh dấu index đầy đủ.
+// Token không khớp (lần dựng khác đã bắt đầu lại) thì bỏ qua.
+const finishUserChannelsScript = `
+if redis.call("HGET", KEYS[1], "_building") ~= ARGV[1] then
+	return 0
+end
+for i = 2, #ARGV, 2 do
+	redis.call("HSETNX", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+local all = redis.call("HGETALL", KEYS[1])
+for i = 1, #all, 2 do
+	if all[i + 1] == "-" then
+		redis.call("HDEL", KEYS[1], all[i])
+	end
+end
+redis.call("HDEL", KEYS[1], "_building")
+redis.call("HSET", KEYS[1], "_", 1)
+return 1
+`
+
+// GetUserChannelsKey key reverse index của user.
+func GetUserChannelsKey(userID int32) string {
+	return fmt.Sprintf("user:%d:channels", userID)
+}
+
+// GetUserChannelsLockName tên khoá dựng lại reverse index của user (key user:<uid>:channels:lock).
+func GetUserChannelsLockName(userID int32) string {
+	return GetUserChannelsKey(userID)
+}
+
+// LockUserChannels chờ lấy khoá dựng lại reverse index của user, trả về hàm nhả khoá.
+func (r *ChannelParticipantsCacheDAO) LockUserChannels(userID int32) (func(), error) {
+	return r.WaitLock(GetUserChannelsLockName(userID), CHANNEL_LOCK_TTL, CHANNEL_LOCK_WAIT)
+}
+
+// encodeUserChannel giá trị field của user:<uid>:channels: "<state>" hoặc "<state>:<banned_until_date>"
+// khi lệnh cấm có thời hạn, để lúc đọc gỡ được lệnh cấm đã hết hạn.
+func encodeUserChannel(it UserChannelDO) string {
+	v := strconv.Itoa(int(it.State))
+	if it.BannedUntilDate > 0 {
+		v += ":" + strconv.Itoa(int(it.BannedUntilDate))
+	}
+	return v
+}
+
+// parseUserChannel đọc field của user:<uid>:channels, false nếu không phải channel (marker, dấu xoá).
+func parseUserChannel(field, value string) (UserChannelDO, bool) {
+	cid, err := strconv.ParseInt(field, 10, 32)
+	if err != nil {
+		return UserChannelDO{}, false
+	}
+	stateStr, untilStr, hasUntil := strings.Cut(value, ":")
+	state, err := strconv.ParseInt(stateStr, 10, 8)
+	if err != nil {
+		return UserChannelDO{}, false
+	}
+	it := UserChannelDO{ChannelID: int32(cid), State: ParticipantState(state)}
+	if hasUntil {
+		until, err := strconv.ParseInt(untilStr, 10, 32)
+		if err != nil {
+			return UserChannelDO{}, false
+		}
+		it.BannedUntilDate = int32(until)
+	}
+	return it, true
+}
+
+// key: user:<uid>:channels - hash channel_id -> state của user trong channel (reverse index theo user).
+// channels: user_id -> channel của user.
+func (r *ChannelParticipantsCacheDAO) SetUserChannelStates(channelID int32, channels map[int32]UserChannelDO) (err error) {
+	r, span := r.startSpan("SetUserChannelStates", attrChannel(channelID), attrCount(len(channels)))
+	defer r.observe(span, "SetUserChannelStates", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	timeStart := time.Now()
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	field := strconv.Itoa(int(channelID))
+
+	pipe := r.conn.Pipeline()
+	for uid, it := range channels {
+		pipe.Eval(setUserChannelScript, []string{GetUserChannelsKey(uid)}, field, encodeUserChannel(it))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return redisError("redis pipeline EVAL user channels error", err)
+	}
+
+	logTiming(r.Logger(), "SetUserChannelStates", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(channels))
+	return nil
+}
+
+// RemoveUserChannel gỡ channel khỏi reverse index của từng user (document đã bị xoá cứng).
+func (r *ChannelParticipantsCacheDAO) RemoveUserChannel(channelID int32, userIDs []int32) (err error) {
+	r, span := r.startSpan("RemoveUserChannel", attrChannel(channelID), attrCount(len(userIDs)))
+	defer r.observe(span, "RemoveUserChannel", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	field := strconv.Itoa(int(channelID))
+
+	pipe := r.conn.Pipeline()
+	for _, uid := range userIDs {
+		pipe.Eval(removeUserChannelScript, []string{GetUserChannelsKey(uid)}, field)
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return redisError("redis pipeline EVAL user channels error", err)
+	}
+	return nil
+}
+
+// SaveUserChannels ghi lại toàn bộ reverse index của một user, states rỗng vẫn ghi marker đầy đủ
+// để lần đọc sau không phải quét lại ES.
+func (r *ChannelParticipantsCacheDAO) SaveUserChannels(userID int32, channels map[int32]UserChannelDO) (err error) {
+	r, span := r.startSpan("SaveUserChannels", attrUser(userID), attrCount(len(channels)))
+	defer r.observe(span, "SaveUserChannels", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	key := GetUserChannelsKey(userID)
+
+	fields := make(map[string]interface{}, len(channels)+1)
+	for cid, it := range channels {
+		fields[strconv.Itoa(int(cid))] = encodeUserChannel(it)
+	}
+	fields[USER_CHANNELS_FIELD_COMPLETE] = 1
+
+	pipe := r.conn.TxPipeline()
+	pipe.Del(key)
+	pipe.HMSet(key, fields)
+	if _, err := pipe.Exec(); err != nil {
+		return redisError("redis DEL/HMSET user channels error", err)
+	}
+	return nil
+}
+
+// BeginUserChannels bắt đầu dựng lại reverse index của user: xoá hash cũ và ghi token của lần dựng,
+// gọi trước khi quét ES rồi truyền token cho FinishUserChannels.
+func (r *ChannelParticipantsCacheDAO) BeginUserChannels(userID int32) (_ string, err error) {
+	r, span := r.startSpan("BeginUserChannels", attrUser(userID))
+	defer r.observe(span, "BeginUserChannels", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return "", err
+	}
+	if r == nil || r.conn == nil {
+		return "", errRedisNil
+	}
+	key := GetUserChannelsKey(userID)
+	token := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.Itoa(rand.Int())
+
+	pipe := r.conn.TxPipeline()
+	pipe.Del(key)
+	pipe.HSet(key, USER_CHANNELS_FIELD_BUILDING, token)
+	if _, err := pipe.Exec(); err != nil {
+		return "", redisError("redis DEL/HSET user channels error", err)
+	}
+	return token, nil
+}
+
+// FinishUserChannels gộp channels quét từ ES vào index đang dựng với token, trả về false nếu lần dựng
+// đã bị lần khác thay thế (index không được đánh dấu đầy đủ).
+func (r *ChannelParticipantsCacheDAO) FinishUserChannels(userID int32, token string, channels map[int32]UserChannelDO) (_ bool, err error) {
+	r, span := r.startSpan("FinishUserChannels", attrUser(userID), attrCount(len(channels)))
+	defer r.observe(span, "FinishUserChannels", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return false, err
+	}
+	if r == nil || r.conn == nil {
+		return false, errRedisNil
+	}
+	args := make([]interface{}, 0, 1+2*len(channels))
+	args = append(args, token)
+	for cid, it := range channels {
+		args = append(args, strconv.Itoa(int(cid)), encodeUserChannel(it))
+	}
+
+	n, err := r.conn.Eval(finishUserChannelsScript, []string{GetUserChannelsKey(userID)}, args...).Int64()
+	if err != nil && err != redis.Nil {
+		return false, redisError("redis EVAL user channels error", err)
+	}
+	return n == 1, nil
+}
+
+// GetUserChannels trả về (nil, false, nil) nếu index của user chưa có hoặc chưa dựng xong.
+func (r *ChannelParticipantsCacheDAO) GetUserChannels(userID int32) (_ map[int32]UserChannelDO, _ bool, err error) {
+	r, span := r.startSpan("GetUserChannels", attrUser(userID))
+	defer r.observe(span, "GetUserChannels", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return nil, false, err
+	}
+	if r == nil || r.conn == nil {
+		return nil, false, errRedisNil
+	}
+
+	fields, err := r.conn.HGetAll(GetUserChannelsKey(userID)).Result()
+	if err != nil {
+		return nil, false, redisError("redis HGETALL error", err)
+	}
+	_, ok := fields[USER_CHANNELS_FIELD_COMPLETE]
+	r.Metrics().cacheResult("user_channels", ok)
+	if !ok {
+		return nil, false, nil
+	}
+	out := make(map[int32]UserChannelDO, len(fields))
+	for k, v := range fields {
+		if it, ok := parseUserChannel(k, v); ok {
+			out[it.ChannelID] = it
+		}
+	}
+	return out, true, nil
+}
+
+// DropChannel xoá mọi key Redis của channel: set, CSV string, version, marker rỗng, hàng chờ duyệt và bộ đếm.
+func (r *ChannelParticipantsCacheDAO) DropChannel(channelID int32) (err error) {
+	r, span := r.startSpan("DropChannel", attrChannel(channelID))
+	defer r.observe(span, "DropChannel", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	keys := []string{
+		fmt.Sprintf("channel:%d:participants", channelID),
+		fmt.Sprintf("channel:%d:participants:str", channelID),
+		fmt.Sprintf("channel:%d:participants:version", channelID),
+		fmt.Sprintf("channel:%d:participants:empty", channelID),
+		fmt.Sprintf("channel:%d:pending", channelID),
+		fmt.Sprintf("channel:%d:stats", channelID),
+		fmt.Sprintf("channel:%d:stats:users", channelID),
+	}
+	if err := r.conn.Del(keys...).Err(); err != nil {
+		return redisError("redis DEL error", err)
+	}
+	return nil
+}
+
+// statsScript cập nhật channel:<id>:stats theo mask mới của từng user, mask cũ lưu ở channel:<id>:stats:users.
+// Chỉ cộng / trừ các bit thay đổi nên chạy lại cùng dữ liệu không làm lệch bộ đếm.
+// Khi chưa có key stats (chưa được dựng từ ES) và không phải reset thì bỏ qua, lần đọc sau sẽ dựng lại.
+const statsScript = `
+local fields = {"total", "active", "admins", "creators", "banned", "kicked", "left", "hidden", "pending"}
+if ARGV[1] == "1" then
+	redis.call("DEL", KEYS[1], KEYS[2])
+	for _, f in ipairs(fields) do
+		redis.call("HSET", KEYS[1], f, 0)
+	end
+elseif redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+for i = 2, #ARGV, 2 do
+	local uid = ARGV[i]
+	local new = tonumber(ARGV[i + 1])
+	local old = tonumber(redis.call("HGET", KEYS[2], uid) or "0")
+	if old ~= new then
+		for b = 1, #fields do
+			local bit = 2 ^ (b - 1)
+			local o = math.floor(old / bit) % 2
+			local n = math.floor(new / bit) % 2
+			if o ~= n then
+				redis.call("HINCRBY", KEYS[1], fields[b], n - o)
+			end
+		end
+		if new == 0 then
+			redis.call("HDEL", KEYS[2], uid)
+		else
+			redis.call("HSET", KEYS[2], uid, new)
+		end
+	end
+end
+return 1
+`
+
+// key: channel:<id>:stats - bộ đếm theo vai trò / trạng thái, channel:<id>:stats:users - mask của từng user.
+// masks: user_id -> mask (STATS_FLAG_*), mask = 0 là user đã bị xoá. reset = true thì dựng lại từ đầu.
+func (r *ChannelParticipantsCacheDAO) ApplyStats(channelID int32, masks map[int32]int32, reset bool) (err error) {
+	r, span := r.startSpan("ApplyStats", attrChannel(channelID), attrCount(len(masks)))
+	defer r.observe(span, "ApplyStats", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	timeStart := time.Now()
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	keys := []string{
+		fmt.Sprintf("channel:%d:stats", channelID),
+		fmt.Sprintf("channel:%d:stats:users", channelID),
+	}
+	if err := r.evalStats(keys, masks, reset); err != nil {
+		return err
+	}
+
+	logTiming(r.Logger(), "ApplyStats", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(masks))
+	return nil
+}
+
+// swapStatsScript đổi 2 key tạm vào chỗ channel:<id>:stats / channel:<id>:stats:users trong một lần.
+// Channel không có user nào thì không có key mask tạm, xoá key mask cũ.
+const swapStatsScript = `
+redis.call("RENAME", KEYS[1], KEYS[3])
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	redis.call("RENAME", KEYS[2], KEYS[4])
+else
+	redis.call("DEL", KEYS[4])
+end
+return 1
+`
+
+// ReplaceStats dựng bộ đếm mới vào key tạm rồi RENAME đè lên key thật, người đọc không bao giờ thấy
+// bộ đếm đang dựng dở (ApplyStats với reset chia nhiều lần EVAL nên có thể lộ trạng thái giữa chừng).
+func (r *ChannelParticipantsCacheDAO) ReplaceStats(channelID int32, masks map[int32]int32) (err error) {
+	r, span := r.startSpan("ReplaceStats", attrChannel(channelID), attrCount(len(masks)))
+	defer r.observe(span, "ReplaceStats", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	timeStart := time.Now()
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	suffix := ":tmp:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	keys := []string{
+		fmt.Sprintf("channel:%d:stats", channelID),
+		fmt.Sprintf("channel:%d:stats:users", channelID),
+	}
+	tmp := []string{keys[0] + suffix, keys[1] + suffix}
+
+	if err := r.evalStats(tmp, masks, true); err != nil {
+		if delErr := r.conn.Del(tmp...).Err(); delErr != nil {
+			r.Logger().Warn("drop temp stats keys failed", LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_ERROR, delErr)
+		}
+		return err
+	}
+	if err := r.conn.Eval(swapStatsScript, append(tmp, keys...)).Err(); err != nil && err != redis.Nil {
+		return redisError("redis EVAL swap stats error", err)
+	}
+
+	logTiming(r.Logger(), "ReplaceStats", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(masks))
+	return nil
+}
+
+// evalStats chạy statsScript trên keys (bộ đếm, mask từng user), chia nhỏ để mỗi lần EVAL không block Redis quá lâu.
+func (r *ChannelParticipantsCacheDAO) evalStats(keys []string, masks map[int32]int32, reset bool) error {
+	const batch = 5000
+	args := make([]interface{}, 0, 1+2*min(len(masks), batch))
+	flush := func() error {
+		if len(args) <= 1 && !reset {
+			return nil
+		}
+		if err := r.conn.Eval(statsScript, keys, args...).Err(); err != nil && err != redis.Nil {
+			return redisError("redis EVAL stats error", err)
+		}
+		reset = false
+		args = args[:0]
+		return nil
+	}
+	resetArg := func() interface{} {
+		if reset {
+			return "1"
+		}
+		return "0"
+	}
+
+	args = append(args, resetArg())
+	for uid, mask := range masks {
+		args = append(args, uid, mask)
+		if len(args) >= 1+2*batch {
+			if err := flush(); err != nil {
+				return err
+			}
+			args = append(args, resetArg())
+		}
+	}
+	return flush()
+}
+
+// GetStats đọc bộ đếm của channel, ok = false nếu chưa có key.
+func (r *ChannelParticipantsCacheDAO) GetStats(channelID int32) (*ChannelStatsDO, bool, error) {
+	res, err := r.GetStatsBatch([]int32{channelID})
+	if err != nil {
+		return nil, false, err
+	}
+	stats, ok := res[channelID]
+	return stats, ok, nil
+}
+
+// GetStatsBatch đọc bộ đếm của nhiều channel trong một pipeline, channel chưa có key không nằm trong map.
+func (r *ChannelParticipantsCacheDAO) GetStatsBatch(channelIDs []int32) (_ map[int32]*ChannelStatsDO, err error) {
+	r, span := r.startSpan("GetStatsBatch", attrCount(len(channelIDs)))
+	defer r.observe(span, "GetStatsBatch", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return nil, err
+	}
+	if r == nil || r.conn == nil {
+		return nil, errRedisNil
+	}
+	pipe := r.conn.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(channelIDs))
+	for i, cid := range channelIDs {
+		cmds[i] = pipe.HGetAll(fmt.Sprintf("channel:%d:stats", cid))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, redisError("redis pipeline HGETALL stats error", err)
+	}
+
+	out := make(map[int32]*ChannelStatsDO, len(channelIDs))
+	for i, cid := range channelIDs {
+		fields := cmds[i].Val()
+		r.Metrics().cacheResult("stats", len(fields) > 0)
+		if len(fields) == 0 {
+			continue
+		}
+		get := func(name string) int64 {
+			v, _ := strconv.ParseInt(fields[name], 10, 64)
+			return v
+		}
+		out[cid] = &ChannelStatsDO{
+			ChannelID: cid,
+			Total:     get("total"),
+			Active:    get("active"),
+			Admins:    get("admins"),
+			Creators:  get("creators"),
+			Banned:    get("banned"),
+			Kicked:    get("kicked"),
+			Left:      get("left"),
+			Hidden:    get("hidden"),
+			Pending:   get("pending"),
+		}
+	}
+	return out, nil
+}
+
+// InvalidateStats xoá bộ đếm của channel, lần đọc sau sẽ dựng lại từ ES.
+func (r *ChannelParticipantsCacheDAO) InvalidateStats(channelID int32) (err error) {
+	r, span := r.startSpan("InvalidateStats", attrChannel(channelID))
+	defer r.observe(span, "InvalidateStats", time.Now(), &err)
+	if err = r.allow(); err != nil {
+		return err
+	}
+	if r == nil || r.conn == nil {
+		return errRedisNil
+	}
+	err = r.conn.Del(fmt.Sprintf("channel:%d:stats", channelID), fmt.Sprintf("channel:%d:stats:users", channelID)).Err()
+	if err != nil {
+		return redisError("redis DEL stats error", err)
+	}
+	return nil
 }
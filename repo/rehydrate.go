@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheRehydrator dựng lại 2 key Redis của channel từ ES khi cache bị miss (flush / hết hạn).
+// Dùng singleflight để nhiều request miss cùng lúc chỉ kích hoạt một lần rebuild cho mỗi channel.
+type CacheRehydrator struct {
+	es    *ElasticChannelParticipantsDAO
+	cache *ChannelParticipantsCacheDAO
+	group singleflight.Group
+}
+
+func NewCacheRehydrator(es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO) *CacheRehydrator {
+	return &CacheRehydrator{es: es, cache: cache}
+}
+
+// GetList đọc channel:<id>:participants, miss thì rebuild từ ES.
+// Channel rỗng không có key set, được coi là đã cache khi marker rỗng còn khớp version (xem MarkEmpty).
+func (h *CacheRehydrator) GetList(channelID int32) ([]int32, error) {
+	list, err := h.cache.GetList(channelID)
+	if err == nil {
+		return list, nil
+	}
+	if isDegradable(err) {
+		return h.readElastic(channelID, err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	empty, err := h.cache.IsEmpty(channelID)
+	if isDegradable(err) {
+		return h.readElastic(channelID, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		return []int32{}, nil
+	}
+	return h.Rehydrate(channelID)
+}
+
+// GetString đọc channel:<id>:participants:str, miss thì rebuild từ ES.
+func (h *CacheRehydrator) GetString(channelID int32) ([]int32, error) {
+	list, err := h.cache.GetString(channelID)
+	if err == nil {
+		return list, nil
+	}
+	if isDegradable(err) {
+		return h.readElastic(channelID, err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return h.Rehydrate(channelID)
+}
+
+// Rehydrate scroll participants đang active của channel từ channel_participants_NNN
+// rồi ghi lại cả set, CSV string và version hiện tại lên Redis.
+func (h *CacheRehydrator) Rehydrate(channelID int32) ([]int32, error) {
+	v, err, _ := h.group.Do(strconv.Itoa(int(channelID)), func() (interface{}, error) {
+		return h.rebuild(channelID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]int32), nil
+}
+
+// readElastic đọc thẳng participants active từ ES khi Redis lỗi / breaker Redis đang mở, không ghi lại cache.
+func (h *CacheRehydrator) readElastic(channelID int32, cacheErr error) ([]int32, error) {
+	h.es.Logger().Warn("redis unavailable, serving participants from elastic",
+		LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_ERROR, cacheErr)
+	list := []int32{}
+	err := h.es.ScrollActiveUserIDs(channelID, func(ids []int32) error {
+		list = append(list, ids...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// rebuild ghi lại cache trong khoá cache của channel (dùng chung với relay / reconciler) và đọc ES
+// sau khi đã lấy khoá, để không ghi đè bằng snapshot cũ hơn thay đổi relay vừa áp dụng lên Redis.
+func (h *CacheRehydrator) rebuild(channelID int32) ([]int32, error) {
+	timeStart := time.Now()
+
+	unlock, err := h.cache.LockChannelCache(channelID)
+	if isDegradable(err) {
+		// Redis lỗi / process khác giữ khoá quá lâu: trả thẳng từ ES, không ghi cache
+		return h.readElastic(channelID, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Lấy version trước khi scroll: nếu có mutation chen vào, version Redis sẽ thấp hơn ES
+	// và bước Redis của relay (chờ khoá này) sẽ cập nhật lại.
+	meta, err := h.es.GetVersion(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []int32{}
+	err = h.es.ScrollActiveUserIDs(channelID, func(ids []int32) error {
+		list = append(list, ids...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.cache.SaveAllData(channelID, list); isDegradable(err) {
+		// Redis không ghi được: vẫn trả về danh sách từ ES, lần đọc sau sẽ rehydrate lại
+		h.es.Logger().Warn("rehydrate skipped, redis unavailable", LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_ERROR, err)
+		return list, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("rehydrate redis set channel %d failed: %w", channelID, err)
+	}
+	if err := h.cache.SaveString(channelID, list); err != nil {
+		return nil, fmt.Errorf("rehydrate redis string channel %d failed: %w", channelID, err)
+	}
+	if err := h.cache.SetVersion(channelID, meta.Version); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		if err := h.cache.MarkEmpty(channelID, meta.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	logTiming(h.es.Logger(), "Rehydrate", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(list))
+	return list, nil
+}
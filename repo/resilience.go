@@ -0,0 +1,451 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	BREAKER_STATE_CLOSED    = "closed"
+	BREAKER_STATE_OPEN      = "open"
+	BREAKER_STATE_HALF_OPEN = "half_open" // cho một lời gọi thử đi qua, thành công thì đóng mạch
+)
+
+// ErrCircuitOpen lỗi khi circuit breaker của backend đang mở, errors.Is(err, ErrUnavailable) cũng đúng.
+var ErrCircuitOpen error = &Error{Kind: ErrUnavailable, Msg: "circuit breaker open"}
+
+// OpPolicy timeout và retry của một op DAO.
+type OpPolicy struct {
+	Timeout     time.Duration // 0 = không giới hạn (op scroll gọi callback của người dùng)
+	MaxRetries  int           // số lần thử lại request / lệnh idempotent
+	BaseBackoff time.Duration // backoff lần đầu, nhân đôi sau mỗi lần, có jitter
+	MaxBackoff  time.Duration
+}
+
+// BreakerConfig cấu hình circuit breaker của mỗi backend.
+type BreakerConfig struct {
+	FailureThreshold int           // số op lỗi (unavailable / timeout) liên tiếp để mở mạch
+	OpenTimeout      time.Duration // thời gian mở mạch trước khi chuyển sang half-open
+}
+
+// ResilienceConfig policy mặc định, policy riêng theo op và cấu hình breaker.
+// Key của Ops là "<backend>.<op>" (ví dụ "elastic.SaveAllUsers") hoặc chỉ "<op>" cho cả 2 backend.
+type ResilienceConfig struct {
+	Default OpPolicy
+	Ops     map[string]OpPolicy
+	Breaker BreakerConfig
+}
+
+// DefaultResilienceConfig op đọc / ghi thường giới hạn 10s, op bulk 2 phút, op scroll không giới hạn.
+func DefaultResilienceConfig() ResilienceConfig {
+	bulk := OpPolicy{Timeout: 2 * time.Minute, MaxRetries: 2, BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	scroll := OpPolicy{MaxRetries: 2, BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	cfg := ResilienceConfig{
+		Default: OpPolicy{Timeout: 10 * time.Second, MaxRetries: 2, BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second},
+		Ops:     map[string]OpPolicy{},
+		Breaker: BreakerConfig{FailureThreshold: 5, OpenTimeout: 30 * time.Second},
+	}
+	for _, op := range []string{"SaveAllUsers", "AddDataToCache", "DeleteUsers", "ApplyAction", "ApplyActionBatches", "UpdateRights", "DropChannel", "PurgeDeparted", "ScrubUserChanges"} {
+		cfg.Ops[METRICS_BACKEND_ELASTIC+"."+op] = bulk
+	}
+	for _, op := range []string{"ScrollActiveUserIDs", "ScrollAdmins", "ScrollPendingUserIDs", "ScrollParticipants", "ScrollAllUserIDs", "ScrollUserChannels",
+		"ScrollExpiredBans", "ScrollDepartedUserIDs", "ScanCreatorViolations"} {
+		cfg.Ops[METRICS_BACKEND_ELASTIC+"."+op] = scroll
+	}
+	cfg.Ops[METRICS_BACKEND_REDIS+".ScanMembers"] = scroll
+	return cfg
+}
+
+// CircuitBreaker ngắt các lời gọi tới backend sau FailureThreshold lỗi liên tiếp,
+// sau OpenTimeout cho một lời gọi thử đi qua (half-open).
+type CircuitBreaker struct {
+	backend string
+	cfg     BreakerConfig
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool // half-open: đang có lời gọi thử
+}
+
+func NewCircuitBreaker(backend string, cfg BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{backend: backend, cfg: cfg, state: BREAKER_STATE_CLOSED}
+}
+
+// State trạng thái hiện tại (closed / open / half_open).
+func (b *CircuitBreaker) State() string {
+	if b == nil {
+		return BREAKER_STATE_CLOSED
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BREAKER_STATE_OPEN && time.Since(b.openedAt) >= b.cfg.OpenTimeout {
+		return BREAKER_STATE_HALF_OPEN
+	}
+	return b.state
+}
+
+// Allow trả về ErrCircuitOpen nếu mạch đang mở, hoặc đang half-open và đã có lời gọi thử.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil || b.cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BREAKER_STATE_OPEN:
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		b.state = BREAKER_STATE_HALF_OPEN
+		b.probing = true
+		return nil
+	case BREAKER_STATE_HALF_OPEN:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record ghi kết quả của lời gọi đã được Allow. Chỉ lỗi unavailable / timeout mới tính là lỗi,
+// lỗi nghiệp vụ (not found, invalid input ...) chứng tỏ backend vẫn phản hồi.
+func (b *CircuitBreaker) Record(err error) {
+	if b == nil || b.cfg.FailureThreshold <= 0 || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	if errors.Is(err, ErrShuttingDown) {
+		// op đã qua Allow (có thể là lời gọi thử khi half-open) nhưng bị từ chối trước khi gọi backend:
+		// không tính là lỗi, trả lại lượt thử để op sau được gọi thử
+		b.mu.Lock()
+		b.probing = false
+		b.mu.Unlock()
+		return
+	}
+	kind := classifyCommon(err)
+	failed := kind == ErrUnavailable || kind == ErrTimeout
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.state
+	b.probing = false
+	if !failed {
+		b.state = BREAKER_STATE_CLOSED
+		b.failures = 0
+	} else {
+		b.failures++
+		if b.state == BREAKER_STATE_HALF_OPEN || b.failures >= b.cfg.FailureThreshold {
+			b.state = BREAKER_STATE_OPEN
+			b.openedAt = time.Now()
+		}
+	}
+	if b.state != prev {
+		slog.Warn("circuit breaker state changed", "backend", b.backend, "from", prev, "to", b.state, "failures", b.failures)
+	}
+}
+
+// Resilience giữ cấu hình timeout / retry và circuit breaker của từng backend, dùng chung cho các DAO.
+type Resilience struct {
+	cfg      ResilienceConfig
+	breakers map[string]*CircuitBreaker
+}
+
+func NewResilience(cfg ResilienceConfig) *Resilience {
+	return &Resilience{
+		cfg: cfg,
+		breakers: map[string]*CircuitBreaker{
+			METRICS_BACKEND_ELASTIC: NewCircuitBreaker(METRICS_BACKEND_ELASTIC, cfg.Breaker),
+			METRICS_BACKEND_REDIS:   NewCircuitBreaker(METRICS_BACKEND_REDIS, cfg.Breaker),
+		},
+	}
+}
+
+// Policy policy của op trên backend, không cấu hình riêng thì dùng Default.
+func (r *Resilience) Policy(backend, op string) OpPolicy {
+	if r == nil {
+		return OpPolicy{}
+	}
+	if p, ok := r.cfg.Ops[backend+"."+op]; ok {
+		return p
+	}
+	if p, ok := r.cfg.Ops[op]; ok {
+		return p
+	}
+	return r.cfg.Default
+}
+
+// Breaker circuit breaker của backend (elastic / redis).
+func (r *Resilience) Breaker(backend string) *CircuitBreaker {
+	if r == nil {
+		return nil
+	}
+	return r.breakers[backend]
+}
+
+// BreakerStates trạng thái breaker của từng backend.
+func (r *Resilience) BreakerStates() map[string]string {
+	out := map[string]string{}
+	if r == nil {
+		return out
+	}
+	for backend, b := range r.breakers {
+		out[backend] = b.State()
+	}
+	return out
+}
+
+// opCall thông tin của op DAO đang chạy, truyền qua context tới retrier của request ES / lệnh Redis.
+type opCall struct {
+	backend string
+	op      string
+	policy  OpPolicy
+	metrics *Metrics
+	nested  bool // gọi bên trong một op khác của cùng backend, breaker chỉ kiểm tra op ngoài cùng
+}
+
+type opCallKey struct{}
+
+func withOpCall(ctx context.Context, c *opCall) context.Context {
+	return context.WithValue(ctx, opCallKey{}, c)
+}
+
+func opCallFrom(ctx context.Context) *opCall {
+	c, _ := ctx.Value(opCallKey{}).(*opCall)
+	return c
+}
+
+// beginOp gắn policy của op vào ctx và áp dụng timeout, cancel != nil phải được gọi khi op kết thúc.
+func (r *Resilience) beginOp(ctx context.Context, backend, op string, m *Metrics) (context.Context, context.CancelFunc) {
+	if r == nil {
+		return ctx, nil
+	}
+	c := &opCall{backend: backend, op: op, policy: r.Policy(backend, op), metrics: m}
+	if parent := opCallFrom(ctx); parent != nil && parent.backend == backend {
+		c.nested = true
+	}
+	ctx = withOpCall(ctx, c)
+	if c.policy.Timeout <= 0 {
+		return ctx, nil
+	}
+	return context.WithTimeout(ctx, c.policy.Timeout)
+}
+
+// backoff thời gian chờ trước lần thử thứ attempt (bắt đầu từ 1): full jitter trong [0, min(max, base*2^(attempt-1))].
+func (p OpPolicy) backoff(attempt int) time.Duration {
+	if p.BaseBackoff <= 0 {
+		return 0
+	}
+	d := p.BaseBackoff << (attempt - 1)
+	if p.MaxBackoff > 0 && (d > p.MaxBackoff || d <= 0) {
+		d = p.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// sleepRetry chờ backoff, trả về false nếu ctx hết hạn trước khi kịp thử lại.
+func sleepRetry(ctx context.Context, wait time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		return false
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// elasticIdempotentEndpoints các endpoint POST chỉ đọc, thử lại không làm thay đổi dữ liệu.
+// Scroll không nằm trong danh sách vì mỗi lần gọi đẩy con trỏ sang trang kế tiếp.
+var elasticIdempotentEndpoints = map[string]bool{
+	"search": true, "msearch": true, "mget": true, "count": true, "refresh": true,
+}
+
+// ElasticRetrier retrier cho elastic.SetRetrier: chỉ thử lại request idempotent (GET / HEAD / search ...)
+// theo policy của op trong ctx, dùng kèm elastic.SetRetryStatusCodes(429, 502, 503, 504).
+func (r *Resilience) ElasticRetrier() elastic.Retrier {
+	return elastic.RetrierFunc(func(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+		if req == nil || errors.Is(err, ErrCircuitOpen) {
+			return 0, false, nil
+		}
+		c := opCallFrom(ctx)
+		policy := r.cfg.Default
+		if c != nil {
+			policy = c.policy
+		}
+		endpoint := elasticEndpoint(req.Method, req.URL.Path)
+		idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || elasticIdempotentEndpoints[endpoint]
+		if !idempotent || retry > policy.MaxRetries {
+			return 0, false, nil
+		}
+		wait := policy.backoff(retry)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return 0, false, nil
+		}
+		if resp != nil && resp.Body != nil {
+			// response lỗi bị bỏ qua khi thử lại, đóng body để trả connection về pool
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if c != nil {
+			c.metrics.IncRetry(METRICS_BACKEND_ELASTIC, c.op)
+		}
+		return wait, true, nil
+	})
+}
+
+// redisIdempotentCommands lệnh Redis thử lại được mà không làm sai dữ liệu.
+// EVAL (stats, release lock), SETNX (lock) và INCR không nằm trong danh sách, SET có NX / XX bị loại ở redisIdempotent.
+var redisIdempotentCommands = map[string]bool{
+	"get": true, "mget": true, "exists": true, "smembers": true, "sscan": true, "scard": true, "sismember": true,
+	"hget": true, "hgetall": true, "ttl": true, "ping": true,
+	"set": true, "del": true, "unlink": true, "sadd": true, "srem": true, "hset": true, "hmset": true, "hdel": true, "expire": true,
+	"multi": true, "exec": true,
+}
+
+// redisIdempotent lệnh có thử lại được không. SET ... NX (AcquireLock) không thử lại được: lần đầu đã lấy khoá
+// nhưng mất reply thì lần thử lại trả về false, caller tưởng khoá đang bận trong khi chính nó đang giữ.
+func redisIdempotent(cmd redis.Cmder) bool {
+	if !redisIdempotentCommands[cmd.Name()] {
+		return false
+	}
+	if cmd.Name() == "set" {
+		for _, arg := range cmd.Args()[1:] {
+			if s, ok := arg.(string); ok && (strings.EqualFold(s, "nx") || strings.EqualFold(s, "xx")) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// retryableRedisError lỗi mạng / timeout, không tính redis.Nil và lỗi do Redis trả về.
+func retryableRedisError(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	kind := classifyCommon(err)
+	return kind == ErrUnavailable || kind == ErrTimeout
+}
+
+// retryRedis bản sao client gắn ctx, thử lại lệnh / pipeline idempotent lỗi mạng theo policy của op trong ctx.
+// go-redis v6 không hỗ trợ context nên timeout của op chỉ chặn các lần thử lại,
+// mỗi lần thử vẫn bị giới hạn bởi ReadTimeout / WriteTimeout của client.
+func retryRedis(ctx context.Context, c *redis.Client) *redis.Client {
+	call := opCallFrom(ctx)
+	if call == nil || call.policy.MaxRetries <= 0 {
+		return c
+	}
+	c = c.WithContext(ctx)
+	retry := func(idempotent bool, do func() error) error {
+		err := do()
+		for attempt := 1; idempotent && attempt <= call.policy.MaxRetries && retryableRedisError(err); attempt++ {
+			if !sleepRetry(ctx, call.policy.backoff(attempt)) {
+				return err
+			}
+			call.metrics.IncRetry(METRICS_BACKEND_REDIS, call.op)
+			err = do()
+		}
+		return err
+	}
+	c.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			return retry(redisIdempotent(cmd), func() error { return old(cmd) })
+		}
+	})
+	c.WrapProcessPipeline(func(old func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			idempotent := true
+			for _, cmd := range cmds {
+				idempotent = idempotent && redisIdempotent(cmd)
+			}
+			return retry(idempotent, func() error { return old(cmds) })
+		}
+	})
+	return c
+}
+
+// isDegradable lỗi cho phép đọc thay thế từ backend còn lại (backend lỗi, timeout hoặc breaker đang mở).
+func isDegradable(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// Resilience cấu hình timeout / retry / breaker của DAO (nil = tắt).
+func (e *ElasticChannelParticipantsDAO) Resilience() *Resilience {
+	if e == nil {
+		return nil
+	}
+	return e.resilience
+}
+
+// WithResilience trả về bản sao DAO áp dụng timeout / breaker của res cho mọi op. Thử lại request ES cần thêm
+// elastic.SetRetrier(res.ElasticRetrier()) khi tạo client (xem ConnectElastic).
+func (e *ElasticChannelParticipantsDAO) WithResilience(res *Resilience) *ElasticChannelParticipantsDAO {
+	if e == nil {
+		return nil
+	}
+	cp := *e
+	cp.resilience = res
+	return &cp
+}
+
+// breaker circuit breaker áp dụng cho op hiện tại, nil nếu op lồng trong op ES khác.
+func (e *ElasticChannelParticipantsDAO) breaker() *CircuitBreaker {
+	if c := opCallFrom(e.Context()); c != nil && c.nested {
+		return nil
+	}
+	return e.Resilience().Breaker(METRICS_BACKEND_ELASTIC)
+}
+
+// allow kiểm tra circuit breaker của ES trước khi thực hiện op.
+func (e *ElasticChannelParticipantsDAO) allow() error {
+	return e.breaker().Allow()
+}
+
+// Resilience cấu hình timeout / retry / breaker của DAO (nil = tắt).
+func (r *ChannelParticipantsCacheDAO) Resilience() *Resilience {
+	if r == nil {
+		return nil
+	}
+	return r.resilience
+}
+
+// WithResilience trả về bản sao DAO áp dụng timeout / retry / breaker của res cho mọi op.
+func (r *ChannelParticipantsCacheDAO) WithResilience(res *Resilience) *ChannelParticipantsCacheDAO {
+	if r == nil {
+		return nil
+	}
+	cp := *r
+	cp.resilience = res
+	return &cp
+}
+
+// breaker circuit breaker áp dụng cho op hiện tại, nil nếu op lồng trong op Redis khác.
+func (r *ChannelParticipantsCacheDAO) breaker() *CircuitBreaker {
+	if c := opCallFrom(r.Context()); c != nil && c.nested {
+		return nil
+	}
+	return r.Resilience().Breaker(METRICS_BACKEND_REDIS)
+}
+
+// allow kiểm tra circuit breaker của Redis trước khi thực hiện op.
+func (r *ChannelParticipantsCacheDAO) allow() error {
+	return r.breaker().Allow()
+}
@@ -0,0 +1,264 @@
+package repo
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const testOpenTimeout = 20 * time.Millisecond
+
+var (
+	errTestUnavailable = &Error{Kind: ErrUnavailable, Backend: METRICS_BACKEND_REDIS, Msg: "connection refused"}
+	errTestNotFound    = notFoundf("key not found")
+)
+
+func newTestBreaker() *CircuitBreaker {
+	return NewCircuitBreaker(METRICS_BACKEND_REDIS, BreakerConfig{FailureThreshold: 3, OpenTimeout: testOpenTimeout})
+}
+
+// tripBreaker ghi đủ FailureThreshold lỗi liên tiếp để mở mạch.
+func tripBreaker(t *testing.T, b *CircuitBreaker) {
+	t.Helper()
+	for i := 0; i < b.cfg.FailureThreshold; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow() before threshold = %v", err)
+		}
+		b.Record(errTestUnavailable)
+	}
+	if got := b.State(); got != BREAKER_STATE_OPEN {
+		t.Fatalf("State() after threshold = %s, want %s", got, BREAKER_STATE_OPEN)
+	}
+}
+
+func TestCircuitBreakerOpensAtThreshold(t *testing.T) {
+	b := newTestBreaker()
+	for i := 0; i < b.cfg.FailureThreshold-1; i++ {
+		b.Allow()
+		b.Record(errTestUnavailable)
+		if got := b.State(); got != BREAKER_STATE_CLOSED {
+			t.Fatalf("State() after %d failures = %s, want %s", i+1, got, BREAKER_STATE_CLOSED)
+		}
+	}
+	b.Allow()
+	b.Record(errTestUnavailable)
+	if got := b.State(); got != BREAKER_STATE_OPEN {
+		t.Fatalf("State() at threshold = %s, want %s", got, BREAKER_STATE_OPEN)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow() while open = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestCircuitBreakerIgnoresBusinessErrors(t *testing.T) {
+	b := newTestBreaker()
+	b.Allow()
+	b.Record(errTestUnavailable)
+	b.Allow()
+	b.Record(errTestUnavailable)
+	// lỗi nghiệp vụ chứng tỏ backend còn phản hồi: reset chuỗi lỗi
+	b.Allow()
+	b.Record(errTestNotFound)
+	b.Allow()
+	b.Record(errTestUnavailable)
+	if got := b.State(); got != BREAKER_STATE_CLOSED {
+		t.Fatalf("State() = %s, want %s", got, BREAKER_STATE_CLOSED)
+	}
+}
+
+func TestCircuitBreakerHalfOpenAfterTimeout(t *testing.T) {
+	b := newTestBreaker()
+	tripBreaker(t, b)
+	time.Sleep(testOpenTimeout)
+	if got := b.State(); got != BREAKER_STATE_HALF_OPEN {
+		t.Fatalf("State() after OpenTimeout = %s, want %s", got, BREAKER_STATE_HALF_OPEN)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := newTestBreaker()
+	tripBreaker(t, b)
+	time.Sleep(testOpenTimeout)
+
+	if err := b.Allow(); err != nil {
+		t.Fatalf("first Allow() when half-open = %v, want nil", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Allow() while probing = %v, want ErrCircuitOpen", err)
+		}
+	}
+
+	// lời gọi thử bị từ chối khi đang tắt trả lại lượt thử
+	b.Record(ErrShuttingDown)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() after released probe = %v, want nil", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpenTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe error
+		want  string
+	}{
+		{"success closes", nil, BREAKER_STATE_CLOSED},
+		{"business error closes", errTestNotFound, BREAKER_STATE_CLOSED},
+		{"failure reopens", errTestUnavailable, BREAKER_STATE_OPEN},
+		{"timeout reopens", &Error{Kind: ErrTimeout, Msg: "deadline"}, BREAKER_STATE_OPEN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBreaker()
+			tripBreaker(t, b)
+			time.Sleep(testOpenTimeout)
+			if err := b.Allow(); err != nil {
+				t.Fatalf("Allow() when half-open = %v", err)
+			}
+			b.Record(tt.probe)
+			if got := b.State(); got != tt.want {
+				t.Fatalf("State() after probe = %s, want %s", got, tt.want)
+			}
+
+			err := b.Allow()
+			if tt.want == BREAKER_STATE_CLOSED && err != nil {
+				t.Fatalf("Allow() after close = %v, want nil", err)
+			}
+			if tt.want == BREAKER_STATE_OPEN && !errors.Is(err, ErrCircuitOpen) {
+				// lỗi một lần khi half-open mở lại mạch ngay, đếm lại OpenTimeout từ đầu
+				t.Fatalf("Allow() after reopen = %v, want ErrCircuitOpen", err)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := NewCircuitBreaker(METRICS_BACKEND_ELASTIC, BreakerConfig{})
+	for i := 0; i < 10; i++ {
+		b.Record(errTestUnavailable)
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() with FailureThreshold = 0: %v", err)
+	}
+}
+
+func TestRedisIdempotent(t *testing.T) {
+	tests := []struct {
+		cmd  redis.Cmder
+		want bool
+	}{
+		{redis.NewStringCmd("get", "k"), true},
+		{redis.NewStatusCmd("set", "k", "v"), true},
+		{redis.NewStatusCmd("set", "k", "v", "px", 1000), true},
+		{redis.NewBoolCmd("set", "k", "v", "px", 1000, "nx"), false},
+		{redis.NewBoolCmd("set", "k", "v", "XX"), false},
+		{redis.NewCmd("eval", "return 1", 0), false},
+		{redis.NewIntCmd("incr", "k"), false},
+	}
+	for _, tt := range tests {
+		if got := redisIdempotent(tt.cmd); got != tt.want {
+			t.Errorf("redisIdempotent(%v) = %v, want %v", tt.cmd.Args(), got, tt.want)
+		}
+	}
+}
+
+// flakyRedis server RESP đóng kết nối thay vì trả lời lệnh đầu tiên (mất reply), các lệnh sau trả về
+// integer 1 (GET trả bulk "1"). Trả về địa chỉ và số lần nhận mỗi lệnh.
+func flakyRedis(t *testing.T) (string, func(name string) int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	seen := map[string]int{}
+	dropped := false
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+					var name string
+					for i := 0; i < 2*n; i++ {
+						arg, err := rd.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if i == 1 {
+							name = strings.ToLower(strings.TrimSpace(arg))
+						}
+					}
+					mu.Lock()
+					seen[name]++
+					drop := !dropped
+					dropped = true
+					mu.Unlock()
+					if drop {
+						return
+					}
+					reply := ":1\r\n"
+					if name == "get" {
+						reply = "$1\r\n1\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen[name]
+	}
+}
+
+func newRetryingCache(t *testing.T, addr string) *ChannelParticipantsCacheDAO {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { rdb.Close() })
+	res := NewResilience(ResilienceConfig{Default: OpPolicy{Timeout: time.Second, MaxRetries: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}})
+	return NewChannelParticipantsCacheDAO(rdb).WithResilience(res)
+}
+
+func TestRedisRetryIdempotentCommand(t *testing.T) {
+	addr, seen := flakyRedis(t)
+	v, err := newRetryingCache(t, addr).GetVersion(1)
+	if err != nil {
+		t.Fatalf("GetVersion() = %v, want retried success", err)
+	}
+	if v != 1 || seen("get") != 2 {
+		t.Errorf("GetVersion() = %d after %d GET, want 1 after 2", v, seen("get"))
+	}
+}
+
+// TestRedisNoRetryLock SET NX mất reply không được thử lại: lần thử lại sẽ thấy chính khoá vừa lấy và báo bận.
+func TestRedisNoRetryLock(t *testing.T) {
+	addr, seen := flakyRedis(t)
+	token, err := newRetryingCache(t, addr).AcquireLock("test", time.Second)
+	if err == nil {
+		t.Fatalf("AcquireLock() = %q, want error for lost reply", token)
+	}
+	if n := seen("set"); n != 1 {
+		t.Errorf("SET NX sent %d times, want 1", n)
+	}
+}
@@ -0,0 +1,166 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AdminRights bitmask quyền admin, lưu ở admin_rights / data.AdminRights.
+type AdminRights int32
+
+const (
+	ADMIN_RIGHT_CHANGE_INFO AdminRights = 1 << iota
+	ADMIN_RIGHT_POST_MESSAGES
+	ADMIN_RIGHT_EDIT_MESSAGES
+	ADMIN_RIGHT_DELETE_MESSAGES
+	ADMIN_RIGHT_BAN_USERS
+	ADMIN_RIGHT_INVITE_USERS
+	ADMIN_RIGHT_PIN_MESSAGES
+	ADMIN_RIGHT_ADD_ADMINS
+	ADMIN_RIGHT_ANONYMOUS
+	ADMIN_RIGHT_MANAGE_CALL
+
+	ADMIN_RIGHTS_ALL = ADMIN_RIGHT_MANAGE_CALL<<1 - 1 // toàn bộ quyền admin, cấp cho creator
+)
+
+// thứ tự tên theo bit 0, 1, 2, ...
+var adminRightNames = []string{
+	"change_info", "post_messages", "edit_messages", "delete_messages", "ban_users",
+	"invite_users", "pin_messages", "add_admins", "anonymous", "manage_call",
+}
+
+// BannedRights bitmask các quyền bị cấm, lưu ở banned_rights / data.BannedRights.
+type BannedRights int32
+
+const (
+	BANNED_RIGHT_VIEW_MESSAGES BannedRights = 1 << iota
+	BANNED_RIGHT_SEND_MESSAGES
+	BANNED_RIGHT_SEND_MEDIA
+	BANNED_RIGHT_SEND_STICKERS
+	BANNED_RIGHT_SEND_GIFS
+	BANNED_RIGHT_SEND_GAMES
+	BANNED_RIGHT_SEND_INLINE
+	BANNED_RIGHT_EMBED_LINKS
+	BANNED_RIGHT_SEND_POLLS
+	BANNED_RIGHT_CHANGE_INFO
+	BANNED_RIGHT_INVITE_USERS
+	BANNED_RIGHT_PIN_MESSAGES
+)
+
+var bannedRightNames = []string{
+	"view_messages", "send_messages", "send_media", "send_stickers", "send_gifs", "send_games",
+	"send_inline", "embed_links", "send_polls", "change_info", "invite_users", "pin_messages",
+}
+
+func (r AdminRights) Has(right AdminRights) bool           { return r&right == right }
+func (r AdminRights) Grant(right AdminRights) AdminRights  { return r | right }
+func (r AdminRights) Revoke(right AdminRights) AdminRights { return r &^ right }
+func (r AdminRights) Names() []string                      { return rightNames(int32(r), adminRightNames) }
+func (r AdminRights) String() string                       { return formatRights(int32(r), adminRightNames) }
+
+func (r BannedRights) Has(right BannedRights) bool            { return r&right == right }
+func (r BannedRights) Grant(right BannedRights) BannedRights  { return r | right }
+func (r BannedRights) Revoke(right BannedRights) BannedRights { return r &^ right }
+func (r BannedRights) Names() []string                        { return rightNames(int32(r), bannedRightNames) }
+func (r BannedRights) String() string                         { return formatRights(int32(r), bannedRightNames) }
+
+// ParseAdminRights nhận số ("5") hoặc danh sách tên ("change_info|ban_users", phân cách bằng | hoặc ,).
+func ParseAdminRights(s string) (AdminRights, error) {
+	v, err := parseRights(s, adminRightNames)
+	return AdminRights(v), err
+}
+
+func ParseBannedRights(s string) (BannedRights, error) {
+	v, err := parseRights(s, bannedRightNames)
+	return BannedRights(v), err
+}
+
+// MarshalJSON mã hoá dạng danh sách tên, ví dụ ["change_info","ban_users"].
+// Model lưu ES vẫn dùng int32 nên không bị ảnh hưởng.
+func (r AdminRights) MarshalJSON() ([]byte, error) { return json.Marshal(r.Names()) }
+
+func (r *AdminRights) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalRights(b, adminRightNames)
+	*r = AdminRights(v)
+	return err
+}
+
+func (r BannedRights) MarshalJSON() ([]byte, error) { return json.Marshal(r.Names()) }
+
+func (r *BannedRights) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalRights(b, bannedRightNames)
+	*r = BannedRights(v)
+	return err
+}
+
+func rightNames(v int32, names []string) []string {
+	out := []string{}
+	for i, name := range names {
+		if v&(1<<i) != 0 {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func formatRights(v int32, names []string) string {
+	out := rightNames(v, names)
+	// bit không có tên vẫn giữ lại để không mất dữ liệu khi format -> parse
+	if unknown := v &^ (1<<len(names) - 1); unknown != 0 {
+		out = append(out, strconv.Itoa(int(unknown)))
+	}
+	if len(out) == 0 {
+		return "none"
+	}
+	return strings.Join(out, "|")
+}
+
+func parseRights(s string, names []string) (int32, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "none" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 32); err == nil {
+		return int32(n), nil
+	}
+
+	var v int32
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == '|' || r == ',' }) {
+		part = strings.TrimSpace(part)
+		if n, err := strconv.ParseInt(part, 10, 32); err == nil {
+			v |= int32(n)
+			continue
+		}
+		found := false
+		for i, name := range names {
+			if name == part {
+				v |= 1 << i
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown right %q", part)
+		}
+	}
+	return v, nil
+}
+
+// unmarshalRights nhận số, chuỗi tên hoặc mảng tên.
+func unmarshalRights(b []byte, names []string) (int32, error) {
+	var n int32
+	if err := json.Unmarshal(b, &n); err == nil {
+		return n, nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		return parseRights(strings.Join(list, "|"), names)
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return 0, fmt.Errorf("invalid rights value %s", string(b))
+	}
+	return parseRights(s, names)
+}
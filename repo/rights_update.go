@@ -0,0 +1,222 @@
+package repo
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	RIGHTS_KIND_ADMIN  = "admin"  // admin_rights
+	RIGHTS_KIND_BANNED = "banned" // banned_rights
+)
+
+// RightsUpdateDO bật / tắt một hoặc nhiều bit quyền mà không ghi đè cả document.
+type RightsUpdateDO struct {
+	Kind    string `json:"kind"`
+	Mask    int32  `json:"mask"`
+	Grant   bool   `json:"grant"`
+	ActorID int32  `json:"actor_id,omitempty"`
+}
+
+func (u *RightsUpdateDO) validate() error {
+	if u.Kind != RIGHTS_KIND_ADMIN && u.Kind != RIGHTS_KIND_BANNED {
+		return invalidInputf("unknown rights kind %q", u.Kind)
+	}
+	if u.Mask == 0 {
+		return invalidInputf("rights mask is empty")
+	}
+	return nil
+}
+
+// apply áp dụng thay đổi lên bản sao dữ liệu, dùng để kiểm tra state trước khi ghi (giống script bên dưới).
+func (u *RightsUpdateDO) apply(p *ChannelParticipantsDO, now int32) {
+	update := func(v int32) int32 {
+		if u.Grant {
+			return v | u.Mask
+		}
+		return v &^ u.Mask
+	}
+
+	if u.Kind == RIGHTS_KIND_ADMIN {
+		p.AdminRights = update(p.AdminRights)
+		if u.Grant {
+			p.PromotedBy, p.PromotedAt = u.ActorID, now
+		}
+		if p.AdminRights == 0 && p.IsCreator == 0 {
+			p.Rank = ""
+		}
+		return
+	}
+
+	p.BannedRights = update(p.BannedRights)
+	if p.BannedRights == 0 {
+		p.BannedUntilDate = 0
+	} else if u.Grant {
+		p.BannedAt = now
+	}
+}
+
+func rightsUpdateScript(u *RightsUpdateDO, now int32) *elastic.Script {
+	topField, dataField := "admin_rights", "AdminRights"
+	if u.Kind == RIGHTS_KIND_BANNED {
+		topField, dataField = "banned_rights", "BannedRights"
+	}
+
+	return elastic.NewScript(`
+		def d = ctx._source.data;
+		long v = ctx._source[params.top_field] == null ? 0 : ctx._source[params.top_field];
+		if (params.grant) { v = v | params.mask; } else { v = v & ~params.mask; }
+		int nv = (int) v;
+		ctx._source[params.top_field] = nv;
+		if (d != null) {
+			d[params.data_field] = nv;
+			d.UpdatedAt = params.updated_at;
+		}
+		if (params.kind == 'admin') {
+			if (d != null && params.grant) { d.PromotedBy = params.actor; d.PromotedAt = params.now; }
+			if (d != null && nv == 0 && d.IsCreator != 1) { d.Rank = ''; }
+		} else if (nv == 0) {
+			ctx._source.banned_until_date = 0;
+			if (d != null) { d.BannedUntilDate = 0; }
+		} else if (d != null && params.grant) {
+			d.BannedAt = params.now;
+		}
+	`+deriveStatePainless).
+		Param("kind", u.Kind).
+		Param("top_field", topField).
+		Param("data_field", dataField).
+		Param("mask", u.Mask).
+		Param("grant", u.Grant).
+		Param("actor", u.ActorID).
+		Param("now", now).
+		Param("updated_at", time.Unix(int64(now), 0).Format(time.RFC3339))
+}
+
+// UpdateRights cập nhật từng bit quyền bằng scripted partial update, ghi cả top-level và data.
+// Đặt version = -1 để tự động tăng, version = 0 để bỏ qua.
+func (e *ElasticChannelParticipantsDAO) UpdateRights(channelID int32, version int32, update *RightsUpdateDO, userIDs []int32) (err error) {
+	e, span := e.startSpan("UpdateRights", attrChannel(channelID), attrCount(len(userIDs)))
+	defer e.observe(span, "UpdateRights", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return errEmptyIndex
+	}
+	if len(userIDs) == 0 {
+		return invalidInputf("listUserID empty")
+	}
+	if err := update.validate(); err != nil {
+		return err
+	}
+
+	ctx := e.Context()
+	script := rightsUpdateScript(update, int32(time.Now().Unix()))
+	changed, err := e.scriptUpdateUsers(ctx, channelID, "rights-"+update.Kind, script, userIDs)
+	if err != nil {
+		return err
+	}
+
+	if err := e.bumpVersionWithChange(ctx, channelID, version, ElasticChannelChangeDO{Updated: changed}); err != nil {
+		return elasticError("set version after rights update failed", err)
+	}
+	if _, err := e.client.Refresh(indexName).Do(ctx); err != nil {
+		return elasticError("refresh failed", err)
+	}
+	logCompleted(e.Logger(), "UpdateRights", timeStart, "kind", update.Kind, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, len(userIDs), "changed", len(changed))
+	return nil
+}
+
+// GetParticipantsWithAdminRight participant đang active có đủ các quyền admin trong right.
+func (e *ElasticChannelParticipantsDAO) GetParticipantsWithAdminRight(channelID int32, right AdminRights, limit, offset int32) (_ []ElasticChannelParticipantsDO, _ int32, err error) {
+	e, span := e.startSpan("GetParticipantsWithAdminRight", attrChannel(channelID))
+	defer e.observe(span, "GetParticipantsWithAdminRight", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, 0, err
+	}
+	q := activeParticipantsQuery(channelID).
+		Filter(rightsMaskQuery("admin_rights", int32(right)))
+	return e.searchParticipants(channelID, q, limit, offset, elastic.NewFieldSort("user_id").Desc())
+}
+
+// GetParticipantsRestrictedFrom participant đang active bị cấm các quyền trong right.
+// Lệnh cấm đã hết hạn được coi như đã gỡ dù worker chưa chạy.
+func (e *ElasticChannelParticipantsDAO) GetParticipantsRestrictedFrom(channelID int32, right BannedRights, limit, offset int32) (_ []ElasticChannelParticipantsDO, _ int32, err error) {
+	e, span := e.startSpan("GetParticipantsRestrictedFrom", attrChannel(channelID))
+	defer e.observe(span, "GetParticipantsRestrictedFrom", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, 0, err
+	}
+	q := activeParticipantsQuery(channelID).
+		Filter(
+			rightsMaskQuery("banned_rights", int32(right)),
+			bannedAtQuery(int32(time.Now().Unix())),
+		)
+	return e.searchParticipants(channelID, q, limit, offset, elastic.NewFieldSort("user_id").Desc())
+}
+
+// rightsMaskQuery (field & mask) == mask, ES không có toán tử bit nên dùng script query.
+func rightsMaskQuery(field string, mask int32) elastic.Query {
+	return elastic.NewScriptQuery(elastic.NewScript(`
+		doc[params.field].size() != 0 && (doc[params.field].value & params.mask) == params.mask
+	`).
+		Param("field", field).
+		Param("mask", mask))
+}
+
+// searchParticipants phân trang from/size theo sort truyền vào.
+// Document có lệnh cấm đã hết hạn được trả về ở dạng đã gỡ cấm (LiftExpiredBan).
+func (e *ElasticChannelParticipantsDAO) searchParticipants(channelID int32, q elastic.Query, limit, offset int32, sorts ...elastic.Sorter) ([]ElasticChannelParticipantsDO, int32, error) {
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return nil, 0, errElasticNil
+	}
+	indexName := GetElasticChannelIndex(channelID, ELASTIC_SIZE_INDEX)
+	if indexName == "" {
+		return nil, 0, errEmptyIndex
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || offset+limit > 10000 {
+		return nil, 0, invalidInputf("limit/offset out of range (offset+limit <= 10000)")
+	}
+
+	res, err := e.client.Search().
+		Index(indexName).
+		Query(q).
+		From(int(offset)).
+		Size(int(limit)).
+		TrackTotalHits(true).
+		SortBy(sorts...).
+		Routing(strconv.Itoa(int(channelID))).
+		Do(e.Context())
+	if err != nil {
+		return nil, 0, elasticError("search failed", err)
+	}
+
+	var total int64
+	if res.Hits != nil && res.Hits.TotalHits != nil {
+		total = res.Hits.TotalHits.Value
+	}
+	now := int32(time.Now().Unix())
+	items := make([]ElasticChannelParticipantsDO, 0, len(res.Hits.Hits))
+	for _, h := range res.Hits.Hits {
+		var doc ElasticChannelParticipantsDO
+		if err := json.Unmarshal(h.Source, &doc); err != nil {
+			e.Logger().Warn("unmarshal participant failed", LOG_KEY_OP, "searchParticipants", LOG_KEY_CHANNEL_ID, channelID, "id", h.Id, LOG_KEY_ERROR, err)
+			continue
+		}
+		items = append(items, *LiftExpiredBan(&doc, now))
+	}
+	logTiming(e.Logger(), "searchParticipants", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, total)
+	return items, int32(total), nil
+}
@@ -0,0 +1,323 @@
+package repo
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"golang.org/x/sync/singleflight"
+)
+
+// Bit của mask thống kê một participant, thứ tự phải khớp với fields trong statsScript.
+const (
+	STATS_FLAG_TOTAL   int32 = 1 << iota // mọi document participant
+	STATS_FLAG_ACTIVE                    // member / admin / creator / restricted
+	STATS_FLAG_ADMIN                     // admin (không tính creator)
+	STATS_FLAG_CREATOR                   // creator
+	STATS_FLAG_BANNED                    // bị kick kèm banned_rights
+	STATS_FLAG_KICKED                    // bị kick không kèm banned_rights
+	STATS_FLAG_LEFT                      // đã rời
+	STATS_FLAG_HIDDEN                    // active và hidden_participant = 1
+	STATS_FLAG_PENDING                   // đang chờ duyệt yêu cầu tham gia
+)
+
+// ChannelStatsDO số lượng participant của channel theo vai trò / trạng thái.
+type ChannelStatsDO struct {
+	ChannelID int32 `json:"channel_id"`
+	Total     int64 `json:"total"`
+	Active    int64 `json:"active"`
+	Admins    int64 `json:"admins"`
+	Creators  int64 `json:"creators"`
+	Banned    int64 `json:"banned"`
+	Kicked    int64 `json:"kicked"`
+	Left      int64 `json:"left"`
+	Hidden    int64 `json:"hidden"`
+	Pending   int64 `json:"pending"`
+}
+
+// Equal so sánh các bộ đếm, bỏ qua ChannelID.
+func (s *ChannelStatsDO) Equal(o *ChannelStatsDO) bool {
+	a, b := *s, *o
+	a.ChannelID, b.ChannelID = 0, 0
+	return a == b
+}
+
+// add cộng một participant có mask vào bộ đếm.
+func (s *ChannelStatsDO) add(mask int32) {
+	counters := []*int64{&s.Total, &s.Active, &s.Admins, &s.Creators, &s.Banned, &s.Kicked, &s.Left, &s.Hidden, &s.Pending}
+	for i, c := range counters {
+		if mask&(1<<i) != 0 {
+			*c++
+		}
+	}
+}
+
+// StatsMask mask thống kê của một document participant (theo DeriveState).
+func StatsMask(doc *ElasticChannelParticipantsDO) int32 {
+	p := participantData(doc)
+	mask := STATS_FLAG_TOTAL
+	state := DeriveState(p)
+	switch state {
+	case PARTICIPANT_STATE_CREATOR:
+		mask |= STATS_FLAG_CREATOR
+	case PARTICIPANT_STATE_ADMIN:
+		mask |= STATS_FLAG_ADMIN
+	case PARTICIPANT_STATE_BANNED:
+		mask |= STATS_FLAG_BANNED
+	case PARTICIPANT_STATE_KICKED:
+		mask |= STATS_FLAG_KICKED
+	case PARTICIPANT_STATE_LEFT:
+		mask |= STATS_FLAG_LEFT
+	case PARTICIPANT_STATE_WAITING_APPROVAL:
+		mask |= STATS_FLAG_PENDING
+	}
+	if state.IsActive() {
+		mask |= STATS_FLAG_ACTIVE
+		if p.HiddenParticipant == 1 {
+			mask |= STATS_FLAG_HIDDEN
+		}
+	}
+	return mask
+}
+
+// channelStatsAggregation filters aggregation tương ứng với từng bit của StatsMask.
+func channelStatsAggregation() *elastic.FiltersAggregation {
+	notKicked := elastic.NewTermQuery("is_kicked", 0)
+	kicked := elastic.NewTermQuery("is_kicked", 1)
+	noBannedRights := elastic.NewTermQuery("banned_rights", 0)
+
+	return elastic.NewFiltersAggregation().
+		FilterWithName("active", activeParticipantsFilter()).
+		FilterWithName("creators", activeParticipantsFilter().Filter(elastic.NewTermQuery("is_creator", 1))).
+		FilterWithName("admins", activeParticipantsFilter().
+			MustNot(elastic.NewTermQuery("is_creator", 1), elastic.NewTermQuery("admin_rights", 0))).
+		FilterWithName("banned", elastic.NewBoolQuery().Filter(kicked).MustNot(noBannedRights)).
+		FilterWithName("kicked", elastic.NewBoolQuery().Filter(kicked, noBannedRights)).
+		FilterWithName("left", elastic.NewBoolQuery().Filter(notKicked, elastic.NewTermQuery("is_left", 1))).
+		FilterWithName("hidden", activeParticipantsFilter().Filter(elastic.NewTermQuery("hidden_participant", 1))).
+		FilterWithName("pending", elastic.NewBoolQuery().Filter(
+			notKicked,
+			elastic.NewTermQuery("is_left", 0),
+			elastic.NewTermQuery("data.IsWaitingAprrove", 1),
+		))
+}
+
+func channelStatsFromResult(channelID int32, res *elastic.SearchResult) *ChannelStatsDO {
+	stats := &ChannelStatsDO{ChannelID: channelID}
+	if res == nil {
+		return stats
+	}
+	if res.Hits != nil && res.Hits.TotalHits != nil {
+		stats.Total = res.Hits.TotalHits.Value
+	}
+	agg, ok := res.Aggregations.Filters("stats")
+	if !ok {
+		return stats
+	}
+	get := func(name string) int64 {
+		if b, ok := agg.NamedBuckets[name]; ok && b != nil {
+			return b.DocCount
+		}
+		return 0
+	}
+	stats.Active = get("active")
+	stats.Admins = get("admins")
+	stats.Creators = get("creators")
+	stats.Banned = get("banned")
+	stats.Kicked = get("kicked")
+	stats.Left = get("left")
+	stats.Hidden = get("hidden")
+	stats.Pending = get("pending")
+	return stats
+}
+
+// AggregateChannelStats đếm participant của channel trực tiếp trên ES (nguồn dữ liệu gốc).
+func (e *ElasticChannelParticipantsDAO) AggregateChannelStats(channelID int32) (*ChannelStatsDO, error) {
+	res, err := e.AggregateChannelStatsBatch([]int32{channelID})
+	if err != nil {
+		return nil, err
+	}
+	return res[channelID], nil
+}
+
+// AggregateChannelStatsBatch đếm participant của nhiều channel trong một multi search, mỗi channel theo routing riêng.
+func (e *ElasticChannelParticipantsDAO) AggregateChannelStatsBatch(channelIDs []int32) (_ map[int32]*ChannelStatsDO, err error) {
+	e, span := e.startSpan("AggregateChannelStatsBatch", attrCount(len(channelIDs)))
+	defer e.observe(span, "AggregateChannelStatsBatch", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return nil, errElasticNil
+	}
+	out := make(map[int32]*ChannelStatsDO, len(channelIDs))
+	if len(channelIDs) == 0 {
+		return out, nil
+	}
+
+	ms := e.client.MultiSearch()
+	for _, cid := range channelIDs {
+		indexName := GetElasticChannelIndex(cid, ELASTIC_SIZE_INDEX)
+		if indexName == "" {
+			return nil, errEmptyIndex
+		}
+		ms = ms.Add(elastic.NewSearchRequest().
+			Index(indexName).
+			Routing(strconv.Itoa(int(cid))).
+			Query(allParticipantsQuery(cid)).
+			Size(0).
+			TrackTotalHits(true).
+			Aggregation("stats", channelStatsAggregation()))
+	}
+	res, err := ms.Do(e.Context())
+	if err != nil {
+		return nil, elasticError("aggregate channel stats failed", err)
+	}
+	if len(res.Responses) != len(channelIDs) {
+		return nil, fmt.Errorf("aggregate channel stats: expected %d responses, got %d", len(channelIDs), len(res.Responses))
+	}
+	for i, cid := range channelIDs {
+		r := res.Responses[i]
+		if r.Error != nil {
+			if r.Error.Type == "index_not_found_exception" {
+				out[cid] = &ChannelStatsDO{ChannelID: cid}
+				continue
+			}
+			return nil, elasticError(fmt.Sprintf("aggregate channel %d stats failed", cid), &elastic.Error{Status: r.Status, Details: r.Error})
+		}
+		out[cid] = channelStatsFromResult(cid, r)
+	}
+
+	logTiming(e.Logger(), "AggregateChannelStatsBatch", timeStart, "channels", len(channelIDs))
+	return out, nil
+}
+
+// ChannelStatsService đọc bộ đếm channel:<id>:stats trên Redis, miss thì dựng lại từ ES.
+// Bộ đếm được outbox relay cập nhật sau mỗi mutation participant.
+type ChannelStatsService struct {
+	es    *ElasticChannelParticipantsDAO
+	cache *ChannelParticipantsCacheDAO
+	group singleflight.Group
+}
+
+func NewChannelStatsService(es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO) *ChannelStatsService {
+	return &ChannelStatsService{es: es, cache: cache}
+}
+
+// GetChannelStats số lượng participant của channel theo vai trò / trạng thái.
+func (s *ChannelStatsService) GetChannelStats(channelID int32) (*ChannelStatsDO, error) {
+	res, err := s.GetChannelStatsBatch([]int32{channelID})
+	if err != nil {
+		return nil, err
+	}
+	return res[channelID], nil
+}
+
+// GetChannelStatsBatch đọc bộ đếm của nhiều channel trong một pipeline, channel chưa có bộ đếm được dựng lại từ ES.
+func (s *ChannelStatsService) GetChannelStatsBatch(channelIDs []int32) (map[int32]*ChannelStatsDO, error) {
+	timeStart := time.Now()
+	out, err := s.cache.GetStatsBatch(channelIDs)
+	if isDegradable(err) {
+		// Redis lỗi / breaker đang mở: aggregation trên ES, không ghi lại bộ đếm
+		s.cache.Logger().Warn("redis unavailable, serving channel stats from elastic", "channels", len(channelIDs), LOG_KEY_ERROR, err)
+		return s.es.AggregateChannelStatsBatch(channelIDs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	missed := 0
+	for _, cid := range channelIDs {
+		if _, ok := out[cid]; ok {
+			continue
+		}
+		missed++
+		stats, err := s.Rebuild(cid)
+		if err != nil {
+			return nil, err
+		}
+		out[cid] = stats
+	}
+	logTiming(s.cache.Logger(), "GetChannelStatsBatch", timeStart, "channels", len(channelIDs), "rebuilt", missed)
+	return out, nil
+}
+
+// Rebuild dựng lại bộ đếm và mask từng user của channel từ ES. Giữ khoá cache của channel như bước Redis
+// của relay (ES được scroll sau khi lấy khoá) và ghi qua key tạm nên không đè mất delta relay vừa áp dụng.
+func (s *ChannelStatsService) Rebuild(channelID int32) (*ChannelStatsDO, error) {
+	v, err, _ := s.group.Do(strconv.Itoa(int(channelID)), func() (interface{}, error) {
+		timeStart := time.Now()
+		unlock, err := s.cache.LockChannelCache(channelID)
+		if isDegradable(err) {
+			// Redis lỗi / khoá bị giữ quá lâu: tính thẳng trên ES, không ghi bộ đếm
+			s.cache.Logger().Warn("rebuild channel stats skipped, redis unavailable", LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_ERROR, err)
+			return s.es.AggregateChannelStats(channelID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		stats := &ChannelStatsDO{ChannelID: channelID}
+		masks := map[int32]int32{}
+		err = s.es.ScrollParticipants(channelID, func(docs []ElasticChannelParticipantsDO) error {
+			for i := range docs {
+				mask := StatsMask(&docs[i])
+				masks[docs[i].UserID] = mask
+				stats.add(mask)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.cache.ReplaceStats(channelID, masks); isDegradable(err) {
+			s.cache.Logger().Warn("rebuild channel stats skipped, redis unavailable", LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_ERROR, err)
+			return stats, nil
+		} else if err != nil {
+			return nil, err
+		}
+		logTiming(s.cache.Logger(), "RebuildChannelStats", timeStart, LOG_KEY_CHANNEL_ID, channelID, LOG_KEY_COUNT, stats.Total)
+		return stats, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*ChannelStatsDO), nil
+}
+
+// ChannelStatsCheckDO kết quả so sánh bộ đếm Redis với aggregation trên ES.
+type ChannelStatsCheckDO struct {
+	ChannelID int32           `json:"channel_id"`
+	Cached    *ChannelStatsDO `json:"cached,omitempty"` // nil nếu Redis chưa có bộ đếm
+	Elastic   *ChannelStatsDO `json:"elastic"`
+	Match     bool            `json:"match"`
+	Repaired  bool            `json:"repaired,omitempty"`
+}
+
+// Verify so sánh bộ đếm Redis với aggregation ES của nhiều channel, repair = true thì dựng lại channel lệch.
+func (s *ChannelStatsService) Verify(channelIDs []int32, repair bool) ([]ChannelStatsCheckDO, error) {
+	cached, err := s.cache.GetStatsBatch(channelIDs)
+	if err != nil {
+		return nil, err
+	}
+	fromES, err := s.es.AggregateChannelStatsBatch(channelIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ChannelStatsCheckDO, 0, len(channelIDs))
+	for _, cid := range channelIDs {
+		check := ChannelStatsCheckDO{ChannelID: cid, Cached: cached[cid], Elastic: fromES[cid]}
+		check.Match = check.Cached != nil && check.Cached.Equal(check.Elastic)
+		if !check.Match && repair {
+			if _, err := s.Rebuild(cid); err != nil {
+				return out, err
+			}
+			check.Repaired = true
+		}
+		out = append(out, check)
+	}
+	return out, nil
+}
@@ -0,0 +1,388 @@
+package repo
+
+import (
+	"context"
+	"time"
+)
+
+// ChannelParticipantsStore là đường ghi chung cho participants:
+// mỗi mutation được ghi vào outbox trước, sau đó relay áp dụng lên ES và Redis.
+type ChannelParticipantsStore struct {
+	es     *ElasticChannelParticipantsDAO
+	cache  *ChannelParticipantsCacheDAO
+	outbox Outbox
+	relay  *OutboxRelay
+}
+
+func NewChannelParticipantsStore(es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO, outbox Outbox) *ChannelParticipantsStore {
+	return &ChannelParticipantsStore{
+		es:     es,
+		cache:  cache,
+		outbox: outbox,
+		relay:  NewOutboxRelay(outbox, es, cache),
+	}
+}
+
+func (s *ChannelParticipantsStore) Relay() *OutboxRelay {
+	return s.relay
+}
+
+func (s *ChannelParticipantsStore) Outbox() Outbox {
+	return s.outbox
+}
+
+// WithContext trả về bản sao store có DAO và relay gắn với ctx, để trace của người gọi
+// bao trùm mọi request ES / Redis của mutation.
+func (s *ChannelParticipantsStore) WithContext(ctx context.Context) *ChannelParticipantsStore {
+	cp := *s
+	cp.es = s.es.WithContext(ctx)
+	cp.cache = s.cache.WithContext(ctx)
+	relay := *s.relay
+	relay.es, relay.cache = cp.es, cp.cache
+	cp.relay = &relay
+	return &cp
+}
+
+// SaveAll reload toàn bộ participants của channel trên ES và Redis.
+func (s *ChannelParticipantsStore) SaveAll(channelID int32, version int32, list []ElasticChannelParticipantsDO) error {
+	docs, err := normalizeParticipants(channelID, list)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockCreators(channelID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := s.validateCreators(channelID, docs, true); err != nil {
+		return err
+	}
+
+	// user bị loại khỏi channel sau khi reset, cần gỡ khỏi reverse index user:<uid>:channels
+	keep := make(map[int32]bool, len(docs))
+	for i := range docs {
+		keep[docs[i].UserID] = true
+	}
+	var removed []int32
+	err = s.es.ScrollAllUserIDs(channelID, func(ids []int32) error {
+		for _, uid := range ids {
+			if !keep[uid] {
+				removed = append(removed, uid)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entry := NewOutboxEntry(channelID, OUTBOX_OP_SAVE_ALL, version)
+	entry.Docs = docs
+	entry.Removed = removed
+	return s.submit(entry)
+}
+
+// Upsert thêm / cập nhật participants trên ES và Redis.
+// Mỗi participant phải hợp lệ và được phép chuyển từ state hiện tại sang state mới.
+func (s *ChannelParticipantsStore) Upsert(channelID int32, version int32, list []ElasticChannelParticipantsDO) error {
+	unlock, err := s.lockCreators(channelID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.upsert(channelID, version, list)
+}
+
+// upsert như Upsert, người gọi đã giữ lockCreators của channel.
+func (s *ChannelParticipantsStore) upsert(channelID int32, version int32, list []ElasticChannelParticipantsDO) error {
+	docs, err := normalizeParticipants(channelID, list)
+	if err != nil {
+		return err
+	}
+
+	userIDs := make([]int32, len(docs))
+	next := make(map[int32]ParticipantState, len(docs))
+	for i := range docs {
+		userIDs[i] = docs[i].UserID
+		next[docs[i].UserID] = ParticipantState(docs[i].Data.State)
+	}
+	current, err := s.es.GetParticipants(channelID, userIDs)
+	if err != nil {
+		return err
+	}
+	err = ValidateTransitions(current, func(uid int32, _ ParticipantState) ParticipantState {
+		return next[uid]
+	}, userIDs)
+	if err != nil {
+		return err
+	}
+	if err := s.validateCreators(channelID, docs, false); err != nil {
+		return err
+	}
+
+	entry := NewOutboxEntry(channelID, OUTBOX_OP_UPSERT, version)
+	entry.Docs = docs
+	return s.submit(entry)
+}
+
+// Delete xoá participants khỏi ES và Redis.
+// Không cho xoá creator, phải TransferOwnership trước.
+func (s *ChannelParticipantsStore) Delete(channelID int32, version int32, userIDs []int32) error {
+	unlock, err := s.lockCreators(channelID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	creators, err := s.es.GetCreatorIDs(channelID)
+	if err != nil {
+		return err
+	}
+	for _, uid := range userIDs {
+		for _, c := range creators {
+			if uid == c {
+				return invalidInputf("delete: user %d is the creator of channel %d, transfer ownership first", uid, channelID)
+			}
+		}
+	}
+
+	entry := NewOutboxEntry(channelID, OUTBOX_OP_DELETE, version)
+	entry.UserIDs = userIDs
+	return s.submit(entry)
+}
+
+// PurgeDeparted xoá cứng user đã rời / bị kick trước before (retention) rồi gỡ channel khỏi user:<uid>:channels.
+// User bị xoá vốn không có trong các key membership nên không đi qua outbox, nhưng version vẫn tăng kèm change log.
+// Giữ khoá cache của channel để relay của user join lại không xen vào giữa lúc gỡ index / bộ đếm.
+func (s *ChannelParticipantsStore) PurgeDeparted(channelID int32, before int32) (_ int64, err error) {
+	s, run, err := s.beginMutation("purge_departed", channelID)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { run.End(err) }()
+	unlock, err := s.cache.LockChannelCache(channelID)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var userIDs []int32
+	err = s.es.ScrollDepartedUserIDs(channelID, before, func(ids []int32) error {
+		userIDs = append(userIDs, ids...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	// chỉ gỡ user ES thực sự đã xoá, user join lại giữa lần scroll và lần xoá giữ nguyên index / bộ đếm
+	removed, err := s.es.PurgeDeparted(channelID, before, userIDs)
+	if err != nil || len(removed) == 0 {
+		return int64(len(removed)), err
+	}
+	if err := s.cache.RemoveUserChannel(channelID, removed); err != nil {
+		return int64(len(removed)), err
+	}
+	masks := make(map[int32]int32, len(removed))
+	for _, uid := range removed {
+		masks[uid] = 0
+	}
+	if err := s.cache.ApplyStats(channelID, masks, false); err != nil {
+		return int64(len(removed)), err
+	}
+	meta, err := s.es.GetVersion(channelID)
+	if err != nil {
+		return int64(len(removed)), err
+	}
+	if err := s.cache.SetVersion(channelID, meta.Version); err != nil {
+		return int64(len(removed)), err
+	}
+	return int64(len(removed)), nil
+}
+
+// Leave đánh dấu user tự rời nhóm, giữ lại document để lưu lịch sử.
+func (s *ChannelParticipantsStore) Leave(channelID int32, userIDs []int32) error {
+	return s.applyAction(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_LEAVE}, userIDs)
+}
+
+// Kick gỡ user khỏi nhóm, user có thể vào lại.
+func (s *ChannelParticipantsStore) Kick(channelID int32, actorID int32, userIDs []int32) error {
+	return s.applyAction(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_KICK, ActorID: actorID}, userIDs)
+}
+
+// Ban gỡ user khỏi nhóm và cấm quyền tới untilDate (0 = vĩnh viễn).
+func (s *ChannelParticipantsStore) Ban(channelID int32, actorID int32, rights int32, untilDate int32, userIDs []int32) error {
+	return s.applyAction(channelID, &ParticipantActionDO{
+		Action:          PARTICIPANT_ACTION_BAN,
+		ActorID:         actorID,
+		BannedRights:    rights,
+		BannedUntilDate: untilDate,
+	}, userIDs)
+}
+
+// Unban gỡ cấm, user vẫn ở ngoài nhóm cho tới khi Rejoin.
+func (s *ChannelParticipantsStore) Unban(channelID int32, actorID int32, userIDs []int32) error {
+	return s.applyAction(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_UNBAN, ActorID: actorID}, userIDs)
+}
+
+// Rejoin đưa user đã rời / bị kick trở lại nhóm.
+func (s *ChannelParticipantsStore) Rejoin(channelID int32, userIDs []int32) error {
+	return s.applyAction(channelID, &ParticipantActionDO{Action: PARTICIPANT_ACTION_REJOIN}, userIDs)
+}
+
+func (s *ChannelParticipantsStore) applyAction(channelID int32, action *ParticipantActionDO, userIDs []int32) error {
+	current, err := s.es.GetParticipants(channelID, userIDs)
+	if err != nil {
+		return err
+	}
+	entry, err := s.prepareAction(channelID, action, userIDs, current)
+	if err != nil {
+		return err
+	}
+	return s.submit(entry)
+}
+
+// prepareAction kiểm tra action hợp lệ với document hiện tại (current) của từng user và dựng entry outbox.
+func (s *ChannelParticipantsStore) prepareAction(channelID int32, action *ParticipantActionDO, userIDs []int32, current map[int32]*ElasticChannelParticipantsDO) (*OutboxEntry, error) {
+	var err error
+	for _, uid := range userIDs {
+		doc, ok := current[uid]
+		if !ok {
+			return nil, notFoundf("%s: user %d is not a participant of channel %d", action.Action, uid, channelID)
+		}
+		state := DeriveState(participantData(doc))
+		if action.ResolvesJoinRequest() && state != PARTICIPANT_STATE_WAITING_APPROVAL {
+			return nil, notFoundf("%s: user %d has no pending join request in channel %d", action.Action, uid, channelID)
+		}
+		if action.RemovesMember() && state == PARTICIPANT_STATE_CREATOR {
+			return nil, invalidInputf("%s: user %d is the creator of channel %d, transfer ownership first", action.Action, uid, channelID)
+		}
+	}
+
+	// Lệnh cấm đã hết hạn không được chặn rejoin: gỡ cấm trước (như worker) rồi đọc lại state.
+	if action.AddsMember() {
+		if current, err = s.liftExpiredBans(channelID, current, userIDs); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateTransitions(current, func(_ int32, from ParticipantState) ParticipantState {
+		return action.TargetState(from)
+	}, userIDs); err != nil {
+		return nil, err
+	}
+
+	entry := NewOutboxEntry(channelID, OUTBOX_OP_ACTION, -1)
+	entry.Action = action
+	entry.UserIDs = userIDs
+	return entry, nil
+}
+
+// liftExpiredBans gỡ các lệnh cấm đã hết hạn trong current qua Unban, sau đó đọc lại document.
+func (s *ChannelParticipantsStore) liftExpiredBans(channelID int32, current map[int32]*ElasticChannelParticipantsDO, userIDs []int32) (map[int32]*ElasticChannelParticipantsDO, error) {
+	now := int32(time.Now().Unix())
+	var expired []int32
+	for _, uid := range userIDs {
+		if doc, ok := current[uid]; ok && IsBanExpired(participantData(doc), now) {
+			expired = append(expired, uid)
+		}
+	}
+	if len(expired) == 0 {
+		return current, nil
+	}
+	if err := s.Unban(channelID, 0, expired); err != nil {
+		return nil, err
+	}
+	return s.es.GetParticipants(channelID, userIDs)
+}
+
+// SetAdminRight cấp / thu hồi quyền admin cho user.
+func (s *ChannelParticipantsStore) SetAdminRight(channelID int32, actorID int32, right AdminRights, grant bool, userIDs []int32) error {
+	return s.UpdateRights(channelID, &RightsUpdateDO{Kind: RIGHTS_KIND_ADMIN, Mask: int32(right), Grant: grant, ActorID: actorID}, userIDs)
+}
+
+// SetBannedRight cấm / bỏ cấm quyền của user (restrict).
+func (s *ChannelParticipantsStore) SetBannedRight(channelID int32, actorID int32, right BannedRights, restrict bool, userIDs []int32) error {
+	return s.UpdateRights(channelID, &RightsUpdateDO{Kind: RIGHTS_KIND_BANNED, Mask: int32(right), Grant: restrict, ActorID: actorID}, userIDs)
+}
+
+// UpdateRights kiểm tra participant sau khi đổi quyền vẫn hợp lệ rồi ghi qua outbox.
+func (s *ChannelParticipantsStore) UpdateRights(channelID int32, update *RightsUpdateDO, userIDs []int32) error {
+	if err := update.validate(); err != nil {
+		return err
+	}
+	current, err := s.es.GetParticipants(channelID, userIDs)
+	if err != nil {
+		return err
+	}
+
+	now := int32(time.Now().Unix())
+	next := make(map[int32]ParticipantState, len(userIDs))
+	for _, uid := range userIDs {
+		doc, ok := current[uid]
+		if !ok {
+			return notFoundf("rights: user %d is not a participant of channel %d", uid, channelID)
+		}
+		data := *participantData(doc)
+		update.apply(&data, now)
+		data.State = int8(PARTICIPANT_STATE_UNKNOWN) // state sẽ được suy ra lại từ các cờ mới
+		if err := ValidateParticipant(&data); err != nil {
+			return err
+		}
+		next[uid] = DeriveState(&data)
+	}
+	if err := ValidateTransitions(current, func(uid int32, _ ParticipantState) ParticipantState {
+		return next[uid]
+	}, userIDs); err != nil {
+		return err
+	}
+
+	entry := NewOutboxEntry(channelID, OUTBOX_OP_RIGHTS, -1)
+	entry.Rights = update
+	entry.UserIDs = userIDs
+	return s.submit(entry)
+}
+
+// submit ghi entry xuống outbox rồi áp dụng ngay.
+// Nếu áp dụng lỗi, entry vẫn nằm trong outbox (failed) để replay sau.
+func (s *ChannelParticipantsStore) submit(entry *OutboxEntry) (err error) {
+	// đang tắt: không ghi entry mới vào outbox, entry đã ghi vẫn được replay ở lần chạy sau
+	s, run, err := s.beginMutation("outbox_"+entry.Op, entry.ChannelID)
+	if err != nil {
+		return err
+	}
+	defer func() { run.End(err) }()
+
+	if err := s.outbox.Save(entry); err != nil {
+		return err
+	}
+	return s.relay.Process(entry)
+}
+
+// beginMutation mở một MutationRun cho cả mutation (ES lẫn các bước Redis) trên các channel,
+// trả về bản sao store có DAO gắn run để bulk của DAO được tính chung vào run đó.
+// Bị ngắt khi tắt thì channel được ghi lại và entry outbox chưa xong được replay ở lần chạy sau.
+func (s *ChannelParticipantsStore) beginMutation(op string, channelIDs ...int32) (*ChannelParticipantsStore, *MutationRun, error) {
+	run, err := s.es.Lifecycle().Begin(op, channelIDs...)
+	if err != nil || run == nil {
+		return s, run, err
+	}
+	return s.WithContext(withMutationRun(s.es.Context(), run)), run, nil
+}
+
+// normalizeParticipants kiểm tra từng participant rồi dựng lại field top-level và State từ dữ liệu chuẩn (Data).
+func normalizeParticipants(channelID int32, list []ElasticChannelParticipantsDO) ([]ElasticChannelParticipantsDO, error) {
+	out := make([]ElasticChannelParticipantsDO, 0, len(list))
+	for i := range list {
+		data := participantData(&list[i])
+		if data.ChannelID != channelID {
+			return nil, invalidInputf("participant user=%d belongs to channel %d, not %d", data.UserID, data.ChannelID, channelID)
+		}
+		if err := ValidateParticipant(data); err != nil {
+			return nil, err
+		}
+		out = append(out, NewElasticParticipant(data))
+	}
+	return out, nil
+}
@@ -0,0 +1,216 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME = "tool_cache/repo"
+
+	TRACE_EXPORTER_NONE   = "none"
+	TRACE_EXPORTER_STDOUT = "stdout"
+	TRACE_EXPORTER_OTLP   = "otlp" // OTLP/HTTP, endpoint lấy từ OTEL_EXPORTER_OTLP_ENDPOINT (mặc định localhost:4318)
+)
+
+// NewSpanExporter tạo exporter theo kind none|stdout|otlp. none trả về nil (tắt tracing).
+func NewSpanExporter(ctx context.Context, kind string, w io.Writer) (sdktrace.SpanExporter, error) {
+	switch strings.ToLower(kind) {
+	case "", TRACE_EXPORTER_NONE:
+		return nil, nil
+	case TRACE_EXPORTER_STDOUT:
+		return stdouttrace.New(stdouttrace.WithWriter(w))
+	case TRACE_EXPORTER_OTLP:
+		return otlptracehttp.New(ctx)
+	}
+	return nil, fmt.Errorf("invalid trace exporter %q (none|stdout|otlp)", kind)
+}
+
+// NewTracerProvider tạo provider gửi span theo batch qua exp. Test có thể truyền
+// tracetest.NewInMemoryExporter() rồi gọi ForceFlush trước khi đọc span.
+// Provider cần được đăng ký bằng otel.SetTracerProvider và Shutdown khi tắt để đẩy hết span còn lại.
+func NewTracerProvider(exp sdktrace.SpanExporter, serviceName string) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+func attrChannel(channelID int32) attribute.KeyValue {
+	return attribute.Int(LOG_KEY_CHANNEL_ID, int(channelID))
+}
+
+func attrUser(userID int32) attribute.KeyValue {
+	return attribute.Int(LOG_KEY_USER_ID, int(userID))
+}
+
+func attrCount(n int) attribute.KeyValue {
+	return attribute.Int(LOG_KEY_COUNT, n)
+}
+
+// endSpan ghi lỗi (nếu có) rồi kết thúc span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Context context của DAO, mặc định context.Background().
+func (e *ElasticChannelParticipantsDAO) Context() context.Context {
+	if e == nil || e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// WithContext trả về bản sao DAO thực thi request ES với ctx: huỷ / deadline và trace của ctx
+// được truyền xuống mọi request.
+func (e *ElasticChannelParticipantsDAO) WithContext(ctx context.Context) *ElasticChannelParticipantsDAO {
+	if e == nil {
+		return nil
+	}
+	cp := *e
+	cp.ctx = ctx
+	cp.cancel = nil
+	return &cp
+}
+
+// startSpan mở span cho op, trả về bản sao DAO có context chứa span để request ES
+// và các lời gọi DAO lồng nhau trở thành span con. Context còn mang timeout / policy retry của op.
+func (e *ElasticChannelParticipantsDAO) startSpan(op string, attrs ...attribute.KeyValue) (*ElasticChannelParticipantsDAO, trace.Span) {
+	ctx, span := tracer().Start(e.Context(), "ElasticChannelParticipantsDAO."+op, trace.WithAttributes(attrs...))
+	if e == nil {
+		return nil, span
+	}
+	cp := *e
+	cp.ctx, cp.cancel = e.resilience.beginOp(ctx, METRICS_BACKEND_ELASTIC, op, e.metrics)
+	return &cp, span
+}
+
+// Context context của DAO, mặc định context.Background().
+func (r *ChannelParticipantsCacheDAO) Context() context.Context {
+	if r == nil || r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext trả về bản sao DAO gắn với ctx, span của các lệnh Redis là con của span trong ctx.
+func (r *ChannelParticipantsCacheDAO) WithContext(ctx context.Context) *ChannelParticipantsCacheDAO {
+	if r == nil {
+		return nil
+	}
+	cp := *r
+	cp.ctx = ctx
+	cp.cancel = nil
+	return &cp
+}
+
+// startSpan mở span cho op. Khi span được ghi lại, bản sao DAO dùng client Redis gắn với span
+// để mỗi lệnh / pipeline có span con riêng.
+func (r *ChannelParticipantsCacheDAO) startSpan(op string, attrs ...attribute.KeyValue) (*ChannelParticipantsCacheDAO, trace.Span) {
+	ctx, span := tracer().Start(r.Context(), "ChannelParticipantsCacheDAO."+op, trace.WithAttributes(attrs...))
+	if r == nil {
+		return nil, span
+	}
+	cp := *r
+	cp.ctx, cp.cancel = r.resilience.beginOp(ctx, METRICS_BACKEND_REDIS, op, r.metrics)
+	if span.IsRecording() && cp.conn != nil {
+		cp.conn = traceRedis(ctx, cp.conn)
+	}
+	if cp.conn != nil {
+		cp.conn = retryRedis(cp.ctx, cp.conn)
+	}
+	return &cp, span
+}
+
+// traceRedis bản sao client gắn ctx, mở span cho từng lệnh và từng pipeline.
+// redis.Nil (key không tồn tại) không bị coi là lỗi.
+func traceRedis(ctx context.Context, c *redis.Client) *redis.Client {
+	c = c.WithContext(ctx)
+	c.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			_, span := tracer().Start(ctx, "redis."+cmd.Name(),
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attribute.String("db.system", "redis"), attribute.String("db.operation", cmd.Name())))
+			err := old(cmd)
+			endSpan(span, ignoreRedisNil(err))
+			return err
+		}
+	})
+	c.WrapProcessPipeline(func(old func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			names := make([]string, 0, len(cmds))
+			for _, cmd := range cmds {
+				names = append(names, cmd.Name())
+			}
+			_, span := tracer().Start(ctx, "redis.pipeline",
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attribute.String("db.system", "redis"), attribute.StringSlice("db.operations", names), attrCount(len(cmds))))
+			err := old(cmds)
+			endSpan(span, ignoreRedisNil(err))
+			return err
+		}
+	})
+	return c
+}
+
+func ignoreRedisNil(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+// TracedHTTPClient http.Client cho elastic.SetHttpClient, mở span cho mỗi request ES (bulk, refresh, search ...)
+// là con của span trong context của request.
+func TracedHTTPClient(base *http.Client) *http.Client {
+	if base == nil {
+		base = http.DefaultClient
+	}
+	cp := *base
+	next := cp.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	cp.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		endpoint := elasticEndpoint(req.Method, req.URL.Path)
+		ctx, span := tracer().Start(req.Context(), "elastic."+endpoint,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "elasticsearch"),
+				attribute.String("db.operation", endpoint),
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+			))
+		resp, err := next.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+			if resp.StatusCode >= 500 {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+		}
+		endSpan(span, err)
+		return resp, err
+	})
+	return &cp
+}
@@ -0,0 +1,171 @@
+package repo
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/olivere/elastic/v7"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestTracer đăng ký provider ghi span đồng bộ vào bộ nhớ, trả lại provider cũ khi test xong.
+func newTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		_ = tp.Shutdown(context.Background())
+	})
+	return exp
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	names := make([]string, 0, len(spans))
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	t.Fatalf("span %q not found, got %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+func assertIntAttr(t *testing.T, s tracetest.SpanStub, key string, want int64) {
+	t.Helper()
+	for _, kv := range s.Attributes {
+		if kv.Key == attribute.Key(key) {
+			if got := kv.Value.AsInt64(); got != want {
+				t.Errorf("span %s attribute %s = %d, want %d", s.Name, key, got, want)
+			}
+			return
+		}
+	}
+	t.Errorf("span %s has no attribute %s", s.Name, key)
+}
+
+func assertChildOf(t *testing.T, child, parent tracetest.SpanStub) {
+	t.Helper()
+	if child.Parent.SpanID() != parent.SpanContext.SpanID() || child.SpanContext.TraceID() != parent.SpanContext.TraceID() {
+		t.Errorf("span %s is not a child of %s", child.Name, parent.Name)
+	}
+}
+
+// fakeRedis server RESP tối thiểu: đọc từng lệnh và trả về integer 1.
+func fakeRedis(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+					for i := 0; i < 2*n; i++ { // mỗi tham số gồm dòng $len và dòng dữ liệu
+						if _, err := rd.ReadString('\n'); err != nil {
+							return
+						}
+					}
+					if _, err := conn.Write([]byte(":1\r\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestElasticDAOSpans(t *testing.T) {
+	exp := newTestTracer(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"docs":[]}`))
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewClient(
+		elastic.SetURL(srv.URL),
+		elastic.SetSniff(false),
+		elastic.SetHealthcheck(false),
+		elastic.SetHttpClient(TracedHTTPClient(srv.Client())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dao := NewElasticChannelParticipantsDAO(client)
+	if _, err := dao.GetParticipants(7, []int32{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.GetSpans()
+	op := findSpan(t, spans, "ElasticChannelParticipantsDAO.GetParticipants")
+	assertIntAttr(t, op, LOG_KEY_CHANNEL_ID, 7)
+	assertIntAttr(t, op, LOG_KEY_COUNT, 2)
+	assertChildOf(t, findSpan(t, spans, "elastic.mget"), op)
+}
+
+func TestRedisDAOSpans(t *testing.T) {
+	exp := newTestTracer(t)
+	rdb := redis.NewClient(&redis.Options{Addr: fakeRedis(t)})
+	defer rdb.Close()
+
+	dao := NewChannelParticipantsCacheDAO(rdb)
+	if err := dao.AddUsers(9, []int32{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.GetSpans()
+	op := findSpan(t, spans, "ChannelParticipantsCacheDAO.AddUsers")
+	assertIntAttr(t, op, LOG_KEY_CHANNEL_ID, 9)
+	assertIntAttr(t, op, LOG_KEY_COUNT, 3)
+	assertChildOf(t, findSpan(t, spans, "redis.eval"), op)
+}
+
+func TestNestedDAOSpans(t *testing.T) {
+	exp := newTestTracer(t)
+	rdb := redis.NewClient(&redis.Options{Addr: fakeRedis(t)})
+	defer rdb.Close()
+
+	// op của DAO chạy trong context của span cha (ví dụ request HTTP) trở thành span con của nó
+	ctx, parent := otel.Tracer(TRACER_NAME).Start(context.Background(), "request")
+	err := NewChannelParticipantsCacheDAO(rdb).WithContext(ctx).AddUsers(9, []int32{1})
+	parent.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exp.GetSpans()
+	op := findSpan(t, spans, "ChannelParticipantsCacheDAO.AddUsers")
+	assertChildOf(t, op, findSpan(t, spans, "request"))
+	assertChildOf(t, findSpan(t, spans, "redis.eval"), op)
+}
@@ -0,0 +1,329 @@
+package repo
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+	"golang.org/x/sync/singleflight"
+)
+
+// Nhóm state hay dùng khi lọc channel của user theo vai trò / trạng thái.
+var (
+	USER_CHANNEL_STATES_ACTIVE = []ParticipantState{
+		PARTICIPANT_STATE_MEMBER, PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_CREATOR, PARTICIPANT_STATE_RESTRICTED,
+	}
+	USER_CHANNEL_STATES_ADMIN   = []ParticipantState{PARTICIPANT_STATE_ADMIN, PARTICIPANT_STATE_CREATOR}
+	USER_CHANNEL_STATES_BANNED  = []ParticipantState{PARTICIPANT_STATE_BANNED}
+	USER_CHANNEL_STATES_PENDING = []ParticipantState{PARTICIPANT_STATE_INVITED, PARTICIPANT_STATE_WAITING_APPROVAL}
+)
+
+// UserChannelDO một channel mà user có document participant, kèm state hiện tại.
+// BannedUntilDate hạn của lệnh cấm còn hiệu lực (0 = không cấm / cấm vĩnh viễn), dùng để gỡ khi đọc lại từ index.
+type UserChannelDO struct {
+	ChannelID       int32            `json:"channel_id"`
+	State           ParticipantState `json:"state"`
+	BannedUntilDate int32            `json:"banned_until_date,omitempty"`
+}
+
+// NewUserChannel state hiệu lực của document tại now (lệnh cấm đã hết hạn được gỡ).
+func NewUserChannel(doc *ElasticChannelParticipantsDO, now int32) UserChannelDO {
+	doc = LiftExpiredBan(doc, now)
+	data := participantData(doc)
+	it := UserChannelDO{ChannelID: doc.ChannelID, State: DeriveState(data)}
+	if data.BannedRights != 0 {
+		it.BannedUntilDate = data.BannedUntilDate
+	}
+	return it
+}
+
+// Effective state tại now: lệnh cấm có thời hạn đã qua thì gỡ như LiftExpiredBan (xem liftedStates).
+func (c UserChannelDO) Effective(now int32) UserChannelDO {
+	if c.BannedUntilDate <= 0 || c.BannedUntilDate > now {
+		return c
+	}
+	for _, l := range liftedStates {
+		if c.State == l.stored {
+			c.State = l.lifted
+			break
+		}
+	}
+	c.BannedUntilDate = 0
+	return c
+}
+
+// allParticipantsQuery mọi document participant của channel (mọi state), bỏ qua document meta.
+func allParticipantsQuery(channelID int32) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(
+			elastic.NewTermQuery("channel_id", channelID),
+			elastic.NewExistsQuery("user_id"),
+		)
+}
+
+// ScrollAllUserIDs duyệt user_id của mọi participant trong channel, kể cả user đã rời / bị kick.
+func (e *ElasticChannelParticipantsDAO) ScrollAllUserIDs(channelID int32, fn func(userIDs []int32) error) (err error) {
+	e, span := e.startSpan("ScrollAllUserIDs", attrChannel(channelID))
+	defer e.observe(span, "ScrollAllUserIDs", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	return e.scrollUserIDs(channelID, allParticipantsQuery(channelID), fn)
+}
+
+// userChannelsQuery document của user có state hiệu lực tại now thuộc states (rỗng = mọi state).
+func userChannelsQuery(userID int32, states []ParticipantState, now int32) *elastic.BoolQuery {
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user_id", userID))
+	if len(states) > 0 {
+		q = q.Filter(effectiveStatesQuery(states, now))
+	}
+	return q
+}
+
+// liftedStates state lưu trên ES đổi thành gì khi lệnh cấm đã hết hạn được gỡ (xem LiftExpiredBan / DeriveState):
+// banned (kicked + cấm) thành kicked, restricted thành member, các state khác không phụ thuộc banned_rights.
+var liftedStates = []struct{ stored, lifted ParticipantState }{
+	{PARTICIPANT_STATE_BANNED, PARTICIPANT_STATE_KICKED},
+	{PARTICIPANT_STATE_RESTRICTED, PARTICIPANT_STATE_MEMBER},
+}
+
+// effectiveStatesQuery document có state hiệu lực (đã gỡ lệnh cấm hết hạn) thuộc states, lọc ngay trên ES
+// để from / size và total của trang khớp với kết quả trả về.
+func effectiveStatesQuery(states []ParticipantState, now int32) *elastic.BoolQuery {
+	values := make([]interface{}, len(states))
+	for i, s := range states {
+		values[i] = int8(s)
+	}
+	changing := make([]interface{}, len(liftedStates))
+	for i, l := range liftedStates {
+		changing[i] = int8(l.stored)
+	}
+
+	// state lưu trên ES còn đúng: không phải banned / restricted có lệnh cấm đã hết hạn
+	q := elastic.NewBoolQuery().
+		Should(elastic.NewBoolQuery().
+			Filter(elastic.NewTermsQuery("data.State", values...)).
+			MustNot(elastic.NewBoolQuery().Filter(
+				elastic.NewTermsQuery("data.State", changing...),
+				expiredBansQuery(now),
+			))).
+		MinimumShouldMatch("1")
+	for _, l := range liftedStates {
+		if containsState(states, l.lifted) {
+			q = q.Should(elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("data.State", int8(l.stored)),
+				expiredBansQuery(now),
+			))
+		}
+	}
+	return q
+}
+
+// GetUserChannels truy vấn trực tiếp ES (channel_participants_*, không routing được nên fan-out mọi shard)
+// các channel của user có state thuộc states (rỗng = mọi state), sắp xếp theo channel_id.
+func (e *ElasticChannelParticipantsDAO) GetUserChannels(userID int32, states []ParticipantState, limit, offset int32) (_ []UserChannelDO, _ int32, err error) {
+	e, span := e.startSpan("GetUserChannels", attrUser(userID), attrCount(len(states)))
+	defer e.observe(span, "GetUserChannels", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return nil, 0, err
+	}
+	timeStart := time.Now()
+	if e == nil || e.client == nil {
+		return nil, 0, errElasticNil
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || offset+limit > 10000 {
+		return nil, 0, invalidInputf("limit/offset out of range (offset+limit <= 10000)")
+	}
+
+	now := int32(time.Now().Unix())
+	res, err := e.client.Search().
+		Index("channel_participants_*").
+		Query(userChannelsQuery(userID, states, now)).
+		From(int(offset)).
+		Size(int(limit)).
+		TrackTotalHits(true).
+		Sort("channel_id", true).
+		Do(e.Context())
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return []UserChannelDO{}, 0, nil
+		}
+		return nil, 0, elasticError("search user channels failed", err)
+	}
+
+	var total int64
+	if res.Hits != nil && res.Hits.TotalHits != nil {
+		total = res.Hits.TotalHits.Value
+	}
+	items := make([]UserChannelDO, 0, len(res.Hits.Hits))
+	for _, h := range res.Hits.Hits {
+		var doc ElasticChannelParticipantsDO
+		if err := json.Unmarshal(h.Source, &doc); err != nil {
+			continue
+		}
+		// lệnh cấm đã hết hạn được coi như đã gỡ, query đã lọc theo cùng state này
+		items = append(items, NewUserChannel(&doc, now))
+	}
+	logTiming(e.Logger(), "GetUserChannels", timeStart, LOG_KEY_USER_ID, userID, LOG_KEY_COUNT, total)
+	return items, int32(total), nil
+}
+
+// ScrollUserChannels duyệt mọi channel của user trên ES theo từng batch (dùng khi dựng lại reverse index).
+func (e *ElasticChannelParticipantsDAO) ScrollUserChannels(userID int32, fn func(items []UserChannelDO) error) (err error) {
+	e, span := e.startSpan("ScrollUserChannels", attrUser(userID))
+	defer e.observe(span, "ScrollUserChannels", time.Now(), &err)
+	if err = e.allow(); err != nil {
+		return err
+	}
+	if e == nil || e.client == nil {
+		return errElasticNil
+	}
+
+	ctx := e.Context()
+	now := int32(time.Now().Unix())
+	scroll := e.client.Scroll("channel_participants_*").
+		Query(userChannelsQuery(userID, nil, 0)).
+		Size(1000).
+		Sort("_doc", true).
+		Scroll("1m")
+	defer scroll.Clear(ctx)
+
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil
+			}
+			return elasticError("scroll user channels failed", err)
+		}
+		if res == nil || res.Hits == nil || len(res.Hits.Hits) == 0 {
+			return nil
+		}
+
+		items := make([]UserChannelDO, 0, len(res.Hits.Hits))
+		for _, h := range res.Hits.Hits {
+			var doc ElasticChannelParticipantsDO
+			if err := json.Unmarshal(h.Source, &doc); err != nil {
+				continue
+			}
+			items = append(items, NewUserChannel(&doc, now))
+		}
+		if err := fn(items); err != nil {
+			return err
+		}
+	}
+}
+
+// UserChannelsIndex đọc reverse index user:<uid>:channels trên Redis, miss thì dựng lại từ ES.
+// Index được outbox relay cập nhật sau mỗi mutation participant.
+type UserChannelsIndex struct {
+	es    *ElasticChannelParticipantsDAO
+	cache *ChannelParticipantsCacheDAO
+	group singleflight.Group
+}
+
+func NewUserChannelsIndex(es *ElasticChannelParticipantsDAO, cache *ChannelParticipantsCacheDAO) *UserChannelsIndex {
+	return &UserChannelsIndex{es: es, cache: cache}
+}
+
+// List các channel của user có state thuộc states (rỗng = mọi state), sắp xếp theo channel_id.
+func (x *UserChannelsIndex) List(userID int32, states ...ParticipantState) ([]UserChannelDO, error) {
+	all, ok, err := x.cache.GetUserChannels(userID)
+	if isDegradable(err) {
+		// Redis lỗi / breaker đang mở: đọc thẳng từ ES, không ghi lại index
+		x.cache.Logger().Warn("redis unavailable, serving user channels from elastic", LOG_KEY_USER_ID, userID, LOG_KEY_ERROR, err)
+		if all, err = x.scroll(userID); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if !ok {
+		if all, err = x.Rebuild(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	// index giữ hạn lệnh cấm nên lệnh cấm hết hạn sau khi ghi vẫn được gỡ khi đọc
+	now := int32(time.Now().Unix())
+	out := make([]UserChannelDO, 0, len(all))
+	for _, it := range all {
+		if it = it.Effective(now); len(states) == 0 || containsState(states, it.State) {
+			out = append(out, it)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ChannelID < out[j].ChannelID })
+	return out, nil
+}
+
+// Rebuild dựng lại user:<uid>:channels từ ES dưới khoá của user. Index được đánh dấu đang dựng trước khi quét ES
+// nên relay ghi xen vào không bị snapshot cũ ghi đè (xem FinishUserChannels).
+func (x *UserChannelsIndex) Rebuild(userID int32) (map[int32]UserChannelDO, error) {
+	v, err, _ := x.group.Do(strconv.Itoa(int(userID)), func() (interface{}, error) {
+		timeStart := time.Now()
+		unlock, err := x.cache.LockUserChannels(userID)
+		if isDegradable(err) {
+			x.cache.Logger().Warn("rebuild user channels skipped, lock unavailable", LOG_KEY_USER_ID, userID, LOG_KEY_ERROR, err)
+			return x.scroll(userID)
+		} else if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		token, err := x.cache.BeginUserChannels(userID)
+		if isDegradable(err) {
+			x.cache.Logger().Warn("rebuild user channels skipped, redis unavailable", LOG_KEY_USER_ID, userID, LOG_KEY_ERROR, err)
+			return x.scroll(userID)
+		} else if err != nil {
+			return nil, err
+		}
+		states, err := x.scroll(userID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := x.cache.FinishUserChannels(userID, token, states); isDegradable(err) {
+			x.cache.Logger().Warn("rebuild user channels skipped, redis unavailable", LOG_KEY_USER_ID, userID, LOG_KEY_ERROR, err)
+			return states, nil
+		} else if err != nil {
+			return nil, err
+		}
+		logTiming(x.cache.Logger(), "RebuildUserChannels", timeStart, LOG_KEY_USER_ID, userID, LOG_KEY_COUNT, len(states))
+		return states, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[int32]UserChannelDO), nil
+}
+
+// scroll state của user ở mọi channel từ ES.
+func (x *UserChannelsIndex) scroll(userID int32) (map[int32]UserChannelDO, error) {
+	states := map[int32]UserChannelDO{}
+	err := x.es.ScrollUserChannels(userID, func(items []UserChannelDO) error {
+		for _, it := range items {
+			states[it.ChannelID] = it
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func containsState(states []ParticipantState, s ParticipantState) bool {
+	for _, v := range states {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
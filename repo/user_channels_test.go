@@ -0,0 +1,62 @@
+package repo
+
+import "testing"
+
+func TestUserChannelEffective(t *testing.T) {
+	const now = 1000
+	tests := []struct {
+		name string
+		in   UserChannelDO
+		want ParticipantState
+	}{
+		{"member", UserChannelDO{State: PARTICIPANT_STATE_MEMBER}, PARTICIPANT_STATE_MEMBER},
+		{"banned forever", UserChannelDO{State: PARTICIPANT_STATE_BANNED}, PARTICIPANT_STATE_BANNED},
+		{"banned until later", UserChannelDO{State: PARTICIPANT_STATE_BANNED, BannedUntilDate: now + 1}, PARTICIPANT_STATE_BANNED},
+		{"banned expired", UserChannelDO{State: PARTICIPANT_STATE_BANNED, BannedUntilDate: now}, PARTICIPANT_STATE_KICKED},
+		{"restricted expired", UserChannelDO{State: PARTICIPANT_STATE_RESTRICTED, BannedUntilDate: now - 1}, PARTICIPANT_STATE_MEMBER},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.in.Effective(now).State; got != tt.want {
+				t.Errorf("Effective() state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNewUserChannel state suy ra từ document khớp với Effective khi đọc lại từ index.
+func TestNewUserChannel(t *testing.T) {
+	p := &ChannelParticipantsDO{ChannelID: 5, UserID: 1, JoinedAt: 1, BannedRights: 1, BannedUntilDate: 100}
+	doc := NewElasticParticipant(p)
+
+	it := NewUserChannel(&doc, 50)
+	if it.State != PARTICIPANT_STATE_RESTRICTED || it.BannedUntilDate != 100 {
+		t.Fatalf("NewUserChannel() before expiry = %+v", it)
+	}
+	if got := it.Effective(100).State; got != PARTICIPANT_STATE_MEMBER {
+		t.Errorf("Effective() after expiry = %s, want %s", got, PARTICIPANT_STATE_MEMBER)
+	}
+	if got := NewUserChannel(&doc, 100); got.State != PARTICIPANT_STATE_MEMBER || got.BannedUntilDate != 0 {
+		t.Errorf("NewUserChannel() after expiry = %+v", got)
+	}
+}
+
+func TestUserChannelEncoding(t *testing.T) {
+	for _, in := range []UserChannelDO{
+		{ChannelID: 7, State: PARTICIPANT_STATE_ADMIN},
+		{ChannelID: 7, State: PARTICIPANT_STATE_BANNED, BannedUntilDate: 1700000000},
+	} {
+		got, ok := parseUserChannel("7", encodeUserChannel(in))
+		if !ok || got != in {
+			t.Errorf("parseUserChannel(encodeUserChannel(%+v)) = %+v, %v", in, got, ok)
+		}
+	}
+	for _, field := range []string{USER_CHANNELS_FIELD_COMPLETE, USER_CHANNELS_FIELD_BUILDING} {
+		if _, ok := parseUserChannel(field, "1"); ok {
+			t.Errorf("parseUserChannel(%q) treated marker as channel", field)
+		}
+	}
+	if _, ok := parseUserChannel("7", USER_CHANNELS_REMOVED); ok {
+		t.Error("parseUserChannel() treated removal mark as channel")
+	}
+}